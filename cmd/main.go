@@ -1,19 +1,36 @@
 package main
 
 import (
+	"context"
 	"diametertransfereagent/internal/app"
 	"diametertransfereagent/pkg/config"
+	"diametertransfereagent/pkg/logging"
+	"diametertransfereagent/pkg/tracing"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
-	cfg, err := config.LoadConfig()
+	cfg, err := config.Load(os.Args[1:])
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
+	if err := logging.Setup(cfg.Log); err != nil {
+		log.Fatalf("Failed to set up logging: %v", err)
+	}
+	shutdownTracing, err := tracing.Setup(cfg.Tracing)
+	if err != nil {
+		log.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer shutdownTracing(context.Background())
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	application := app.NewApp(cfg)
-	if err := application.Run(); err != nil {
+	if err := application.Run(ctx); err != nil {
 		log.Fatalf("Application failed: %v", err)
 	}
 }
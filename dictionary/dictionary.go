@@ -0,0 +1,10 @@
+// Package dictionary builds the Diameter dictionaries of this directory into
+// the binary, for the agent to load when no dictionary_dir is configured.
+package dictionary
+
+import "embed"
+
+// Files are the XML dictionaries of this directory.
+//
+//go:embed *.xml
+var Files embed.FS
@@ -0,0 +1,36 @@
+package app
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"diametertransfereagent/pkg/config"
+	"diametertransfereagent/pkg/radius"
+)
+
+// configHandler dumps the configuration last loaded with its secrets
+// redacted.
+func configHandler(cfg func() *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, cfg().Redacted())
+	}
+}
+
+// radiusServersHandler lists the AAA servers with what the RADIUS client
+// last saw of them.
+func radiusServersHandler(client *radius.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, client.Health())
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		slog.Error("Failed to write admin response", "error", err)
+	}
+}
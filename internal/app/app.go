@@ -1,37 +1,154 @@
 package app
 
 import (
+	"context"
+	"errors"
+	"log"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
 	"diametertransfereagent/pkg/config"
 	"diametertransfereagent/pkg/diameter"
 	"diametertransfereagent/pkg/radius"
+	"diametertransfereagent/pkg/radiusdict"
 )
 
 type App struct {
 	diameterServer *diameter.Server
+	radiusServer   *radius.Server
+	daeServer      *radius.DAEServer
 	radiusClient   *radius.Client
 	requestChan    chan radius.Request
-	responseChan   chan radius.Response
+	// shutdownTimeout bounds how long Run waits for the work in flight once
+	// it is asked to stop.
+	shutdownTimeout time.Duration
+
+	// started is the configuration the agent started with and cfg the one
+	// last loaded, by Reload.
+	started  *config.Config
+	cfg      atomic.Pointer[config.Config]
+	reloadMu sync.Mutex
 }
 
 func NewApp(cfg *config.Config) *App {
 	requestChan := make(chan radius.Request, 100) // Buffered channel
-	responseChan := make(chan radius.Response, 100)
-	radiusClient := radius.NewClient(cfg.RadiusConfig, requestChan, responseChan)
-	diameterServer := diameter.NewServer(cfg.DiameterConfig, requestChan, responseChan)
+	attributes, err := radiusdict.Load(cfg.RadiusConfig.Dictionaries...)
+	if err != nil {
+		log.Fatalf("Failed to load RADIUS dictionaries: %v", err)
+	}
+	if len(attributes.Files) > 0 {
+		slog.Info("Loaded RADIUS dictionaries", "files", attributes.Files)
+	}
+	radiusClient := radius.NewClient(cfg.RadiusConfig, attributes, requestChan)
+	radiusClient.SetServerGroups(serverGroups(cfg))
+	diameterServer := diameter.NewServer(cfg.DiameterConfig, attributes, requestChan)
+	diameterServer.AddReadinessCheck("radius_servers", radiusClient.Ready)
+	diameterServer.HandleAdmin("GET /radius/servers", radiusServersHandler(radiusClient))
+
+	var radiusServer *radius.Server
+	if cfg.RadiusServerConfig.AuthAddr != "" || cfg.RadiusServerConfig.AcctAddr != "" {
+		radiusServer = radius.NewServer(cfg.RadiusServerConfig, diameterServer.Gateway(cfg.RadiusServerConfig))
+	}
 
-	return &App{
+	var daeServer *radius.DAEServer
+	if cfg.RadiusConfig.DAEAddr != "" {
+		daeServer = radius.NewDAEServer(cfg.RadiusConfig, diameterServer)
+	}
 
+	a := &App{
 		diameterServer: diameterServer,
+		radiusServer:   radiusServer,
+		daeServer:      daeServer,
 		radiusClient:   radiusClient,
 		requestChan:    requestChan,
-		responseChan:   responseChan,
 	}
+	a.started = cfg
+	a.cfg.Store(cfg)
+	diameterServer.HandleAdmin("GET /config", configHandler(a.cfg.Load))
+	diameterServer.HandleAdmin("POST /reload", reloadHandler(a))
+	a.shutdownTimeout = defaultShutdownTimeout
+	if cfg.DiameterConfig.ShutdownTimeout > 0 {
+		a.shutdownTimeout = time.Duration(cfg.DiameterConfig.ShutdownTimeout) * time.Second
+	}
+	return a
+}
+
+// serverGroups are the AAA server groups of the translation profiles.
+func serverGroups(cfg *config.Config) []radius.ServerGroup {
+	var groups []radius.ServerGroup
+	for _, profile := range cfg.DiameterConfig.Profiles {
+		if len(profile.RadiusServers) > 0 {
+			groups = append(groups, radius.ServerGroup{Servers: profile.RadiusServers, Secret: profile.RadiusSecret})
+		}
+	}
+	return groups
 }
 
-func (a *App) Run() error {
+const defaultShutdownTimeout = 10 * time.Second
+
+// Run starts the agent and serves until ctx is done, reloading the
+// configuration on SIGHUP, then shuts it down gracefully: the RADIUS
+// listeners stop taking requests, the Diameter peers are sent a DPR, and
+// the Diameter requests and RADIUS exchanges in flight, pending accounting
+// included, are given up to shutdown_timeout to complete before the session
+// store is flushed.
+func (a *App) Run(ctx context.Context) error {
 	// Start handling messages
 	go a.diameterServer.Start()
 	go a.radiusClient.Start()
+	if a.radiusServer != nil {
+		a.radiusServer.Start()
+	}
+	if a.daeServer != nil {
+		a.daeServer.Start()
+	}
+
+	// SIGHUP reloads the configuration, as POST /reload does.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-hup:
+			if _, err := a.Reload(); err != nil {
+				slog.Error("Failed to reload the configuration", "error", err)
+			}
+		case <-ctx.Done():
+			slog.Info("Shutting down, waiting for the requests in flight", "timeout", a.shutdownTimeout.String())
+			return a.shutdown()
+		}
+	}
+}
+
+func (a *App) shutdown() error {
+	ctx, cancel := context.WithTimeout(context.Background(), a.shutdownTimeout)
+	defer cancel()
 
-	select {}
+	var errs []error
+	if a.radiusServer != nil {
+		if err := a.radiusServer.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if a.daeServer != nil {
+		if err := a.daeServer.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := a.diameterServer.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := a.radiusClient.Shutdown(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	slog.Info("Shut down cleanly")
+	return nil
 }
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"log/slog"
+	"net/http"
+
+	"diametertransfereagent/pkg/config"
+	"diametertransfereagent/pkg/radiusdict"
+)
+
+// ReloadReport is what a reload changed.
+type ReloadReport struct {
+	// Applied are the settings that changed and now apply to new requests.
+	Applied []string `json:"applied"`
+	// RestartRequired are the settings that differ from the running ones
+	// but only take effect on restart.
+	RestartRequired []string `json:"restart_required"`
+	// Files are the Diameter dictionaries, mapping rules, script and RADIUS
+	// dictionaries read again.
+	Files []string `json:"files"`
+}
+
+// Reload loads the configuration again, from the same file, environment and
+// command line, and applies what it can to new requests: the RADIUS
+// secret and servers, the translation profiles, the mapping rules, the
+// script and the dictionaries. Requests in flight finish with the settings
+// they started with. Nothing changes when the configuration or one of its
+// files is invalid.
+func (a *App) Reload() (ReloadReport, error) {
+	a.reloadMu.Lock()
+	defer a.reloadMu.Unlock()
+
+	current := a.cfg.Load()
+	cfg, err := current.Reload()
+	if err != nil {
+		return ReloadReport{}, err
+	}
+	attributes, err := radiusdict.Load(cfg.RadiusConfig.Dictionaries...)
+	if err != nil {
+		return ReloadReport{}, err
+	}
+	files, err := a.diameterServer.Reload(cfg.DiameterConfig, attributes)
+	if err != nil {
+		return ReloadReport{}, err
+	}
+	files = append(files, attributes.Files...)
+	a.radiusClient.Reload(cfg.RadiusConfig, attributes)
+	a.radiusClient.SetServerGroups(serverGroups(cfg))
+	if a.daeServer != nil {
+		a.daeServer.Reload(cfg.RadiusConfig)
+	}
+	a.cfg.Store(cfg)
+
+	report := ReloadReport{Applied: []string{}, RestartRequired: []string{}, Files: files}
+	for _, path := range config.Diff(current, cfg) {
+		if config.Reloadable(path) {
+			report.Applied = append(report.Applied, path)
+		}
+	}
+	for _, path := range config.Diff(a.started, cfg) {
+		if !config.Reloadable(path) {
+			report.RestartRequired = append(report.RestartRequired, path)
+		}
+	}
+	slog.Info("Reloaded the configuration", "applied", report.Applied)
+	if len(report.RestartRequired) > 0 {
+		slog.Warn("Settings changed that only take effect on restart", "settings", report.RestartRequired)
+	}
+	return report, nil
+}
+
+// reloadHandler reloads the configuration and reports what changed.
+func reloadHandler(a *App) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, err := a.Reload()
+		if err != nil {
+			slog.Error("Failed to reload the configuration", "error", err)
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		writeJSON(w, report)
+	}
+}
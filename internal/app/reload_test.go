@@ -0,0 +1,103 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"diametertransfereagent/pkg/config"
+)
+
+// configJSON is a configuration with the given RADIUS secret, watchdog
+// interval and script.
+func configJSON(secret string, watchdog int, script string) string {
+	return fmt.Sprintf(`{
+  "diameter": {
+    "addr": "127.0.0.1:0",
+    "diam_host": "dta.example.org",
+    "diam_realm": "example.org",
+    "network_type": "tcp",
+    "watchdog_interval": %d,
+    "script_file": %q
+  },
+  "radius": {"addr": "127.0.0.1", "secret": %q}
+}`, watchdog, script, secret)
+}
+
+func writeFile(t *testing.T, path, text string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path, script := filepath.Join(dir, "config.json"), filepath.Join(dir, "hooks.star")
+	writeFile(t, script, "def after_decode(command, avps):\n    pass\n")
+	writeFile(t, path, configJSON("secret", 30, script))
+	cfg, err := config.Load([]string{"--config", path})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	a := NewApp(cfg)
+	if _, err := a.Reload(); err == nil {
+		t.Errorf("Reload succeeded before the Diameter server started")
+	}
+	a.diameterServer.Start()
+	defer a.diameterServer.Shutdown(context.Background())
+
+	writeFile(t, path, configJSON("changed", 10, script))
+	report, err := a.Reload()
+	if err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if !slices.Equal(report.Applied, []string{"radius.secret"}) {
+		t.Errorf("Applied = %v, want radius.secret", report.Applied)
+	}
+	if !slices.Equal(report.RestartRequired, []string{"diameter.watchdog_interval"}) {
+		t.Errorf("RestartRequired = %v, want diameter.watchdog_interval", report.RestartRequired)
+	}
+	if !slices.Contains(report.Files, script) {
+		t.Errorf("Files = %v, want the script read again", report.Files)
+	}
+	if secret := a.cfg.Load().RadiusConfig.Secret; secret != "changed" {
+		t.Errorf("secret = %q after the reload", secret)
+	}
+
+	// A broken script leaves the configuration as it was.
+	writeFile(t, script, "def after_decode(command, avps):\n    pass\nafter_radius = 1\n")
+	writeFile(t, path, configJSON("broken", 10, script))
+	if _, err := a.Reload(); err == nil || !strings.Contains(err.Error(), "script") {
+		t.Errorf("Reload = %v, want the script error", err)
+	}
+	if secret := a.cfg.Load().RadiusConfig.Secret; secret != "changed" {
+		t.Errorf("secret = %q after a failed reload, want the previous one", secret)
+	}
+
+	handler := reloadHandler(a)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Errorf("POST /reload = %d with a broken script, want %d", w.Code, http.StatusUnprocessableEntity)
+	}
+
+	writeFile(t, script, "def after_decode(command, avps):\n    pass\n")
+	w = httptest.NewRecorder()
+	handler(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	var posted ReloadReport
+	if err := json.NewDecoder(w.Body).Decode(&posted); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("POST /reload = %d: %v", w.Code, err)
+	}
+	// The secret changed again since the last successful reload.
+	if !slices.Equal(posted.Applied, []string{"radius.secret"}) || !slices.Equal(posted.RestartRequired, []string{"diameter.watchdog_interval"}) {
+		t.Errorf("POST /reload = %+v", posted)
+	}
+}
@@ -1,44 +1,274 @@
 package config
 
-import (
-	"encoding/json"
-	"os"
-)
-
 type Config struct {
-	DiameterConfig DiameterConfig `json:"diameter"`
-	RadiusConfig   RadiusConfig   `json:"radius"`
+	DiameterConfig     DiameterConfig     `json:"diameter"`
+	RadiusConfig       RadiusConfig       `json:"radius"`
+	RadiusServerConfig RadiusServerConfig `json:"radius_server"`
+	Log                LogConfig          `json:"log"`
+	Tracing            TracingConfig      `json:"tracing"`
+
+	// args are the command line arguments the configuration was loaded
+	// with, for Reload.
+	args []string
+}
+
+// LogConfig is the log of the agent. Level is debug, info (the default),
+// warn or error, Format is json (the default) or text, and Mask lists the
+// subscriber identities to redact: imsi, msisdn and imei.
+type LogConfig struct {
+	Level  string   `json:"level"`
+	Format string   `json:"format"`
+	Mask   []string `json:"mask"`
+}
+
+// TracingConfig is the export of the OpenTelemetry spans of each request.
+// Exporter is otlp, sending them over OTLP/HTTP to Endpoint (host:port,
+// localhost:4318 when empty), or file, appending them as JSON to File.
+// Empty records none. SampleRatio is the fraction of transactions traced;
+// zero traces all of them.
+type TracingConfig struct {
+	Exporter    string  `json:"exporter"`
+	Endpoint    string  `json:"endpoint"`
+	Insecure    bool    `json:"insecure"`
+	File        string  `json:"file"`
+	SampleRatio float64 `json:"sample_ratio"`
 }
 
 type DiameterConfig struct {
-	Addr        string `json:"addr"`
-	SSL         bool   `json:"ssl"`
-	DiamHost    string `json:"diam_host"`
-	DiamRealm   string `json:"diam_realm"`
-	CertFile    string `json:"cert_file"`
-	KeyFile     string `json:"key_file"`
-	NetworkType string `json:"network_type"`
-	// PeerAddr    string `json:"peer_addr"`
+	Addr             string        `json:"addr"`
+	SSL              bool          `json:"ssl"`
+	DiamHost         string        `json:"diam_host"`
+	DiamRealm        string        `json:"diam_realm"`
+	CertFile         string        `json:"cert_file"`
+	KeyFile          string        `json:"key_file"`
+	NetworkType      string        `json:"network_type"`
+	WatchdogInterval int           `json:"watchdog_interval"`
+	Peers            []PeerConfig  `json:"peers"`
+	AllowedPeers     []PeerPolicy  `json:"allowed_peers"`
+	Routes           []RouteConfig `json:"routes"`
+	// HealthAddr is the address of the HTTP server of the probes (/healthz,
+	// /readyz) and the Prometheus metrics (/metrics), which only report on
+	// the agent and can listen where the orchestrator and Prometheus reach
+	// it. Empty serves them on the admin server.
+	HealthAddr string `json:"health_addr"`
+	// AdminAddr is the address of the admin HTTP server: log level
+	// (/log/level), peers, sessions, AAA servers, configuration, reload and
+	// pprof (/debug/pprof/). Empty disables it. It has no authentication and
+	// can terminate sessions, so it should listen on a loopback or
+	// management address only.
+	AdminAddr string `json:"admin_addr"`
+	// ShutdownTimeout is how long, in seconds, a SIGTERM waits for the
+	// requests in flight and the pending accounting before the process
+	// exits. Zero waits 10 seconds.
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// SessionStore is the file active sessions are persisted to so they
+	// survive a restart. Empty keeps them in memory only.
+	SessionStore string `json:"session_store"`
+	// StopSessionsOnRestart closes every session found in the store at start
+	// with an Accounting-Stop (Acct-Terminate-Cause NAS-Reboot) instead of
+	// restoring it.
+	StopSessionsOnRestart bool         `json:"stop_sessions_on_restart"`
+	Pools                 []PoolConfig `json:"pools"`
+	// DictionaryDir is the directory of the Diameter dictionaries. Empty
+	// loads the ones built into the binary.
+	DictionaryDir string `json:"dictionary_dir"`
+	// Dictionaries are the files to load from DictionaryDir, in order, by
+	// name or glob pattern such as "3gpp-*.xml". Empty loads every *.xml
+	// file. Files defining an AVP code differently are rejected. The
+	// built-in base.xml is loaded first unless one of the files is a
+	// base.xml.
+	Dictionaries []string `json:"dictionaries"`
+	// MappingFile is a YAML or JSON file of AVP to RADIUS attribute mapping
+	// rules applied on top of the built-in translation. Empty applies none.
+	MappingFile string `json:"mapping_file"`
+	// ScriptFile is a Starlark script whose hooks can change or reject each
+	// request and answer as it is translated. Empty runs none.
+	ScriptFile string `json:"script_file"`
+	// UserNameTemplate builds the RADIUS User-Name from the subscriber
+	// identity, such as "{{.IMSI}}@{{.Realm}}" (see package identity). Empty
+	// sends the User-Name without its realm, or else the IMSI or MSISDN of
+	// the Subscription-Id.
+	UserNameTemplate string `json:"user_name_template"`
+	// Profiles translate the requests they select differently from the
+	// settings above; the first matching profile is used.
+	Profiles []ProfileConfig `json:"profiles"`
+}
+
+// ProfileConfig is a named translation profile. It selects the requests
+// whose Origin-Realm, Destination-Realm, APN (Service-Selection),
+// Called-Station-Id and IMSI prefix match the ones set, and sends them to
+// its own group of RADIUS servers, tried in order, with its own secret,
+// credentials, mapping rules, granted quota and Result-Codes. Settings left
+// empty fall back to the global ones.
+type ProfileConfig struct {
+	Name             string `json:"name"`
+	OriginRealm      string `json:"origin_realm"`
+	DestinationRealm string `json:"destination_realm"`
+	APN              string `json:"apn"`
+	CalledStationID  string `json:"called_station_id"`
+	IMSIPrefix       string `json:"imsi_prefix"`
+
+	RadiusServers []string `json:"radius_servers"`
+	RadiusSecret  string   `json:"radius_secret"`
+	// RadiusSecretFile is a file to read RadiusSecret from, which takes
+	// precedence over it.
+	RadiusSecretFile string `json:"radius_secret_file"`
+	// Password is sent in the User-Password of Access-Requests, and
+	// KeepRealm sends the User-Name with its realm. UserNameTemplate
+	// replaces the global one and takes precedence over KeepRealm.
+	// PasswordFile is a file to read Password from.
+	Password         string           `json:"password"`
+	PasswordFile     string           `json:"password_file"`
+	KeepRealm        bool             `json:"keep_realm"`
+	UserNameTemplate string           `json:"user_name_template"`
+	MappingFile      string           `json:"mapping_file"`
+	Quota            QuotaConfig      `json:"quota"`
+	ResultCodes      ResultCodeConfig `json:"result_codes"`
+}
+
+// QuotaConfig is the Granted-Service-Unit of Credit-Control answers.
+type QuotaConfig struct {
+	Time         uint32 `json:"time"`
+	InputOctets  uint64 `json:"input_octets"`
+	OutputOctets uint64 `json:"output_octets"`
+}
+
+// ResultCodeConfig sets the Result-Code answered when the AAA server rejects
+// a request and when it does not answer.
+type ResultCodeConfig struct {
+	Reject  uint32 `json:"reject"`
+	Timeout uint32 `json:"timeout"`
+}
+
+// PoolConfig is a local address pool used when the AAA server accepts a
+// session without assigning a Framed-IP-Address. It serves the sessions of
+// APN and Realm, or of any when empty. IPv4 is a CIDR range to allocate host
+// addresses from and IPv6Prefix a CIDR prefix to delegate prefixes of
+// IPv6PrefixLength bits (64 by default) from.
+type PoolConfig struct {
+	Name             string `json:"name"`
+	APN              string `json:"apn"`
+	Realm            string `json:"realm"`
+	IPv4             string `json:"ipv4"`
+	IPv6Prefix       string `json:"ipv6_prefix"`
+	IPv6PrefixLength int    `json:"ipv6_prefix_length"`
+}
+
+// PeerConfig describes a Diameter peer the agent dials out to.
+type PeerConfig struct {
+	Addr                string   `json:"addr"`
+	NetworkType         string   `json:"network_type"`
+	SSL                 bool     `json:"ssl"`
+	CertFile            string   `json:"cert_file"`
+	KeyFile             string   `json:"key_file"`
+	VendorID            uint32   `json:"vendor_id"`
+	AuthAppIDs          []uint32 `json:"auth_app_ids"`
+	AcctAppIDs          []uint32 `json:"acct_app_ids"`
+	WatchdogInterval    int      `json:"watchdog_interval"`
+	ReconnectInterval   int      `json:"reconnect_interval"`
+	MaxReconnectBackoff int      `json:"max_reconnect_backoff"`
+}
+
+// PeerPolicy permits a Diameter peer to connect and restricts the
+// applications advertised to it in the CEA. An empty list of allowed peers
+// accepts any peer.
+type PeerPolicy struct {
+	OriginHost  string   `json:"origin_host"`
+	OriginRealm string   `json:"origin_realm"`
+	IPs         []string `json:"ips"`
+	VendorID    uint32   `json:"vendor_id"`
+	AuthAppIDs  []uint32 `json:"auth_app_ids"`
+	AcctAppIDs  []uint32 `json:"acct_app_ids"`
+}
+
+// RouteConfig selects how requests for a Destination-Realm and application
+// are handled. Action is "local" to translate them here, "relay" or "proxy"
+// to forward them to the first connected peer of Peers. Realm "*" matches
+// any realm and AppID 0 any application.
+type RouteConfig struct {
+	Realm  string   `json:"realm"`
+	AppID  uint32   `json:"app_id"`
+	Action string   `json:"action"`
+	Peers  []string `json:"peers"`
 }
 
 type RadiusConfig struct {
+	// Addr is the AAA server, sent authentication on port 1812 and
+	// accounting on port 1813 unless it has a port of its own, as in
+	// 127.0.0.1:11812. The same goes for the servers of profiles.
 	Addr   string `json:"addr"`
 	Secret string `json:"secret"`
-	// ClientPort int    `json:"client_port"`
+	// SecretFile is a file to read Secret from, which takes precedence
+	// over it.
+	SecretFile string `json:"secret_file"`
+	// ClientPort is the UDP port every request to the AAA servers is sent
+	// from, for servers that only accept a known source port. Zero sends
+	// each exchange from its own ephemeral port.
+	ClientPort int `json:"client_port"`
+	// DAEAddr is where the AAA server sends Disconnect and CoA requests
+	// (RFC 5176), usually port 3799. Empty disables the listener.
+	DAEAddr string `json:"dae_addr"`
+	// StickyAttributes lists the attribute types, besides Class, that are
+	// kept from the Access-Accept and echoed in every Accounting-Request and
+	// re-authorization of the session, e.g. 89 for Chargeable-User-Identity.
+	StickyAttributes []int `json:"sticky_attributes"`
+	// LocationAttributes are the text attributes the decoded user location
+	// and time zone of accounting requests are sent in.
+	LocationAttributes LocationAttributes `json:"location_attributes"`
+	// StatusInterval is how often, in seconds, a Status-Server (RFC 5997)
+	// checks that the AAA server is up. Zero sends none, leaving its
+	// liveness to the outcome of the requests.
+	StatusInterval int `json:"status_interval"`
+	// Dictionaries are FreeRADIUS dictionary files, or glob patterns, loaded
+	// on top of the built-in RFC and 3GPP attributes, such as
+	// /usr/share/freeradius/dictionary.cisco. Mapping rules and logs refer
+	// to the attributes they define by name.
+	Dictionaries []string `json:"dictionaries"`
 }
 
-func LoadConfig() (*Config, error) {
-	file, err := os.Open("config.json")
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
+// LocationAttributes sends the fields decoded from 3GPP-User-Location-Info
+// and 3GPP-MS-TimeZone as text Vendor-Specific attributes of Vendor, with
+// the types given by field name, such as {"mcc": 1, "mnc": 2, "tac": 3,
+// "eci": 4}. The fields are location_type, mcc, mnc, lac, ci, sac, rac,
+// tac, eci, nci, time_zone (as +hh:mm) and dst. No Vendor sends none.
+type LocationAttributes struct {
+	Vendor uint32          `json:"vendor"`
+	Types  map[string]byte `json:"types"`
+}
 
-	var cfg Config
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&cfg); err != nil {
-		return nil, err
-	}
+// RadiusServerConfig configures the RADIUS front end that translates
+// requests from NAS and WLAN gateways into Diameter. It is disabled when
+// no address is set. Application is "nasreq", "s6b" or "sta" and
+// Accounting is "acr" or "ccr". SecretFile is a file to read Secret from,
+// which takes precedence over it.
+type RadiusServerConfig struct {
+	AuthAddr         string `json:"auth_addr"`
+	AcctAddr         string `json:"acct_addr"`
+	Secret           string `json:"secret"`
+	SecretFile       string `json:"secret_file"`
+	Application      string `json:"application"`
+	Accounting       string `json:"accounting"`
+	PeerHost         string `json:"peer_host"`
+	DestinationRealm string `json:"destination_realm"`
+}
 
-	return &cfg, nil
+// Redacted returns a copy of the configuration with its secrets and
+// passwords replaced, fit for display.
+func (c Config) Redacted() Config {
+	const redacted = "<redacted>"
+	redact := func(secret *string) {
+		if *secret != "" {
+			*secret = redacted
+		}
+	}
+	redact(&c.RadiusConfig.Secret)
+	redact(&c.RadiusServerConfig.Secret)
+	profiles := make([]ProfileConfig, len(c.DiameterConfig.Profiles))
+	for i, profile := range c.DiameterConfig.Profiles {
+		redact(&profile.RadiusSecret)
+		redact(&profile.Password)
+		profiles[i] = profile
+	}
+	c.DiameterConfig.Profiles = profiles
+	return c
 }
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+)
+
+// reloadable lists the settings a reload applies. A change to any other
+// setting only takes effect on restart.
+var reloadable = []string{
+	"diameter.dictionary_dir",
+	"diameter.dictionaries",
+	"diameter.mapping_file",
+	"diameter.script_file",
+	"diameter.user_name_template",
+	"diameter.profiles",
+	"radius.addr",
+	"radius.secret",
+	"radius.secret_file",
+	"radius.sticky_attributes",
+	"radius.location_attributes",
+	"radius.dictionaries",
+}
+
+// Reloadable reports whether a reload applies the setting at path, as
+// returned by Diff.
+func Reloadable(path string) bool {
+	for _, setting := range reloadable {
+		if path == setting || strings.HasPrefix(path, setting+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff returns the path of each setting that differs between the two
+// configurations, such as radius.secret. Lists and maps are compared as a
+// whole.
+func Diff(old, new *Config) []string {
+	return diff(reflect.ValueOf(*old), reflect.ValueOf(*new), "")
+}
+
+func diff(old, new reflect.Value, prefix string) []string {
+	var changed []string
+	t := old.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		path := tag
+		if prefix != "" {
+			path = prefix + "." + tag
+		}
+		if t.Field(i).Type.Kind() == reflect.Struct {
+			changed = append(changed, diff(old.Field(i), new.Field(i), path)...)
+			continue
+		}
+		if !reflect.DeepEqual(old.Field(i).Interface(), new.Field(i).Interface()) {
+			changed = append(changed, path)
+		}
+	}
+	return changed
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// DefaultPath is the configuration file read when --config is not set.
+	DefaultPath = "config.json"
+
+	// EnvPrefix starts the name of the environment variables overriding the
+	// configuration file, such as DTA_RADIUS_SECRET for radius.secret.
+	EnvPrefix = "DTA_"
+	// envFileSuffix ends the name of the environment variables giving the
+	// file to read a setting from, such as DTA_RADIUS_SECRET_FILE.
+	envFileSuffix = "_FILE"
+)
+
+// commandLine are the settings that can also be set on the command line,
+// by flag name.
+var commandLine = []struct {
+	name, usage string
+	setting     func(*Config) *string
+}{
+	{"addr", "address in the form of ip:port to listen on", func(c *Config) *string { return &c.DiameterConfig.Addr }},
+	{"health_addr", "address in form of ip:port for the health and metrics HTTP server", func(c *Config) *string { return &c.DiameterConfig.HealthAddr }},
+	{"admin_addr", "address in form of ip:port for the admin HTTP server", func(c *Config) *string { return &c.DiameterConfig.AdminAddr }},
+	{"pprof_addr", "deprecated alias of admin_addr", func(c *Config) *string { return &c.DiameterConfig.AdminAddr }},
+	{"diam_host", "diameter identity host", func(c *Config) *string { return &c.DiameterConfig.DiamHost }},
+	{"diam_realm", "diameter identity realm", func(c *Config) *string { return &c.DiameterConfig.DiamRealm }},
+	{"cert_file", "tls certificate file (optional)", func(c *Config) *string { return &c.DiameterConfig.CertFile }},
+	{"key_file", "tls key file (optional)", func(c *Config) *string { return &c.DiameterConfig.KeyFile }},
+	{"network_type", "protocol type tcp/sctp", func(c *Config) *string { return &c.DiameterConfig.NetworkType }},
+}
+
+// Load reads the configuration file named by the --config flag of args,
+// applies the DTA_ environment variables and then the other flags on top of
+// it, and validates the result.
+func Load(args []string) (*Config, error) {
+	fs := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ExitOnError)
+	path := fs.String("config", DefaultPath, "configuration file, JSON or YAML (.yaml, .yml)")
+	values := make(map[string]*string, len(commandLine))
+	for _, option := range commandLine {
+		values[option.name] = fs.String(option.name, "", option.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg, err := LoadFile(*path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.applyEnv(os.Environ()); err != nil {
+		return nil, err
+	}
+	// Visit goes through the flags in lexical order, so admin_addr gives way
+	// to its pprof_addr alias as it used to.
+	fs.Visit(func(f *flag.Flag) {
+		for _, option := range commandLine {
+			if option.name == f.Name {
+				*option.setting(cfg) = *values[f.Name]
+			}
+		}
+	})
+	if err := cfg.readSecretFiles(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.args = args
+	return cfg, nil
+}
+
+// Reload loads the configuration again the way it was first loaded, from
+// the same file, environment and command line.
+func (c *Config) Reload() (*Config, error) {
+	return Load(c.args)
+}
+
+// LoadFile reads a JSON configuration file, or a YAML one when its name
+// ends in .yaml or .yml. Unknown settings are rejected.
+func LoadFile(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		// YAML is decoded through JSON so that both use the json tags.
+		var doc interface{}
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		if data, err = json.Marshal(doc); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	var cfg Config
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &cfg, nil
+}
+
+// readSecretFiles reads the secrets and passwords whose *_file setting
+// names a file, such as radius.secret from radius.secret_file, so that they
+// can be kept out of the configuration file. The trailing newline of a file
+// is not part of the secret.
+func (c *Config) readSecretFiles() error {
+	type secretFile struct {
+		path         string
+		file, secret *string
+	}
+	files := []secretFile{
+		{"radius.secret_file", &c.RadiusConfig.SecretFile, &c.RadiusConfig.Secret},
+		{"radius_server.secret_file", &c.RadiusServerConfig.SecretFile, &c.RadiusServerConfig.Secret},
+	}
+	for i := range c.DiameterConfig.Profiles {
+		profile := &c.DiameterConfig.Profiles[i]
+		path := fmt.Sprintf("diameter.profiles[%d]", i)
+		files = append(files,
+			secretFile{path + ".radius_secret_file", &profile.RadiusSecretFile, &profile.RadiusSecret},
+			secretFile{path + ".password_file", &profile.PasswordFile, &profile.Password},
+		)
+	}
+	for _, f := range files {
+		if *f.file == "" {
+			continue
+		}
+		data, err := os.ReadFile(*f.file)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.path, err)
+		}
+		*f.secret = strings.TrimRight(string(data), "\r\n")
+	}
+	return nil
+}
+
+// applyEnv overrides the settings with the environment variables named after
+// their path, such as DTA_DIAMETER_ADDR for diameter.addr. Lists of numbers
+// or strings are comma separated. A variable ending in _FILE, such as
+// DTA_RADIUS_SECRET_FILE, names a file to read the setting from, which suits
+// secrets mounted in containers. Lists of objects such as peers and
+// profiles can only be set in the file.
+func (c *Config) applyEnv(environ []string) error {
+	env := make(map[string]string, len(environ))
+	for _, kv := range environ {
+		if name, value, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(name, EnvPrefix) {
+			env[name] = value
+		}
+	}
+	if len(env) == 0 {
+		return nil
+	}
+	return applyEnv(reflect.ValueOf(c).Elem(), strings.TrimSuffix(EnvPrefix, "_"), env)
+}
+
+func applyEnv(v reflect.Value, prefix string, env map[string]string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(tag)
+		if field.Type.Kind() == reflect.Struct {
+			if err := applyEnv(v.Field(i), name, env); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := env[name]
+		if file, fromFile := env[name+envFileSuffix]; fromFile {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name+envFileSuffix, err)
+			}
+			value, ok = strings.TrimRight(string(data), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+		if err := setValue(v.Field(i), value); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// setValue parses s into a setting of a scalar type or a list of them.
+func setValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", s)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", s)
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var items []string
+		if s != "" {
+			items = strings.Split(s, ",")
+		}
+		list := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			if err := setValue(list.Index(i), strings.TrimSpace(item)); err != nil {
+				return err
+			}
+		}
+		v.Set(list)
+	default:
+		return fmt.Errorf("cannot be set from the environment")
+	}
+	return nil
+}
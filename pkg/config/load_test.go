@@ -0,0 +1,344 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testJSON = `{
+  "diameter": {
+    "addr": "127.0.0.1:3868",
+    "diam_host": "dta.example.org",
+    "diam_realm": "example.org",
+    "network_type": "tcp",
+    "watchdog_interval": 30,
+    "peers": [{"addr": "10.0.0.2:3868", "auth_app_ids": [1]}]
+  },
+  "radius": {
+    "addr": "127.0.0.1",
+    "secret": "secret",
+    "sticky_attributes": [25]
+  },
+  "log": {"level": "info"}
+}`
+
+const testYAML = `
+diameter:
+  addr: 127.0.0.1:3868
+  diam_host: dta.example.org
+  diam_realm: example.org
+  network_type: tcp
+  watchdog_interval: 30
+  peers:
+    - addr: 10.0.0.2:3868
+      auth_app_ids: [1]
+radius:
+  addr: 127.0.0.1
+  secret: secret
+  sticky_attributes: [25]
+log:
+  level: info
+`
+
+func writeFile(t *testing.T, name, text string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	fromJSON, err := LoadFile(writeFile(t, "config.json", testJSON))
+	if err != nil {
+		t.Fatalf("LoadFile of JSON: %v", err)
+	}
+	if fromJSON.DiameterConfig.DiamHost != "dta.example.org" || fromJSON.DiameterConfig.WatchdogInterval != 30 ||
+		len(fromJSON.DiameterConfig.Peers) != 1 || fromJSON.DiameterConfig.Peers[0].AuthAppIDs[0] != 1 {
+		t.Errorf("LoadFile of JSON = %+v", fromJSON.DiameterConfig)
+	}
+
+	for _, name := range []string{"config.yaml", "config.YML"} {
+		fromYAML, err := LoadFile(writeFile(t, name, testYAML))
+		if err != nil {
+			t.Fatalf("LoadFile of %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(fromYAML, fromJSON) {
+			t.Errorf("LoadFile of %s = %+v, want %+v as from JSON", name, fromYAML, fromJSON)
+		}
+	}
+
+	tests := []struct {
+		name, file, text string
+	}{
+		{"unknown JSON setting", "config.json", `{"diameter": {"adress": ":3868"}}`},
+		{"unknown YAML setting", "config.yaml", "radius:\n  secrett: x\n"},
+		{"invalid JSON", "config.json", `{"diameter": `},
+		{"invalid YAML", "config.yaml", "radius: [\n"},
+		{"YAML parsed as JSON", "config.conf", testYAML},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := LoadFile(writeFile(t, tt.file, tt.text)); err == nil {
+				t.Errorf("LoadFile succeeded")
+			}
+		})
+	}
+	if _, err := LoadFile(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Errorf("LoadFile of a missing file succeeded")
+	}
+}
+
+func TestLoad(t *testing.T) {
+	path := writeFile(t, "config.json", testJSON)
+	secretFile := writeFile(t, "secret", "from-file\n")
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		check func(*Config) bool
+	}{
+		{
+			name: "file only",
+			check: func(c *Config) bool {
+				return c.RadiusConfig.Secret == "secret" && c.DiameterConfig.Addr == "127.0.0.1:3868"
+			},
+		},
+		{
+			name: "environment",
+			env: map[string]string{
+				"DTA_RADIUS_SECRET":              "from-env",
+				"DTA_DIAMETER_WATCHDOG_INTERVAL": "10",
+				"DTA_RADIUS_STICKY_ATTRIBUTES":   "25, 89",
+				"DTA_DIAMETER_SSL":               "false",
+				"DTA_TRACING_SAMPLE_RATIO":       "0.5",
+				"OTHER_RADIUS_SECRET":            "ignored",
+			},
+			check: func(c *Config) bool {
+				return c.RadiusConfig.Secret == "from-env" && c.DiameterConfig.WatchdogInterval == 10 &&
+					reflect.DeepEqual(c.RadiusConfig.StickyAttributes, []int{25, 89}) && c.Tracing.SampleRatio == 0.5
+			},
+		},
+		{
+			name:  "empty list from the environment",
+			env:   map[string]string{"DTA_RADIUS_STICKY_ATTRIBUTES": ""},
+			check: func(c *Config) bool { return len(c.RadiusConfig.StickyAttributes) == 0 },
+		},
+		{
+			name:  "setting read from a file",
+			env:   map[string]string{"DTA_RADIUS_SECRET": "from-env", "DTA_RADIUS_SECRET_FILE": secretFile},
+			check: func(c *Config) bool { return c.RadiusConfig.Secret == "from-file" },
+		},
+		{
+			name: "flags over the environment",
+			env:  map[string]string{"DTA_DIAMETER_ADDR": "127.0.0.1:3869"},
+			args: []string{"--addr", "127.0.0.1:3870", "--diam_host", "other.example.org"},
+			check: func(c *Config) bool {
+				return c.DiameterConfig.Addr == "127.0.0.1:3870" && c.DiameterConfig.DiamHost == "other.example.org"
+			},
+		},
+		{
+			name:  "pprof_addr alias",
+			args:  []string{"--admin_addr", "127.0.0.1:9000", "--pprof_addr", "127.0.0.1:9001"},
+			check: func(c *Config) bool { return c.DiameterConfig.AdminAddr == "127.0.0.1:9001" },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+			args := append([]string{"--config", path}, tt.args...)
+			cfg, err := Load(args)
+			if err != nil {
+				t.Fatalf("Load: %v", err)
+			}
+			if !tt.check(cfg) {
+				t.Errorf("Load = %+v", cfg)
+			}
+			if !reflect.DeepEqual(cfg.args, args) {
+				t.Errorf("args = %v, want %v", cfg.args, args)
+			}
+		})
+	}
+}
+
+func TestLoadSecretFiles(t *testing.T) {
+	dir := t.TempDir()
+	secret := func(name, text string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	password := secret("password", "profile-password\n")
+	config := strings.NewReplacer(
+		"RADIUS_SECRET", secret("radius", "radius-secret\n"),
+		"SERVER_SECRET", secret("server", "server-secret"),
+		"PROFILE_SECRET", secret("profile", "profile-secret\r\n"),
+		"PROFILE_PASSWORD", password,
+	).Replace(`{
+  "diameter": {
+    "addr": "127.0.0.1:3868",
+    "diam_host": "dta.example.org",
+    "diam_realm": "example.org",
+    "network_type": "tcp",
+    "profiles": [
+      {"name": "partner", "radius_servers": ["192.0.2.1"], "radius_secret": "inline", "radius_secret_file": "PROFILE_SECRET", "password_file": "PROFILE_PASSWORD"},
+      {"name": "inline", "radius_secret": "inline", "password": "inline"}
+    ]
+  },
+  "radius": {"addr": "127.0.0.1", "secret_file": "RADIUS_SECRET"},
+  "radius_server": {"secret": "inline", "secret_file": "SERVER_SECRET"}
+}`)
+	cfg, err := Load([]string{"--config", writeFile(t, "config.json", config)})
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	partner, inline := cfg.DiameterConfig.Profiles[0], cfg.DiameterConfig.Profiles[1]
+	for _, tt := range []struct{ setting, got, want string }{
+		{"radius.secret", cfg.RadiusConfig.Secret, "radius-secret"},
+		{"radius_server.secret", cfg.RadiusServerConfig.Secret, "server-secret"},
+		{"profiles[0].radius_secret", partner.RadiusSecret, "profile-secret"},
+		{"profiles[0].password", partner.Password, "profile-password"},
+		{"profiles[1].radius_secret", inline.RadiusSecret, "inline"},
+		{"profiles[1].password", inline.Password, "inline"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s = %q, want %q", tt.setting, tt.got, tt.want)
+		}
+	}
+	if redacted := cfg.Redacted(); redacted.DiameterConfig.Profiles[0].Password != "<redacted>" || redacted.RadiusConfig.SecretFile == "" {
+		t.Errorf("Redacted = %+v, want the secrets hidden and their files shown", redacted)
+	}
+
+	missing := strings.Replace(config, password, filepath.Join(dir, "missing"), 1)
+	_, err = Load([]string{"--config", writeFile(t, "config.json", missing)})
+	if err == nil || !strings.Contains(err.Error(), "diameter.profiles[0].password_file") {
+		t.Errorf("Load = %v, want an error about the missing password file", err)
+	}
+}
+
+func TestLoadEnvErrors(t *testing.T) {
+	path := writeFile(t, "config.json", testJSON)
+	tests := []struct {
+		name, value, err string
+	}{
+		{"DTA_DIAMETER_WATCHDOG_INTERVAL", "often", "DTA_DIAMETER_WATCHDOG_INTERVAL: invalid integer"},
+		{"DTA_DIAMETER_SSL", "maybe", "DTA_DIAMETER_SSL: invalid boolean"},
+		{"DTA_RADIUS_STICKY_ATTRIBUTES", "25,x", "DTA_RADIUS_STICKY_ATTRIBUTES: invalid integer"},
+		{"DTA_RADIUS_SECRET_FILE", filepath.Join(t.TempDir(), "missing"), "DTA_RADIUS_SECRET_FILE"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(tt.name, tt.value)
+			_, err := Load([]string{"--config", path})
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load = %v, want an error with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Config {
+		cfg, err := LoadFile(writeFile(t, "config.json", testJSON))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cfg
+	}
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		change   func(*Config)
+		problems []string
+	}{
+		{
+			name:     "missing settings",
+			change:   func(c *Config) { c.DiameterConfig.DiamHost, c.RadiusConfig.Secret = "", "" },
+			problems: []string{"diameter.diam_host: must be set", "radius.secret: must be set"},
+		},
+		{
+			name: "bad addresses",
+			change: func(c *Config) {
+				c.DiameterConfig.Addr, c.DiameterConfig.HealthAddr, c.DiameterConfig.AdminAddr = "3868", "9100", "127.0.0.1:99999"
+			},
+			problems: []string{
+				`diameter.addr: "3868" is not a host:port address`,
+				`diameter.health_addr: "9100" is not a host:port address`,
+				`diameter.admin_addr: "127.0.0.1:99999" has an invalid port`,
+			},
+		},
+		{
+			name:     "network type",
+			change:   func(c *Config) { c.DiameterConfig.NetworkType = "udp" },
+			problems: []string{`diameter.network_type: must be tcp or sctp, not "udp"`},
+		},
+		{
+			name: "peers and routes",
+			change: func(c *Config) {
+				c.DiameterConfig.Peers[0].ReconnectInterval = -1
+				c.DiameterConfig.Routes = []RouteConfig{{Realm: "", Action: "drop"}}
+			},
+			problems: []string{
+				"diameter.peers[0].reconnect_interval: must not be negative",
+				`diameter.routes[0].realm: must be set, to "*" for any realm`,
+				`diameter.routes[0].action: must be local, relay or proxy, not "drop"`,
+			},
+		},
+		{
+			name: "pools",
+			change: func(c *Config) {
+				c.DiameterConfig.Pools = []PoolConfig{{Name: "a", IPv4: "10.0.0.0/8"}, {Name: "a", IPv4: "2001:db8::/32"}, {Name: "b"}}
+			},
+			problems: []string{
+				`diameter.pools[1].name: pool "a" is defined twice`,
+				`diameter.pools[1].ipv4: "2001:db8::/32" is not an IPv4 CIDR range`,
+				"diameter.pools[2]: must set ipv4 or ipv6_prefix",
+			},
+		},
+		{
+			name:     "TLS without a key",
+			change:   func(c *Config) { c.DiameterConfig.SSL = true },
+			problems: []string{"diameter: ssl requires cert_file and key_file"},
+		},
+		{
+			name:     "RADIUS dictionaries",
+			change:   func(c *Config) { c.RadiusConfig.Dictionaries = []string{filepath.Join(t.TempDir(), "dictionary.*")} },
+			problems: []string{"radius.dictionaries[0]: no file matches"},
+		},
+		{
+			name:     "RADIUS server",
+			change:   func(c *Config) { c.RadiusServerConfig = RadiusServerConfig{AuthAddr: ":1812", Application: "swm"} },
+			problems: []string{"radius_server.secret: must be set", `radius_server.application: must be nasreq, s6b or sta, not "swm"`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := valid()
+			tt.change(cfg)
+			err := cfg.Validate()
+			if err == nil {
+				t.Fatalf("Validate succeeded")
+			}
+			for _, problem := range tt.problems {
+				if !strings.Contains(err.Error(), "\n  "+problem) {
+					t.Errorf("Validate = %v, want %q", err, problem)
+				}
+			}
+			if n := strings.Count(err.Error(), "\n  "); n != len(tt.problems) {
+				t.Errorf("Validate reported %d problems, want %d: %v", n, len(tt.problems), err)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// problems collects what is wrong with the configuration, each prefixed
+// with the path of the setting at fault.
+type problems []string
+
+func (p *problems) addf(path, format string, args ...interface{}) {
+	*p = append(*p, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (p problems) err() error {
+	if len(p) == 0 {
+		return nil
+	}
+	return errors.New("invalid configuration:\n  " + strings.Join(p, "\n  "))
+}
+
+// Validate checks the settings before anything starts, and reports every
+// problem it finds at once. The log and tracing settings are checked when
+// they are set up.
+func (c *Config) Validate() error {
+	var p problems
+	c.DiameterConfig.validate(&p)
+	c.RadiusConfig.validate(&p)
+	c.RadiusServerConfig.validate(&p)
+	return p.err()
+}
+
+func (c *DiameterConfig) validate(p *problems) {
+	checkAddr(p, "diameter.addr", c.Addr, true)
+	if c.DiamHost == "" {
+		p.addf("diameter.diam_host", "must be set")
+	}
+	if c.DiamRealm == "" {
+		p.addf("diameter.diam_realm", "must be set")
+	}
+	checkNetworkType(p, "diameter.network_type", c.NetworkType, true)
+	checkKeyPair(p, "diameter", c.CertFile, c.KeyFile, c.SSL)
+	checkNonNegative(p, "diameter.watchdog_interval", c.WatchdogInterval)
+	checkAddr(p, "diameter.health_addr", c.HealthAddr, false)
+	checkAddr(p, "diameter.admin_addr", c.AdminAddr, false)
+	checkNonNegative(p, "diameter.shutdown_timeout", c.ShutdownTimeout)
+	checkDir(p, "diameter.dictionary_dir", c.DictionaryDir)
+	for i, pattern := range c.Dictionaries {
+		if _, err := path.Match(pattern, ""); err != nil || pattern == "" {
+			p.addf(fmt.Sprintf("diameter.dictionaries[%d]", i), "%q is not a file name or glob pattern", pattern)
+		}
+	}
+	checkFile(p, "diameter.mapping_file", c.MappingFile)
+	checkFile(p, "diameter.script_file", c.ScriptFile)
+
+	for i, peer := range c.Peers {
+		path := fmt.Sprintf("diameter.peers[%d]", i)
+		checkAddr(p, path+".addr", peer.Addr, true)
+		checkNetworkType(p, path+".network_type", peer.NetworkType, false)
+		checkKeyPair(p, path, peer.CertFile, peer.KeyFile, false)
+		checkNonNegative(p, path+".watchdog_interval", peer.WatchdogInterval)
+		checkNonNegative(p, path+".reconnect_interval", peer.ReconnectInterval)
+		checkNonNegative(p, path+".max_reconnect_backoff", peer.MaxReconnectBackoff)
+	}
+	for i, policy := range c.AllowedPeers {
+		for j, ip := range policy.IPs {
+			if _, _, err := net.ParseCIDR(ip); err != nil && net.ParseIP(ip) == nil {
+				p.addf(fmt.Sprintf("diameter.allowed_peers[%d].ips[%d]", i, j), "%q is neither an IP address nor a CIDR range", ip)
+			}
+		}
+	}
+	for i, route := range c.Routes {
+		path := fmt.Sprintf("diameter.routes[%d]", i)
+		if route.Realm == "" {
+			p.addf(path+".realm", "must be set, to \"*\" for any realm")
+		}
+		switch route.Action {
+		case "local":
+		case "", "relay", "proxy":
+			if len(route.Peers) == 0 {
+				p.addf(path+".peers", "must list the peers to forward to")
+			}
+		default:
+			p.addf(path+".action", "must be local, relay or proxy, not %q", route.Action)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i, pool := range c.Pools {
+		path := fmt.Sprintf("diameter.pools[%d]", i)
+		if pool.Name == "" {
+			p.addf(path+".name", "must be set")
+		} else if names[pool.Name] {
+			p.addf(path+".name", "pool %q is defined twice", pool.Name)
+		}
+		names[pool.Name] = true
+		if pool.IPv4 == "" && pool.IPv6Prefix == "" {
+			p.addf(path, "must set ipv4 or ipv6_prefix")
+		}
+		if pool.IPv4 != "" {
+			if _, network, err := net.ParseCIDR(pool.IPv4); err != nil || network.IP.To4() == nil {
+				p.addf(path+".ipv4", "%q is not an IPv4 CIDR range", pool.IPv4)
+			}
+		}
+		if pool.IPv6Prefix != "" {
+			_, network, err := net.ParseCIDR(pool.IPv6Prefix)
+			if err != nil || network.IP.To4() != nil {
+				p.addf(path+".ipv6_prefix", "%q is not an IPv6 CIDR prefix", pool.IPv6Prefix)
+			} else if ones, _ := network.Mask.Size(); pool.IPv6PrefixLength != 0 && (pool.IPv6PrefixLength < ones || pool.IPv6PrefixLength > 128) {
+				p.addf(path+".ipv6_prefix_length", "must be between %d and 128", ones)
+			}
+		}
+	}
+
+	names = make(map[string]bool)
+	for i, profile := range c.Profiles {
+		path := fmt.Sprintf("diameter.profiles[%d]", i)
+		if profile.Name == "" {
+			p.addf(path+".name", "must be set")
+		} else if names[profile.Name] {
+			p.addf(path+".name", "profile %q is defined twice", profile.Name)
+		}
+		names[profile.Name] = true
+		checkFile(p, path+".mapping_file", profile.MappingFile)
+	}
+}
+
+func (c *RadiusConfig) validate(p *problems) {
+	if c.Addr == "" {
+		p.addf("radius.addr", "must be set")
+	}
+	if c.Secret == "" {
+		p.addf("radius.secret", "must be set")
+	}
+	if c.ClientPort < 0 || c.ClientPort > 65535 {
+		p.addf("radius.client_port", "must be a port number, not %d", c.ClientPort)
+	}
+	checkAddr(p, "radius.dae_addr", c.DAEAddr, false)
+	checkNonNegative(p, "radius.status_interval", c.StatusInterval)
+	for i, t := range c.StickyAttributes {
+		if t < 1 || t > 255 {
+			p.addf(fmt.Sprintf("radius.sticky_attributes[%d]", i), "%d is not an attribute type", t)
+		}
+	}
+	for i, pattern := range c.Dictionaries {
+		if matches, err := filepath.Glob(pattern); err != nil || len(matches) == 0 {
+			p.addf(fmt.Sprintf("radius.dictionaries[%d]", i), "no file matches %q", pattern)
+		}
+	}
+}
+
+func (c *RadiusServerConfig) validate(p *problems) {
+	if c.AuthAddr == "" && c.AcctAddr == "" {
+		return
+	}
+	checkAddr(p, "radius_server.auth_addr", c.AuthAddr, false)
+	checkAddr(p, "radius_server.acct_addr", c.AcctAddr, false)
+	if c.Secret == "" {
+		p.addf("radius_server.secret", "must be set")
+	}
+	switch c.Application {
+	case "", "nasreq", "s6b", "sta":
+	default:
+		p.addf("radius_server.application", "must be nasreq, s6b or sta, not %q", c.Application)
+	}
+	switch c.Accounting {
+	case "", "acr", "ccr":
+	default:
+		p.addf("radius_server.accounting", "must be acr or ccr, not %q", c.Accounting)
+	}
+}
+
+// checkAddr checks an ip:port or host:port address, which may be empty
+// unless required.
+func checkAddr(p *problems, path, addr string, required bool) {
+	if addr == "" {
+		if required {
+			p.addf(path, "must be set")
+		}
+		return
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		p.addf(path, "%q is not a host:port address", addr)
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		p.addf(path, "%q has an invalid port", addr)
+	}
+}
+
+func checkNetworkType(p *problems, path, networkType string, required bool) {
+	switch networkType {
+	case "tcp", "tcp4", "tcp6", "sctp", "sctp4", "sctp6":
+	case "":
+		if required {
+			p.addf(path, "must be set to tcp or sctp")
+		}
+	default:
+		p.addf(path, "must be tcp or sctp, not %q", networkType)
+	}
+}
+
+// checkKeyPair checks that a TLS certificate comes with its key, and that
+// both are set when TLS is required.
+func checkKeyPair(p *problems, path, cert, key string, required bool) {
+	switch {
+	case cert == "" && key == "":
+		if required {
+			p.addf(path, "ssl requires cert_file and key_file")
+		}
+		return
+	case cert == "":
+		p.addf(path+".cert_file", "must be set along with key_file")
+	case key == "":
+		p.addf(path+".key_file", "must be set along with cert_file")
+	}
+	checkFile(p, path+".cert_file", cert)
+	checkFile(p, path+".key_file", key)
+}
+
+func checkFile(p *problems, path, file string) {
+	if file == "" {
+		return
+	}
+	if _, err := os.Stat(file); err != nil {
+		p.addf(path, "%v", err)
+	}
+}
+
+func checkDir(p *problems, path, dir string) {
+	if dir == "" {
+		return
+	}
+	if info, err := os.Stat(dir); err != nil {
+		p.addf(path, "%v", err)
+	} else if !info.IsDir() {
+		p.addf(path, "%s is not a directory", dir)
+	}
+}
+
+func checkNonNegative(p *problems, path string, n int) {
+	if n < 0 {
+		p.addf(path, "must not be negative")
+	}
+}
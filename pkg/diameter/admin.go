@@ -0,0 +1,304 @@
+package diameter
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"sort"
+	"time"
+
+	"diametertransfereagent/pkg/logging"
+	"diametertransfereagent/pkg/metrics"
+
+	"layeh.com/radius/rfc2866"
+)
+
+// readinessCheck is a dependency /readyz reports on, failing with an error
+// while it cannot serve.
+type readinessCheck struct {
+	name  string
+	check func() error
+}
+
+// newHealthMux serves the health of the agent on /healthz and /readyz and
+// the Prometheus metrics on /metrics.
+func (s *Server) newHealthMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	s.handleHealth(mux)
+	return mux
+}
+
+func (s *Server) handleHealth(mux *http.ServeMux) {
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthz", s.handleHealthz)
+	mux.HandleFunc("GET /readyz", s.handleReadyz)
+}
+
+// newAdminMux serves the log level on /log/level, the runtime profiles on
+// /debug/pprof/, and the peers and sessions of the agent. It also serves
+// the health and metrics when they have no listener of their own.
+func (s *Server) newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	if s.cfg.HealthAddr == "" {
+		s.handleHealth(mux)
+	}
+	mux.Handle("/log/level", logging.LevelHandler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("GET /peers", s.handlePeers)
+	mux.HandleFunc("GET /sessions", s.handleSessions)
+	mux.HandleFunc("GET /sessions/{id}", s.handleSession)
+	mux.HandleFunc("DELETE /sessions/{id}", s.handleTerminateSession)
+	return mux
+}
+
+// HandleAdmin adds a handler to the admin HTTP server. It must be called
+// before Start.
+func (s *Server) HandleAdmin(pattern string, handler http.Handler) {
+	s.admin.Handle(pattern, handler)
+}
+
+// AddReadinessCheck makes /readyz fail while check does. It must be called
+// before Start.
+func (s *Server) AddReadinessCheck(name string, check func() error) {
+	s.checks = append(s.checks, readinessCheck{name: name, check: check})
+}
+
+// handleHealthz reports whether the Diameter listener is up.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	if !s.listening.Load() {
+		http.Error(w, "diameter listener is down", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReadyz reports whether the agent can translate requests: its
+// listener is up, one of its outbound peers, if it has any, is open, and
+// the registered checks, such as the liveness of the AAA servers, pass.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := append([]readinessCheck{
+		{"diameter_listener", s.listenerReady},
+		{"diameter_peers", s.peersReady},
+	}, s.checks...)
+
+	status := http.StatusOK
+	results := make(map[string]string, len(checks))
+	for _, c := range checks {
+		if err := c.check(); err != nil {
+			status = http.StatusServiceUnavailable
+			results[c.name] = err.Error()
+			continue
+		}
+		results[c.name] = "ok"
+	}
+	writeJSON(w, status, map[string]interface{}{
+		"ready":  status == http.StatusOK,
+		"checks": results,
+	})
+}
+
+func (s *Server) listenerReady() error {
+	if !s.listening.Load() {
+		return fmt.Errorf("not listening on %s", s.cfg.Addr)
+	}
+	return nil
+}
+
+func (s *Server) peersReady() error {
+	if len(s.peers) == 0 {
+		return nil
+	}
+	for _, peer := range s.peers {
+		if state := peer.State(); state == PeerIOpen || state == PeerROpen {
+			return nil
+		}
+	}
+	return fmt.Errorf("none of the %d outbound peers is open", len(s.peers))
+}
+
+// peerStatus is a peer as listed by /peers.
+type peerStatus struct {
+	OriginHost   string    `json:"origin_host"`
+	OriginRealm  string    `json:"origin_realm"`
+	Addr         string    `json:"addr"`
+	Direction    string    `json:"direction"`
+	State        string    `json:"state"`
+	Watchdog     string    `json:"watchdog,omitempty"`
+	Applications []uint32  `json:"applications,omitempty"`
+	ConnectedAt  time.Time `json:"connected_at"`
+	LastActivity time.Time `json:"last_activity"`
+}
+
+// handlePeers lists the peers of the peer table and the configured outbound
+// peers that are not connected.
+func (s *Server) handlePeers(w http.ResponseWriter, r *http.Request) {
+	peers := []peerStatus{}
+	for _, entry := range s.peerTable.List() {
+		direction := "outbound"
+		if entry.Inbound {
+			direction = "inbound"
+		}
+		peers = append(peers, peerStatus{
+			OriginHost:   string(entry.OriginHost),
+			OriginRealm:  string(entry.OriginRealm),
+			Addr:         entry.RemoteAddr,
+			Direction:    direction,
+			State:        entry.State.String(),
+			Watchdog:     entry.Watchdog.String(),
+			Applications: entry.Applications,
+			ConnectedAt:  entry.ConnectedAt,
+			LastActivity: entry.LastActivity,
+		})
+	}
+	for _, peer := range s.peers {
+		if peer.OriginHost() != "" {
+			continue
+		}
+		peers = append(peers, peerStatus{Addr: peer.Addr(), Direction: "outbound", State: peer.State().String()})
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].OriginHost+peers[i].Addr < peers[j].OriginHost+peers[j].Addr })
+	writeJSON(w, http.StatusOK, peers)
+}
+
+// sessionStatus is a session as shown by /sessions.
+type sessionStatus struct {
+	ID               string    `json:"id"`
+	AppID            uint32    `json:"app_id"`
+	OriginHost       string    `json:"origin_host"`
+	OriginRealm      string    `json:"origin_realm"`
+	UserName         string    `json:"user_name"`
+	IMSI             string    `json:"imsi,omitempty"`
+	AcctSessionID    string    `json:"acct_session_id"`
+	Profile          string    `json:"profile,omitempty"`
+	FramedIP         net.IP    `json:"framed_ip,omitempty"`
+	FramedIPv6Prefix string    `json:"framed_ipv6_prefix,omitempty"`
+	Pool             string    `json:"pool,omitempty"`
+	StartTime        time.Time `json:"start_time"`
+	LastSeen         time.Time `json:"last_seen"`
+	Expires          time.Time `json:"expires"`
+	SessionTimeout   uint32    `json:"session_timeout,omitempty"`
+	IdleTimeout      uint32    `json:"idle_timeout,omitempty"`
+	InterimInterval  uint32    `json:"interim_interval,omitempty"`
+	Accounting       bool      `json:"accounting"`
+	InputOctets      uint64    `json:"input_octets"`
+	OutputOctets     uint64    `json:"output_octets"`
+}
+
+// newSessionStatus describes a session for /sessions, with its subscriber
+// identities masked as in the logs.
+func newSessionStatus(session Session) sessionStatus {
+	return sessionStatus{
+		ID:               session.ID,
+		AppID:            session.AppID,
+		OriginHost:       string(session.OriginHost),
+		OriginRealm:      string(session.OriginRealm),
+		UserName:         logging.UserName(session.UserName).Value.String(),
+		IMSI:             logging.IMSI(session.IMSI).Value.String(),
+		AcctSessionID:    session.AcctSessionID,
+		Profile:          session.Profile,
+		FramedIP:         session.FramedIP,
+		FramedIPv6Prefix: session.FramedIPv6Prefix,
+		Pool:             session.Pool,
+		StartTime:        session.StartTime,
+		LastSeen:         session.LastSeen,
+		Expires:          session.Expires,
+		SessionTimeout:   session.Timeout,
+		IdleTimeout:      session.IdleTimeout,
+		InterimInterval:  session.InterimInterval,
+		Accounting:       session.Accounting,
+		InputOctets:      session.InputOctets,
+		OutputOctets:     session.OutputOctets,
+	}
+}
+
+// handleSessions lists the sessions, or those matching the acct_session_id,
+// user_name (or IMSI) and framed_ip query parameters.
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var framedIP net.IP
+	if ip := query.Get("framed_ip"); ip != "" {
+		if framedIP = net.ParseIP(ip); framedIP == nil {
+			http.Error(w, "invalid framed_ip", http.StatusBadRequest)
+			return
+		}
+	}
+	var sessions []Session
+	if acctSessionID, userName := query.Get("acct_session_id"), query.Get("user_name"); acctSessionID != "" || userName != "" || framedIP != nil {
+		sessions = s.sessions.Find(acctSessionID, userName, framedIP)
+	} else {
+		sessions = s.sessions.List()
+	}
+	statuses := make([]sessionStatus, 0, len(sessions))
+	for _, session := range sessions {
+		statuses = append(statuses, newSessionStatus(session))
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].ID < statuses[j].ID })
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func (s *Server) handleSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessions.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSessionStatus(session))
+}
+
+// handleTerminateSession aborts a session with an ASR to its peer, as a
+// Disconnect-Request does. The session ends with the STR or CCR-T the peer
+// sends after the ASA.
+func (s *Server) handleTerminateSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := s.sessions.Get(r.PathValue("id"))
+	if !ok {
+		http.Error(w, "unknown session", http.StatusNotFound)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), stopSessionTimeout)
+	defer cancel()
+	asr := BuildAbortSessionRequest(s.settings, s.dictionary.Load(), session.AppID, session.ID, session.OriginHost, session.OriginRealm)
+	resultCode, err := s.sessionRequest(ctx, session, asr, rfc2866.AcctTerminateCause_Value_AdminReset)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]uint32{"result_code": resultCode})
+}
+
+// serveHTTP serves handler on addr until Shutdown.
+func serveHTTP(addr string, handler http.Handler) *http.Server {
+	server := &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		ReadTimeout:  5 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		IdleTimeout:  15 * time.Second,
+	}
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+	return server
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		slog.Error("Failed to write admin response", "error", err)
+	}
+}
@@ -0,0 +1,128 @@
+package diameter
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+)
+
+func serve(t *testing.T, mux *http.ServeMux, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// TestAdminListeners checks that the probes and metrics are kept apart from
+// the management of the agent when they have a listener of their own.
+func TestAdminListeners(t *testing.T) {
+	s, _ := newTestPeer(t, "pgw.example.org", answerWith(diam.Success))
+	s.cfg.HealthAddr = "127.0.0.1:9100"
+	health, admin := s.newHealthMux(), s.newAdminMux()
+
+	for _, target := range []string{"/healthz", "/readyz", "/metrics"} {
+		if w := serve(t, health, http.MethodGet, target); w.Code == http.StatusNotFound {
+			t.Errorf("health server does not serve %s", target)
+		}
+		if w := serve(t, admin, http.MethodGet, target); w.Code != http.StatusNotFound {
+			t.Errorf("admin server serves %s with %d, want it on the health server only", target, w.Code)
+		}
+	}
+	for _, req := range []struct{ method, target string }{
+		{http.MethodGet, "/sessions"},
+		{http.MethodDelete, "/sessions/pgw.example.org;1"},
+		{http.MethodPut, "/log/level"},
+		{http.MethodGet, "/debug/pprof/"},
+	} {
+		if w := serve(t, health, req.method, req.target); w.Code != http.StatusNotFound {
+			t.Errorf("health server serves %s %s with %d", req.method, req.target, w.Code)
+		}
+	}
+
+	// Without a listener of their own, they are on the admin server.
+	s.cfg.HealthAddr = ""
+	admin = s.newAdminMux()
+	if w := serve(t, admin, http.MethodGet, "/healthz"); w.Code == http.StatusNotFound {
+		t.Errorf("admin server does not serve /healthz when health_addr is empty")
+	}
+}
+
+func TestAdminHealth(t *testing.T) {
+	s, _ := newTestPeer(t, "pgw.example.org", answerWith(diam.Success))
+	health := s.newHealthMux()
+	if w := serve(t, health, http.MethodGet, "/healthz"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("/healthz = %d before listening, want %d", w.Code, http.StatusServiceUnavailable)
+	}
+	s.listening.Store(true)
+	if w := serve(t, health, http.MethodGet, "/healthz"); w.Code != http.StatusOK {
+		t.Errorf("/healthz = %d, want %d", w.Code, http.StatusOK)
+	}
+
+	var aaaDown error
+	s.AddReadinessCheck("radius_servers", func() error { return aaaDown })
+	if w := serve(t, health, http.MethodGet, "/readyz"); w.Code != http.StatusOK {
+		t.Errorf("/readyz = %d: %s", w.Code, w.Body)
+	}
+	aaaDown = errors.New("no RADIUS server answered")
+	w := serve(t, health, http.MethodGet, "/readyz")
+	var ready struct {
+		Ready  bool              `json:"ready"`
+		Checks map[string]string `json:"checks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&ready); err != nil {
+		t.Fatalf("decode /readyz: %v", err)
+	}
+	if w.Code != http.StatusServiceUnavailable || ready.Ready || ready.Checks["radius_servers"] != aaaDown.Error() || ready.Checks["diameter_listener"] != "ok" {
+		t.Errorf("/readyz = %d %+v, want the failing check", w.Code, ready)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	s, peer := newTestPeer(t, "pgw.example.org", answerWith(diam.Success))
+	admin := s.newAdminMux()
+	s.sessions.Update("pgw.example.org;1", func(session *Session) {
+		session.AppID = S6B_APP_ID
+		session.OriginHost = "pgw.example.org"
+		session.OriginRealm = "example.net"
+		session.UserName = "alice@example.org"
+		session.AcctSessionID = "0001"
+	})
+	s.sessions.Update("pgw.example.org;2", func(session *Session) { session.AcctSessionID = "0002" })
+
+	var list []sessionStatus
+	if err := json.NewDecoder(serve(t, admin, http.MethodGet, "/sessions").Body).Decode(&list); err != nil || len(list) != 2 {
+		t.Fatalf("/sessions = %+v, %v, want both sessions", list, err)
+	}
+	if err := json.NewDecoder(serve(t, admin, http.MethodGet, "/sessions?acct_session_id=0002").Body).Decode(&list); err != nil || len(list) != 1 || list[0].ID != "pgw.example.org;2" {
+		t.Errorf("/sessions?acct_session_id=0002 = %+v, %v", list, err)
+	}
+	if w := serve(t, admin, http.MethodGet, "/sessions?framed_ip=bogus"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid framed_ip = %d", w.Code)
+	}
+	if w := serve(t, admin, http.MethodGet, "/sessions/pgw.example.org;1"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "alice@example.org") {
+		t.Errorf("/sessions/pgw.example.org;1 = %d %s", w.Code, w.Body)
+	}
+	if w := serve(t, admin, http.MethodGet, "/sessions/unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown session = %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	w := serve(t, admin, http.MethodDelete, "/sessions/pgw.example.org;1")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"result_code": 2001`) {
+		t.Errorf("DELETE = %d %s", w.Code, w.Body)
+	}
+	if sent := peer.sent(); len(sent) != 1 || sent[0].Header.CommandCode != diam.AbortSession {
+		t.Errorf("peer received %v, want an ASR", sent)
+	}
+	// The session waits for the STR that follows the ASA.
+	if _, ok := s.sessions.Get("pgw.example.org;1"); !ok {
+		t.Errorf("session removed before its STR")
+	}
+	if w := serve(t, admin, http.MethodDelete, "/sessions/unknown"); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE unknown session = %d", w.Code)
+	}
+}
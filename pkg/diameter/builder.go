@@ -8,6 +8,7 @@ import (
 	"github.com/fiorix/go-diameter/v4/diam"
 	"github.com/fiorix/go-diameter/v4/diam/avp"
 	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
 	"github.com/fiorix/go-diameter/v4/diam/sm"
 )
 
@@ -82,10 +83,6 @@ func BuildDiameterResponse(settings sm.Settings, req models.DiameterRequest, res
 		if err != nil {
 			log.Printf("Error Setting AuthRequestType: %v", err)
 		}
-		_, err = a.NewAVP(avp.SessionTimeout, avp.Mbit, 0, datatype.Unsigned32(7200))
-		if err != nil {
-			log.Printf("Error Setting SessionTimeout: %v", err)
-		}
 		_, err = a.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
 		if err != nil {
 			log.Printf("Error Setting OriginHost: %v", err)
@@ -149,6 +146,17 @@ func BuildDiameterResponse(settings sm.Settings, req models.DiameterRequest, res
 			}
 		}
 
+	case models.SessionTerminationRequest:
+		a.InsertAVP(diam.NewAVP(avp.SessionID, avp.Mbit, 0, r.SessionID))
+		_, err := a.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
+		if err != nil {
+			log.Printf("Error Setting OriginHost: %v", err)
+		}
+		_, err = a.NewAVP(avp.OriginRealm, avp.Mbit, 0, settings.OriginRealm)
+		if err != nil {
+			log.Printf("Error Setting OriginRealm: %v", err)
+		}
+
 	case models.DisconnectPeerRequest:
 		_, err := a.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
 		if err != nil {
@@ -162,3 +170,60 @@ func BuildDiameterResponse(settings sm.Settings, req models.DiameterRequest, res
 
 	return a
 }
+
+// BuildReAuthRequest constructs a server-initiated Re-Auth-Request for a session
+func BuildReAuthRequest(settings sm.Settings, parser *dict.Parser, appID uint32, sessionID string, destHost, destRealm datatype.DiameterIdentity, reAuthRequestType uint32) *diam.Message {
+	m := diam.NewRequest(diam.ReAuth, appID, parser)
+	m.Header.CommandFlags |= diam.ProxiableFlag
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sessionID))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, settings.OriginRealm)
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, destRealm)
+	m.NewAVP(avp.DestinationHost, avp.Mbit, 0, destHost)
+	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(appID))
+	m.NewAVP(avp.ReAuthRequestType, avp.Mbit, 0, datatype.Enumerated(reAuthRequestType))
+	return m
+}
+
+// BuildAbortSessionRequest constructs a server-initiated Abort-Session-Request for a session
+func BuildAbortSessionRequest(settings sm.Settings, parser *dict.Parser, appID uint32, sessionID string, destHost, destRealm datatype.DiameterIdentity) *diam.Message {
+	m := diam.NewRequest(diam.AbortSession, appID, parser)
+	m.Header.CommandFlags |= diam.ProxiableFlag
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sessionID))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, settings.OriginRealm)
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, destRealm)
+	m.NewAVP(avp.DestinationHost, avp.Mbit, 0, destHost)
+	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(appID))
+	return m
+}
+
+// BuildCancelLocationRequest constructs an S6a Cancel-Location-Request for a subscriber
+func BuildCancelLocationRequest(settings sm.Settings, parser *dict.Parser, sessionID string, destHost, destRealm datatype.DiameterIdentity, userName string, cancellationType uint32) *diam.Message {
+	m := diam.NewRequest(diam.CancelLocation, diam.TGPP_S6A_APP_ID, parser)
+	m.Header.CommandFlags |= diam.ProxiableFlag
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sessionID))
+	m.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
+		AVP: []*diam.AVP{
+			diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(diam.TGPP_S6A_APP_ID)),
+			diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(VENDOR_3GPP)),
+		},
+	})
+	m.NewAVP(avp.AuthSessionState, avp.Mbit, 0, datatype.Enumerated(1))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, settings.OriginRealm)
+	m.NewAVP(avp.DestinationHost, avp.Mbit, 0, destHost)
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, destRealm)
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String(userName))
+	m.NewAVP(avp.CancellationType, avp.Mbit|avp.Vbit, VENDOR_3GPP, datatype.Enumerated(cancellationType))
+	return m
+}
+
+// BuildDisconnectPeerRequest constructs a Disconnect-Peer-Request closing the connection to a peer
+func BuildDisconnectPeerRequest(settings sm.Settings, parser *dict.Parser, disconnectCause uint32) *diam.Message {
+	m := diam.NewRequest(diam.DisconnectPeer, 0, parser)
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, settings.OriginRealm)
+	m.NewAVP(avp.DisconnectCause, avp.Mbit, 0, datatype.Enumerated(disconnectCause))
+	return m
+}
@@ -1,14 +1,18 @@
 package diameter
 
 import (
+	"diametertransfereagent/pkg/identity"
+	"diametertransfereagent/pkg/location"
 	"diametertransfereagent/pkg/models"
 	"diametertransfereagent/pkg/radius"
 	"log"
 	"net"
 	"strconv"
-	"strings"
+	"time"
 
 	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
 	"layeh.com/radius/rfc2865"
 	"layeh.com/radius/rfc2866"
 )
@@ -27,11 +31,9 @@ func ConvertToRadius(messagetype string, m *diam.Message, c diam.Conn) (radius.R
 			return nil, req
 		}
 		radiuspacket.Type = radius.AccessRequest
-		usernameparts := strings.Split(string(req.UserName), "@")
-		username := usernameparts[0]
-		radiuspacket.Username = string(username)
+		radiuspacket.Username = requestIdentity(m).Name()
 		radiuspacket.Password = "12345"
-		radiuspacket.NASIPAddress = c.RemoteAddr().String()
+		radiuspacket.NASIPAddress = remoteIP(c)
 		radiuspacket.NASPortType = rfc2865.NASPortType_Value_Virtual
 		radiuspacket.ServiceType = rfc2865.ServiceType_Value_FramedUser
 		radiuspacket.CalledStationID = "00-14-22-01-23-45"
@@ -47,11 +49,9 @@ func ConvertToRadius(messagetype string, m *diam.Message, c diam.Conn) (radius.R
 			return nil, req
 		}
 		radiuspacket.Type = radius.AccessRequest
-		usernameparts := strings.Split(string(req.UserName), "@")
-		username := usernameparts[0]
-		radiuspacket.Username = string(username)
+		radiuspacket.Username = requestIdentity(m).Name()
 		radiuspacket.Password = "12345"
-		radiuspacket.NASIPAddress = c.RemoteAddr().String()
+		radiuspacket.NASIPAddress = remoteIP(c)
 		radiuspacket.NASPortType = rfc2865.NASPortType_Value_Virtual
 		radiuspacket.ServiceType = rfc2865.ServiceType_Value_FramedUser
 		radiuspacket.CalledStationID = "00-14-22-01-23-45"
@@ -68,41 +68,38 @@ func ConvertToRadius(messagetype string, m *diam.Message, c diam.Conn) (radius.R
 		}
 
 		radiuspacket.Type = radius.AccountingRequest
-		radiuspacket.Username = string(req.SubscriptionId.SubscriptionIDData)
+		id := requestIdentity(m)
+		radiuspacket.Username = id.Name()
 
 		if req.CCRequestType == models.CCRequestTypeInitial {
 			radiuspacket.AcctStatus = rfc2866.AcctStatusType_Value_Start
 
 		} else if req.CCRequestType == models.CCRequestTypeUpdate {
 			radiuspacket.AcctStatus = rfc2866.AcctStatusType_Value_InterimUpdate
-			radiuspacket.UsedInputOctets = uint64(req.MultipleServiceCreditControl.UsedServiceUnit.CCInputOctets)
-			radiuspacket.UsedOutputOctets = uint64(req.MultipleServiceCreditControl.UsedServiceUnit.CCOutputOctets)
-			radiuspacket.Acctsessiontime = uint32(req.MultipleServiceCreditControl.UsedServiceUnit.CCTime)
-
 		} else {
 			radiuspacket.AcctStatus = rfc2866.AcctStatusType_Value_Stop
 		}
+		// Used-Service-Unit reports the usage since the previous CCR; the
+		// session store turns it into the running totals RADIUS expects.
+		radiuspacket.UsedInputOctets = uint64(req.MultipleServiceCreditControl.UsedServiceUnit.CCInputOctets)
+		radiuspacket.UsedOutputOctets = uint64(req.MultipleServiceCreditControl.UsedServiceUnit.CCOutputOctets)
+		radiuspacket.Acctsessiontime = uint32(req.MultipleServiceCreditControl.UsedServiceUnit.CCTime)
 
 		radiuspacket.PDPType = int32(req.ServiceInformation.PsInformation.PDPType)
 
-		if req.ServiceInformation.PsInformation.PDPType == 0 {
-			radiuspacket.Ipv4FramedIP = net.IP(req.ServiceInformation.PsInformation.PDPAddress[0])
-			// radiuspacket.Ipv6FramedIP = nil
-		} else {
-			radiuspacket.Ipv4FramedIP = net.IP(req.ServiceInformation.PsInformation.PDPAddress[0])
-			radiuspacket.Ipv6FramedIP = net.IP(req.ServiceInformation.PsInformation.PDPAddress[1])
+		pdpAddress := req.ServiceInformation.PsInformation.PDPAddress
+		if len(pdpAddress) > 0 {
+			radiuspacket.Ipv4FramedIP = net.IP(pdpAddress[0])
+		}
+		if req.ServiceInformation.PsInformation.PDPType != 0 && len(pdpAddress) > 1 {
+			radiuspacket.Ipv6FramedIP = net.IP(pdpAddress[1])
 		}
 
 		radiuspacket.CalledStationID = string(req.ServiceInformation.PsInformation.CalledStationId)
 		radiuspacket.AcctDelayTime = rfc2866.AcctDelayTime(0)
 
-		parts := strings.Split(string(req.SessionID), ";")
-		if len(parts) > 2 {
-			session_id := parts[len(parts)-2]
-			radiuspacket.AcctSessionID = string(session_id)
-		}
-		// radiuspacket.AcctSessionID = string(req.SessionID)
-		radiuspacket.IMSI = string(req.SubscriptionId.SubscriptionIDData)
+		// Acct-Session-Id is assigned by the session store.
+		radiuspacket.IMSI = id.IMSI
 		radiuspacket.ULAMBR = strconv.FormatUint(uint64(req.MultipleServiceCreditControl.Qos.APNAggregateMaxBitrateUL), 10)
 		radiuspacket.DLAMBR = strconv.FormatUint(uint64(req.MultipleServiceCreditControl.Qos.APNAggregateMaxBitrateDL), 10)
 		radiuspacket.SGSNAddress = net.IP(req.ServiceInformation.PsInformation.SGSNAddress)
@@ -112,7 +109,14 @@ func ConvertToRadius(messagetype string, m *diam.Message, c diam.Conn) (radius.R
 		radiuspacket.RATType = string(req.MultipleServiceCreditControl.TGPPRATType)
 		radiuspacket.UserLocationInfo = string(req.ServiceInformation.PsInformation.ThreeGPPUserLocationInfo)
 		radiuspacket.Timezone = string(req.ServiceInformation.PsInformation.ThreeGPPMSTimeZone)
-		radiuspacket.EventTimestamp = req.ServiceInformation.PsInformation.EventTimestamp.String()
+		radiuspacket.Location = decodeLocation([]byte(req.ServiceInformation.PsInformation.ThreeGPPUserLocationInfo), []byte(req.ServiceInformation.PsInformation.ThreeGPPMSTimeZone))
+		// Event-Timestamp is in the CCR itself (RFC 4006 section 8.38) or in
+		// its PS-Information (3GPP TS 32.299).
+		if a, err := m.FindAVP(avp.EventTimestamp, 0); err == nil {
+			if ts, ok := a.Data.(datatype.Time); ok {
+				radiuspacket.EventTimestamp = time.Time(ts)
+			}
+		}
 
 		return &radiuspacket, req
 
@@ -129,3 +133,60 @@ func ConvertToRadius(messagetype string, m *diam.Message, c diam.Conn) (radius.R
 
 	return nil, nil
 }
+
+// remoteIP is the address of the peer without its port.
+func remoteIP(c diam.Conn) string {
+	host, _, err := net.SplitHostPort(c.RemoteAddr().String())
+	if err != nil {
+		return c.RemoteAddr().String()
+	}
+	return host
+}
+
+// requestIdentity is the subscriber identity of a request, from its
+// User-Name and all of its Subscription-Id AVPs.
+func requestIdentity(m *diam.Message) identity.Identity {
+	var ids []identity.SubscriptionID
+	subscriptions, _ := m.FindAVPs(avp.SubscriptionID, 0)
+	for _, a := range subscriptions {
+		group, ok := a.Data.(*diam.GroupedAVP)
+		if !ok {
+			continue
+		}
+		var id identity.SubscriptionID
+		for _, field := range group.AVP {
+			switch field.Code {
+			case avp.SubscriptionIDType:
+				if typ, ok := field.Data.(datatype.Enumerated); ok {
+					id.Type = uint32(typ)
+				}
+			case avp.SubscriptionIDData:
+				id.Data = string(field.Data.Serialize())
+			}
+		}
+		ids = append(ids, id)
+	}
+	return identity.New(string(findAVPBytes(m, avp.UserName)), ids)
+}
+
+// decodeLocation returns the fields of a 3GPP-User-Location-Info and a
+// 3GPP-MS-TimeZone, leaving out those that are absent or malformed.
+func decodeLocation(uli, timeZone []byte) map[string]string {
+	fields := make(map[string]string)
+	if len(uli) > 0 {
+		if loc, err := location.Decode(uli); err == nil {
+			fields = loc.Fields
+		} else {
+			log.Printf("Failed to decode User-Location-Info %x: %v", uli, err)
+		}
+	}
+	if len(timeZone) > 0 {
+		if tz, err := location.DecodeTimeZone(timeZone); err == nil {
+			fields["time_zone"] = tz.String()
+			fields["dst"] = strconv.Itoa(tz.DST)
+		} else {
+			log.Printf("Failed to decode MS-TimeZone %x: %v", timeZone, err)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,74 @@
+package diameter
+
+import (
+	"context"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc3576"
+)
+
+// AUTHORIZE_ONLY Re-Auth-Request-Type (RFC 6733 section 8.12)
+const reAuthAuthorizeOnly = 0
+
+// Disconnect sends an ASR for every session targeted by a Disconnect-Request
+// and returns the Error-Cause of the NAK, or zero for an ACK.
+func (s *Server) Disconnect(ctx context.Context, req *radius.Request) (rfc3576.ErrorCause, error) {
+	return s.dynamicAuthorization(ctx, req, func(session *Session) *diam.Message {
+		return BuildAbortSessionRequest(s.settings, s.dictionary.Load(), session.AppID, session.ID, session.OriginHost, session.OriginRealm)
+	})
+}
+
+// ChangeOfAuthorization sends a RAR for every session targeted by a
+// CoA-Request, asking the peer to re-authorize it.
+func (s *Server) ChangeOfAuthorization(ctx context.Context, req *radius.Request) (rfc3576.ErrorCause, error) {
+	return s.dynamicAuthorization(ctx, req, func(session *Session) *diam.Message {
+		return BuildReAuthRequest(s.settings, s.dictionary.Load(), session.AppID, session.ID, session.OriginHost, session.OriginRealm, reAuthAuthorizeOnly)
+	})
+}
+
+func (s *Server) dynamicAuthorization(ctx context.Context, req *radius.Request, build func(*Session) *diam.Message) (rfc3576.ErrorCause, error) {
+	acctSessionID := rfc2866.AcctSessionID_GetString(req.Packet)
+	userName := rfc2865.UserName_GetString(req.Packet)
+	framedIP := rfc2865.FramedIPAddress_Get(req.Packet)
+	// Without any of the attributes identifying a session the request
+	// would target none (RFC 5176 section 3).
+	if acctSessionID == "" && userName == "" && framedIP == nil {
+		return rfc3576.ErrorCause_Value_MissingAttribute, nil
+	}
+
+	sessions := s.sessions.Find(acctSessionID, userName, framedIP)
+	if len(sessions) == 0 {
+		return rfc3576.ErrorCause_Value_SessionContextNotFound, nil
+	}
+
+	for _, session := range sessions {
+		m := build(&session)
+		resultCode, err := s.sessionRequest(ctx, session, m, rfc2866.AcctTerminateCause_Value_AdminReset)
+		if err != nil {
+			return rfc3576.ErrorCause_Value_ResourcesUnavailable, err
+		}
+		switch resultCode {
+		case diam.Success:
+			// An aborted session ends with the STR or CCR-T that follows
+			// the ASA, which closes its accounting.
+		case diam.UnknownSessionID:
+			return rfc3576.ErrorCause_Value_SessionContextNotFound, nil
+		default:
+			if m.Header.CommandCode == diam.AbortSession {
+				return rfc3576.ErrorCause_Value_SessionContextNotRemovable, nil
+			}
+			return rfc3576.ErrorCause_Value_ResourcesUnavailable, nil
+		}
+	}
+	return 0, nil
+}
+
+func commandName(m *diam.Message) string {
+	if m.Header.CommandCode == diam.AbortSession {
+		return "ASR"
+	}
+	return "RAR"
+}
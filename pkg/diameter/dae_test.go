@@ -0,0 +1,125 @@
+package diameter
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc3576"
+)
+
+func TestDynamicAuthorization(t *testing.T) {
+	tests := []struct {
+		name string
+		coa  bool
+		// attrs identify the targeted sessions and answer is the Result-Code
+		// of the peer.
+		attrs  func(p *radius.Packet)
+		answer uint32
+		// cause is the Error-Cause of the NAK, zero for an ACK, and sent the
+		// command the peer received.
+		cause rfc3576.ErrorCause
+		sent  uint32
+		// removed is whether the session is gone afterwards.
+		removed bool
+	}{
+		{
+			name:   "disconnect",
+			attrs:  func(p *radius.Packet) { _ = rfc2865.UserName_SetString(p, "user@example.org") },
+			answer: diam.Success,
+			sent:   diam.AbortSession,
+		},
+		{
+			name:   "change of authorization",
+			coa:    true,
+			attrs:  func(p *radius.Packet) { _ = rfc2865.FramedIPAddress_Set(p, net.IPv4(10, 0, 0, 1)) },
+			answer: diam.Success,
+			sent:   diam.ReAuth,
+		},
+		{
+			name:  "unknown session",
+			attrs: func(p *radius.Packet) { _ = rfc2866.AcctSessionID_SetString(p, "0002") },
+			cause: rfc3576.ErrorCause_Value_SessionContextNotFound,
+		},
+		{
+			name:    "session unknown to the peer",
+			attrs:   func(p *radius.Packet) { _ = rfc2866.AcctSessionID_SetString(p, "0001") },
+			answer:  diam.UnknownSessionID,
+			cause:   rfc3576.ErrorCause_Value_SessionContextNotFound,
+			sent:    diam.AbortSession,
+			removed: true,
+		},
+		{
+			name:   "abort refused",
+			attrs:  func(p *radius.Packet) { _ = rfc2865.UserName_SetString(p, "001010123456789") },
+			answer: diam.UnableToComply,
+			cause:  rfc3576.ErrorCause_Value_SessionContextNotRemovable,
+			sent:   diam.AbortSession,
+		},
+		{
+			name:  "no identifying attribute",
+			attrs: func(p *radius.Packet) {},
+			cause: rfc3576.ErrorCause_Value_MissingAttribute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, peer := newTestPeer(t, "pgw.example.org", answerWith(tt.answer))
+			s.sessions.Update("pgw.example.org;1", func(session *Session) {
+				session.AppID = diam.CHARGING_CONTROL_APP_ID
+				session.OriginHost = "pgw.example.org"
+				session.OriginRealm = "example.net"
+				session.UserName = "user@example.org"
+				session.IMSI = "001010123456789"
+				session.AcctSessionID = "0001"
+				session.FramedIP = net.IPv4(10, 0, 0, 1)
+			})
+
+			p := radius.New(radius.CodeDisconnectRequest, []byte(testSecret))
+			tt.attrs(p)
+			req := &radius.Request{Packet: p}
+			var cause rfc3576.ErrorCause
+			var err error
+			if tt.coa {
+				cause, err = s.ChangeOfAuthorization(context.Background(), req)
+			} else {
+				cause, err = s.Disconnect(context.Background(), req)
+			}
+			if err != nil {
+				t.Fatalf("dynamic authorization: %v", err)
+			}
+			if cause != tt.cause {
+				t.Errorf("Error-Cause = %v, want %v", cause, tt.cause)
+			}
+
+			sent := peer.sent()
+			if tt.sent == 0 {
+				if len(sent) != 0 {
+					t.Errorf("peer received %d requests, want none", len(sent))
+				}
+			} else {
+				if len(sent) != 1 {
+					t.Fatalf("peer received %d requests, want 1", len(sent))
+				}
+				if code := sent[0].Header.CommandCode; code != tt.sent {
+					t.Errorf("command = %d, want %d", code, tt.sent)
+				}
+				if id := sessionID(sent[0]); id != "pgw.example.org;1" {
+					t.Errorf("Session-Id = %q", id)
+				}
+				if host, err := sent[0].FindAVP(avp.DestinationHost, 0); err != nil || host.Data.(datatype.DiameterIdentity) != "pgw.example.org" {
+					t.Errorf("Destination-Host = %v, want the peer of the session", host)
+				}
+			}
+			if _, ok := s.sessions.Get("pgw.example.org;1"); ok == tt.removed {
+				t.Errorf("session kept = %t, want %t", ok, !tt.removed)
+			}
+		})
+	}
+}
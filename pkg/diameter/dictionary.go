@@ -0,0 +1,151 @@
+package diameter
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"diametertransfereagent/dictionary"
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+const (
+	// builtinDictionaries names the dictionaries built into the binary in
+	// logs and reports.
+	builtinDictionaries = "built-in"
+	defaultDictionaries = "*.xml"
+	// baseDictionary defines the base protocol of RFC 6733, which every
+	// application relies on.
+	baseDictionary = "base.xml"
+)
+
+// dictionaryFile is a dictionary file read for loading.
+type dictionaryFile struct {
+	name string
+	data []byte
+	file dict.File
+}
+
+// loadDictionary loads the dictionaries of cfg into a new parser. It returns
+// the files loaded.
+func loadDictionary(cfg *config.DiameterConfig) (*dict.Parser, []string, error) {
+	files, err := readDictionaries(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := checkConflicts(files); err != nil {
+		return nil, nil, err
+	}
+
+	parser, err := dict.NewParser()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create dictionary parser: %w", err)
+	}
+	names := make([]string, 0, len(files))
+	for _, f := range files {
+		if err := parser.Load(bytes.NewReader(f.data)); err != nil {
+			return nil, nil, fmt.Errorf("failed to load dictionary from file %s: %w", f.name, err)
+		}
+		names = append(names, f.name)
+	}
+	log.Printf("Loaded dictionaries %v", names)
+	return parser, names, nil
+}
+
+// readDictionaries reads the files matching the dictionaries patterns of
+// cfg, in the order of the patterns, from dictionary_dir or else from the
+// dictionaries built into the binary. The built-in base dictionary comes
+// first unless one of the files is a base.xml of its own.
+func readDictionaries(cfg *config.DiameterConfig) ([]dictionaryFile, error) {
+	fsys, dir := fs.FS(dictionary.Files), builtinDictionaries
+	if cfg.DictionaryDir != "" {
+		fsys, dir = os.DirFS(cfg.DictionaryDir), cfg.DictionaryDir
+	}
+	patterns := cfg.Dictionaries
+	if len(patterns) == 0 {
+		patterns = []string{defaultDictionaries}
+	}
+
+	var files []dictionaryFile
+	read := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := fs.Glob(fsys, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("dictionaries %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no dictionary in %s matches %q", dir, pattern)
+		}
+		for _, match := range matches {
+			if read[match] {
+				continue
+			}
+			read[match] = true
+			f, err := readDictionary(fsys, dir, match)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, f)
+		}
+	}
+
+	for match := range read {
+		if path.Base(match) == baseDictionary {
+			return files, nil
+		}
+	}
+	base, err := readDictionary(dictionary.Files, builtinDictionaries, baseDictionary)
+	if err != nil {
+		return nil, err
+	}
+	return append([]dictionaryFile{base}, files...), nil
+}
+
+func readDictionary(fsys fs.FS, dir, name string) (dictionaryFile, error) {
+	f := dictionaryFile{name: path.Join(dir, name)}
+	var err error
+	if f.data, err = fs.ReadFile(fsys, name); err != nil {
+		return f, fmt.Errorf("failed to read dictionary file %s: %w", f.name, err)
+	}
+	if err := xml.Unmarshal(f.data, &f.file); err != nil {
+		return f, fmt.Errorf("failed to parse dictionary file %s: %w", f.name, err)
+	}
+	return f, nil
+}
+
+// checkConflicts rejects files defining an AVP code of a vendor with another
+// name or data type than an earlier file did. AVPs are looked up by name and
+// by code across applications, by the mapping rules among others, so which
+// definition applied would depend on the loading order.
+func checkConflicts(files []dictionaryFile) error {
+	type avpKey struct{ code, vendorID uint32 }
+	type definition struct{ name, typ, file string }
+
+	defined := make(map[avpKey]definition)
+	var conflicts []string
+	for _, f := range files {
+		for _, app := range f.file.App {
+			for _, a := range app.AVP {
+				key := avpKey{a.Code, a.VendorID}
+				def := definition{a.Name, a.Data.TypeName, f.name}
+				if prev, ok := defined[key]; ok && prev.file != def.file && (prev.name != def.name || prev.typ != def.typ) {
+					conflicts = append(conflicts, fmt.Sprintf("AVP code %d of vendor %d is %s (%s) in %s but %s (%s) in %s",
+						a.Code, a.VendorID, prev.name, prev.typ, prev.file, def.name, def.typ, def.file))
+					continue
+				}
+				defined[key] = def
+			}
+		}
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("conflicting dictionaries:\n  %s", strings.Join(conflicts, "\n  "))
+	}
+	return nil
+}
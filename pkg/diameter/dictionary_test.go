@@ -0,0 +1,79 @@
+package diameter
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+)
+
+const customDictionary = `<?xml version="1.0" encoding="UTF-8"?>
+<diameter>
+    <application id="16777999" type="auth" name="Custom">
+        <avp name="Custom-Id" code="65000" must="M" may="P" must-not="V" may-encrypt="-">
+            <data type="UTF8String"/>
+        </avp>
+    </application>
+</diameter>
+`
+
+func TestLoadDictionary(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "custom.xml"), []byte(customDictionary), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// A base.xml of its own takes the place of the built-in one.
+	if err := os.WriteFile(filepath.Join(dir, "base.xml"), []byte(strings.Replace(customDictionary, "16777999", "0", 1)), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		cfg  config.DiameterConfig
+		// files are the files expected loaded, in order.
+		files []string
+	}{
+		{
+			name:  "built-in subset",
+			cfg:   config.DiameterConfig{Dictionaries: []string{"gy.xml"}},
+			files: []string{"built-in/base.xml", "built-in/gy.xml"},
+		},
+		{
+			name:  "built-in base listed",
+			cfg:   config.DiameterConfig{Dictionaries: []string{"gy.xml", "base.xml"}},
+			files: []string{"built-in/gy.xml", "built-in/base.xml"},
+		},
+		{
+			name:  "directory without a base",
+			cfg:   config.DiameterConfig{DictionaryDir: dir, Dictionaries: []string{"custom.xml"}},
+			files: []string{"built-in/base.xml", filepath.Join(dir, "custom.xml")},
+		},
+		{
+			name:  "directory with a base",
+			cfg:   config.DiameterConfig{DictionaryDir: dir},
+			files: []string{filepath.Join(dir, "base.xml"), filepath.Join(dir, "custom.xml")},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parser, files, err := loadDictionary(&tt.cfg)
+			if err != nil {
+				t.Fatalf("loadDictionary: %v", err)
+			}
+			if !slices.Equal(files, tt.files) {
+				t.Errorf("files = %v, want %v", files, tt.files)
+			}
+			if !slices.Contains(files, "built-in/base.xml") {
+				return
+			}
+			if _, err := parser.FindAVP(0, avp.SessionID); err != nil {
+				t.Errorf("Session-Id not found: %v", err)
+			}
+		})
+	}
+}
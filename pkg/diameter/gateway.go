@@ -0,0 +1,443 @@
+package diameter
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+	"layeh.com/radius/vendors/microsoft"
+)
+
+const (
+	STA_APP_ID = 16777250
+
+	GatewayApplicationNASREQ = "nasreq"
+	GatewayApplicationS6b    = "s6b"
+	GatewayApplicationSTa    = "sta"
+
+	GatewayAccountingACR = "acr"
+	GatewayAccountingCCR = "ccr"
+
+	// Codes missing from the go-diameter constants. The EAP AVPs live in
+	// application 5, outside the lookup path of the STa dictionary.
+	avpEAPPayload          = 462
+	avpEAPMasterSessionKey = 464
+	avpState               = 24
+	cmdDiameterEAP         = 268
+
+	// gatewayTag prefixes the Class and State attributes that carry the
+	// Diameter Session-Id back and forth through the NAS.
+	gatewayTag = "dta:"
+
+	ratTypeWLAN           = 0
+	authorizeAuthenticate = 3
+
+	// gatewayRecordLifetime is how long the record number of an accounting
+	// session is kept after its last record, for sessions whose Stop was
+	// lost.
+	gatewayRecordLifetime = stateMaintainedLifetime
+)
+
+// Accounting-Record-Type values (RFC 6733 section 9.8.1)
+const (
+	accountingEventRecord   = 1
+	accountingStartRecord   = 2
+	accountingInterimRecord = 3
+	accountingStopRecord    = 4
+)
+
+// Gateway translates requests received by the RADIUS front end into
+// Diameter requests towards the configured peer, and their answers back
+// into RADIUS replies.
+type Gateway struct {
+	server  *Server
+	cfg     config.RadiusServerConfig
+	mu      sync.Mutex
+	counter uint32
+	records map[string]*gatewayRecord
+	// pruned is when records was last cleared of the sessions that
+	// outlived gatewayRecordLifetime.
+	pruned time.Time
+}
+
+// gatewayRecord is the Accounting-Record-Number of the next record of an
+// accounting session.
+type gatewayRecord struct {
+	number   uint32
+	lastSeen time.Time
+}
+
+// Gateway returns the RADIUS gateway sending its requests through this server.
+func (s *Server) Gateway(cfg config.RadiusServerConfig) *Gateway {
+	return &Gateway{server: s, cfg: cfg, records: make(map[string]*gatewayRecord), pruned: time.Now()}
+}
+
+// Authenticate sends an AAR, or a DER for STa, for the Access-Request.
+func (g *Gateway) Authenticate(ctx context.Context, req *radius.Request) (*radius.Packet, error) {
+	sessionID := tagged(rfc2865.State_GetString(req.Packet))
+	if sessionID == "" {
+		sessionID = g.newSessionID()
+	}
+
+	var m *diam.Message
+	switch g.cfg.Application {
+	case GatewayApplicationSTa:
+		m = g.buildDER(req.Packet, sessionID)
+	case GatewayApplicationS6b:
+		m = g.buildAAR(req.Packet, sessionID, S6B_APP_ID)
+	default:
+		m = g.buildAAR(req.Packet, sessionID, diam.NETWORK_ACCESS_APP_ID)
+	}
+
+	a, err := g.server.SendRequest(ctx, datatype.DiameterIdentity(g.cfg.PeerHost), m)
+	if err != nil {
+		return nil, err
+	}
+
+	resultCode := answerResultCode(a)
+	log.Printf("Received %s answer with result code %d for session %s", g.cfg.Application, resultCode, sessionID)
+
+	var reply *radius.Packet
+	switch resultCode {
+	case diam.Success:
+		reply = req.Response(radius.CodeAccessAccept)
+		copyAuthorization(reply, a)
+		_ = rfc2865.Class_AddString(reply, gatewayTag+sessionID)
+		if msk := findAVPBytes(a, avpEAPMasterSessionKey); len(msk) >= 64 {
+			// RFC 3748 section 7.10: the first half of the MSK is the
+			// receive key of the authenticator, the second its send key.
+			_ = microsoft.MSMPPERecvKey_Add(reply, msk[:32])
+			_ = microsoft.MSMPPESendKey_Add(reply, msk[32:64])
+		}
+	case diam.MultiRoundAuth:
+		reply = req.Response(radius.CodeAccessChallenge)
+		_ = rfc2865.State_SetString(reply, gatewayTag+sessionID)
+	default:
+		reply = req.Response(radius.CodeAccessReject)
+	}
+
+	if payload := findAVPBytes(a, avpEAPPayload); len(payload) > 0 {
+		_ = rfc2869.EAPMessage_Set(reply, payload)
+	}
+	for _, msg := range findAllAVPBytes(a, avp.ReplyMessage) {
+		_ = rfc2865.ReplyMessage_Add(reply, msg)
+	}
+	return reply, nil
+}
+
+// Account sends an ACR, or a CCR when configured, for the Accounting-Request.
+// A nil reply is returned when the peer did not store the record.
+func (g *Gateway) Account(ctx context.Context, req *radius.Request) (*radius.Packet, error) {
+	sessionID := ""
+	if classes, err := rfc2865.Class_GetStrings(req.Packet); err == nil {
+		for _, class := range classes {
+			if id := tagged(class); id != "" {
+				sessionID = id
+				break
+			}
+		}
+	}
+	if sessionID == "" {
+		sessionID = fmt.Sprintf("%s;%s", string(g.server.settings.OriginHost), rfc2866.AcctSessionID_GetString(req.Packet))
+	}
+
+	recordType := accountingRecordType(rfc2866.AcctStatusType_Get(req.Packet))
+	recordNumber := g.nextRecord(sessionID, recordType, time.Now())
+
+	var m *diam.Message
+	if g.cfg.Accounting == GatewayAccountingCCR {
+		m = g.buildCCR(req.Packet, sessionID, recordType, recordNumber)
+	} else {
+		m = g.buildACR(req.Packet, sessionID, recordType, recordNumber)
+	}
+
+	a, err := g.server.SendRequest(ctx, datatype.DiameterIdentity(g.cfg.PeerHost), m)
+	if err != nil {
+		return nil, err
+	}
+	if resultCode := answerResultCode(a); resultCode != diam.Success {
+		return nil, fmt.Errorf("accounting for session %s failed with result code %d", sessionID, resultCode)
+	}
+	return req.Response(radius.CodeAccountingResponse), nil
+}
+
+func (g *Gateway) newSessionID() string {
+	g.mu.Lock()
+	g.counter++
+	counter := g.counter
+	g.mu.Unlock()
+	return fmt.Sprintf("%s;%d;%d", string(g.server.settings.OriginHost), time.Now().Unix(), counter)
+}
+
+// nextRecord returns the Accounting-Record-Number of the next record of the
+// session and forgets the session on its stop record, or once it had no
+// record for gatewayRecordLifetime.
+func (g *Gateway) nextRecord(sessionID string, recordType uint32, now time.Time) uint32 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if now.Sub(g.pruned) >= sessionExpiryInterval {
+		for id, record := range g.records {
+			if now.Sub(record.lastSeen) >= gatewayRecordLifetime {
+				delete(g.records, id)
+			}
+		}
+		g.pruned = now
+	}
+
+	record, ok := g.records[sessionID]
+	if !ok {
+		record = &gatewayRecord{}
+	}
+	number := record.number
+	if recordType == accountingStopRecord || recordType == accountingEventRecord {
+		delete(g.records, sessionID)
+	} else {
+		record.number++
+		record.lastSeen = now
+		g.records[sessionID] = record
+	}
+	return number
+}
+
+func (g *Gateway) newRequest(cmd, appID uint32, sessionID string) *diam.Message {
+	settings := g.server.settings
+	m := diam.NewRequest(cmd, appID, g.server.dictionary.Load())
+	m.Header.CommandFlags |= diam.ProxiableFlag
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sessionID))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, settings.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, settings.OriginRealm)
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, datatype.DiameterIdentity(g.cfg.DestinationRealm))
+	if g.cfg.PeerHost != "" {
+		m.NewAVP(avp.DestinationHost, avp.Mbit, 0, datatype.DiameterIdentity(g.cfg.PeerHost))
+	}
+	return m
+}
+
+// buildAAR maps an Access-Request onto an AA-Request (RFC 7155 section 9.1).
+func (g *Gateway) buildAAR(p *radius.Packet, sessionID string, appID uint32) *diam.Message {
+	m := g.newRequest(diam.AA, appID, sessionID)
+	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(appID))
+	m.NewAVP(avp.AuthRequestType, avp.Mbit, 0, datatype.Enumerated(authorizeAuthenticate))
+	addUserAVPs(m, p)
+	if password := rfc2865.UserPassword_Get(p); len(password) > 0 {
+		m.NewAVP(avp.UserPassword, avp.Mbit, 0, datatype.OctetString(password))
+	}
+	if state := rfc2865.State_Get(p); len(state) > 0 && tagged(string(state)) == "" {
+		m.NewAVP(avpState, avp.Mbit, 0, datatype.OctetString(state))
+	}
+	if eap := rfc2869.EAPMessage_Get(p); len(eap) > 0 {
+		m.NewAVP(avpEAPPayload, avp.Mbit, 0, datatype.OctetString(eap))
+	}
+	return m
+}
+
+// buildDER maps an EAP Access-Request onto an STa Diameter-EAP-Request
+// (3GPP TS 29.273 section 4.2.2).
+func (g *Gateway) buildDER(p *radius.Packet, sessionID string) *diam.Message {
+	m := g.newRequest(cmdDiameterEAP, STA_APP_ID, sessionID)
+	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(STA_APP_ID))
+	m.NewAVP(avp.AuthRequestType, avp.Mbit, 0, datatype.Enumerated(authorizeAuthenticate))
+	m.NewAVP(avpEAPPayload, avp.Mbit, 0, datatype.OctetString(rfc2869.EAPMessage_Get(p)))
+	addUserAVPs(m, p)
+	m.NewAVP(avp.RATType, avp.Mbit|avp.Vbit, VENDOR_3GPP, datatype.Enumerated(ratTypeWLAN))
+	return m
+}
+
+// buildACR maps an Accounting-Request onto an Accounting-Request
+// (RFC 7155 section 9.6).
+func (g *Gateway) buildACR(p *radius.Packet, sessionID string, recordType, recordNumber uint32) *diam.Message {
+	m := g.newRequest(diam.Accounting, diam.BASE_ACCOUNTING_APP_ID, sessionID)
+	m.NewAVP(avp.AccountingRecordType, avp.Mbit, 0, datatype.Enumerated(recordType))
+	m.NewAVP(avp.AccountingRecordNumber, avp.Mbit, 0, datatype.Unsigned32(recordNumber))
+	m.NewAVP(avp.AcctApplicationID, avp.Mbit, 0, datatype.Unsigned32(diam.BASE_ACCOUNTING_APP_ID))
+	addUserAVPs(m, p)
+	if acctSessionID := rfc2866.AcctSessionID_Get(p); len(acctSessionID) > 0 {
+		m.NewAVP(avp.AccountingSessionID, avp.Mbit, 0, datatype.OctetString(acctSessionID))
+	}
+	if ip := rfc2865.FramedIPAddress_Get(p); ip != nil {
+		m.NewAVP(avp.FramedIPAddress, avp.Mbit, 0, datatype.OctetString(ip.To4()))
+	}
+	if recordType == accountingInterimRecord || recordType == accountingStopRecord {
+		m.NewAVP(avp.AcctSessionTime, avp.Mbit, 0, datatype.Unsigned32(rfc2866.AcctSessionTime_Get(p)))
+		m.NewAVP(avp.AccountingInputOctets, avp.Mbit, 0, datatype.Unsigned64(inputOctets(p)))
+		m.NewAVP(avp.AccountingOutputOctets, avp.Mbit, 0, datatype.Unsigned64(outputOctets(p)))
+		m.NewAVP(avp.AccountingInputPackets, avp.Mbit, 0, datatype.Unsigned64(rfc2866.AcctInputPackets_Get(p)))
+		m.NewAVP(avp.AccountingOutputPackets, avp.Mbit, 0, datatype.Unsigned64(rfc2866.AcctOutputPackets_Get(p)))
+	}
+	if cause := rfc2866.AcctTerminateCause_Get(p); cause != 0 {
+		// RFC 7155 section 4.4.7: the Diameter value is the RADIUS one plus 10.
+		m.NewAVP(avp.TerminationCause, avp.Mbit, 0, datatype.Enumerated(uint32(cause)+10))
+	}
+	return m
+}
+
+// buildCCR maps an Accounting-Request onto a Credit-Control-Request for
+// offline charging peers that only speak Gy/Ro.
+func (g *Gateway) buildCCR(p *radius.Packet, sessionID string, recordType, recordNumber uint32) *diam.Message {
+	m := g.newRequest(diam.CreditControl, diam.CHARGING_CONTROL_APP_ID, sessionID)
+	m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(diam.CHARGING_CONTROL_APP_ID))
+	m.NewAVP(avp.ServiceContextID, avp.Mbit, 0, datatype.UTF8String("32251@3gpp.org"))
+	// CC-Request-Type values are the Accounting-Record-Type ones shifted by
+	// one, with EVENT_REQUEST last.
+	ccRequestType := recordType - 1
+	if recordType == accountingEventRecord {
+		ccRequestType = 4
+	}
+	m.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(ccRequestType))
+	m.NewAVP(avp.CCRequestNumber, avp.Mbit, 0, datatype.Unsigned32(recordNumber))
+	if userName := rfc2865.UserName_GetString(p); userName != "" {
+		m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String(userName))
+		m.NewAVP(avp.SubscriptionID, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.SubscriptionIDType, avp.Mbit, 0, datatype.Enumerated(3)), // END_USER_NAI
+				diam.NewAVP(avp.SubscriptionIDData, avp.Mbit, 0, datatype.UTF8String(userName)),
+			},
+		})
+	}
+	if recordType == accountingInterimRecord || recordType == accountingStopRecord {
+		m.NewAVP(avp.MultipleServicesCreditControl, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.UsedServiceUnit, avp.Mbit, 0, &diam.GroupedAVP{
+					AVP: []*diam.AVP{
+						diam.NewAVP(avp.CCTime, avp.Mbit, 0, datatype.Unsigned32(rfc2866.AcctSessionTime_Get(p))),
+						diam.NewAVP(avp.CCInputOctets, avp.Mbit, 0, datatype.Unsigned64(inputOctets(p))),
+						diam.NewAVP(avp.CCOutputOctets, avp.Mbit, 0, datatype.Unsigned64(outputOctets(p))),
+					},
+				}),
+			},
+		})
+	}
+	if cause := rfc2866.AcctTerminateCause_Get(p); cause != 0 {
+		m.NewAVP(avp.TerminationCause, avp.Mbit, 0, datatype.Enumerated(uint32(cause)+10))
+	}
+	return m
+}
+
+// addUserAVPs copies the attributes that NASREQ defines with the same code
+// and meaning as RADIUS.
+func addUserAVPs(m *diam.Message, p *radius.Packet) {
+	if userName := rfc2865.UserName_GetString(p); userName != "" {
+		m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String(userName))
+	}
+	if calling := rfc2865.CallingStationID_GetString(p); calling != "" {
+		m.NewAVP(avp.CallingStationID, avp.Mbit, 0, datatype.UTF8String(calling))
+	}
+	if called := rfc2865.CalledStationID_GetString(p); called != "" {
+		m.NewAVP(avp.CalledStationID, avp.Mbit, 0, datatype.UTF8String(called))
+	}
+	if portType, err := rfc2865.NASPortType_Lookup(p); err == nil {
+		m.NewAVP(avp.NASPortType, avp.Mbit, 0, datatype.Enumerated(portType))
+	}
+	if serviceType, err := rfc2865.ServiceType_Lookup(p); err == nil {
+		m.NewAVP(avp.ServiceType, avp.Mbit, 0, datatype.Enumerated(serviceType))
+	}
+}
+
+// copyAuthorization copies the authorization AVPs of an AA or DE answer to
+// the Access-Accept.
+func copyAuthorization(reply *radius.Packet, a *diam.Message) {
+	for _, answerAVP := range a.AVP {
+		value := answerAVP.Data.Serialize()
+		switch answerAVP.Code {
+		case avp.FramedIPAddress:
+			if len(value) == 4 {
+				_ = rfc2865.FramedIPAddress_Set(reply, value)
+			}
+		case avp.FramedMTU:
+			_ = rfc2865.FramedMTU_Set(reply, rfc2865.FramedMTU(beUint32(value)))
+		case avp.SessionTimeout:
+			_ = rfc2865.SessionTimeout_Set(reply, rfc2865.SessionTimeout(beUint32(value)))
+		case avp.IdleTimeout:
+			_ = rfc2865.IdleTimeout_Set(reply, rfc2865.IdleTimeout(beUint32(value)))
+		case avp.AcctInterimInterval:
+			_ = rfc2869.AcctInterimInterval_Set(reply, rfc2869.AcctInterimInterval(beUint32(value)))
+		case avp.Class:
+			_ = rfc2865.Class_Add(reply, value)
+		}
+	}
+}
+
+func answerResultCode(a *diam.Message) uint32 {
+	if rc, err := a.FindAVP(avp.ResultCode, 0); err == nil {
+		return beUint32(rc.Data.Serialize())
+	}
+	if er, err := a.FindAVP(avp.ExperimentalResult, 0); err == nil {
+		if group, ok := er.Data.(*diam.GroupedAVP); ok {
+			for _, member := range group.AVP {
+				if member.Code == avp.ExperimentalResultCode {
+					return beUint32(member.Data.Serialize())
+				}
+			}
+		}
+	}
+	return diam.UnableToComply
+}
+
+func findAVPBytes(m *diam.Message, code uint32) []byte {
+	for _, a := range m.AVP {
+		if a.Code == code {
+			return a.Data.Serialize()
+		}
+	}
+	return nil
+}
+
+func findAllAVPBytes(m *diam.Message, code uint32) [][]byte {
+	var values [][]byte
+	for _, a := range m.AVP {
+		if a.Code == code {
+			values = append(values, a.Data.Serialize())
+		}
+	}
+	return values
+}
+
+func accountingRecordType(status rfc2866.AcctStatusType) uint32 {
+	switch status {
+	case rfc2866.AcctStatusType_Value_Start:
+		return accountingStartRecord
+	case rfc2866.AcctStatusType_Value_InterimUpdate:
+		return accountingInterimRecord
+	case rfc2866.AcctStatusType_Value_Stop:
+		return accountingStopRecord
+	default:
+		return accountingEventRecord
+	}
+}
+
+func inputOctets(p *radius.Packet) uint64 {
+	return uint64(rfc2869.AcctInputGigawords_Get(p))<<32 | uint64(rfc2866.AcctInputOctets_Get(p))
+}
+
+func outputOctets(p *radius.Packet) uint64 {
+	return uint64(rfc2869.AcctOutputGigawords_Get(p))<<32 | uint64(rfc2866.AcctOutputOctets_Get(p))
+}
+
+// tagged returns the Session-Id carried in a Class or State value set by the
+// gateway, or an empty string.
+func tagged(value string) string {
+	if !strings.HasPrefix(value, gatewayTag) {
+		return ""
+	}
+	return strings.TrimPrefix(value, gatewayTag)
+}
+
+func beUint32(b []byte) uint32 {
+	if len(b) != 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
@@ -0,0 +1,359 @@
+package diameter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smpeer"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+	"layeh.com/radius/vendors/microsoft"
+)
+
+// testPeer is a connected Diameter peer that answers the requests the
+// server sends it with respond, or not at all when respond returns nil.
+type testPeer struct {
+	server  *Server
+	parser  *dict.Parser
+	respond func(m *diam.Message) *diam.Message
+
+	mu       sync.Mutex
+	requests []*diam.Message
+}
+
+// newTestPeer returns a server connected to a peer with the Origin-Host
+// host.
+func newTestPeer(t *testing.T, host string, respond func(m *diam.Message) *diam.Message) (*Server, *testPeer) {
+	t.Helper()
+	parser := testParser(t)
+	s := &Server{cfg: &config.DiameterConfig{}, settings: testSettings, txns: newTransactions(), sessions: NewSessions(nil)}
+	s.dictionary.Store(parser)
+	s.peerTable = NewPeerTable(testSettings, s.dictionary.Load, nil, time.Hour)
+	p := &testPeer{server: s, parser: parser, respond: respond}
+	s.peerTable.Open(p, &smpeer.Metadata{OriginHost: datatype.DiameterIdentity(host), OriginRealm: "example.net"}, true)
+	return s, p
+}
+
+func (p *testPeer) Write(b []byte) (int, error) {
+	m, err := diam.ReadMessage(bytes.NewReader(b), p.parser)
+	if err != nil {
+		return 0, err
+	}
+	p.mu.Lock()
+	p.requests = append(p.requests, m)
+	p.mu.Unlock()
+	if a := p.respond(m); a != nil {
+		go p.server.txns.handleAnswer(p, a)
+	}
+	return len(b), nil
+}
+
+// sent returns the requests the peer received.
+func (p *testPeer) sent() []*diam.Message {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*diam.Message(nil), p.requests...)
+}
+
+func (p *testPeer) WriteStream(b []byte, _ uint) (int, error) { return p.Write(b) }
+func (p *testPeer) Close()                                    {}
+func (p *testPeer) LocalAddr() net.Addr                       { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3868} }
+func (p *testPeer) RemoteAddr() net.Addr                      { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 3), Port: 3868} }
+func (p *testPeer) TLS() *tls.ConnectionState                 { return nil }
+func (p *testPeer) Dictionary() *dict.Parser                  { return p.parser }
+func (p *testPeer) Context() context.Context                  { return context.Background() }
+func (p *testPeer) SetContext(context.Context)                {}
+func (p *testPeer) Connection() net.Conn                      { return nil }
+
+// answerWith answers requests with resultCode and avps.
+func answerWith(resultCode uint32, avps ...*diam.AVP) func(m *diam.Message) *diam.Message {
+	return func(m *diam.Message) *diam.Message {
+		a := m.Answer(resultCode)
+		for _, answerAVP := range avps {
+			a.AddAVP(answerAVP)
+		}
+		return a
+	}
+}
+
+func gatewayRequest(code radius.Code, attrs ...func(p *radius.Packet)) *radius.Request {
+	p := radius.New(code, []byte(testSecret))
+	_ = rfc2865.UserName_SetString(p, "user@example.org")
+	for _, set := range attrs {
+		set(p)
+	}
+	return &radius.Request{Packet: p}
+}
+
+func TestGatewayAuthenticate(t *testing.T) {
+	msk := bytes.Repeat([]byte{0xaa}, 32)
+	msk = append(msk, bytes.Repeat([]byte{0xbb}, 32)...)
+
+	tests := []struct {
+		name        string
+		application string
+		answer      func(m *diam.Message) *diam.Message
+		code        radius.Code
+		// command and appID are those of the request sent to the peer.
+		command uint32
+		appID   uint32
+		check   func(t *testing.T, reply *radius.Packet, sessionID string)
+	}{
+		{
+			name:   "NASREQ accept",
+			answer: answerWith(diam.Success, diam.NewAVP(avp.FramedIPAddress, avp.Mbit, 0, datatype.OctetString(net.IPv4(10, 0, 0, 1).To4())), diam.NewAVP(avp.SessionTimeout, avp.Mbit, 0, datatype.Unsigned32(3600)), diam.NewAVP(avp.Class, avp.Mbit, 0, datatype.OctetString("peer"))),
+			code:   radius.CodeAccessAccept,
+			appID:  diam.NETWORK_ACCESS_APP_ID,
+			check: func(t *testing.T, reply *radius.Packet, sessionID string) {
+				if ip := rfc2865.FramedIPAddress_Get(reply); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+					t.Errorf("Framed-IP-Address = %s", ip)
+				}
+				if timeout := rfc2865.SessionTimeout_Get(reply); timeout != 3600 {
+					t.Errorf("Session-Timeout = %d", timeout)
+				}
+				classes, _ := rfc2865.Class_GetStrings(reply)
+				if strings.Join(classes, " ") != "peer "+gatewayTag+sessionID {
+					t.Errorf("Class = %q, want the Class of the peer and the tagged Session-Id", classes)
+				}
+			},
+		},
+		{
+			name:        "S6b reject",
+			application: GatewayApplicationS6b,
+			answer:      answerWith(diam.AuthorizationRejected, diam.NewAVP(avp.ReplyMessage, avp.Mbit, 0, datatype.UTF8String("denied"))),
+			code:        radius.CodeAccessReject,
+			appID:       S6B_APP_ID,
+			check: func(t *testing.T, reply *radius.Packet, _ string) {
+				if msg := rfc2865.ReplyMessage_GetString(reply); msg != "denied" {
+					t.Errorf("Reply-Message = %q", msg)
+				}
+			},
+		},
+		{
+			name:        "STa challenge",
+			application: GatewayApplicationSTa,
+			answer:      answerWith(diam.MultiRoundAuth, diam.NewAVP(avpEAPPayload, avp.Mbit, 0, datatype.OctetString([]byte{1, 2, 0, 4}))),
+			code:        radius.CodeAccessChallenge,
+			command:     cmdDiameterEAP,
+			appID:       STA_APP_ID,
+			check: func(t *testing.T, reply *radius.Packet, sessionID string) {
+				if state := rfc2865.State_GetString(reply); state != gatewayTag+sessionID {
+					t.Errorf("State = %q, want the tagged Session-Id", state)
+				}
+				if eap := rfc2869.EAPMessage_Get(reply); !bytes.Equal(eap, []byte{1, 2, 0, 4}) {
+					t.Errorf("EAP-Message = %x", eap)
+				}
+			},
+		},
+		{
+			name:        "STa accept with an MSK",
+			application: GatewayApplicationSTa,
+			answer:      answerWith(diam.Success, diam.NewAVP(avpEAPMasterSessionKey, avp.Mbit, 0, datatype.OctetString(msk))),
+			code:        radius.CodeAccessAccept,
+			command:     cmdDiameterEAP,
+			appID:       STA_APP_ID,
+			check: func(t *testing.T, reply *radius.Packet, _ string) {
+				// The keys are salted and encrypted with the secret and
+				// the authenticator of the request.
+				if recv := microsoft.MSMPPERecvKey_Get(reply, reply); !bytes.Equal(recv, msk[:32]) {
+					t.Errorf("MS-MPPE-Recv-Key = %x, want the first half of the MSK", recv)
+				}
+				if send := microsoft.MSMPPESendKey_Get(reply, reply); !bytes.Equal(send, msk[32:]) {
+					t.Errorf("MS-MPPE-Send-Key = %x, want the second half of the MSK", send)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, peer := newTestPeer(t, "aaa.example.net", tt.answer)
+			g := s.Gateway(config.RadiusServerConfig{Application: tt.application, PeerHost: "aaa.example.net", DestinationRealm: "example.net"})
+
+			req := gatewayRequest(radius.CodeAccessRequest, func(p *radius.Packet) {
+				_ = rfc2865.UserPassword_SetString(p, "password")
+				_ = rfc2865.CalledStationID_SetString(p, "internet")
+				_ = rfc2869.EAPMessage_Set(p, []byte{2, 1, 0, 4})
+			})
+			reply, err := g.Authenticate(context.Background(), req)
+			if err != nil {
+				t.Fatalf("Authenticate: %v", err)
+			}
+			if reply.Code != tt.code {
+				t.Errorf("reply = %v, want %v", reply.Code, tt.code)
+			}
+
+			sent := peer.sent()
+			if len(sent) != 1 {
+				t.Fatalf("peer received %d requests, want 1", len(sent))
+			}
+			m := sent[0]
+			command := tt.command
+			if command == 0 {
+				command = diam.AA
+			}
+			if m.Header.CommandCode != command || m.Header.ApplicationID != tt.appID {
+				t.Errorf("request = command %d of application %d, want %d of %d", m.Header.CommandCode, m.Header.ApplicationID, command, tt.appID)
+			}
+			if name := findAVPBytes(m, avp.UserName); string(name) != "user@example.org" {
+				t.Errorf("User-Name = %q", name)
+			}
+			if called := findAVPBytes(m, avp.CalledStationID); string(called) != "internet" {
+				t.Errorf("Called-Station-Id = %q", called)
+			}
+			if eap := findAVPBytes(m, avpEAPPayload); !bytes.Equal(eap, []byte{2, 1, 0, 4}) {
+				t.Errorf("EAP-Payload = %x", eap)
+			}
+			if tt.command == 0 {
+				if password := findAVPBytes(m, avp.UserPassword); string(password) != "password" {
+					t.Errorf("User-Password = %q", password)
+				}
+			}
+			tt.check(t, reply, sessionID(m))
+		})
+	}
+}
+
+// TestGatewayChallengeSession checks that the Access-Request answering a
+// challenge continues the Diameter session of the first one.
+func TestGatewayChallengeSession(t *testing.T) {
+	rounds := 0
+	s, peer := newTestPeer(t, "aaa.example.net", func(m *diam.Message) *diam.Message {
+		rounds++
+		if rounds == 1 {
+			return m.Answer(diam.MultiRoundAuth)
+		}
+		return m.Answer(diam.Success)
+	})
+	g := s.Gateway(config.RadiusServerConfig{Application: GatewayApplicationSTa, PeerHost: "aaa.example.net"})
+
+	challenge, err := g.Authenticate(context.Background(), gatewayRequest(radius.CodeAccessRequest))
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	state := rfc2865.State_Get(challenge)
+	reply, err := g.Authenticate(context.Background(), gatewayRequest(radius.CodeAccessRequest, func(p *radius.Packet) {
+		_ = rfc2865.State_Set(p, state)
+	}))
+	if err != nil {
+		t.Fatalf("Authenticate: %v", err)
+	}
+	if reply.Code != radius.CodeAccessAccept {
+		t.Errorf("reply = %v", reply.Code)
+	}
+	sent := peer.sent()
+	if first, second := sessionID(sent[0]), sessionID(sent[1]); first != second {
+		t.Errorf("Session-Ids = %q and %q, want one session", first, second)
+	}
+	if _, err := sent[1].FindAVP(avpState, 0); err == nil {
+		t.Errorf("State of the gateway sent to the peer")
+	}
+}
+
+func TestGatewayAccount(t *testing.T) {
+	for _, accounting := range []string{GatewayAccountingACR, GatewayAccountingCCR} {
+		t.Run(accounting, func(t *testing.T) {
+			s, peer := newTestPeer(t, "ocs.example.net", answerWith(diam.Success))
+			g := s.Gateway(config.RadiusServerConfig{Accounting: accounting, PeerHost: "ocs.example.net"})
+
+			statuses := []rfc2866.AcctStatusType{
+				rfc2866.AcctStatusType_Value_Start,
+				rfc2866.AcctStatusType_Value_InterimUpdate,
+				rfc2866.AcctStatusType_Value_Stop,
+			}
+			for _, status := range statuses {
+				req := gatewayRequest(radius.CodeAccountingRequest, func(p *radius.Packet) {
+					_ = rfc2866.AcctStatusType_Set(p, status)
+					_ = rfc2866.AcctSessionID_SetString(p, "0001")
+					_ = rfc2865.Class_SetString(p, gatewayTag+"aaa;1")
+					_ = rfc2866.AcctInputOctets_Set(p, 7)
+					_ = rfc2869.AcctInputGigawords_Set(p, 1)
+					_ = rfc2866.AcctTerminateCause_Set(p, rfc2866.AcctTerminateCause_Value_UserRequest)
+				})
+				reply, err := g.Account(context.Background(), req)
+				if err != nil {
+					t.Fatalf("Account: %v", err)
+				}
+				if reply.Code != radius.CodeAccountingResponse {
+					t.Errorf("reply = %v", reply.Code)
+				}
+			}
+
+			sent := peer.sent()
+			if len(sent) != 3 {
+				t.Fatalf("peer received %d requests, want 3", len(sent))
+			}
+			for i, m := range sent {
+				if id := sessionID(m); id != "aaa;1" {
+					t.Errorf("Session-Id = %q, want the one of the Class", id)
+				}
+				var number, recordType uint32
+				if accounting == GatewayAccountingACR {
+					number = beUint32(findAVPBytes(m, avp.AccountingRecordNumber))
+					recordType = beUint32(findAVPBytes(m, avp.AccountingRecordType))
+				} else {
+					number = beUint32(findAVPBytes(m, avp.CCRequestNumber))
+					recordType = beUint32(findAVPBytes(m, avp.CCRequestType)) + 1
+				}
+				if number != uint32(i) || recordType != uint32(accountingStartRecord+i) {
+					t.Errorf("record %d = number %d of type %d", i, number, recordType)
+				}
+				if cause := beUint32(findAVPBytes(m, avp.TerminationCause)); cause != uint32(rfc2866.AcctTerminateCause_Value_UserRequest)+10 {
+					t.Errorf("Termination-Cause = %d", cause)
+				}
+			}
+			if accounting == GatewayAccountingACR {
+				stop := sent[2]
+				if octets := findAVPBytes(stop, avp.AccountingInputOctets); len(octets) != 8 || binary.BigEndian.Uint64(octets) != 1<<32+7 {
+					t.Errorf("Accounting-Input-Octets = %x", octets)
+				}
+			}
+			if n := len(g.records); n != 0 {
+				t.Errorf("%d sessions left after their Stop", n)
+			}
+		})
+	}
+
+	s, _ := newTestPeer(t, "ocs.example.net", answerWith(diam.UnableToComply))
+	g := s.Gateway(config.RadiusServerConfig{PeerHost: "ocs.example.net"})
+	reply, err := g.Account(context.Background(), gatewayRequest(radius.CodeAccountingRequest))
+	if err == nil {
+		t.Errorf("Account = %v, want an error for a record the peer did not store", reply.Code)
+	}
+}
+
+// TestGatewayRecordLifetime checks that the record numbers of the sessions
+// whose Stop never came are dropped.
+func TestGatewayRecordLifetime(t *testing.T) {
+	s, _ := newTestPeer(t, "ocs.example.net", answerWith(diam.Success))
+	g := s.Gateway(config.RadiusServerConfig{})
+	start := time.Now()
+
+	g.nextRecord("lost", accountingStartRecord, start)
+	g.nextRecord("live", accountingStartRecord, start)
+	later := start.Add(gatewayRecordLifetime - time.Minute)
+	if number := g.nextRecord("live", accountingInterimRecord, later); number != 1 {
+		t.Errorf("record number = %d, want 1", number)
+	}
+	g.nextRecord("live", accountingInterimRecord, start.Add(gatewayRecordLifetime))
+	if _, ok := g.records["lost"]; ok {
+		t.Errorf("session without records for %s kept", gatewayRecordLifetime)
+	}
+	if record, ok := g.records["live"]; !ok || record.number != 3 {
+		t.Errorf("live session = %+v, %t", record, ok)
+	}
+}
@@ -2,115 +2,375 @@ package diameter
 
 import (
 	"context"
+	"diametertransfereagent/pkg/identity"
+	"diametertransfereagent/pkg/logging"
+	"diametertransfereagent/pkg/metrics"
 	"diametertransfereagent/pkg/models"
 	"diametertransfereagent/pkg/radius"
+	"diametertransfereagent/pkg/script"
+	"diametertransfereagent/pkg/tracing"
 	"io"
 	"log"
+	"log/slog"
 	"net"
 	"time"
 
 	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
 	"github.com/fiorix/go-diameter/v4/diam/sm"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	radiusres "layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
 )
 
+// radiusResponseTimeout is how long a request waits for the RADIUS response
+// before it is answered with the timeout Result-Code of its profile.
+var radiusResponseTimeout = 5 * time.Second
+
 func PrintErrors(ec <-chan *diam.ErrorReport) {
 	for err := range ec {
 		log.Println(err)
 	}
 }
 
-func handleDiameterRequest(settings sm.Settings, requestChan chan radius.Request, responseChan chan radius.Response, messageType string, c diam.Conn, m *diam.Message) {
-	log.Printf("Handling %s Request from %s", messageType, c.RemoteAddr())
+func handleDiameterRequest(settings sm.Settings, sessions *Sessions, translation func() *Translation, requestChan chan radius.Request, messageType string, c diam.Conn, m *diam.Message) {
+	current := translation()
+	profiles, hooks := current.Profiles, current.Script
+	spanCtx, span := startSpan(messageType, m)
+	defer span.End()
+	logger := transactionLog(messageType, c, m, span)
+	logger.Debug("Handling request")
+	start := time.Now()
+	metrics.DiameterRequests.WithLabelValues(messageType).Inc()
+	metrics.InFlight.WithLabelValues(metrics.LegDiameter).Inc()
+	defer metrics.InFlight.WithLabelValues(metrics.LegDiameter).Dec()
+
+	// building spans the time from the RADIUS response, or the decision
+	// not to wait for one, to the answer.
+	var building trace.Span
+	build := func() {
+		_, building = tracing.Tracer.Start(spanCtx, "diameter.build_answer")
+	}
+
+	// reply gives the script the last word on every answer.
+	reply := func(a *diam.Message) {
+		if code := hooks.Message(script.BeforeAnswer, messageType, a); code != 0 {
+			setResultCode(a, code)
+		}
+		if building != nil {
+			building.End()
+		}
+		resultCode := observeAnswer(messageType, a, start)
+		span.SetAttributes(attribute.Int64("diameter.result_code", int64(resultCode)))
+		// A session whose authorization failed, however it failed, gets no
+		// STR and would otherwise hold its addresses until it expires.
+		if messageType != diam.CCR && resultCode != diam.Success {
+			sessions.Remove(sessionID(m))
+		}
+		if err := writeAnswer(spanCtx, c, a); err != nil {
+			logger.Error("Failed to send answer", "result_code", resultCode, "error", err)
+			return
+		}
+		logger.Info("Sent answer", "result_code", resultCode, "duration", time.Since(start))
+	}
+
+	rejectCode := hooks.Message(script.AfterDecode, messageType, m)
 
+	_, converting := tracing.Tracer.Start(spanCtx, "diameter.convert")
+	profile := profiles.Select(m)
 	radiusMessageparams, req := ConvertToRadius(messageType, m, c)
 
 	if radiusMessageparams == nil {
+		converting.End()
+		build()
 		switch messageType {
 		case diam.AIR:
 			a := BuildDiameterResponse(settings, req.(models.AuthenticationInformationRequest), diam.UnableToComply, nil, 0, m)
-			_, _ = sendReply(c, a)
+			reply(a)
 		case diam.AAR:
 			a := BuildDiameterResponse(settings, req.(models.AuthenticationAuthorizationRequest), diam.UnableToComply, nil, 0, m)
-			_, _ = sendReply(c, a)
+			reply(a)
 		case diam.CCR:
 			a := BuildDiameterResponse(settings, req.(models.CreditControlRequest), diam.UnableToComply, nil, 0, m)
-			_, _ = sendReply(c, a)
+			reply(a)
+		}
+		return
+	}
+
+	profile.apply(radiusMessageparams, m)
+	if profile.Name != "" {
+		logger = logger.With("profile", profile.Name)
+	}
+	switch params := radiusMessageparams.(type) {
+	case *radius.AuthRequest:
+		params.Mapped = profile.mapper.ToRadius(messageType, m)
+		params.Log = logger
+	case *radius.AccRequest:
+		params.Mapped = profile.mapper.ToRadius(messageType, m)
+		if params.IMEISV != "" {
+			logger = logger.With(logging.IMEI(params.IMEISV))
 		}
+		params.Log = logger
+	}
+	converting.End()
+
+	if rejectCode == 0 {
+		rejectCode = hooks.Fields(script.BeforeRadius, messageType, radiusMessageparams, m)
+	}
+	if rejectCode != 0 {
+		build()
+		reply(buildAnswer(settings, messageType, req, rejectCode, m))
 		return
 	}
 
-	// Send a request to the Radius client
+	// The usage a CCR reports is counted in its session only once the
+	// Accounting-Response shows the AAA server has it.
+	var usedInput, usedOutput uint64
+	if accRequest, ok := radiusMessageparams.(*radius.AccRequest); ok {
+		usedInput, usedOutput = accRequest.UsedInputOctets, accRequest.UsedOutputOctets
+	}
+	if messageType != diam.AIR {
+		beginSession(sessions, m, radiusMessageparams, profile.Name)
+	}
+
+	// Send a request to the Radius client, which answers on responses
+	// whether or not the handler is still waiting.
+	responses := make(chan radius.Response, 1)
+	switch params := radiusMessageparams.(type) {
+	case *radius.AuthRequest:
+		params.Context = tracing.Enqueue(spanCtx)
+		params.Reply = responses
+	case *radius.AccRequest:
+		params.Context = tracing.Enqueue(spanCtx)
+		params.Reply = responses
+	}
 	requestChan <- radiusMessageparams
 
 	// Wait for the response from the Radius client
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), radiusResponseTimeout)
 	defer cancel()
 
 	select {
-	case response := <-responseChan:
+	case response := <-responses:
+		build()
 		var resultCode uint32
 		var radiusIp net.IP
 		var radiusMtu uint32
+		var authorized Session
 		if authResponse, ok := response.(radius.AuthResponse); ok {
-			if authResponse.Code == radiusres.CodeAccessAccept && authResponse.FramedIP != nil && authResponse.FramedMTU != 0 {
-				log.Printf("Received a successful response from Radius client: %v", response)
+			rejectCode = hooks.Fields(script.AfterRadius, messageType, &authResponse, m)
+			// An Access-Accept without a Framed-IP-Address gets its
+			// addresses from the local pools.
+			accepted := authResponse.Code == radiusres.CodeAccessAccept && rejectCode == 0
+			var pooled Session
+			if accepted && authResponse.FramedIP == nil {
+				apn, realm := poolKeys(m)
+				pooled, accepted = sessions.Allocate(sessionID(m), apn, realm)
+			}
+			if accepted {
+				logger.Debug("Received a successful RADIUS response", "code", authResponse.Code.String())
 				resultCode = diam.Success
 				radiusIp = authResponse.FramedIP
+				if radiusIp == nil {
+					radiusIp = pooled.FramedIP
+				}
 				radiusMtu = authResponse.FramedMTU
+				authorized = pooled
+				if messageType == diam.AAR {
+					authorized = sessions.Update(sessionID(m), func(session *Session) {
+						if authResponse.FramedIP != nil {
+							session.FramedIP = authResponse.FramedIP
+						}
+						session.Class = authResponse.Class
+						session.State = authResponse.State
+						session.Sticky = authResponse.Sticky
+						session.AuthTime = time.Now()
+						session.Timeout = authResponse.SessionTimeout
+						session.IdleTimeout = authResponse.IdleTimeout
+						session.InterimInterval = authResponse.AcctInterimInterval
+						session.ReAuth = authResponse.TerminationAction == rfc2865.TerminationAction_Value_RADIUSRequest
+						session.ReAuthSent = false
+					})
+				}
 			} else {
-				log.Printf("Received an unsuccessful response from Radius client: %v", response)
-				resultCode = diam.AuthorizationRejected
+				logger.Debug("Received an unsuccessful RADIUS response", "code", authResponse.Code.String())
+				resultCode = profile.rejectCode()
+				if rejectCode != 0 {
+					resultCode = rejectCode
+				}
 			}
 			switch messageType {
 			case diam.AIR:
 				a := BuildDiameterResponse(settings, req.(models.AuthenticationInformationRequest), resultCode, radiusIp, radiusMtu, m)
-				_, _ = sendReply(c, a)
+				if resultCode == diam.Success {
+					addFramedIPv6Prefix(a, authorized.FramedIPv6Prefix)
+					profile.mapper.ToDiameter(messageType, authResponse.Attributes, a)
+				}
+				reply(a)
+				// An AIR starts no session, and no STR will release the
+				// addresses the answer reported.
+				if pooled.Pool != "" {
+					sessions.Remove(sessionID(m))
+				}
 			case diam.AAR:
 				a := BuildDiameterResponse(settings, req.(models.AuthenticationAuthorizationRequest), resultCode, radiusIp, radiusMtu, m)
-				_, _ = sendReply(c, a)
+				if resultCode == diam.Success {
+					addFramedIPv6Prefix(a, authorized.FramedIPv6Prefix)
+					addLifetimeAVPs(a, authorized)
+					profile.mapper.ToDiameter(messageType, authResponse.Attributes, a)
+				}
+				reply(a)
 			}
 
 		} else if accResponse, ok := response.(radius.AccResponse); ok {
-			log.Printf("Received an Acct response from Radius client: %v", accResponse)
-			a := BuildDiameterResponse(settings, req.(models.CreditControlRequest), diam.Success, nil, 0, m)
-			_, _ = sendReply(c, a)
+			logger.Debug("Received a RADIUS accounting response", "code", accResponse.Code.String())
+			resultCode := uint32(diam.Success)
+			if code := hooks.Fields(script.AfterRadius, messageType, &accResponse, m); code != 0 {
+				resultCode = code
+			}
+			authorization, limited := sessions.Authorization(sessionID(m))
+			if accRequest, ok := radiusMessageparams.(*radius.AccRequest); ok && accRequest.AcctStatus == rfc2866.AcctStatusType_Value_Stop {
+				sessions.Remove(sessionID(m))
+			} else {
+				sessions.AddUsage(sessionID(m), ccRequestNumber(m), usedInput, usedOutput)
+			}
+			a := BuildDiameterResponse(settings, req.(models.CreditControlRequest), resultCode, nil, 0, m)
+			if resultCode == diam.Success {
+				profile.grantQuota(a)
+				if limited {
+					a = withValidityTime(a, m, authorization, time.Now())
+				}
+			}
+			profile.mapper.ToDiameter(messageType, accResponse.Attributes, a)
+			reply(a)
 
 		}
 
 	case <-ctx.Done():
-		log.Println("Timeout waiting for Radius response")
+		logger.Warn("Timed out waiting for the RADIUS response")
+		span.SetStatus(codes.Error, "timed out waiting for the RADIUS response")
+		build()
+		metrics.DiameterTimeouts.WithLabelValues(messageType).Inc()
 		// Send a reject response back to the Diameter client
-		switch messageType {
-		case diam.AIR:
-			a := BuildDiameterResponse(settings, req.(models.AuthenticationInformationRequest), diam.AuthorizationRejected, nil, 0, m)
-			_, _ = sendReply(c, a)
-		case diam.AAR:
-			a := BuildDiameterResponse(settings, req.(models.AuthenticationAuthorizationRequest), diam.AuthorizationRejected, nil, 0, m)
-			_, _ = sendReply(c, a)
-		case diam.CCR:
-			a := BuildDiameterResponse(settings, req.(models.CreditControlRequest), diam.UnknownUser, nil, 0, m)
-			_, _ = sendReply(c, a)
-		}
+		reply(buildAnswer(settings, messageType, req, profile.timeoutCode(messageType), m))
 	}
 }
 
-func HandleAuthenticationInformation(settings sm.Settings, requestChan chan radius.Request, responseChan chan radius.Response) diam.HandlerFunc {
+func HandleAuthenticationInformation(settings sm.Settings, sessions *Sessions, translation func() *Translation, requestChan chan radius.Request) diam.HandlerFunc {
 	return func(c diam.Conn, m *diam.Message) {
-		go handleDiameterRequest(settings, requestChan, responseChan, diam.AIR, c, m)
+		handleDiameterRequest(settings, sessions, translation, requestChan, diam.AIR, c, m)
 	}
 }
 
-func HandleAuthorizationAuthenticationRequest(settings sm.Settings, requestChan chan radius.Request, responseChan chan radius.Response) diam.HandlerFunc {
+func HandleAuthorizationAuthenticationRequest(settings sm.Settings, sessions *Sessions, translation func() *Translation, requestChan chan radius.Request) diam.HandlerFunc {
 	return func(c diam.Conn, m *diam.Message) {
-		go handleDiameterRequest(settings, requestChan, responseChan, diam.AAR, c, m)
+		handleDiameterRequest(settings, sessions, translation, requestChan, diam.AAR, c, m)
 	}
 }
 
-func HandleCreditControlRequest(settings sm.Settings, requestChan chan radius.Request, responseChan chan radius.Response) diam.HandlerFunc {
+func HandleCreditControlRequest(settings sm.Settings, sessions *Sessions, translation func() *Translation, requestChan chan radius.Request) diam.HandlerFunc {
 	return func(c diam.Conn, m *diam.Message) {
-		go handleDiameterRequest(settings, requestChan, responseChan, diam.CCR, c, m)
+		handleDiameterRequest(settings, sessions, translation, requestChan, diam.CCR, c, m)
+	}
+}
+
+// buildAnswer answers a translated request with resultCode.
+func buildAnswer(settings sm.Settings, messageType string, req models.DiameterRequest, resultCode uint32, m *diam.Message) *diam.Message {
+	switch messageType {
+	case diam.AIR:
+		return BuildDiameterResponse(settings, req.(models.AuthenticationInformationRequest), resultCode, nil, 0, m)
+	case diam.AAR:
+		return BuildDiameterResponse(settings, req.(models.AuthenticationAuthorizationRequest), resultCode, nil, 0, m)
+	}
+	return BuildDiameterResponse(settings, req.(models.CreditControlRequest), resultCode, nil, 0, m)
+}
+
+// setResultCode replaces the Result-Code of an answer.
+func setResultCode(a *diam.Message, resultCode uint32) {
+	if rc, err := a.FindAVP(avp.ResultCode, 0); err == nil {
+		rc.Data = datatype.Unsigned32(resultCode)
+		return
+	}
+	a.InsertAVP(diam.NewAVP(avp.ResultCode, avp.Mbit, 0, datatype.Unsigned32(resultCode)))
+}
+
+// observeAnswer records an answer to a command received at start and
+// returns its Result-Code.
+func observeAnswer(command string, a *diam.Message, start time.Time) uint32 {
+	var resultCode uint32
+	if rc, err := a.FindAVP(avp.ResultCode, 0); err == nil {
+		if code, ok := rc.Data.(datatype.Unsigned32); ok {
+			resultCode = uint32(code)
+		}
+	}
+	metrics.DiameterAnswers.WithLabelValues(command, metrics.ResultCode(resultCode)).Inc()
+	metrics.DiameterDuration.WithLabelValues(command).Observe(time.Since(start).Seconds())
+	return resultCode
+}
+
+// startSpan starts the diameter.receive span of a request, the root of the
+// spans of its translation.
+func startSpan(command string, m *diam.Message) (context.Context, trace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("diameter.command", command),
+		attribute.Int64("diameter.command_code", int64(m.Header.CommandCode)),
+		attribute.Int64("diameter.application_id", int64(m.Header.ApplicationID)),
+		attribute.String("diameter.session_id", sessionID(m)),
+		attribute.Int64("diameter.hop_by_hop", int64(m.Header.HopByHopID)),
+		attribute.Int64("diameter.end_to_end", int64(m.Header.EndToEndID)),
+	}
+	if host, err := m.FindAVP(avp.OriginHost, 0); err == nil {
+		peer, _ := host.Data.(datatype.DiameterIdentity)
+		attrs = append(attrs, attribute.String("diameter.origin_host", string(peer)))
+	}
+	return tracing.Tracer.Start(context.Background(), "diameter.receive",
+		trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(attrs...))
+}
+
+// writeAnswer sends an answer within a diameter.write span.
+func writeAnswer(ctx context.Context, c diam.Conn, a *diam.Message) error {
+	_, span := tracing.Tracer.Start(ctx, "diameter.write")
+	defer span.End()
+	if _, err := sendReply(c, a); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
+}
+
+// transactionLog is the logger of a request, with the fields identifying
+// its transaction, its trace, its peer and its subscriber.
+func transactionLog(command string, c diam.Conn, m *diam.Message, span trace.Span) *slog.Logger {
+	attrs := []any{
+		slog.String("txn_id", logging.TransactionID()),
+		slog.String("command", command),
+		slog.String("session_id", sessionID(m)),
+		slog.Uint64("hop_by_hop", uint64(m.Header.HopByHopID)),
+		slog.Uint64("end_to_end", uint64(m.Header.EndToEndID)),
+		slog.String("remote_addr", c.RemoteAddr().String()),
+	}
+	if sc := span.SpanContext(); sc.IsValid() {
+		attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+	}
+	if host, err := m.FindAVP(avp.OriginHost, 0); err == nil {
+		peer, _ := host.Data.(datatype.DiameterIdentity)
+		attrs = append(attrs, slog.String("peer", string(peer)))
+	}
+	id := requestIdentity(m)
+	if id.NAI != "" {
+		attrs = append(attrs, logging.UserName(id.NAI))
+	}
+	if id.IMSI != "" {
+		attrs = append(attrs, logging.IMSI(id.IMSI))
+	}
+	if id.MSISDN != "" {
+		attrs = append(attrs, logging.MSISDN(id.MSISDN))
 	}
+	return slog.Default().With(attrs...)
 }
 
 func sendReply(w io.Writer, m *diam.Message) (n int64, err error) {
@@ -130,9 +390,123 @@ func HandleDisconnectPeerRequest(settings sm.Settings) diam.HandlerFunc {
 	}
 }
 
+// HandleSessionTerminationRequest ends the session of an STR.
+func HandleSessionTerminationRequest(settings sm.Settings, sessions *Sessions) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		spanCtx, span := startSpan(diam.STR, m)
+		defer span.End()
+		logger := transactionLog(diam.STR, c, m, span)
+		logger.Debug("Handling request")
+		start := time.Now()
+		metrics.DiameterRequests.WithLabelValues(diam.STR).Inc()
+		var req models.SessionTerminationRequest
+		if err := m.Unmarshal(&req); err != nil {
+			logger.Error("Failed to unmarshal STR", "error", err)
+		}
+		resultCode := uint32(diam.Success)
+		if _, ok := sessions.Remove(string(req.SessionID)); !ok {
+			resultCode = diam.UnknownSessionID
+		}
+		a := BuildDiameterResponse(settings, req, resultCode, nil, 0, m)
+		resultCode = observeAnswer(diam.STR, a, start)
+		span.SetAttributes(attribute.Int64("diameter.result_code", int64(resultCode)))
+		if err := writeAnswer(spanCtx, c, a); err != nil {
+			logger.Error("Failed to send answer", "result_code", resultCode, "error", err)
+			return
+		}
+		logger.Info("Sent answer", "result_code", resultCode, "duration", time.Since(start))
+	}
+}
+
+// beginSession records the request in the session store and fills the
+// RADIUS request with what the session knows: the Acct-Session-Id assigned
+// on its first request and the usage accumulated since.
+func beginSession(sessions *Sessions, m *diam.Message, params radius.Request, profile string) {
+	id := sessionID(m)
+	if id == "" {
+		return
+	}
+	session := sessions.Update(id, func(session *Session) {
+		session.AppID = m.Header.ApplicationID
+		session.Profile = profile
+		if host, err := m.FindAVP(avp.OriginHost, 0); err == nil {
+			session.OriginHost, _ = host.Data.(datatype.DiameterIdentity)
+		}
+		if realm, err := m.FindAVP(avp.OriginRealm, 0); err == nil {
+			session.OriginRealm, _ = realm.Data.(datatype.DiameterIdentity)
+		}
+		if userName, err := m.FindAVP(avp.UserName, 0); err == nil {
+			name, _ := userName.Data.(datatype.UTF8String)
+			session.UserName = string(name)
+			session.IMSI = identity.ParseNAI(string(name)).IMSI
+		}
+		if state, err := m.FindAVP(avp.AuthSessionState, 0); err == nil {
+			value, _ := state.Data.(datatype.Enumerated)
+			session.NoStateMaintain = value == authSessionNoStateMaintained
+		}
+		if req, ok := params.(*radius.AccRequest); ok {
+			if req.IMSI != "" {
+				session.IMSI = req.IMSI
+			}
+			if session.UserName == "" {
+				session.UserName = req.Username
+			}
+			if req.Ipv4FramedIP != nil {
+				session.FramedIP = req.Ipv4FramedIP
+			}
+			session.Accounting = true
+		}
+	})
+
+	switch req := params.(type) {
+	case *radius.AuthRequest:
+		req.State = session.State
+		req.Sticky = session.Sticky
+	case *radius.AccRequest:
+		// A session without an Access-Accept of its own, such as a Gy one,
+		// echoes the one of its subscriber.
+		accepted := session
+		if authorized, ok := sessions.Accepted(id); ok {
+			accepted = authorized
+		}
+		req.Class = accepted.Class
+		req.Sticky = accepted.Sticky
+		prefix := session.FramedIPv6Prefix
+		if prefix == "" {
+			prefix = accepted.FramedIPv6Prefix
+		}
+		req.FramedIPv6Prefix = parsePrefix(prefix)
+		req.AcctSessionID = session.AcctSessionID
+		req.UsedInputOctets, req.UsedOutputOctets = session.usageWith(ccRequestNumber(m), req.UsedInputOctets, req.UsedOutputOctets)
+		req.Acctsessiontime = uint32(time.Since(session.StartTime).Seconds())
+	}
+}
+
+func ccRequestNumber(m *diam.Message) uint32 {
+	if a, err := m.FindAVP(avp.CCRequestNumber, 0); err == nil {
+		number, _ := a.Data.(datatype.Unsigned32)
+		return uint32(number)
+	}
+	return 0
+}
+
+func sessionID(m *diam.Message) string {
+	if a, err := m.FindAVP(avp.SessionID, 0); err == nil {
+		id, _ := a.Data.(datatype.UTF8String)
+		return string(id)
+	}
+	return ""
+}
+
 func HandleALL(c diam.Conn, m *diam.Message) {
 	go func() {
 		// Handle all other messages here
-		log.Printf("Received unexpected message from %s:\n%s", c.RemoteAddr(), m)
+		slog.Warn("Received unexpected message",
+			"remote_addr", c.RemoteAddr().String(),
+			"command_code", m.Header.CommandCode,
+			"application_id", m.Header.ApplicationID,
+			"request", m.Header.CommandFlags&diam.RequestFlag != 0,
+			"hop_by_hop", m.Header.HopByHopID,
+			"end_to_end", m.Header.EndToEndID)
 	}()
 }
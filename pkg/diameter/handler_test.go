@@ -0,0 +1,461 @@
+package diameter
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+	"diametertransfereagent/pkg/radius"
+	"diametertransfereagent/pkg/radiusdict"
+	"diametertransfereagent/pkg/radiustest"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm"
+	radiusres "layeh.com/radius"
+)
+
+const testSecret = "secret"
+
+func TestMain(m *testing.M) {
+	// The cases where the AAA server does not answer in time wait this
+	// long.
+	radiusResponseTimeout = 500 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// testConn is a diam.Conn that keeps what the handler writes.
+type testConn struct {
+	parser *dict.Parser
+	// ctx is the context of the connection, which carries the metadata of
+	// the peer once it passed the capabilities exchange.
+	ctx context.Context
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(b)
+}
+
+func (c *testConn) WriteStream(b []byte, _ uint) (int, error) { return c.Write(b) }
+func (c *testConn) Close()                                    {}
+func (c *testConn) LocalAddr() net.Addr                       { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3868} }
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 40000}
+}
+func (c *testConn) TLS() *tls.ConnectionState  { return nil }
+func (c *testConn) Dictionary() *dict.Parser   { return c.parser }
+func (c *testConn) SetContext(context.Context) {}
+
+func (c *testConn) Context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+func (c *testConn) Connection() net.Conn { return nil }
+
+// answer reads the answer the handler wrote.
+func (c *testConn) answer(t *testing.T) *diam.Message {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, err := diam.ReadMessage(&c.buf, c.parser)
+	if err != nil {
+		t.Fatalf("no answer: %v", err)
+	}
+	return a
+}
+
+// testHandler translates requests for the AAA server srv, through a
+// radius.Client as the agent does.
+type testHandler struct {
+	parser      *dict.Parser
+	settings    sm.Settings
+	sessions    *Sessions
+	translation *Translation
+	requests    chan radius.Request
+}
+
+func newTestHandler(t *testing.T, srv *radiustest.Server, pools []config.PoolConfig) *testHandler {
+	t.Helper()
+	parser, _, err := loadDictionary(&config.DiameterConfig{})
+	if err != nil {
+		t.Fatalf("loadDictionary: %v", err)
+	}
+	attributes := radiusdict.New()
+	translation, err := newTranslation(&config.DiameterConfig{}, parser, attributes)
+	if err != nil {
+		t.Fatalf("newTranslation: %v", err)
+	}
+	h := &testHandler{
+		parser: parser,
+		settings: sm.Settings{
+			OriginHost:  "dta.example.org",
+			OriginRealm: "example.org",
+			VendorID:    13,
+			ProductName: "go-diameter",
+		},
+		sessions:    NewSessions(NewPools(pools)),
+		translation: translation,
+		requests:    make(chan radius.Request),
+	}
+	client := radius.NewClient(config.RadiusConfig{Addr: srv.Addr, Secret: testSecret}, attributes, h.requests)
+	go client.Start()
+	t.Cleanup(func() { close(h.requests) })
+	return h
+}
+
+// handle passes m to handleDiameterRequest and returns the answer.
+func (h *testHandler) handle(t *testing.T, messageType string, m *diam.Message) *diam.Message {
+	t.Helper()
+	c := &testConn{parser: h.parser}
+	handleDiameterRequest(h.settings, h.sessions, func() *Translation { return h.translation }, h.requests, messageType, c, m)
+	return c.answer(t)
+}
+
+func (h *testHandler) request(code, appID uint32, sessionID string, avps ...*diam.AVP) *diam.Message {
+	m := diam.NewRequest(code, appID, h.parser)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String(sessionID))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("pgw.example.org"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.org"))
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.org"))
+	for _, a := range avps {
+		m.InsertAVP(a)
+	}
+	return m
+}
+
+func (h *testHandler) aar(sessionID string) *diam.Message {
+	return h.request(diam.AA, S6B_APP_ID, sessionID,
+		diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(S6B_APP_ID)),
+		diam.NewAVP(avp.AuthRequestType, avp.Mbit, 0, datatype.Enumerated(1)),
+		diam.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String("0001010000000001@nai.epc.mnc001.mcc001.3gppnetwork.org")),
+		diam.NewAVP(avp.ServiceSelection, avp.Mbit, 0, datatype.UTF8String("internet")),
+	)
+}
+
+func resultCode(t *testing.T, a *diam.Message) uint32 {
+	t.Helper()
+	rc, err := a.FindAVP(avp.ResultCode, 0)
+	if err != nil {
+		t.Fatalf("answer has no Result-Code: %v", err)
+	}
+	return uint32(rc.Data.(datatype.Unsigned32))
+}
+
+// framedIP returns the Framed-IP-Address of an answer, if any. The AVP is
+// looked up by code as the S6a and S6b dictionaries do not define it.
+func framedIP(a *diam.Message) string {
+	for _, ip := range a.AVP {
+		if ip.Code == avp.FramedIPAddress && ip.VendorID == 0 {
+			return net.IP(ip.Data.Serialize()).String()
+		}
+	}
+	return ""
+}
+
+func TestHandleAAR(t *testing.T) {
+	tests := []struct {
+		name     string
+		response radiustest.Response
+		code     uint32
+		// framedIP is the Framed-IP-Address of the answer, if any.
+		framedIP string
+	}{
+		{
+			name:     "accept",
+			response: radiustest.Accept(radiustest.Attr("Framed-IP-Address", "10.0.0.1"), radiustest.Attr("Class", "0x01")),
+			code:     diam.Success,
+			framedIP: "10.0.0.1",
+		},
+		{
+			name:     "reject",
+			response: radiustest.Reject(),
+			code:     diam.AuthorizationRejected,
+		},
+		{
+			name:     "challenge",
+			response: radiustest.Challenge(radiustest.Attr("State", "0x01")),
+			code:     diam.AuthorizationRejected,
+		},
+		{
+			name:     "delay",
+			response: radiustest.Accept(radiustest.Attr("Framed-IP-Address", "10.0.0.1")).After(100 * time.Millisecond),
+			code:     diam.Success,
+			framedIP: "10.0.0.1",
+		},
+		{
+			name:     "timeout",
+			response: radiustest.Accept().After(10 * time.Second),
+			code:     diam.AuthorizationRejected,
+		},
+		{
+			name:     "drop",
+			response: radiustest.Drop(),
+			code:     diam.AuthorizationRejected,
+		},
+		{
+			name:     "malformed",
+			response: radiustest.Malformed(),
+			code:     diam.AuthorizationRejected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := radiustest.NewServer(testSecret)
+			defer srv.Close()
+			srv.On(radiustest.Code(radiusres.CodeAccessRequest), tt.response)
+			h := newTestHandler(t, srv, nil)
+
+			a := h.handle(t, diam.AAR, h.aar("aar;"+tt.name))
+			if code := resultCode(t, a); code != tt.code {
+				t.Errorf("Result-Code = %d, want %d", code, tt.code)
+			}
+			if framedIP := framedIP(a); framedIP != tt.framedIP {
+				t.Errorf("Framed-IP-Address = %q, want %q", framedIP, tt.framedIP)
+			}
+
+			// Every request reaches the server, whether or not it answers.
+			received := srv.Received()
+			if len(received) == 0 {
+				t.Fatalf("server received no request")
+			}
+			if name, _ := received[0].Value("User-Name"); name != "0001010000000001" {
+				t.Errorf("User-Name = %q", name)
+			}
+
+			session, ok := h.sessions.Get("aar;" + tt.name)
+			if tt.code != diam.Success {
+				// No STR follows a failed authorization.
+				if ok {
+					t.Errorf("unauthorized session %+v is kept", session)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("session is not kept")
+			}
+			if session.IMSI != "001010000000001" || session.FramedIP.String() != tt.framedIP {
+				t.Errorf("session = %+v", session)
+			}
+		})
+	}
+}
+
+func TestHandleCCR(t *testing.T) {
+	tests := []struct {
+		name     string
+		response radiustest.Response
+		code     uint32
+	}{
+		{"accept", radiustest.Accept(), diam.Success},
+		{"reject", radiustest.Reject(), diam.UnknownUser},
+		{"drop", radiustest.Drop(), diam.UnknownUser},
+		{"malformed", radiustest.Malformed(), diam.UnknownUser},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := radiustest.NewServer(testSecret)
+			defer srv.Close()
+			srv.On(radiustest.Code(radiusres.CodeAccountingRequest), tt.response)
+			h := newTestHandler(t, srv, nil)
+
+			ccr := h.request(diam.CreditControl, 4, "ccr;"+tt.name,
+				diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4)),
+				diam.NewAVP(avp.ServiceContextID, avp.Mbit, 0, datatype.UTF8String("32251@3gpp.org")),
+				diam.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(1)),
+				diam.NewAVP(avp.CCRequestNumber, avp.Mbit, 0, datatype.Unsigned32(0)),
+				diam.NewAVP(avp.SubscriptionID, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+					diam.NewAVP(avp.SubscriptionIDType, avp.Mbit, 0, datatype.Enumerated(1)),
+					diam.NewAVP(avp.SubscriptionIDData, avp.Mbit, 0, datatype.UTF8String("001010000000001")),
+				}}),
+			)
+			a := h.handle(t, diam.CCR, ccr)
+			if code := resultCode(t, a); code != tt.code {
+				t.Errorf("Result-Code = %d, want %d", code, tt.code)
+			}
+
+			received := srv.Received()
+			if len(received) == 0 {
+				t.Fatalf("server received no request")
+			}
+			if status, _ := received[0].Value("Acct-Status-Type"); status != "Start" {
+				t.Errorf("Acct-Status-Type = %q, want Start", status)
+			}
+			if imsi, _ := received[0].Value("3GPP-IMSI"); imsi != "001010000000001" {
+				t.Errorf("3GPP-IMSI = %q", imsi)
+			}
+		})
+	}
+}
+
+// TestHandleAIRPool checks that the pool addresses given in an AIA go back
+// to the pool, since no STR follows an AIR.
+func TestHandleAIRPool(t *testing.T) {
+	srv := radiustest.NewServer(testSecret)
+	defer srv.Close()
+	h := newTestHandler(t, srv, []config.PoolConfig{{Name: "small", IPv4: "10.1.0.0/30"}})
+
+	// The pool has two addresses.
+	for _, id := range []string{"air;1", "air;2", "air;3"} {
+		air := h.request(diam.AuthenticationInformation, diam.TGPP_S6A_APP_ID, id,
+			diam.NewAVP(avp.AuthSessionState, avp.Mbit, 0, datatype.Enumerated(1)),
+			diam.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String("001010000000001")),
+			diam.NewAVP(avp.VisitedPLMNID, avp.Mbit|avp.Vbit, 10415, datatype.OctetString([]byte{0x00, 0xf1, 0x10})),
+		)
+		a := h.handle(t, diam.AIR, air)
+		if code := resultCode(t, a); code != diam.Success {
+			t.Fatalf("%s: Result-Code = %d, want %d", id, code, diam.Success)
+		}
+		if ip := framedIP(a); ip != "10.1.0.1" && ip != "10.1.0.2" {
+			t.Errorf("%s: Framed-IP-Address = %q, want an address of the pool", id, ip)
+		}
+		if _, ok := h.sessions.Get(id); ok {
+			t.Errorf("%s: session kept after the AIA", id)
+		}
+	}
+}
+
+// TestHandleCCRUsage checks that the usage of a CCR is counted in its
+// session once the AAA server has it, and only once.
+func TestHandleCCRUsage(t *testing.T) {
+	srv := radiustest.NewServer(testSecret)
+	defer srv.Close()
+	srv.On(radiustest.Equal("Acct-Status-Type", "Interim-Update"), radiustest.Drop()).Times(1)
+	h := newTestHandler(t, srv, nil)
+
+	ccr := func(requestType, number uint32, input, output uint64) *diam.Message {
+		return h.request(diam.CreditControl, 4, "ccr;usage",
+			diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4)),
+			diam.NewAVP(avp.ServiceContextID, avp.Mbit, 0, datatype.UTF8String("32251@3gpp.org")),
+			diam.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(requestType)),
+			diam.NewAVP(avp.CCRequestNumber, avp.Mbit, 0, datatype.Unsigned32(number)),
+			diam.NewAVP(avp.SubscriptionID, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+				diam.NewAVP(avp.SubscriptionIDType, avp.Mbit, 0, datatype.Enumerated(1)),
+				diam.NewAVP(avp.SubscriptionIDData, avp.Mbit, 0, datatype.UTF8String("001010000000001")),
+			}}),
+			diam.NewAVP(avp.MultipleServicesCreditControl, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+				diam.NewAVP(avp.UsedServiceUnit, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+					diam.NewAVP(avp.CCInputOctets, avp.Mbit, 0, datatype.Unsigned64(input)),
+					diam.NewAVP(avp.CCOutputOctets, avp.Mbit, 0, datatype.Unsigned64(output)),
+				}}),
+			}}),
+		)
+	}
+
+	steps := []struct {
+		name          string
+		requestType   uint32
+		number        uint32
+		input, output uint64
+		// sent is the Acct-Input-Octets of the Accounting-Request, if any,
+		// and totalInput and totalOutput the usage of the session afterwards.
+		sent                    string
+		totalInput, totalOutput uint64
+	}{
+		{name: "initial", requestType: 1},
+		{name: "update lost", requestType: 2, number: 1, input: 100, output: 200, sent: "100"},
+		{name: "update retransmitted", requestType: 2, number: 1, input: 100, output: 200, sent: "100", totalInput: 100, totalOutput: 200},
+		{name: "update retransmitted again", requestType: 2, number: 1, input: 100, output: 200, sent: "100", totalInput: 100, totalOutput: 200},
+		{name: "next update", requestType: 2, number: 2, input: 50, output: 50, sent: "150", totalInput: 150, totalOutput: 250},
+	}
+	for i, step := range steps {
+		h.handle(t, diam.CCR, ccr(step.requestType, step.number, step.input, step.output))
+		received := srv.Received()
+		if len(received) != i+1 {
+			t.Fatalf("%s: server received %d requests, want %d", step.name, len(received), i+1)
+		}
+		if octets, _ := received[i].Value("Acct-Input-Octets"); octets != step.sent {
+			t.Errorf("%s: Acct-Input-Octets = %q, want %q", step.name, octets, step.sent)
+		}
+		session, _ := h.sessions.Get("ccr;usage")
+		if session.InputOctets != step.totalInput || session.OutputOctets != step.totalOutput {
+			t.Errorf("%s: session usage = %d/%d, want %d/%d", step.name, session.InputOctets, session.OutputOctets, step.totalInput, step.totalOutput)
+		}
+	}
+}
+
+// TestHandleCCRClass checks that the accounting of a Gy session echoes the
+// Class of the Access-Accept of the AAR of its subscriber.
+func TestHandleCCRClass(t *testing.T) {
+	srv := radiustest.NewServer(testSecret)
+	defer srv.Close()
+	srv.On(radiustest.Code(radiusres.CodeAccessRequest), radiustest.Accept(radiustest.Attr("Framed-IP-Address", "10.0.0.1"), radiustest.Attr("Class", "0x0102")))
+	h := newTestHandler(t, srv, nil)
+
+	if code := resultCode(t, h.handle(t, diam.AAR, h.aar("aar;class"))); code != diam.Success {
+		t.Fatalf("AAR Result-Code = %d, want %d", code, diam.Success)
+	}
+	ccr := h.request(diam.CreditControl, 4, "ccr;class",
+		diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4)),
+		diam.NewAVP(avp.ServiceContextID, avp.Mbit, 0, datatype.UTF8String("32251@3gpp.org")),
+		diam.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(1)),
+		diam.NewAVP(avp.CCRequestNumber, avp.Mbit, 0, datatype.Unsigned32(0)),
+		diam.NewAVP(avp.SubscriptionID, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+			diam.NewAVP(avp.SubscriptionIDType, avp.Mbit, 0, datatype.Enumerated(1)),
+			diam.NewAVP(avp.SubscriptionIDData, avp.Mbit, 0, datatype.UTF8String("001010000000001")),
+		}}),
+	)
+	if code := resultCode(t, h.handle(t, diam.CCR, ccr)); code != diam.Success {
+		t.Fatalf("CCR Result-Code = %d, want %d", code, diam.Success)
+	}
+
+	received := srv.Received()
+	if len(received) != 2 {
+		t.Fatalf("server received %d requests, want 2", len(received))
+	}
+	if status, _ := received[1].Value("Acct-Status-Type"); status != "Start" {
+		t.Errorf("Acct-Status-Type = %q, want Start", status)
+	}
+	if class, _ := received[1].Value("Class"); class != "0x0102" {
+		t.Errorf("Class = %q, want the one of the Access-Accept", class)
+	}
+}
+
+// TestHandleCCRPooledPrefix checks that the accounting of a subscriber
+// reports the IPv6 prefix its AAR was given from a pool.
+func TestHandleCCRPooledPrefix(t *testing.T) {
+	srv := radiustest.NewServer(testSecret)
+	defer srv.Close()
+	srv.On(radiustest.Code(radiusres.CodeAccessRequest), radiustest.Accept(radiustest.Attr("Class", "0x01")))
+	h := newTestHandler(t, srv, []config.PoolConfig{{Name: "v6", IPv6Prefix: "2001:db8::/48"}})
+
+	if code := resultCode(t, h.handle(t, diam.AAR, h.aar("aar;prefix"))); code != diam.Success {
+		t.Fatalf("AAR Result-Code = %d, want %d", code, diam.Success)
+	}
+	ccr := h.request(diam.CreditControl, 4, "ccr;prefix",
+		diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(4)),
+		diam.NewAVP(avp.ServiceContextID, avp.Mbit, 0, datatype.UTF8String("32251@3gpp.org")),
+		diam.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(1)),
+		diam.NewAVP(avp.CCRequestNumber, avp.Mbit, 0, datatype.Unsigned32(0)),
+		diam.NewAVP(avp.SubscriptionID, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+			diam.NewAVP(avp.SubscriptionIDType, avp.Mbit, 0, datatype.Enumerated(1)),
+			diam.NewAVP(avp.SubscriptionIDData, avp.Mbit, 0, datatype.UTF8String("001010000000001")),
+		}}),
+	)
+	if code := resultCode(t, h.handle(t, diam.CCR, ccr)); code != diam.Success {
+		t.Fatalf("CCR Result-Code = %d, want %d", code, diam.Success)
+	}
+
+	received := srv.Received()
+	if len(received) != 2 {
+		t.Fatalf("server received %d requests, want 2", len(received))
+	}
+	if prefix, _ := received[1].Value("Framed-IPv6-Prefix"); prefix != "2001:db8::/64" {
+		t.Errorf("Framed-IPv6-Prefix = %q, want the pooled prefix", prefix)
+	}
+}
@@ -0,0 +1,145 @@
+package diameter
+
+import (
+	"context"
+	"log"
+	"log/slog"
+	"time"
+
+	"diametertransfereagent/pkg/logging"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"layeh.com/radius/rfc2866"
+)
+
+// authGracePeriod is the Auth-Grace-Period in seconds granted to sessions
+// that must re-authorize (Termination-Action RADIUS-Request) before they
+// are aborted.
+const authGracePeriod = 60
+
+// addLifetimeAVPs puts the lifetime the Access-Accept granted to the session
+// in an AA answer. A session that must re-authorize gets an
+// Authorization-Lifetime and keeps its Session-Timeout for the grace period
+// after it.
+func addLifetimeAVPs(a *diam.Message, session Session) {
+	if session.Timeout > 0 {
+		timeout := session.Timeout
+		if session.ReAuth {
+			_, err := a.NewAVP(avp.AuthorizationLifetime, avp.Mbit, 0, datatype.Unsigned32(session.Timeout))
+			if err != nil {
+				log.Printf("Error Setting AuthorizationLifetime: %v", err)
+			}
+			_, err = a.NewAVP(avp.AuthGracePeriod, avp.Mbit, 0, datatype.Unsigned32(authGracePeriod))
+			if err != nil {
+				log.Printf("Error Setting AuthGracePeriod: %v", err)
+			}
+			timeout += authGracePeriod
+		}
+		_, err := a.NewAVP(avp.SessionTimeout, avp.Mbit, 0, datatype.Unsigned32(timeout))
+		if err != nil {
+			log.Printf("Error Setting SessionTimeout: %v", err)
+		}
+	}
+	if session.IdleTimeout > 0 {
+		_, err := a.NewAVP(avp.IdleTimeout, avp.Mbit, 0, datatype.Unsigned32(session.IdleTimeout))
+		if err != nil {
+			log.Printf("Error Setting IdleTimeout: %v", err)
+		}
+	}
+	if session.InterimInterval > 0 {
+		_, err := a.NewAVP(avp.AcctInterimInterval, avp.Mbit, 0, datatype.Unsigned32(session.InterimInterval))
+		if err != nil {
+			log.Printf("Error Setting AcctInterimInterval: %v", err)
+		}
+	}
+}
+
+// withValidityTime returns the CCA a with a Validity-Time in every
+// Multiple-Services-Credit-Control, so that the Gy client reports back by the
+// time the subscriber's authorization needs an interim update or ends. The
+// answer is rebuilt from m, the CCR, to keep the stream of the request.
+func withValidityTime(a, m *diam.Message, authorization Session, now time.Time) *diam.Message {
+	var validity uint32
+	if authorization.Timeout > 0 {
+		if remaining := authorization.authorizationEnd().Sub(now); remaining > 0 {
+			validity = uint32(remaining / time.Second)
+		}
+	}
+	if interval := authorization.InterimInterval; interval > 0 && (validity == 0 || interval < validity) {
+		validity = interval
+	}
+	if validity == 0 {
+		return a
+	}
+
+	answer := m.Answer(0)
+	answer.Header.CommandFlags = a.Header.CommandFlags
+	for _, answerAVP := range a.AVP {
+		if group, ok := answerAVP.Data.(*diam.GroupedAVP); ok && answerAVP.Code == avp.MultipleServicesCreditControl {
+			members := append(append([]*diam.AVP(nil), group.AVP...), diam.NewAVP(avp.ValidityTime, avp.Mbit, 0, datatype.Unsigned32(validity)))
+			answerAVP = diam.NewAVP(answerAVP.Code, answerAVP.Flags, answerAVP.VendorID, &diam.GroupedAVP{AVP: members})
+		}
+		answer.AddAVP(answerAVP)
+	}
+	return answer
+}
+
+// sessionExpired closes a session that outlived its lifetime. A session
+// that was granted one is aborted with an ASR first, and stays in the store
+// for the STR that follows.
+func (s *Server) sessionExpired(session Session) {
+	slog.Info("Session expired", "session_id", session.ID, logging.UserName(session.UserName))
+	cause := rfc2866.AcctTerminateCause_Value_SessionTimeout
+	if session.Aborted {
+		if session.idleExpired() {
+			cause = rfc2866.AcctTerminateCause_Value_IdleTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), stopSessionTimeout)
+		defer cancel()
+		asr := BuildAbortSessionRequest(s.settings, s.dictionary.Load(), session.AppID, session.ID, session.OriginHost, session.OriginRealm)
+		if resultCode, err := s.sessionRequest(ctx, session, asr, cause); err == nil && resultCode == diam.UnknownSessionID {
+			// The peer no longer knew the session: sessionRequest removed
+			// it and closed its accounting.
+			return
+		}
+	}
+	if session.Accounting {
+		s.stopSession(session, cause)
+	}
+}
+
+// sessionReAuth asks the peer to re-authorize a session whose
+// Authorization-Lifetime ended.
+func (s *Server) sessionReAuth(session Session) {
+	slog.Info("Authorization ended, requesting re-authorization", "session_id", session.ID, logging.UserName(session.UserName))
+	s.lifetimeRequest(session, BuildReAuthRequest(s.settings, s.dictionary.Load(), session.AppID, session.ID, session.OriginHost, session.OriginRealm, reAuthAuthorizeOnly))
+}
+
+func (s *Server) lifetimeRequest(session Session, m *diam.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), stopSessionTimeout)
+	defer cancel()
+	s.sessionRequest(ctx, session, m, rfc2866.AcctTerminateCause_Value_LostService)
+}
+
+// sessionRequest sends m, an ASR or RAR about session, to the peer of the
+// session and returns the Result-Code of its answer. The session stays in
+// the store until its STR or CCR-T, except when the peer does not know it
+// any more: no STR or CCR-T will come, so it is removed here and its
+// accounting closed with cause.
+func (s *Server) sessionRequest(ctx context.Context, session Session, m *diam.Message, cause rfc2866.AcctTerminateCause) (uint32, error) {
+	a, err := s.SendRequest(ctx, session.OriginHost, m)
+	if err != nil {
+		slog.Error("Failed to send request", "command", commandName(m), "session_id", session.ID, "peer", string(session.OriginHost), "error", err)
+		return 0, err
+	}
+	resultCode := answerResultCode(a)
+	slog.Info("Received answer", "command", commandName(m), "session_id", session.ID, "result_code", resultCode)
+	if resultCode == diam.UnknownSessionID {
+		if removed, ok := s.sessions.Remove(session.ID); ok && removed.Accounting {
+			s.stopSession(removed, cause)
+		}
+	}
+	return resultCode, nil
+}
@@ -0,0 +1,124 @@
+package diameter
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+func TestWithValidityTime(t *testing.T) {
+	parser := testParser(t)
+	ccr := routedRequest(parser, "example.org")
+	cca := ccr.Answer(diam.Success)
+	cca.NewAVP(avp.MultipleServicesCreditControl, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+		diam.NewAVP(avp.GrantedServiceUnit, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+			diam.NewAVP(avp.CCTime, avp.Mbit, 0, datatype.Unsigned32(5)),
+		}}),
+	}})
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		authorization Session
+		// validity is the Validity-Time expected, zero for none.
+		validity uint32
+	}{
+		{name: "unlimited"},
+		{name: "session timeout", authorization: Session{AuthTime: now, Timeout: 600}, validity: 600},
+		{name: "interim interval", authorization: Session{AuthTime: now, Timeout: 600, InterimInterval: 300}, validity: 300},
+		{name: "authorization ended", authorization: Session{AuthTime: now.Add(-time.Hour), Timeout: 600}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := withValidityTime(cca, ccr, tt.authorization, now)
+			b, err := a.Serialize()
+			if err != nil {
+				t.Fatalf("Serialize: %v", err)
+			}
+			if len(b) != int(a.Header.MessageLength) {
+				t.Fatalf("message of %d bytes with a Message-Length of %d", len(b), a.Header.MessageLength)
+			}
+			decoded, err := diam.ReadMessage(bytes.NewReader(b), parser)
+			if err != nil {
+				t.Fatalf("ReadMessage: %v", err)
+			}
+			if code := resultCode(t, decoded); code != diam.Success {
+				t.Errorf("Result-Code = %d, want %d", code, diam.Success)
+			}
+			validity, err := decoded.FindAVPsWithPath([]interface{}{avp.MultipleServicesCreditControl, avp.ValidityTime}, 0)
+			if tt.validity == 0 {
+				if len(validity) != 0 {
+					t.Errorf("Validity-Time = %v, want none", validity)
+				}
+				return
+			}
+			if err != nil || len(validity) != 1 || validity[0].Data.(datatype.Unsigned32) != datatype.Unsigned32(tt.validity) {
+				t.Errorf("Validity-Time = %v, want %d", validity, tt.validity)
+			}
+		})
+	}
+}
+
+// TestSessionExpiredAbort checks that a session aborted at the end of its
+// lifetime waits for its STR.
+func TestSessionExpiredAbort(t *testing.T) {
+	for _, answer := range []uint32{diam.Success, diam.UnknownSessionID} {
+		s, peer := newTestPeer(t, "pgw.example.org", answerWith(answer))
+		start := time.Now().Add(-2 * time.Minute)
+		s.sessions.Update("pgw.example.org;1", func(session *Session) {
+			session.AppID = S6B_APP_ID
+			session.OriginHost = "pgw.example.org"
+			session.OriginRealm = "example.net"
+			session.AuthTime = start
+			session.Timeout = 60
+		})
+
+		expired := s.sessions.expire(time.Now())
+		if len(expired) != 1 || !expired[0].Aborted {
+			t.Fatalf("expired = %+v, want the session to abort", expired)
+		}
+		s.sessionExpired(expired[0])
+		sent := peer.sent()
+		if len(sent) != 1 || sent[0].Header.CommandCode != diam.AbortSession {
+			t.Fatalf("peer received %v, want an ASR", sent)
+		}
+		if _, ok := s.sessions.Get("pgw.example.org;1"); ok != (answer == diam.Success) {
+			t.Errorf("ASA %d: session kept = %t", answer, ok)
+		}
+		if answer != diam.Success {
+			continue
+		}
+
+		str := diam.NewRequest(diam.SessionTermination, S6B_APP_ID, peer.parser)
+		str.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("pgw.example.org;1"))
+		str.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("pgw.example.org"))
+		str.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.net"))
+		str.NewAVP(avp.TerminationCause, avp.Mbit, 0, datatype.Enumerated(1))
+		c := &testConn{parser: peer.parser}
+		HandleSessionTerminationRequest(testSettings, s.sessions)(c, str)
+		if code := resultCode(t, c.answer(t)); code != diam.Success {
+			t.Errorf("STA Result-Code = %d, want %d", code, diam.Success)
+		}
+	}
+
+	// An aborted session whose STR never comes is dropped quietly.
+	s := NewSessions(nil)
+	s.Update("pgw.example.org;1", func(session *Session) {
+		session.AuthTime = time.Now().Add(-2 * time.Minute)
+		session.Timeout = 60
+	})
+	now := time.Now()
+	if expired := s.expire(now); len(expired) != 1 {
+		t.Fatalf("expired %d sessions, want 1", len(expired))
+	}
+	if expired := s.expire(now.Add(abortedLifetime / 2)); len(expired) != 0 || s.Len() != 1 {
+		t.Errorf("aborted session dropped before its STR could come")
+	}
+	if expired := s.expire(now.Add(abortedLifetime)); len(expired) != 0 || s.Len() != 0 {
+		t.Errorf("aborted session kept past %v, or aborted again", abortedLifetime)
+	}
+}
@@ -0,0 +1,99 @@
+package diameter
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// dictServer is a diam.Server reading messages with one dictionary. The
+// connections accepted by Server.serve go to the one of the current
+// dictionary; a reload replaces it with a new one and the connections
+// already open keep the dictionary they were accepted with, since
+// go-diameter reads it without a lock.
+type dictServer struct {
+	server *diam.Server
+	conns  chan net.Conn
+	closed chan struct{}
+	once   sync.Once
+	addr   net.Addr
+}
+
+// newDictServer starts serving the connections handed to it with handler
+// and parser.
+func newDictServer(network string, addr net.Addr, handler diam.Handler, parser *dict.Parser) *dictServer {
+	d := &dictServer{
+		server: &diam.Server{Network: network, Addr: addr.String(), Handler: handler, Dict: parser},
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+		addr:   addr,
+	}
+	go d.server.Serve(d)
+	return d
+}
+
+// Accept returns the next connection handed to the server. It implements
+// net.Listener for diam.Server.Serve.
+func (d *dictServer) Accept() (net.Conn, error) {
+	select {
+	case c := <-d.conns:
+		return c, nil
+	case <-d.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops the server from taking new connections; those it serves go
+// on until they end.
+func (d *dictServer) Close() error {
+	d.once.Do(func() { close(d.closed) })
+	return nil
+}
+
+func (d *dictServer) Addr() net.Addr {
+	return d.addr
+}
+
+// hand passes c to the server, reporting false when it is closed.
+func (d *dictServer) hand(c net.Conn) bool {
+	select {
+	case d.conns <- c:
+		return true
+	case <-d.closed:
+		return false
+	}
+}
+
+// serve accepts the connections of l and hands each to the server of the
+// current dictionary, until l is closed.
+func (s *Server) serve(l net.Listener) {
+	defer func() {
+		if d := s.diamServer.Load(); d != nil {
+			d.Close()
+		}
+	}()
+	var delay time.Duration
+	for {
+		c, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			// Such as running out of file descriptors: back off as
+			// net/http does.
+			delay = min(max(2*delay, 5*time.Millisecond), time.Second)
+			log.Printf("Failed to accept a Diameter connection: %v; retrying in %v", err, delay)
+			time.Sleep(delay)
+			continue
+		}
+		delay = 0
+		for d := s.diamServer.Load(); !d.hand(c); d = s.diamServer.Load() {
+			// d was replaced by a reload meanwhile.
+		}
+	}
+}
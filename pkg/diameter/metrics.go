@@ -0,0 +1,52 @@
+package diameter
+
+import (
+	"diametertransfereagent/pkg/metrics"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var peerStateDesc = prometheus.NewDesc("dta_diameter_peer_state",
+	"State of each Diameter peer, 1 for the state the peer is in.",
+	[]string{"peer", "direction", "state"}, nil)
+
+// peerCollector reports the state of the peers of the peer table and of the
+// configured outbound peers at each scrape.
+type peerCollector struct {
+	s *Server
+}
+
+func (pc peerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- peerStateDesc
+}
+
+func (pc peerCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, entry := range pc.s.peerTable.List() {
+		direction := "outbound"
+		if entry.Inbound {
+			direction = "inbound"
+		}
+		ch <- prometheus.MustNewConstMetric(peerStateDesc, prometheus.GaugeValue, 1,
+			string(entry.OriginHost), direction, entry.State.String())
+	}
+	// Outbound peers that are not connected are only known by address.
+	for _, peer := range pc.s.peers {
+		if peer.OriginHost() != "" {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(peerStateDesc, prometheus.GaugeValue, 1,
+			peer.Addr(), "outbound", peer.State().String())
+	}
+}
+
+// registerMetrics adds the gauges read from the server state to the metrics
+// registry.
+func (s *Server) registerMetrics() {
+	metrics.Gauge("sessions_active", "Sessions in the session store.", func() float64 {
+		return float64(s.sessions.Len())
+	})
+	metrics.Gauge("radius_request_queue_depth", "RADIUS requests waiting for the RADIUS client.", func() float64 {
+		return float64(len(s.requestChan))
+	})
+	metrics.Registry.MustRegister(peerCollector{s})
+}
@@ -0,0 +1,294 @@
+package diameter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smpeer"
+)
+
+const (
+	defaultWatchdogInterval    = 30 * time.Second
+	defaultReconnectInterval   = 1 * time.Second
+	defaultMaxReconnectBackoff = 60 * time.Second
+)
+
+var ErrPeerNotConnected = errors.New("diameter peer not connected")
+
+// answerCommands lists the answers to requests the agent originates towards peers.
+var answerCommands = []string{"RAA", "ASA", "CLA", "DPA"}
+
+// Peer is an outbound Diameter connection. It performs CER/CEA when dialing,
+// keeps the link up with DWR/DWA and reconnects with exponential backoff.
+type Peer struct {
+	cfg        config.PeerConfig
+	dictionary func() *dict.Parser
+	mux        *sm.StateMachine
+	client     *sm.Client
+
+	table *PeerTable
+	txns  *transactions
+
+	mu    sync.RWMutex
+	state PeerState
+	conn  diam.Conn
+	meta  *smpeer.Metadata
+}
+
+// NewPeer creates an outbound peer. The register callback installs the
+// request and answer handlers on the peer's own state machine, since
+// go-diameter rewires the CER/CEA handlers of the state machine it
+// handshakes with. Answers are correlated through txns, and messages decoded
+// with the dictionary current when the peer connects.
+func NewPeer(cfg config.PeerConfig, settings sm.Settings, dictionary func() *dict.Parser, table *PeerTable, txns *transactions, register func(*sm.StateMachine)) *Peer {
+	p := &Peer{cfg: cfg, dictionary: dictionary, table: table, txns: txns}
+	p.mux = sm.New(&settings)
+	register(p.mux)
+
+	watchdog := defaultWatchdogInterval
+	if cfg.WatchdogInterval > 0 {
+		watchdog = time.Duration(cfg.WatchdogInterval) * time.Second
+	}
+	p.client = &sm.Client{
+		Handler:            p.mux,
+		MaxRetransmits:     3,
+		RetransmitInterval: time.Second,
+		EnableWatchdog:     true,
+		WatchdogInterval:   watchdog,
+	}
+	if cfg.VendorID != 0 {
+		p.client.SupportedVendorID = []*diam.AVP{
+			diam.NewAVP(avp.SupportedVendorID, avp.Mbit, 0, datatype.Unsigned32(cfg.VendorID)),
+		}
+	}
+	var apps []*diam.AVP
+	for _, id := range cfg.AuthAppIDs {
+		if cfg.VendorID != 0 {
+			p.client.VendorSpecificApplicationID = append(p.client.VendorSpecificApplicationID,
+				diam.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
+					AVP: []*diam.AVP{
+						diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(id)),
+						diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(cfg.VendorID)),
+					},
+				}))
+		} else {
+			apps = append(apps, diam.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(id)))
+		}
+	}
+	for _, id := range cfg.AcctAppIDs {
+		apps = append(apps, diam.NewAVP(avp.AcctApplicationID, avp.Mbit, 0, datatype.Unsigned32(id)))
+	}
+	// go-diameter checks the Auth- and Acct-Application-Ids of a client
+	// against dict.Default, not its dictionary, but sends the AVPs of
+	// VendorSpecificApplicationID as they are. dial checks them against
+	// the dictionary instead.
+	p.client.VendorSpecificApplicationID = append(p.client.VendorSpecificApplicationID, apps...)
+	return p
+}
+
+// Addr returns the configured address of the peer.
+func (p *Peer) Addr() string {
+	return p.cfg.Addr
+}
+
+// OriginHost returns the Origin-Host learned from the peer's CEA, or an
+// empty identity while the peer is not connected.
+func (p *Peer) OriginHost() datatype.DiameterIdentity {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.meta == nil {
+		return ""
+	}
+	return p.meta.OriginHost
+}
+
+// OriginRealm returns the Origin-Realm learned from the peer's CEA.
+func (p *Peer) OriginRealm() datatype.DiameterIdentity {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.meta == nil {
+		return ""
+	}
+	return p.meta.OriginRealm
+}
+
+// State returns the RFC 6733 state of the outbound connection.
+func (p *Peer) State() PeerState {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.state
+}
+
+// Conn returns the current connection to the peer, if any.
+func (p *Peer) Conn() (diam.Conn, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.conn, p.conn != nil
+}
+
+// Run dials the peer and keeps reconnecting until ctx is cancelled.
+func (p *Peer) Run(ctx context.Context) {
+	backoff := defaultReconnectInterval
+	if p.cfg.ReconnectInterval > 0 {
+		backoff = time.Duration(p.cfg.ReconnectInterval) * time.Second
+	}
+	maxBackoff := defaultMaxReconnectBackoff
+	if p.cfg.MaxReconnectBackoff > 0 {
+		maxBackoff = time.Duration(p.cfg.MaxReconnectBackoff) * time.Second
+	}
+
+	delay := backoff
+	for {
+		p.setState(PeerWaitConnAck)
+		c, err := p.dial()
+		if err != nil {
+			p.setState(PeerClosed)
+			log.Printf("Failed to connect to diameter peer %s: %v (retrying in %s)", p.cfg.Addr, err, delay)
+		} else {
+			delay = backoff
+			meta, _ := smpeer.FromContext(c.Context())
+			p.setConn(c, meta)
+			p.setState(PeerIOpen)
+			p.table.Open(c, meta, false)
+			log.Printf("Connected to diameter peer %s (%s)", p.cfg.Addr, string(p.OriginHost()))
+
+			select {
+			case <-c.(diam.CloseNotifier).CloseNotify():
+				log.Printf("Connection to diameter peer %s lost", p.cfg.Addr)
+			case <-ctx.Done():
+				p.setState(PeerClosing)
+				c.Close()
+			}
+			p.table.Closed(c, meta)
+			p.setConn(nil, nil)
+			p.setState(PeerClosed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		if err != nil {
+			delay *= 2
+			if delay > maxBackoff {
+				delay = maxBackoff
+			}
+		}
+	}
+}
+
+func (p *Peer) dial() (diam.Conn, error) {
+	networkType := p.cfg.NetworkType
+	if networkType == "" {
+		networkType = "tcp"
+	}
+	parser := p.dictionary()
+	if err := p.checkApps(parser); err != nil {
+		return nil, err
+	}
+	p.client.Dict = parser
+	if p.cfg.SSL {
+		return p.client.DialTLSExt(networkType, p.cfg.Addr, p.cfg.CertFile, p.cfg.KeyFile, 5*time.Second, nil)
+	}
+	return p.client.DialExt(networkType, p.cfg.Addr, 5*time.Second, nil)
+}
+
+// checkApps checks that the applications advertised to the peer are in the
+// dictionaries of parser.
+func (p *Peer) checkApps(parser *dict.Parser) error {
+	for _, id := range p.cfg.AuthAppIDs {
+		if _, err := parser.App(id); err != nil {
+			return fmt.Errorf("auth application %d is not in the dictionaries", id)
+		}
+	}
+	for _, id := range p.cfg.AcctAppIDs {
+		if _, err := parser.App(id); err != nil {
+			return fmt.Errorf("acct application %d is not in the dictionaries", id)
+		}
+	}
+	return nil
+}
+
+func (p *Peer) setConn(c diam.Conn, meta *smpeer.Metadata) {
+	p.mu.Lock()
+	p.conn = c
+	p.meta = meta
+	p.mu.Unlock()
+}
+
+func (p *Peer) setState(state PeerState) {
+	p.mu.Lock()
+	p.state = state
+	p.mu.Unlock()
+}
+
+// SendRequest writes a request originated by the agent (RAR, ASR, CLR...)
+// to the peer and waits for the matching answer.
+func (p *Peer) SendRequest(ctx context.Context, m *diam.Message) (*diam.Message, error) {
+	c, ok := p.Conn()
+	if !ok {
+		return nil, ErrPeerNotConnected
+	}
+	return p.txns.send(ctx, c, m)
+}
+
+// transactions correlates answers with the requests the agent originated,
+// using the Hop-by-Hop Identifier.
+type transactions struct {
+	mu      sync.Mutex
+	pending map[uint32]chan *diam.Message
+}
+
+func newTransactions() *transactions {
+	return &transactions{pending: make(map[uint32]chan *diam.Message)}
+}
+
+func (t *transactions) send(ctx context.Context, c diam.Conn, m *diam.Message) (*diam.Message, error) {
+	answerChan := make(chan *diam.Message, 1)
+	hopByHop := m.Header.HopByHopID
+	t.mu.Lock()
+	t.pending[hopByHop] = answerChan
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.pending, hopByHop)
+		t.mu.Unlock()
+	}()
+
+	if _, err := m.WriteTo(c); err != nil {
+		return nil, fmt.Errorf("failed to send request to %s: %w", c.RemoteAddr(), err)
+	}
+
+	select {
+	case a := <-answerChan:
+		return a, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (t *transactions) handleAnswer(c diam.Conn, m *diam.Message) {
+	t.mu.Lock()
+	answerChan, ok := t.pending[m.Header.HopByHopID]
+	t.mu.Unlock()
+	if !ok {
+		log.Printf("Dropping unexpected answer from %s: hop-by-hop %d", c.RemoteAddr(), m.Header.HopByHopID)
+		return
+	}
+	select {
+	case answerChan <- m:
+	default:
+	}
+}
@@ -0,0 +1,131 @@
+package diameter
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm"
+)
+
+// serveHSS answers CERs as hss.example.org on ln, and ASRs with Success.
+func serveHSS(t *testing.T, parser *dict.Parser, ln net.Listener) {
+	t.Helper()
+	mux := sm.New(&sm.Settings{
+		OriginHost:  "hss.example.org",
+		OriginRealm: "example.net",
+		VendorID:    10415,
+		ProductName: "hss",
+	})
+	mux.HandleFunc("ASR", func(c diam.Conn, m *diam.Message) {
+		m.Answer(diam.Success).WriteTo(c)
+	})
+	srv := &diam.Server{Handler: mux, Dict: parser}
+	go srv.Serve(ln)
+	t.Cleanup(func() { ln.Close() })
+}
+
+func newOutboundPeer(t *testing.T, cfg config.PeerConfig) (*Peer, *PeerTable) {
+	parser := testParser(t)
+	dictionary := func() *dict.Parser { return parser }
+	table := NewPeerTable(testSettings, dictionary, nil, time.Hour)
+	txns := newTransactions()
+	p := NewPeer(cfg, testSettings, dictionary, table, txns, func(mux *sm.StateMachine) {
+		mux.HandleFunc("ASA", txns.handleAnswer)
+	})
+	return p, table
+}
+
+// waitState waits for p to reach state.
+func waitState(t *testing.T, p *Peer, state PeerState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for p.State() != state {
+		if time.Now().After(deadline) {
+			t.Fatalf("peer %s, want %s", p.State(), state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPeerCheckApps(t *testing.T) {
+	p, _ := newOutboundPeer(t, config.PeerConfig{Addr: "127.0.0.1:1", AuthAppIDs: []uint32{S6B_APP_ID}, AcctAppIDs: []uint32{999999}})
+	if _, err := p.dial(); err == nil || err.Error() != "acct application 999999 is not in the dictionaries" {
+		t.Errorf("dial = %v, want the unknown application refused", err)
+	}
+}
+
+// TestPeerRun checks that a peer that cannot be reached is retried, and that
+// once connected it is in the peer table and carries the agent's requests.
+func TestPeerRun(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p, table := newOutboundPeer(t, config.PeerConfig{
+		Addr:              addr,
+		VendorID:          10415,
+		AuthAppIDs:        []uint32{S6B_APP_ID},
+		ReconnectInterval: 1,
+	})
+	if p.Addr() != addr || p.OriginHost() != "" || p.State() != PeerClosed {
+		t.Errorf("new peer = %s %q %s", p.Addr(), p.OriginHost(), p.State())
+	}
+	asr := diam.NewRequest(diam.AbortSession, 0, testParser(t))
+	if _, err := p.SendRequest(context.Background(), asr); !errors.Is(err, ErrPeerNotConnected) {
+		t.Errorf("SendRequest = %v before connecting, want %v", err, ErrPeerNotConnected)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+	// Let the first attempt fail before the peer starts listening.
+	time.Sleep(100 * time.Millisecond)
+	ln, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveHSS(t, testParser(t), ln)
+
+	waitState(t, p, PeerIOpen)
+	if p.OriginHost() != "hss.example.org" || p.OriginRealm() != "example.net" {
+		t.Errorf("peer identity = %q %q, want the one of its CEA", p.OriginHost(), p.OriginRealm())
+	}
+	if entry, ok := table.Get("hss.example.org"); !ok || entry.Inbound || entry.State != PeerIOpen {
+		t.Errorf("peer table entry = %+v, want it I-Open", entry)
+	}
+	reqCtx, reqCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer reqCancel()
+	asa, err := p.SendRequest(reqCtx, asr)
+	if err != nil {
+		t.Fatalf("SendRequest: %v", err)
+	}
+	if code := resultCode(t, asa); code != diam.Success {
+		t.Errorf("ASA Result-Code = %d, want %d", code, diam.Success)
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return once cancelled")
+	}
+	if _, ok := p.Conn(); ok || p.State() != PeerClosed {
+		t.Errorf("peer %s after Run returned, want it closed", p.State())
+	}
+	if _, ok := table.Get("hss.example.org"); ok {
+		t.Errorf("closed peer still in the table")
+	}
+}
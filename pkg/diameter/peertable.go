@@ -0,0 +1,502 @@
+package diameter
+
+import (
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smparser"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smpeer"
+)
+
+// PeerState is the peer state of RFC 6733 section 5.6.
+type PeerState int
+
+const (
+	PeerClosed PeerState = iota
+	PeerWaitConnAck
+	PeerWaitICEA
+	PeerROpen
+	PeerIOpen
+	PeerClosing
+)
+
+func (s PeerState) String() string {
+	switch s {
+	case PeerClosed:
+		return "Closed"
+	case PeerWaitConnAck:
+		return "Wait-Conn-Ack"
+	case PeerWaitICEA:
+		return "Wait-I-CEA"
+	case PeerROpen:
+		return "R-Open"
+	case PeerIOpen:
+		return "I-Open"
+	case PeerClosing:
+		return "Closing"
+	}
+	return "Unknown"
+}
+
+// WatchdogState is the watchdog state of RFC 3539 section 3.4.
+type WatchdogState int
+
+const (
+	WatchdogOkay WatchdogState = iota
+	WatchdogSuspect
+	WatchdogDown
+)
+
+func (s WatchdogState) String() string {
+	switch s {
+	case WatchdogOkay:
+		return "OKAY"
+	case WatchdogSuspect:
+		return "SUSPECT"
+	case WatchdogDown:
+		return "DOWN"
+	}
+	return "Unknown"
+}
+
+// PeerEntry is a snapshot of a peer in the peer table.
+type PeerEntry struct {
+	OriginHost   datatype.DiameterIdentity
+	OriginRealm  datatype.DiameterIdentity
+	RemoteAddr   string
+	Inbound      bool
+	State        PeerState
+	Watchdog     WatchdogState
+	Applications []uint32
+	ConnectedAt  time.Time
+	LastActivity time.Time
+}
+
+type peerEntry struct {
+	PeerEntry
+	conn       diam.Conn
+	pendingDWR bool
+}
+
+// PeerTable tracks the connected Diameter peers keyed by Origin-Host,
+// enforces the peer allowlist on CER and runs the watchdog of inbound
+// connections.
+type PeerTable struct {
+	settings         sm.Settings
+	dictionary       func() *dict.Parser
+	policies         []config.PeerPolicy
+	watchdogInterval time.Duration
+
+	mu    sync.RWMutex
+	peers map[datatype.DiameterIdentity]*peerEntry
+}
+
+func NewPeerTable(settings sm.Settings, dictionary func() *dict.Parser, policies []config.PeerPolicy, watchdogInterval time.Duration) *PeerTable {
+	if watchdogInterval <= 0 {
+		watchdogInterval = defaultWatchdogInterval
+	}
+	return &PeerTable{
+		settings:         settings,
+		dictionary:       dictionary,
+		policies:         policies,
+		watchdogInterval: watchdogInterval,
+		peers:            make(map[datatype.DiameterIdentity]*peerEntry),
+	}
+}
+
+// Authorize returns the policy permitting a peer with the given identity and
+// remote address. When no allowlist is configured any peer is accepted.
+func (t *PeerTable) Authorize(host, realm datatype.DiameterIdentity, addr net.Addr) (*config.PeerPolicy, bool) {
+	if len(t.policies) == 0 {
+		return nil, true
+	}
+	for i := range t.policies {
+		policy := &t.policies[i]
+		if !strings.EqualFold(policy.OriginHost, string(host)) {
+			continue
+		}
+		if policy.OriginRealm != "" && !strings.EqualFold(policy.OriginRealm, string(realm)) {
+			continue
+		}
+		if len(policy.IPs) > 0 && !addrAllowed(addr, policy.IPs) {
+			continue
+		}
+		return policy, true
+	}
+	return nil, false
+}
+
+// addrAllowed checks every address of a (possibly multi-homed SCTP) remote
+// address against a list of IPs or CIDR prefixes.
+func addrAllowed(addr net.Addr, allowed []string) bool {
+	if addr == nil {
+		return false
+	}
+	hosts := addr.String()
+	if h, _, err := net.SplitHostPort(hosts); err == nil {
+		hosts = h
+	}
+	for _, host := range strings.Split(hosts, "/") {
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		for _, entry := range allowed {
+			if strings.Contains(entry, "/") {
+				if _, prefix, err := net.ParseCIDR(entry); err == nil && prefix.Contains(ip) {
+					return true
+				}
+			} else if allowedIP := net.ParseIP(entry); allowedIP != nil && allowedIP.Equal(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Open records a peer that completed the capabilities exchange. An older
+// connection from the same Origin-Host is closed in favour of the new one.
+func (t *PeerTable) Open(c diam.Conn, meta *smpeer.Metadata, inbound bool) {
+	if meta == nil {
+		return
+	}
+	state := PeerIOpen
+	if inbound {
+		state = PeerROpen
+	}
+	now := time.Now()
+	entry := &peerEntry{
+		PeerEntry: PeerEntry{
+			OriginHost:   meta.OriginHost,
+			OriginRealm:  meta.OriginRealm,
+			RemoteAddr:   c.RemoteAddr().String(),
+			Inbound:      inbound,
+			State:        state,
+			Watchdog:     WatchdogOkay,
+			Applications: meta.Applications,
+			ConnectedAt:  now,
+			LastActivity: now,
+		},
+		conn: c,
+	}
+
+	t.mu.Lock()
+	old, exists := t.peers[meta.OriginHost]
+	t.peers[meta.OriginHost] = entry
+	t.mu.Unlock()
+
+	if exists && old.conn != c {
+		log.Printf("Replacing connection of diameter peer %s from %s", string(meta.OriginHost), old.RemoteAddr)
+		old.conn.Close()
+	}
+	log.Printf("Diameter peer %s (%s) is %s", string(meta.OriginHost), entry.RemoteAddr, state)
+}
+
+// Closed removes the peer if c is still its current connection.
+func (t *PeerTable) Closed(c diam.Conn, meta *smpeer.Metadata) {
+	if meta == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, ok := t.peers[meta.OriginHost]; ok && entry.conn == c {
+		delete(t.peers, meta.OriginHost)
+		log.Printf("Diameter peer %s is %s", string(meta.OriginHost), PeerClosed)
+	}
+}
+
+// SetState updates the state of a peer, e.g. to Closing on DPR.
+func (t *PeerTable) SetState(host datatype.DiameterIdentity, state PeerState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, ok := t.peers[host]; ok {
+		entry.State = state
+	}
+}
+
+// Touch records traffic from the peer, which resets its watchdog timer.
+func (t *PeerTable) Touch(host datatype.DiameterIdentity) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, ok := t.peers[host]; ok {
+		entry.LastActivity = time.Now()
+		entry.pendingDWR = false
+		entry.Watchdog = WatchdogOkay
+	}
+}
+
+// Get returns a snapshot of the peer with the given Origin-Host.
+func (t *PeerTable) Get(host datatype.DiameterIdentity) (PeerEntry, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	entry, ok := t.peers[host]
+	if !ok {
+		return PeerEntry{}, false
+	}
+	return entry.PeerEntry, true
+}
+
+// List returns a snapshot of every peer in the table.
+func (t *PeerTable) List() []PeerEntry {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	entries := make([]PeerEntry, 0, len(t.peers))
+	for _, entry := range t.peers {
+		entries = append(entries, entry.PeerEntry)
+	}
+	return entries
+}
+
+// Conn returns the open connection to the peer with the given Origin-Host.
+func (t *PeerTable) Conn(host datatype.DiameterIdentity) (diam.Conn, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	entry, ok := t.peers[host]
+	if !ok || (entry.State != PeerROpen && entry.State != PeerIOpen) {
+		return nil, false
+	}
+	return entry.conn, true
+}
+
+// HandleCER performs the capabilities exchange for inbound connections in
+// place of the go-diameter state machine, so that unknown peers can be
+// rejected and each peer only sees the applications it is permitted to use.
+func (t *PeerTable) HandleCER(c diam.Conn, m *diam.Message) {
+	if _, ok := smpeer.FromContext(c.Context()); ok {
+		// Ignore retransmission.
+		return
+	}
+
+	cer := new(smparser.CER)
+	_, parseErr := cer.Parse(m, smparser.Server)
+	if len(cer.OriginHost) == 0 || len(cer.OriginRealm) == 0 {
+		log.Printf("Rejecting CER from %s: %v", c.RemoteAddr(), parseErr)
+		t.sendCEA(c, m, cer, diam.MissingAVP, nil)
+		c.Close()
+		return
+	}
+
+	policy, ok := t.Authorize(cer.OriginHost, cer.OriginRealm, c.RemoteAddr())
+	if !ok {
+		log.Printf("Rejecting CER from unknown peer %s (%s) at %s", string(cer.OriginHost), string(cer.OriginRealm), c.RemoteAddr())
+		t.sendCEA(c, m, cer, diam.UnknownPeer, nil)
+		c.Close()
+		return
+	}
+
+	switch parseErr {
+	case nil:
+	case smparser.ErrNoCommonSecurity:
+		t.sendCEA(c, m, cer, diam.NoCommonSecurity, nil)
+		c.Close()
+		return
+	case smparser.ErrNoCommonApplication:
+		t.sendCEA(c, m, cer, diam.NoCommonApplication, nil)
+		c.Close()
+		return
+	default:
+		log.Printf("Rejecting CER from %s: %v", string(cer.OriginHost), parseErr)
+		t.sendCEA(c, m, cer, diam.UnableToComply, nil)
+		c.Close()
+		return
+	}
+
+	apps := advertisedApps(policy, t.dictionary())
+	common := commonApps(cer.Applications(), apps)
+	if len(common) == 0 {
+		log.Printf("Rejecting CER from %s: no common application", string(cer.OriginHost))
+		t.sendCEA(c, m, cer, diam.NoCommonApplication, nil)
+		c.Close()
+		return
+	}
+
+	if err := t.sendCEA(c, m, cer, diam.Success, apps); err != nil {
+		log.Printf("Failed to send CEA to %s: %v", string(cer.OriginHost), err)
+		return
+	}
+
+	meta := &smpeer.Metadata{
+		OriginHost:   cer.OriginHost,
+		OriginRealm:  cer.OriginRealm,
+		Applications: common,
+	}
+	c.SetContext(smpeer.NewContext(c.Context(), meta))
+	t.Open(c, meta, true)
+
+	go t.watchdog(c, meta)
+}
+
+// advertisedApps returns the applications advertised in the CEA: those of
+// the peer policy if it lists any, otherwise every application of the
+// dictionaries of parser.
+func advertisedApps(policy *config.PeerPolicy, parser *dict.Parser) []*sm.SupportedApp {
+	if policy == nil || (len(policy.AuthAppIDs) == 0 && len(policy.AcctAppIDs) == 0) {
+		return sm.PrepareSupportedApps(parser)
+	}
+	var apps []*sm.SupportedApp
+	for _, id := range policy.AuthAppIDs {
+		apps = append(apps, &sm.SupportedApp{ID: id, AppType: "auth", Vendor: policy.VendorID})
+	}
+	for _, id := range policy.AcctAppIDs {
+		apps = append(apps, &sm.SupportedApp{ID: id, AppType: "acct", Vendor: policy.VendorID})
+	}
+	return apps
+}
+
+func commonApps(requested []uint32, supported []*sm.SupportedApp) []uint32 {
+	var common []uint32
+	for _, id := range requested {
+		for _, app := range supported {
+			if app.ID == id || id == 0xffffffff {
+				common = append(common, id)
+				break
+			}
+		}
+	}
+	return common
+}
+
+func (t *PeerTable) sendCEA(c diam.Conn, m *diam.Message, cer *smparser.CER, resultCode uint32, apps []*sm.SupportedApp) error {
+	a := m.Answer(resultCode)
+	if resultCode != diam.Success {
+		a.Header.CommandFlags |= diam.ErrorFlag
+	}
+	a.NewAVP(avp.OriginHost, avp.Mbit, 0, t.settings.OriginHost)
+	a.NewAVP(avp.OriginRealm, avp.Mbit, 0, t.settings.OriginRealm)
+	for _, hostAddress := range t.hostAddresses(c) {
+		a.NewAVP(avp.HostIPAddress, avp.Mbit, 0, hostAddress)
+	}
+	a.NewAVP(avp.VendorID, avp.Mbit, 0, t.settings.VendorID)
+	a.NewAVP(avp.ProductName, 0, 0, t.settings.ProductName)
+	if cer.OriginStateID != nil {
+		a.AddAVP(cer.OriginStateID)
+	}
+	for _, app := range apps {
+		typ := uint32(avp.AuthApplicationID)
+		if app.AppType == "acct" {
+			typ = avp.AcctApplicationID
+		}
+		if app.Vendor != 0 {
+			a.NewAVP(avp.SupportedVendorID, avp.Mbit, 0, datatype.Unsigned32(app.Vendor))
+			a.NewAVP(avp.VendorSpecificApplicationID, avp.Mbit, 0, &diam.GroupedAVP{
+				AVP: []*diam.AVP{
+					diam.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(app.Vendor)),
+					diam.NewAVP(typ, avp.Mbit, 0, datatype.Unsigned32(app.ID)),
+				},
+			})
+		} else {
+			a.NewAVP(typ, avp.Mbit, 0, datatype.Unsigned32(app.ID))
+		}
+	}
+	if t.settings.FirmwareRevision != 0 {
+		a.NewAVP(avp.FirmwareRevision, 0, 0, t.settings.FirmwareRevision)
+	}
+	_, err := a.WriteTo(c)
+	return err
+}
+
+func (t *PeerTable) hostAddresses(c diam.Conn) []datatype.Address {
+	if len(t.settings.HostIPAddresses) > 0 {
+		return t.settings.HostIPAddresses
+	}
+	var addresses []datatype.Address
+	if c.LocalAddr() == nil {
+		return addresses
+	}
+	hosts := c.LocalAddr().String()
+	if h, _, err := net.SplitHostPort(hosts); err == nil {
+		hosts = h
+	}
+	for _, host := range strings.Split(hosts, "/") {
+		if ip := net.ParseIP(host); ip != nil {
+			addresses = append(addresses, datatype.Address(ip))
+		}
+	}
+	return addresses
+}
+
+// HandleDWA clears the outstanding watchdog of an inbound peer.
+func (t *PeerTable) HandleDWA(c diam.Conn, m *diam.Message) {
+	meta, ok := smpeer.FromContext(c.Context())
+	if !ok {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if entry, ok := t.peers[meta.OriginHost]; ok && entry.conn == c {
+		entry.pendingDWR = false
+		entry.Watchdog = WatchdogOkay
+		entry.LastActivity = time.Now()
+	}
+}
+
+// watchdog implements the RFC 3539 algorithm for an inbound connection: a
+// DWR is sent after Tw without traffic, the peer becomes SUSPECT when it
+// stays unanswered and the connection is closed after another Tw.
+func (t *PeerTable) watchdog(c diam.Conn, meta *smpeer.Metadata) {
+	disconnect := c.(diam.CloseNotifier).CloseNotify()
+	defer t.Closed(c, meta)
+	for {
+		// Jitter of +/- 2 seconds as recommended by RFC 3539.
+		jitter := time.Duration(rand.Int63n(int64(4*time.Second))) - 2*time.Second
+		select {
+		case <-disconnect:
+			return
+		case <-time.After(t.watchdogInterval + jitter):
+		}
+
+		t.mu.Lock()
+		entry, ok := t.peers[meta.OriginHost]
+		if !ok || entry.conn != c {
+			t.mu.Unlock()
+			return
+		}
+		if time.Since(entry.LastActivity) < t.watchdogInterval && !entry.pendingDWR {
+			t.mu.Unlock()
+			continue
+		}
+		var down, send bool
+		switch {
+		case !entry.pendingDWR:
+			entry.pendingDWR = true
+			send = true
+		case entry.Watchdog == WatchdogOkay:
+			entry.Watchdog = WatchdogSuspect
+			log.Printf("Diameter peer %s is %s", string(meta.OriginHost), WatchdogSuspect)
+		default:
+			entry.Watchdog = WatchdogDown
+			down = true
+		}
+		t.mu.Unlock()
+
+		if send {
+			if _, err := t.makeDWR().WriteTo(c); err != nil {
+				log.Printf("Failed to send DWR to %s: %v", string(meta.OriginHost), err)
+			}
+		}
+		if down {
+			log.Printf("Diameter peer %s is %s, closing connection", string(meta.OriginHost), WatchdogDown)
+			c.Close()
+			return
+		}
+	}
+}
+
+func (t *PeerTable) makeDWR() *diam.Message {
+	m := diam.NewRequest(diam.DeviceWatchdog, 0, t.dictionary())
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, t.settings.OriginHost)
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, t.settings.OriginRealm)
+	m.NewAVP(avp.OriginStateID, avp.Mbit, 0, t.settings.OriginStateID)
+	return m
+}
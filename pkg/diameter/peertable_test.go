@@ -0,0 +1,227 @@
+package diameter
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smpeer"
+)
+
+// peerConn is an inbound connection the peer table can open, watch and
+// close.
+type peerConn struct {
+	testConn
+	ctxMu  sync.Mutex
+	once   sync.Once
+	closed chan struct{}
+}
+
+func newPeerConn(t *testing.T) *peerConn {
+	return &peerConn{testConn: testConn{parser: testParser(t)}, closed: make(chan struct{})}
+}
+
+func (c *peerConn) Close()                         { c.once.Do(func() { close(c.closed) }) }
+func (c *peerConn) CloseNotify() <-chan struct{}   { return c.closed }
+func (c *peerConn) SetContext(ctx context.Context) { c.ctxMu.Lock(); c.ctx = ctx; c.ctxMu.Unlock() }
+
+func (c *peerConn) Context() context.Context {
+	c.ctxMu.Lock()
+	defer c.ctxMu.Unlock()
+	return c.testConn.Context()
+}
+
+func (c *peerConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// sctpAddr is the remote address of a multi-homed SCTP association.
+type sctpAddr string
+
+func (a sctpAddr) Network() string { return "sctp" }
+func (a sctpAddr) String() string  { return string(a) }
+
+func TestPeerTableAuthorize(t *testing.T) {
+	table := NewPeerTable(testSettings, nil, []config.PeerPolicy{
+		{OriginHost: "pgw.example.org", OriginRealm: "example.net", IPs: []string{"10.0.0.0/24", "192.0.2.7"}},
+		{OriginHost: "smf.example.org"},
+	}, time.Hour)
+	tests := []struct {
+		host, realm string
+		addr        net.Addr
+		allowed     bool
+	}{
+		{"pgw.example.org", "example.net", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5)}, true},
+		{"PGW.example.org", "EXAMPLE.net", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 7)}, true},
+		{"pgw.example.org", "example.net", sctpAddr("172.16.0.1/10.0.0.9:3868"), true},
+		{"pgw.example.org", "example.net", &net.TCPAddr{IP: net.IPv4(10, 0, 1, 5)}, false},
+		{"pgw.example.org", "other.net", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5)}, false},
+		{"smf.example.org", "any.net", &net.TCPAddr{IP: net.IPv4(203, 0, 113, 1)}, true},
+		{"unknown.example.org", "example.net", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5)}, false},
+	}
+	for _, tt := range tests {
+		if _, ok := table.Authorize(datatype.DiameterIdentity(tt.host), datatype.DiameterIdentity(tt.realm), tt.addr); ok != tt.allowed {
+			t.Errorf("Authorize(%s, %s, %s) = %t, want %t", tt.host, tt.realm, tt.addr, ok, tt.allowed)
+		}
+	}
+
+	open := NewPeerTable(testSettings, nil, nil, time.Hour)
+	if _, ok := open.Authorize("anyone.example.org", "example.net", nil); !ok {
+		t.Errorf("peer refused without an allowlist")
+	}
+}
+
+// cer is a CER from host, listing apps as Auth-Application-Ids.
+func cer(parser *dict.Parser, host string, apps ...uint32) *diam.Message {
+	m := diam.NewRequest(diam.CapabilitiesExchange, 0, parser)
+	if host != "" {
+		m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity(host))
+	}
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.net"))
+	m.NewAVP(avp.HostIPAddress, avp.Mbit, 0, datatype.Address(net.IPv4(127, 0, 0, 2)))
+	m.NewAVP(avp.VendorID, avp.Mbit, 0, datatype.Unsigned32(10415))
+	m.NewAVP(avp.ProductName, 0, 0, datatype.UTF8String("pgw"))
+	for _, app := range apps {
+		m.NewAVP(avp.AuthApplicationID, avp.Mbit, 0, datatype.Unsigned32(app))
+	}
+	return m
+}
+
+func TestHandleCER(t *testing.T) {
+	parser := testParser(t)
+	policies := []config.PeerPolicy{{OriginHost: "pgw.example.org", AuthAppIDs: []uint32{S6B_APP_ID}}}
+	tests := []struct {
+		name       string
+		cer        *diam.Message
+		resultCode uint32
+	}{
+		{"allowed", cer(parser, "pgw.example.org", S6B_APP_ID, 4), diam.Success},
+		{"unknown peer", cer(parser, "rogue.example.org", S6B_APP_ID), diam.UnknownPeer},
+		{"application not permitted", cer(parser, "pgw.example.org", 4), diam.NoCommonApplication},
+		{"no Origin-Host", cer(parser, "", S6B_APP_ID), diam.MissingAVP},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			table := NewPeerTable(testSettings, func() *dict.Parser { return parser }, policies, time.Hour)
+			c := newPeerConn(t)
+			defer c.Close()
+			table.HandleCER(c, tt.cer)
+
+			cea := c.answer(t)
+			if code := resultCode(t, cea); code != tt.resultCode {
+				t.Fatalf("Result-Code = %d, want %d", code, tt.resultCode)
+			}
+			entry, open := table.Get("pgw.example.org")
+			if tt.resultCode != diam.Success {
+				if open || !c.isClosed() {
+					t.Errorf("rejected peer in the table = %t, connection closed = %t", open, c.isClosed())
+				}
+				return
+			}
+			if !open || entry.State != PeerROpen || !entry.Inbound || len(entry.Applications) != 1 || entry.Applications[0] != S6B_APP_ID {
+				t.Errorf("peer = %+v, want it R-Open with S6b only", entry)
+			}
+			// Only the applications of its policy are advertised.
+			apps, _ := cea.FindAVPs(avp.AuthApplicationID, 0)
+			if len(apps) != 1 || apps[0].Data.(datatype.Unsigned32) != S6B_APP_ID {
+				t.Errorf("CEA advertises %v, want S6b", apps)
+			}
+			if meta, ok := smpeer.FromContext(c.Context()); !ok || meta.OriginHost != "pgw.example.org" {
+				t.Errorf("connection metadata = %+v", meta)
+			}
+		})
+	}
+}
+
+func TestPeerTableOpen(t *testing.T) {
+	table := NewPeerTable(testSettings, nil, nil, time.Hour)
+	meta := &smpeer.Metadata{OriginHost: "pgw.example.org", OriginRealm: "example.net"}
+	first, second := newPeerConn(t), newPeerConn(t)
+
+	table.Open(first, meta, false)
+	if entry, ok := table.Get("pgw.example.org"); !ok || entry.State != PeerIOpen || entry.Inbound {
+		t.Fatalf("peer = %+v, want it I-Open", entry)
+	}
+	table.Open(second, meta, true)
+	if !first.isClosed() {
+		t.Errorf("replaced connection left open")
+	}
+	if c, ok := table.Conn("pgw.example.org"); !ok || c != second {
+		t.Errorf("Conn = %v, want the new connection", c)
+	}
+	// The replaced connection closing leaves the peer alone.
+	table.Closed(first, meta)
+	if len(table.List()) != 1 {
+		t.Errorf("peer removed by its replaced connection")
+	}
+
+	table.SetState("pgw.example.org", PeerClosing)
+	if _, ok := table.Conn("pgw.example.org"); ok {
+		t.Errorf("Conn of a closing peer")
+	}
+	table.Closed(second, meta)
+	if _, ok := table.Get("pgw.example.org"); ok {
+		t.Errorf("closed peer still in the table")
+	}
+}
+
+// TestPeerTableWatchdog checks that an inbound peer that stops answering
+// DWRs goes SUSPECT and then DOWN, and that its connection is closed.
+func TestPeerTableWatchdog(t *testing.T) {
+	parser := testParser(t)
+	table := NewPeerTable(testSettings, func() *dict.Parser { return parser }, nil, 10*time.Millisecond)
+	c := newPeerConn(t)
+	table.HandleCER(c, cer(parser, "pgw.example.org", S6B_APP_ID))
+	if code := resultCode(t, c.answer(t)); code != diam.Success {
+		t.Fatalf("CEA Result-Code = %d", code)
+	}
+
+	select {
+	case <-c.closed:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("connection of a silent peer not closed")
+	}
+	dwr := c.answer(t)
+	if dwr.Header.CommandCode != diam.DeviceWatchdog || dwr.Header.CommandFlags&diam.RequestFlag == 0 {
+		t.Errorf("sent %v, want a DWR", dwr)
+	}
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if _, ok := table.Get("pgw.example.org"); !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("peer kept in the table after its connection closed")
+}
+
+func TestHandleDWA(t *testing.T) {
+	parser := testParser(t)
+	table := NewPeerTable(testSettings, func() *dict.Parser { return parser }, nil, time.Hour)
+	c := newPeerConn(t)
+	meta := &smpeer.Metadata{OriginHost: "pgw.example.org", OriginRealm: "example.net"}
+	c.SetContext(smpeer.NewContext(context.Background(), meta))
+	table.Open(c, meta, true)
+	table.mu.Lock()
+	table.peers["pgw.example.org"].pendingDWR = true
+	table.peers["pgw.example.org"].Watchdog = WatchdogSuspect
+	table.mu.Unlock()
+
+	table.HandleDWA(c, table.makeDWR().Answer(diam.Success))
+	if entry, _ := table.Get("pgw.example.org"); entry.Watchdog != WatchdogOkay {
+		t.Errorf("watchdog = %s after the DWA, want %s", entry.Watchdog, WatchdogOkay)
+	}
+}
@@ -0,0 +1,266 @@
+package diameter
+
+import (
+	"encoding/binary"
+	"log"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+const (
+	defaultIPv6PrefixLength = 64
+
+	// Framed-IPv6-Prefix (RFC 7155 section 4.4.10.5.2) and Service-Selection
+	// (RFC 5778 section 6.2)
+	avpFramedIPv6Prefix = 97
+	avpServiceSelection = 493
+
+	// Delegated IPv6 prefixes are counted in a uint32.
+	maxIPv6Prefixes = 1 << 32
+)
+
+// Pools allocates addresses to sessions the AAA server accepted without a
+// Framed-IP-Address. A pool serves the sessions of its APN and realm, or of
+// any APN or realm when they are empty; the first matching pool is used.
+type Pools struct {
+	mu    sync.Mutex
+	pools []*pool
+}
+
+type pool struct {
+	name  string
+	apn   string
+	realm string
+
+	// IPv4 hosts are base+1 to base+v4Size (the network and broadcast
+	// addresses are skipped), in use by the Session-Id in v4Used.
+	v4Base uint32
+	v4Size uint32
+	v4Next uint32
+	v4Used map[uint32]string
+
+	// IPv6 prefixes of v6Length bits are delegated out of v6Prefix.
+	v6Prefix *net.IPNet
+	v6Length int
+	v6Size   uint64
+	v6Next   uint64
+	v6Used   map[uint64]string
+}
+
+func NewPools(cfgs []config.PoolConfig) *Pools {
+	p := &Pools{}
+	for _, cfg := range cfgs {
+		pl := &pool{
+			name:   cfg.Name,
+			apn:    cfg.APN,
+			realm:  cfg.Realm,
+			v4Used: make(map[uint32]string),
+			v6Used: make(map[uint64]string),
+		}
+		if cfg.IPv4 != "" {
+			if _, network, err := net.ParseCIDR(cfg.IPv4); err != nil || network.IP.To4() == nil {
+				log.Printf("Ignoring invalid ipv4 range %q of pool %s", cfg.IPv4, cfg.Name)
+			} else {
+				ones, bits := network.Mask.Size()
+				size := uint64(1) << (bits - ones)
+				pl.v4Base = binary.BigEndian.Uint32(network.IP.To4())
+				if size > 2 {
+					pl.v4Size = uint32(size - 2)
+				}
+			}
+		}
+		if cfg.IPv6Prefix != "" {
+			length := cfg.IPv6PrefixLength
+			if length == 0 {
+				length = defaultIPv6PrefixLength
+			}
+			_, network, err := net.ParseCIDR(cfg.IPv6Prefix)
+			ones, bits := 0, 0
+			if err == nil {
+				ones, bits = network.Mask.Size()
+			}
+			if err != nil || bits != 128 || length < ones || length > 128 {
+				log.Printf("Ignoring invalid ipv6 prefix %q/%d of pool %s", cfg.IPv6Prefix, length, cfg.Name)
+			} else {
+				pl.v6Prefix = network
+				pl.v6Length = length
+				pl.v6Size = maxIPv6Prefixes
+				if length-ones < 32 {
+					pl.v6Size = uint64(1) << (length - ones)
+				}
+			}
+		}
+		log.Printf("Address pool %s has %d IPv4 addresses and %d IPv6 prefixes", pl.name, pl.v4Size, pl.v6Size)
+		p.pools = append(p.pools, pl)
+	}
+	return p
+}
+
+// Allocate assigns an IPv4 address and an IPv6 prefix, from the pools that
+// have them, to the session. It returns false when no pool matches or the
+// matching pool is exhausted.
+func (p *Pools) Allocate(sessionID, apn, realm string) (name string, ip net.IP, prefix string, ok bool) {
+	if p == nil {
+		return "", nil, "", false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pl := range p.pools {
+		if !pl.matches(apn, realm) {
+			continue
+		}
+		ip = pl.allocateIPv4(sessionID)
+		prefix = pl.allocateIPv6(sessionID)
+		if ip == nil && prefix == "" {
+			log.Printf("Address pool %s is exhausted", pl.name)
+			return "", nil, "", false
+		}
+		return pl.name, ip, prefix, true
+	}
+	return "", nil, "", false
+}
+
+// Reserve marks the addresses of a restored session as in use.
+func (p *Pools) Reserve(session Session) {
+	p.update(session, session.ID)
+}
+
+// Release returns the addresses of a session to its pool.
+func (p *Pools) Release(session Session) {
+	p.update(session, "")
+}
+
+func (p *Pools) update(session Session, owner string) {
+	if p == nil || session.Pool == "" {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pl := range p.pools {
+		if pl.name != session.Pool {
+			continue
+		}
+		if i, ok := pl.ipv4Index(session.FramedIP); ok {
+			if owner != "" {
+				pl.v4Used[i] = owner
+			} else if pl.v4Used[i] == session.ID {
+				delete(pl.v4Used, i)
+			}
+		}
+		if i, ok := pl.ipv6Index(session.FramedIPv6Prefix); ok {
+			if owner != "" {
+				pl.v6Used[i] = owner
+			} else if pl.v6Used[i] == session.ID {
+				delete(pl.v6Used, i)
+			}
+		}
+		return
+	}
+}
+
+func (pl *pool) matches(apn, realm string) bool {
+	if pl.apn != "" && !strings.EqualFold(pl.apn, apn) {
+		return false
+	}
+	if pl.realm != "" && !strings.EqualFold(pl.realm, realm) {
+		return false
+	}
+	return true
+}
+
+func (pl *pool) allocateIPv4(sessionID string) net.IP {
+	for n := uint32(0); n < pl.v4Size; n++ {
+		i := (pl.v4Next + n) % pl.v4Size
+		if _, used := pl.v4Used[i]; used {
+			continue
+		}
+		pl.v4Used[i] = sessionID
+		pl.v4Next = (i + 1) % pl.v4Size
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, pl.v4Base+1+i)
+		return ip
+	}
+	return nil
+}
+
+func (pl *pool) ipv4Index(ip net.IP) (uint32, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil || pl.v4Size == 0 {
+		return 0, false
+	}
+	i := binary.BigEndian.Uint32(ip4) - pl.v4Base - 1
+	return i, i < pl.v4Size
+}
+
+func (pl *pool) allocateIPv6(sessionID string) string {
+	for n := uint64(0); n < pl.v6Size; n++ {
+		i := (pl.v6Next + n) % pl.v6Size
+		if _, used := pl.v6Used[i]; used {
+			continue
+		}
+		pl.v6Used[i] = sessionID
+		pl.v6Next = (i + 1) % pl.v6Size
+		offset := new(big.Int).Lsh(new(big.Int).SetUint64(i), uint(128-pl.v6Length))
+		base := new(big.Int).SetBytes(pl.v6Prefix.IP.To16())
+		prefix := &net.IPNet{
+			IP:   net.IP(new(big.Int).Add(base, offset).FillBytes(make([]byte, net.IPv6len))),
+			Mask: net.CIDRMask(pl.v6Length, 128),
+		}
+		return prefix.String()
+	}
+	return ""
+}
+
+func (pl *pool) ipv6Index(prefix string) (uint64, bool) {
+	if pl.v6Prefix == nil || prefix == "" {
+		return 0, false
+	}
+	ip, _, err := net.ParseCIDR(prefix)
+	if err != nil || !pl.v6Prefix.Contains(ip) {
+		return 0, false
+	}
+	offset := new(big.Int).Sub(new(big.Int).SetBytes(ip.To16()), new(big.Int).SetBytes(pl.v6Prefix.IP.To16()))
+	i := offset.Rsh(offset, uint(128-pl.v6Length)).Uint64()
+	return i, i < pl.v6Size
+}
+
+// poolKeys returns the APN and the realm of the User-Name of a request, which
+// select the address pool.
+func poolKeys(m *diam.Message) (apn, realm string) {
+	userName := string(findAVPBytes(m, avp.UserName))
+	if at := strings.LastIndexByte(userName, '@'); at >= 0 {
+		realm = userName[at+1:]
+	}
+	return string(findAVPBytes(m, avpServiceSelection)), realm
+}
+
+// parsePrefix returns the delegated prefix of a session, nil for none.
+func parsePrefix(prefix string) *net.IPNet {
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil
+	}
+	return network
+}
+
+// addFramedIPv6Prefix puts a delegated prefix in an answer.
+func addFramedIPv6Prefix(a *diam.Message, prefix string) {
+	network := parsePrefix(prefix)
+	if network == nil {
+		return
+	}
+	ones, _ := network.Mask.Size()
+	value := append([]byte{0, byte(ones)}, network.IP.To16()[:(ones+7)/8]...)
+	_, err := a.NewAVP(avpFramedIPv6Prefix, avp.Mbit, 0, datatype.OctetString(value))
+	if err != nil {
+		log.Printf("Error Setting FramedIPv6Prefix: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package diameter
+
+import (
+	"net"
+	"testing"
+
+	"diametertransfereagent/pkg/config"
+)
+
+func TestPools(t *testing.T) {
+	pools := NewPools([]config.PoolConfig{
+		{Name: "ims", APN: "ims", IPv6Prefix: "2001:db8:1::/48"},
+		{Name: "internet", Realm: "example.org", IPv4: "10.1.0.0/30", IPv6Prefix: "2001:db8::/62", IPv6PrefixLength: 64},
+	})
+
+	if _, _, _, ok := pools.Allocate("s;0", "internet", "example.net"); ok {
+		t.Errorf("addresses allocated from a pool of another realm")
+	}
+	name, ip, prefix, ok := pools.Allocate("s;1", "ims", "example.org")
+	if !ok || name != "ims" || ip != nil || prefix != "2001:db8:1::/64" {
+		t.Errorf("ims allocation = %s %v %q %t", name, ip, prefix, ok)
+	}
+
+	// The pool of the realm has two addresses and four prefixes.
+	sessions := make([]Session, 0, 2)
+	for _, id := range []string{"s;2", "s;3"} {
+		name, ip, prefix, ok := pools.Allocate(id, "internet", "example.org")
+		if !ok || name != "internet" || ip == nil || prefix == "" {
+			t.Fatalf("%s: allocation = %s %v %q %t", id, name, ip, prefix, ok)
+		}
+		if !(&net.IPNet{IP: net.IPv4(10, 1, 0, 0), Mask: net.CIDRMask(30, 32)}).Contains(ip) {
+			t.Errorf("%s: address %v out of the pool", id, ip)
+		}
+		if network := parsePrefix(prefix); network == nil || !(&net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(62, 128)}).Contains(network.IP) {
+			t.Errorf("%s: prefix %q out of the pool", id, prefix)
+		}
+		sessions = append(sessions, Session{ID: id, Pool: name, FramedIP: ip, FramedIPv6Prefix: prefix})
+	}
+	if sessions[0].FramedIP.Equal(sessions[1].FramedIP) || sessions[0].FramedIPv6Prefix == sessions[1].FramedIPv6Prefix {
+		t.Errorf("sessions share their addresses: %+v", sessions)
+	}
+	// With its addresses exhausted the pool still has prefixes.
+	if _, ip, prefix, ok := pools.Allocate("s;4", "internet", "example.org"); !ok || ip != nil || prefix == "" {
+		t.Errorf("allocation from exhausted addresses = %v %q %t, want a prefix only", ip, prefix, ok)
+	}
+
+	// Released addresses go to the next session; a session restored
+	// after a restart keeps its own.
+	pools.Release(sessions[0])
+	if _, ip, _, _ := pools.Allocate("s;5", "internet", "example.org"); !ip.Equal(sessions[0].FramedIP) {
+		t.Errorf("address %v allocated, want the released %v", ip, sessions[0].FramedIP)
+	}
+	restored := NewPools([]config.PoolConfig{{Name: "internet", IPv4: "10.1.0.0/30"}})
+	restored.Reserve(sessions[0])
+	restored.Reserve(sessions[1])
+	if _, _, _, ok := restored.Allocate("s;6", "internet", "example.org"); ok {
+		t.Errorf("address allocated while every address is reserved")
+	}
+}
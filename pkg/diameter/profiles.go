@@ -0,0 +1,216 @@
+package diameter
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"diametertransfereagent/pkg/config"
+	"diametertransfereagent/pkg/identity"
+	"diametertransfereagent/pkg/mapping"
+	"diametertransfereagent/pkg/radius"
+	"diametertransfereagent/pkg/radiusdict"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// Called-Station-Id (RFC 7155 section 4.2.1)
+const avpCalledStationID = 30
+
+// Profile is how the requests it selects are translated. The zero Profile
+// uses the global settings.
+type Profile struct {
+	config.ProfileConfig
+	mapper   *mapping.Mapper
+	userName *identity.Template
+}
+
+// Profiles selects the translation profile of each request, falling back
+// to the global settings when none matches.
+type Profiles struct {
+	profiles []*Profile
+	fallback *Profile
+}
+
+// NewProfiles loads the mapping rules, against the dictionaries of parser
+// and the RADIUS attributes of attributes, and User-Name templates of the
+// profiles. Those without their own use mapper and userName.
+func NewProfiles(cfgs []config.ProfileConfig, parser *dict.Parser, attributes *radiusdict.Dictionary, mapper *mapping.Mapper, userName string) (*Profiles, error) {
+	fallback := &Profile{mapper: mapper}
+	if userName != "" {
+		var err error
+		if fallback.userName, err = identity.ParseTemplate(userName); err != nil {
+			return nil, fmt.Errorf("user_name_template: %w", err)
+		}
+	}
+	p := &Profiles{fallback: fallback}
+	for _, cfg := range cfgs {
+		profile := &Profile{ProfileConfig: cfg, mapper: mapper, userName: fallback.userName}
+		var err error
+		if cfg.MappingFile != "" {
+			if profile.mapper, err = mapping.Load(cfg.MappingFile, parser, attributes); err != nil {
+				return nil, fmt.Errorf("profile %s: %w", cfg.Name, err)
+			}
+		}
+		if cfg.UserNameTemplate != "" {
+			if profile.userName, err = identity.ParseTemplate(cfg.UserNameTemplate); err != nil {
+				return nil, fmt.Errorf("profile %s: user_name_template: %w", cfg.Name, err)
+			}
+		} else if cfg.KeepRealm {
+			profile.userName = nil
+		}
+		p.profiles = append(p.profiles, profile)
+	}
+	slog.Info("Loaded translation profiles", "profiles", len(p.profiles))
+	return p, nil
+}
+
+// Select returns the first profile matching the request.
+func (p *Profiles) Select(m *diam.Message) *Profile {
+	keys := newProfileSelector(m)
+	for _, profile := range p.profiles {
+		if profile.matches(keys) {
+			return profile
+		}
+	}
+	return p.fallback
+}
+
+// Get returns the profile with the name recorded in a session.
+func (p *Profiles) Get(name string) *Profile {
+	for _, profile := range p.profiles {
+		if profile.Name == name {
+			return profile
+		}
+	}
+	return p.fallback
+}
+
+type profileSelector struct {
+	originRealm      string
+	destinationRealm string
+	apn              string
+	calledStationID  string
+	imsi             string
+}
+
+// newProfileSelector collects the values of a request profiles select on.
+func newProfileSelector(m *diam.Message) profileSelector {
+	keys := profileSelector{
+		originRealm:      string(findAVPBytes(m, avp.OriginRealm)),
+		destinationRealm: string(findAVPBytes(m, avp.DestinationRealm)),
+		apn:              string(findAVPBytes(m, avpServiceSelection)),
+		imsi:             requestIdentity(m).IMSI,
+	}
+	// Credit-Control requests carry it inside Service-Information.
+	if a, err := m.FindAVP(avpCalledStationID, 0); err == nil {
+		keys.calledStationID = string(a.Data.Serialize())
+	}
+	return keys
+}
+
+func (profile *Profile) matches(keys profileSelector) bool {
+	return matchKey(profile.OriginRealm, keys.originRealm) &&
+		matchKey(profile.DestinationRealm, keys.destinationRealm) &&
+		matchKey(profile.APN, keys.apn) &&
+		matchKey(profile.CalledStationID, keys.calledStationID) &&
+		strings.HasPrefix(keys.imsi, profile.IMSIPrefix)
+}
+
+func matchKey(want, got string) bool {
+	return want == "" || strings.EqualFold(want, got)
+}
+
+// apply sets the RADIUS servers and credentials of the profile on a
+// request. m is the Diameter request, nil for requests the agent makes up
+// itself, which keep their User-Name.
+func (profile *Profile) apply(params radius.Request, m *diam.Message) {
+	switch req := params.(type) {
+	case *radius.AuthRequest:
+		req.Servers = profile.RadiusServers
+		req.Secret = profile.RadiusSecret
+		if profile.Password != "" {
+			req.Password = profile.Password
+		}
+		if m != nil {
+			req.Username = profile.userNameOf(m, req.Username)
+		}
+	case *radius.AccRequest:
+		req.Servers = profile.RadiusServers
+		req.Secret = profile.RadiusSecret
+		if m != nil {
+			req.Username = profile.userNameOf(m, req.Username)
+		}
+	}
+}
+
+// userNameOf builds the User-Name of a request, which is name unless the
+// profile has a template or keeps the realm.
+func (profile *Profile) userNameOf(m *diam.Message, name string) string {
+	switch {
+	case profile.userName != nil:
+		userName, err := profile.userName.Execute(requestIdentity(m))
+		if err != nil {
+			slog.Error("Failed to build User-Name", "error", err)
+			return name
+		}
+		return userName
+	case profile.KeepRealm:
+		if nai := requestIdentity(m).NAI; nai != "" {
+			return nai
+		}
+	}
+	return name
+}
+
+// rejectCode is the Result-Code answered when the AAA server rejects a
+// request.
+func (profile *Profile) rejectCode() uint32 {
+	if profile.ResultCodes.Reject != 0 {
+		return profile.ResultCodes.Reject
+	}
+	return diam.AuthorizationRejected
+}
+
+// timeoutCode is the Result-Code answered when the AAA server does not
+// answer.
+func (profile *Profile) timeoutCode(messageType string) uint32 {
+	if profile.ResultCodes.Timeout != 0 {
+		return profile.ResultCodes.Timeout
+	}
+	if messageType == diam.CCR {
+		return diam.UnknownUser
+	}
+	return diam.AuthorizationRejected
+}
+
+// grantQuota replaces the units granted in a Credit-Control answer with
+// those of the profile.
+func (profile *Profile) grantQuota(a *diam.Message) {
+	quota := profile.Quota
+	if quota == (config.QuotaConfig{}) {
+		return
+	}
+	gsu, err := a.FindAVP(avp.GrantedServiceUnit, 0)
+	if err != nil {
+		return
+	}
+	group, ok := gsu.Data.(*diam.GroupedAVP)
+	if !ok {
+		return
+	}
+	// The units keep their types, so the lengths in the answer still hold.
+	for _, unit := range group.AVP {
+		switch {
+		case unit.Code == avp.CCTime && quota.Time != 0:
+			unit.Data = datatype.Unsigned32(quota.Time)
+		case unit.Code == avp.CCInputOctets && quota.InputOctets != 0:
+			unit.Data = datatype.Unsigned64(quota.InputOctets)
+		case unit.Code == avp.CCOutputOctets && quota.OutputOctets != 0:
+			unit.Data = datatype.Unsigned64(quota.OutputOctets)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package diameter
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"diametertransfereagent/pkg/config"
+	"diametertransfereagent/pkg/mapping"
+	"diametertransfereagent/pkg/radiusdict"
+	"diametertransfereagent/pkg/script"
+
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+)
+
+// Translation is what requests are translated with: the translation
+// profiles, with their mapping rules, and the script. Reload replaces it as
+// a whole; a request keeps the one it started with.
+type Translation struct {
+	Profiles *Profiles
+	Script   *script.Script
+}
+
+// newTranslation loads the translation of cfg, resolving AVP names against
+// the dictionaries of parser and RADIUS attribute names against attributes.
+func newTranslation(cfg *config.DiameterConfig, parser *dict.Parser, attributes *radiusdict.Dictionary) (*Translation, error) {
+	var mapper *mapping.Mapper
+	var err error
+	if cfg.MappingFile != "" {
+		if mapper, err = mapping.Load(cfg.MappingFile, parser, attributes); err != nil {
+			return nil, fmt.Errorf("mapping rules: %w", err)
+		}
+	}
+	t := &Translation{}
+	if t.Profiles, err = NewProfiles(cfg.Profiles, parser, attributes, mapper, cfg.UserNameTemplate); err != nil {
+		return nil, fmt.Errorf("profiles: %w", err)
+	}
+	if cfg.ScriptFile != "" {
+		if t.Script, err = script.Load(cfg.ScriptFile); err != nil {
+			return nil, fmt.Errorf("script: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// Reload loads the dictionaries again, along with the mapping rules, the
+// script and the translation profiles of cfg, and once they all load makes
+// new requests use them. The mapping rules refer to the RADIUS attributes
+// of attributes. Nothing changes when one fails to load. It returns the
+// files read.
+func (s *Server) Reload(cfg config.DiameterConfig, attributes *radiusdict.Dictionary) ([]string, error) {
+	if s.diamServer.Load() == nil {
+		return nil, errors.New("the Diameter server has not started yet")
+	}
+	parser, files, err := loadDictionary(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	translation, err := newTranslation(&cfg, parser, attributes)
+	if err != nil {
+		return nil, err
+	}
+	s.setDictionary(parser)
+	s.translation.Store(translation)
+
+	if cfg.MappingFile != "" {
+		files = append(files, cfg.MappingFile)
+	}
+	for _, profile := range cfg.Profiles {
+		if profile.MappingFile != "" {
+			files = append(files, profile.MappingFile)
+		}
+	}
+	if cfg.ScriptFile != "" {
+		files = append(files, cfg.ScriptFile)
+	}
+	slog.Info("Reloaded the translation", "files", files)
+	return files, nil
+}
+
+// setDictionary makes parser the dictionary of the connections accepted from
+// now on and of the requests the server sends. The connections open keep
+// the one they were accepted with, and outbound peers take it up when they
+// next connect but keep advertising the applications of the dictionary they
+// started with.
+func (s *Server) setDictionary(parser *dict.Parser) {
+	s.dictionary.Store(parser)
+	previous := s.diamServer.Swap(newDictServer(s.cfg.NetworkType, s.listener.Addr(), s.handler, parser))
+	previous.Close()
+}
@@ -0,0 +1,198 @@
+package diameter
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand"
+	"strings"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/sm"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smpeer"
+)
+
+const (
+	RouteActionLocal = "local"
+	RouteActionRelay = "relay"
+	RouteActionProxy = "proxy"
+
+	forwardTimeout = 10 * time.Second
+)
+
+// sendFunc sends a request to the peer with the given Origin-Host and waits
+// for the answer.
+type sendFunc func(ctx context.Context, host datatype.DiameterIdentity, m *diam.Message) (*diam.Message, error)
+
+// Router decides whether a request is translated locally or forwarded to a
+// next-hop peer, based on its Destination-Realm and Application-Id.
+type Router struct {
+	settings sm.Settings
+	routes   []config.RouteConfig
+	send     sendFunc
+}
+
+func NewRouter(settings sm.Settings, routes []config.RouteConfig, send sendFunc) *Router {
+	return &Router{settings: settings, routes: routes, send: send}
+}
+
+// Route handles requests that are not for the local realm. It returns false
+// when the request must be served by the local translation handlers. A
+// forwarded request is answered before Route returns, so it must not run in
+// the read loop of the connection.
+func (r *Router) Route(c diam.Conn, m *diam.Message) bool {
+	destRealm := destinationRealm(m)
+	if destRealm == "" || strings.EqualFold(destRealm, string(r.settings.OriginRealm)) {
+		return false
+	}
+
+	route := r.lookup(destRealm, m.Header.ApplicationID)
+	if route != nil && route.Action == RouteActionLocal {
+		return false
+	}
+
+	if r.isLoop(m) {
+		log.Printf("Loop detected for request to realm %s from %s", destRealm, c.RemoteAddr())
+		_, _ = sendReply(c, r.errorAnswer(m, diam.LoopDetected))
+		return true
+	}
+
+	if route == nil || len(route.Peers) == 0 {
+		log.Printf("No route to realm %s for application %d", destRealm, m.Header.ApplicationID)
+		_, _ = sendReply(c, r.errorAnswer(m, diam.UnableToDeliver))
+		return true
+	}
+
+	r.forward(c, m, route)
+	return true
+}
+
+func (r *Router) lookup(realm string, appID uint32) *config.RouteConfig {
+	var fallback *config.RouteConfig
+	for i := range r.routes {
+		route := &r.routes[i]
+		if route.AppID != 0 && route.AppID != appID {
+			continue
+		}
+		if strings.EqualFold(route.Realm, realm) {
+			return route
+		}
+		if route.Realm == "*" && fallback == nil {
+			fallback = route
+		}
+	}
+	return fallback
+}
+
+// isLoop reports whether the request already went through this agent.
+func (r *Router) isLoop(m *diam.Message) bool {
+	for _, a := range m.AVP {
+		if a.Code != avp.RouteRecord {
+			continue
+		}
+		if host, ok := a.Data.(datatype.DiameterIdentity); ok && strings.EqualFold(string(host), string(r.settings.OriginHost)) {
+			return true
+		}
+	}
+	return false
+}
+
+// forward sends the request to the first next hop that accepts it, with a
+// Route-Record for the peer it came from and a fresh Hop-by-Hop Identifier,
+// then returns the answer to the originator. In proxy mode the original
+// identifier travels in a Proxy-Info AVP that is removed from the answer.
+func (r *Router) forward(c diam.Conn, m *diam.Message, route *config.RouteConfig) {
+	hopByHop := m.Header.HopByHopID
+	fwd := diam.NewMessage(m.Header.CommandCode, m.Header.CommandFlags, m.Header.ApplicationID,
+		rand.Uint32(), m.Header.EndToEndID, m.Dictionary())
+	for _, a := range m.AVP {
+		fwd.AddAVP(a)
+	}
+	if meta, ok := smpeer.FromContext(c.Context()); ok {
+		fwd.NewAVP(avp.RouteRecord, avp.Mbit, 0, meta.OriginHost)
+	}
+	if route.Action == RouteActionProxy {
+		state := make([]byte, 4)
+		binary.BigEndian.PutUint32(state, hopByHop)
+		fwd.NewAVP(avp.ProxyInfo, avp.Mbit, 0, &diam.GroupedAVP{
+			AVP: []*diam.AVP{
+				diam.NewAVP(avp.ProxyHost, avp.Mbit, 0, r.settings.OriginHost),
+				diam.NewAVP(avp.ProxyState, avp.Mbit, 0, datatype.OctetString(state)),
+			},
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), forwardTimeout)
+	defer cancel()
+
+	for _, host := range route.Peers {
+		a, err := r.send(ctx, datatype.DiameterIdentity(host), fwd)
+		if errors.Is(err, ErrPeerNotConnected) {
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to forward request to %s: %v", host, err)
+			break
+		}
+
+		answer := diam.NewMessage(a.Header.CommandCode, a.Header.CommandFlags, a.Header.ApplicationID,
+			hopByHop, a.Header.EndToEndID, a.Dictionary())
+		for _, answerAVP := range a.AVP {
+			if route.Action == RouteActionProxy && r.isOwnProxyInfo(answerAVP) {
+				continue
+			}
+			answer.AddAVP(answerAVP)
+		}
+		_, _ = sendReply(c, answer)
+		return
+	}
+
+	log.Printf("Unable to deliver request to realm %s", route.Realm)
+	_, _ = sendReply(c, r.errorAnswer(m, diam.UnableToDeliver))
+}
+
+func (r *Router) isOwnProxyInfo(a *diam.AVP) bool {
+	if a.Code != avp.ProxyInfo {
+		return false
+	}
+	group, ok := a.Data.(*diam.GroupedAVP)
+	if !ok {
+		return false
+	}
+	for _, member := range group.AVP {
+		if member.Code == avp.ProxyHost {
+			host, _ := member.Data.(datatype.DiameterIdentity)
+			return strings.EqualFold(string(host), string(r.settings.OriginHost))
+		}
+	}
+	return false
+}
+
+// errorAnswer builds a protocol error answer carrying the E bit.
+func (r *Router) errorAnswer(m *diam.Message, resultCode uint32) *diam.Message {
+	a := m.Answer(resultCode)
+	a.Header.CommandFlags |= diam.ErrorFlag
+	if sessionID, err := m.FindAVP(avp.SessionID, 0); err == nil {
+		a.InsertAVP(diam.NewAVP(avp.SessionID, avp.Mbit, 0, sessionID.Data))
+	}
+	a.NewAVP(avp.OriginHost, avp.Mbit, 0, r.settings.OriginHost)
+	a.NewAVP(avp.OriginRealm, avp.Mbit, 0, r.settings.OriginRealm)
+	return a
+}
+
+func destinationRealm(m *diam.Message) string {
+	for _, a := range m.AVP {
+		if a.Code == avp.DestinationRealm {
+			if realm, ok := a.Data.(datatype.DiameterIdentity); ok {
+				return string(realm)
+			}
+		}
+	}
+	return ""
+}
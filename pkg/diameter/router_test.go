@@ -0,0 +1,220 @@
+package diameter
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"testing"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"github.com/fiorix/go-diameter/v4/diam/sm"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smpeer"
+)
+
+var testSettings = sm.Settings{
+	OriginHost:  "dta.example.org",
+	OriginRealm: "example.org",
+	VendorID:    13,
+	ProductName: "go-diameter",
+}
+
+func testParser(t *testing.T) *dict.Parser {
+	t.Helper()
+	parser, _, err := loadDictionary(&config.DiameterConfig{})
+	if err != nil {
+		t.Fatalf("loadDictionary: %v", err)
+	}
+	return parser
+}
+
+// testNextHop stands for the next-hop peers of a router: it answers what it
+// is sent with Success, echoing the Proxy-Info, unless the peer is down.
+type testNextHop struct {
+	down map[datatype.DiameterIdentity]bool
+	// release, when set, holds the answers until it is closed.
+	release chan struct{}
+
+	mu   sync.Mutex
+	sent map[datatype.DiameterIdentity]*diam.Message
+}
+
+func (n *testNextHop) send(ctx context.Context, host datatype.DiameterIdentity, m *diam.Message) (*diam.Message, error) {
+	if n.down[host] {
+		return nil, ErrPeerNotConnected
+	}
+	n.mu.Lock()
+	if n.sent == nil {
+		n.sent = make(map[datatype.DiameterIdentity]*diam.Message)
+	}
+	n.sent[host] = m
+	n.mu.Unlock()
+	if n.release != nil {
+		<-n.release
+	}
+	a := m.Answer(diam.Success)
+	a.NewAVP(avp.OriginHost, avp.Mbit, 0, host)
+	for _, proxyInfo := range m.AVP {
+		if proxyInfo.Code == avp.ProxyInfo {
+			a.AddAVP(proxyInfo)
+		}
+	}
+	return a, nil
+}
+
+func routedRequest(parser *dict.Parser, realm string, avps ...*diam.AVP) *diam.Message {
+	m := diam.NewRequest(diam.CreditControl, diam.CHARGING_CONTROL_APP_ID, parser)
+	m.Header.HopByHopID = 0x1234
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("pgw.example.org;1"))
+	m.NewAVP(avp.OriginHost, avp.Mbit, 0, datatype.DiameterIdentity("pgw.example.org"))
+	m.NewAVP(avp.OriginRealm, avp.Mbit, 0, datatype.DiameterIdentity("example.org"))
+	m.NewAVP(avp.DestinationRealm, avp.Mbit, 0, datatype.DiameterIdentity(realm))
+	for _, a := range avps {
+		m.AddAVP(a)
+	}
+	return m
+}
+
+func TestRoute(t *testing.T) {
+	parser := testParser(t)
+	routes := []config.RouteConfig{
+		{Realm: "local.example.net", Action: RouteActionLocal},
+		{Realm: "relay.example.net", Action: RouteActionRelay, Peers: []string{"down.example.net", "ocs.example.net"}},
+		{Realm: "proxy.example.net", Action: RouteActionProxy, Peers: []string{"ocs.example.net"}},
+		{Realm: "gone.example.net", Action: RouteActionRelay, Peers: []string{"down.example.net"}},
+		{Realm: "*", AppID: diam.TGPP_S6A_APP_ID, Action: RouteActionRelay, Peers: []string{"hss.example.net"}},
+	}
+
+	tests := []struct {
+		name  string
+		realm string
+		avps  []*diam.AVP
+		// routed is whether the router handles the request, code the
+		// Result-Code of its answer and peer the next hop it went to.
+		routed bool
+		code   uint32
+		peer   datatype.DiameterIdentity
+	}{
+		{name: "own realm", realm: "example.org"},
+		{name: "local route", realm: "local.example.net"},
+		{name: "relay past a peer that is down", realm: "relay.example.net", routed: true, code: diam.Success, peer: "ocs.example.net"},
+		{name: "proxy", realm: "proxy.example.net", routed: true, code: diam.Success, peer: "ocs.example.net"},
+		{name: "no connected peer", realm: "gone.example.net", routed: true, code: diam.UnableToDeliver},
+		{name: "no route", realm: "other.example.net", routed: true, code: diam.UnableToDeliver},
+		{
+			name:   "loop",
+			realm:  "relay.example.net",
+			avps:   []*diam.AVP{diam.NewAVP(avp.RouteRecord, avp.Mbit, 0, datatype.DiameterIdentity("DTA.example.org"))},
+			routed: true,
+			code:   diam.LoopDetected,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hop := &testNextHop{down: map[datatype.DiameterIdentity]bool{"down.example.net": true}}
+			r := NewRouter(testSettings, routes, hop.send)
+			c := &testConn{parser: parser, ctx: smpeer.NewContext(context.Background(), &smpeer.Metadata{OriginHost: "pgw.example.org"})}
+
+			m := routedRequest(parser, tt.realm, tt.avps...)
+			if routed := r.Route(c, m); routed != tt.routed {
+				t.Fatalf("Route = %t, want %t", routed, tt.routed)
+			}
+			if !tt.routed {
+				return
+			}
+			a := c.answer(t)
+			if code := resultCode(t, a); code != tt.code {
+				t.Errorf("Result-Code = %d, want %d", code, tt.code)
+			}
+			if a.Header.HopByHopID != m.Header.HopByHopID || a.Header.EndToEndID != m.Header.EndToEndID {
+				t.Errorf("answer identifiers = %#x %#x, want those of the request", a.Header.HopByHopID, a.Header.EndToEndID)
+			}
+			if tt.code != diam.Success {
+				if a.Header.CommandFlags&diam.ErrorFlag == 0 {
+					t.Errorf("error answer without the E bit")
+				}
+				return
+			}
+			if host, _ := a.FindAVP(avp.OriginHost, 0); host == nil || host.Data.(datatype.DiameterIdentity) != tt.peer {
+				t.Errorf("answered by %v, want %s", host, tt.peer)
+			}
+			if _, err := a.FindAVP(avp.ProxyInfo, 0); err == nil {
+				t.Errorf("answer keeps the Proxy-Info of the agent")
+			}
+
+			fwd := hop.sent[tt.peer]
+			if fwd.Header.HopByHopID == m.Header.HopByHopID {
+				t.Errorf("forwarded request keeps the Hop-by-Hop Identifier")
+			}
+			if record, err := fwd.FindAVP(avp.RouteRecord, 0); err != nil || record.Data.(datatype.DiameterIdentity) != "pgw.example.org" {
+				t.Errorf("Route-Record = %v, want the peer the request came from", record)
+			}
+			proxyInfo, err := fwd.FindAVP(avp.ProxyInfo, 0)
+			if tt.realm != "proxy.example.net" {
+				if err == nil {
+					t.Errorf("relayed request has a Proxy-Info")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("proxied request has no Proxy-Info")
+			}
+			for _, member := range proxyInfo.Data.(*diam.GroupedAVP).AVP {
+				if member.Code == avp.ProxyState && binary.BigEndian.Uint32(member.Data.Serialize()) != m.Header.HopByHopID {
+					t.Errorf("Proxy-State = %x, want the Hop-by-Hop Identifier of the request", member.Data.Serialize())
+				}
+			}
+		})
+	}
+
+	// A route for any realm only takes the requests of its application.
+	hop := &testNextHop{}
+	r := NewRouter(testSettings, routes, hop.send)
+	c := &testConn{parser: parser}
+	air := diam.NewRequest(diam.AuthenticationInformation, diam.TGPP_S6A_APP_ID, parser)
+	air.NewAVP(avp.DestinationRealm, avp.Mbit, 0, datatype.DiameterIdentity("epc.mnc001.mcc001.3gppnetwork.org"))
+	if !r.Route(c, air) || hop.sent["hss.example.net"] == nil {
+		t.Errorf("S6a request not relayed to the HSS")
+	}
+}
+
+// TestTrackedRoute checks that a forwarded request counts as in flight
+// until its answer is relayed, so that Shutdown waits for it.
+func TestTrackedRoute(t *testing.T) {
+	parser := testParser(t)
+	hop := &testNextHop{release: make(chan struct{})}
+	s := &Server{router: NewRouter(testSettings, []config.RouteConfig{{Realm: "*", Action: RouteActionRelay, Peers: []string{"ocs.example.net"}}}, hop.send)}
+	c := &testConn{parser: parser}
+
+	local := diam.HandlerFunc(func(diam.Conn, *diam.Message) { t.Errorf("request for another realm handled locally") })
+	s.tracked(s.routed(local)).ServeDIAM(c, routedRequest(parser, "other.example.net"))
+	// An unexpected request goes through the router as well.
+	s.handleALL(c, routedRequest(parser, "other.example.net"))
+
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		t.Fatalf("forwarded requests not in flight")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(hop.release)
+	select {
+	case <-drained:
+	case <-time.After(time.Second):
+		t.Fatalf("forwarded requests still in flight once answered")
+	}
+	for i := 0; i < 2; i++ {
+		if code := resultCode(t, c.answer(t)); code != diam.Success {
+			t.Errorf("Result-Code = %d, want %d", code, diam.Success)
+		}
+	}
+}
@@ -1,143 +1,316 @@
 package diameter
 
 import (
-	"bytes"
-	"flag"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"diametertransfereagent/pkg/config"
 	"diametertransfereagent/pkg/radius"
+	"diametertransfereagent/pkg/radiusdict"
 
 	"github.com/fiorix/go-diameter/v4/diam"
 	"github.com/fiorix/go-diameter/v4/diam/datatype"
 	"github.com/fiorix/go-diameter/v4/diam/dict"
 	"github.com/fiorix/go-diameter/v4/diam/sm"
+	"github.com/fiorix/go-diameter/v4/diam/sm/smpeer"
+	"layeh.com/radius/rfc2866"
 )
 
 const (
-	VENDOR_3GPP           = 10415
-	S6B_APP_ID            = 16777272
-	defaultDictionaryPath = "./dictionary/"
+	VENDOR_3GPP        = 10415
+	S6B_APP_ID         = 16777272
+	stopSessionTimeout = 5 * time.Second
 )
 
 type Server struct {
-	cfg          *config.DiameterConfig
-	requestChan  chan radius.Request
-	responseChan chan radius.Response
+	cfg         *config.DiameterConfig
+	requestChan chan radius.Request
+	peers       []*Peer
+	peerTable   *PeerTable
+	router      *Router
+	txns        *transactions
+	settings    sm.Settings
+	dictionary  atomic.Pointer[dict.Parser]
+	attributes  *radiusdict.Dictionary
+	// handler serves the inbound connections, which diamServer takes
+	// from listener.
+	handler     diam.Handler
+	diamServer  atomic.Pointer[dictServer]
+	sessions    *Sessions
+	translation atomic.Pointer[Translation]
+	// health serves the probes and metrics, and admin the management of
+	// the agent, each on its own listener when configured.
+	health       *http.ServeMux
+	healthServer *http.Server
+	admin        *http.ServeMux
+	adminServer  *http.Server
+	checks       []readinessCheck
+	listener     net.Listener
+	listening    atomic.Bool
+	stopPeers    context.CancelFunc
+
+	// inflight counts the requests being translated; once draining is set
+	// no more are accepted.
+	inflight sync.WaitGroup
+	drainMu  sync.Mutex
+	draining bool
 }
 
-func NewServer(cfg config.DiameterConfig, requestChan chan radius.Request, responseChan chan radius.Response) *Server {
-	return &Server{cfg: &cfg, requestChan: requestChan, responseChan: responseChan}
+// NewServer creates the Diameter server. Its mapping rules refer to the
+// RADIUS attributes of attributes.
+func NewServer(cfg config.DiameterConfig, attributes *radiusdict.Dictionary, requestChan chan radius.Request) *Server {
+	s := &Server{cfg: &cfg, attributes: attributes, requestChan: requestChan, txns: newTransactions(), sessions: NewSessions(NewPools(cfg.Pools))}
+	s.health = s.newHealthMux()
+	s.admin = s.newAdminMux()
+	return s
 }
 
 func (s *Server) Start() {
-	addr := flag.String("addr", s.cfg.Addr, "address in the form of ip:port to listen on")
-	ppaddr := flag.String("pprof_addr", ":9000", "address in form of ip:port for the pprof server")
-	host := flag.String("diam_host", s.cfg.DiamHost, "diameter identity host")
-	realm := flag.String("diam_realm", s.cfg.DiamRealm, "diameter identity realm")
-	certFile := flag.String("cert_file", s.cfg.CertFile, "tls certificate file (optional)")
-	keyFile := flag.String("key_file", s.cfg.KeyFile, "tls key file (optional)")
-	networkType := flag.String("network_type", s.cfg.NetworkType, "protocol type tcp/sctp")
-	flag.Parse()
-
 	settings := &sm.Settings{
-		OriginHost:       datatype.DiameterIdentity(*host),
-		OriginRealm:      datatype.DiameterIdentity(*realm),
+		OriginHost:       datatype.DiameterIdentity(s.cfg.DiamHost),
+		OriginRealm:      datatype.DiameterIdentity(s.cfg.DiamRealm),
 		VendorID:         13,
 		ProductName:      "go-diameter",
 		FirmwareRevision: 1,
+		OriginStateID:    datatype.Unsigned32(time.Now().Unix()),
 	}
 
-	customDict, err := loadCustomDictionaries()
+	s.settings = *settings
+
+	parser, _, err := loadDictionary(s.cfg)
 	if err != nil {
-		log.Fatalf("Failed to load custom dictionaries: %v", err)
+		log.Fatalf("Failed to load dictionaries: %v", err)
 	}
-	//changing default dictonary global variable
-	dict.Default = customDict
+	s.dictionary.Store(parser)
+	translation, err := newTranslation(s.cfg, parser, s.attributes)
+	if err != nil {
+		log.Fatalf("Failed to load %v", err)
+	}
+	s.translation.Store(translation)
+	s.peerTable = NewPeerTable(*settings, s.dictionary.Load, s.cfg.AllowedPeers, time.Duration(s.cfg.WatchdogInterval)*time.Second)
+	s.router = NewRouter(*settings, s.cfg.Routes, s.SendRequest)
+	// The applications of the state machine only matter to the CER handler
+	// of go-diameter, which peerHandler takes the place of.
 	mux := sm.New(settings)
+	s.registerHandlers(*settings, mux)
+	mux.HandleFunc("DWA", s.peerTable.HandleDWA)
 
-	mux.Handle("AIR", HandleAuthenticationInformation(*settings, s.requestChan, s.responseChan))
-	mux.Handle("AAR", HandleAuthorizationAuthenticationRequest(*settings, s.requestChan, s.responseChan))
-	mux.Handle("CCR", HandleCreditControlRequest(*settings, s.requestChan, s.responseChan))
-	mux.Handle("DPR", HandleDisconnectPeerRequest(*settings))
-	mux.HandleFunc("ALL", HandleALL)
+	if s.cfg.SessionStore != "" {
+		s.restoreSessions()
+	}
 
 	go PrintErrors(mux.ErrorReports())
+	go s.sessions.run(s.sessionExpired, s.sessionReAuth)
 
-	if len(*ppaddr) > 0 {
-		go func() {
-			srv := &http.Server{
-				Addr:         *ppaddr,
-				Handler:      nil,
-				ReadTimeout:  5 * time.Second,
-				WriteTimeout: 10 * time.Second,
-				IdleTimeout:  15 * time.Second,
-			}
-			log.Fatal(srv.ListenAndServe())
-		}()
+	s.startPeers(*settings)
+	s.registerMetrics()
+
+	if len(s.cfg.HealthAddr) > 0 {
+		s.healthServer = serveHTTP(s.cfg.HealthAddr, s.health)
+	}
+	if len(s.cfg.AdminAddr) > 0 {
+		s.adminServer = serveHTTP(s.cfg.AdminAddr, s.admin)
 	}
 	// Start listening for incoming connections
+	l, err := listen(s.cfg.NetworkType, s.cfg.Addr, s.cfg.CertFile, s.cfg.KeyFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.listener = l
+	s.handler = peerHandler(s.peerTable, mux)
+	s.listening.Store(true)
+	s.diamServer.Store(newDictServer(s.cfg.NetworkType, l.Addr(), s.handler, parser))
 	go func() {
-		if err := listen(*networkType, *addr, *certFile, *keyFile, mux); err != nil {
-			log.Fatal(err)
-		}
+		defer s.listening.Store(false)
+		s.serve(l)
 	}()
 
 }
 
-func listen(networkType, addr, cert, key string, handler diam.Handler) error {
+func (s *Server) registerHandlers(settings sm.Settings, mux *sm.StateMachine) {
+	mux.Handle("AIR", s.tracked(s.routed(HandleAuthenticationInformation(settings, s.sessions, s.translation.Load, s.requestChan))))
+	mux.Handle("AAR", s.tracked(s.routed(HandleAuthorizationAuthenticationRequest(settings, s.sessions, s.translation.Load, s.requestChan))))
+	mux.Handle("CCR", s.tracked(s.routed(HandleCreditControlRequest(settings, s.sessions, s.translation.Load, s.requestChan))))
+	mux.Handle("STR", s.tracked(s.routed(HandleSessionTerminationRequest(settings, s.sessions))))
+	mux.Handle("DPR", HandleDisconnectPeerRequest(settings))
+	for _, cmd := range answerCommands {
+		mux.HandleFunc(cmd, s.txns.handleAnswer)
+	}
+	mux.HandleFunc("ALL", s.handleALL)
+}
+
+// routed sends requests for other realms through the router and only lets
+// requests for our own realm reach the local translation handler. Forwarding
+// waits for the answer of the next hop, so routed runs under tracked, which
+// also keeps Shutdown from closing the peers under a forwarded request.
+func (s *Server) routed(handler diam.Handler) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		if s.router.Route(c, m) {
+			return
+		}
+		handler.ServeDIAM(c, m)
+	}
+}
+
+// handleALL delivers answers to forwarded requests and routes requests
+// that have no local handler, tracked as those that have one.
+func (s *Server) handleALL(c diam.Conn, m *diam.Message) {
+	if m.Header.CommandFlags&diam.RequestFlag == 0 {
+		s.txns.handleAnswer(c, m)
+		return
+	}
+	s.tracked(s.routed(diam.HandlerFunc(HandleALL))).ServeDIAM(c, m)
+}
+
+// startPeers dials every configured outbound peer in the background until
+// Shutdown.
+func (s *Server) startPeers(settings sm.Settings) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopPeers = cancel
+	for _, peerCfg := range s.cfg.Peers {
+		peer := NewPeer(peerCfg, settings, s.dictionary.Load, s.peerTable, s.txns, func(mux *sm.StateMachine) {
+			s.registerHandlers(settings, mux)
+			go PrintErrors(mux.ErrorReports())
+		})
+		s.peers = append(s.peers, peer)
+		go peer.Run(ctx)
+	}
+}
+
+// Peers returns the configured outbound peers.
+func (s *Server) Peers() []*Peer {
+	return s.peers
+}
+
+// PeerTable returns the table of connected peers.
+func (s *Server) PeerTable() *PeerTable {
+	return s.peerTable
+}
+
+// Peer returns the connected outbound peer advertising the given Origin-Host.
+func (s *Server) Peer(host datatype.DiameterIdentity) (*Peer, bool) {
+	for _, peer := range s.peers {
+		if peer.OriginHost() == host {
+			return peer, true
+		}
+	}
+	return nil, false
+}
+
+// SendRequest sends a server-initiated request to the peer identified by host,
+// over an outbound connection if there is one or else over the inbound
+// connection the peer opened, and waits for its answer.
+func (s *Server) SendRequest(ctx context.Context, host datatype.DiameterIdentity, m *diam.Message) (*diam.Message, error) {
+	if peer, ok := s.Peer(host); ok {
+		return peer.SendRequest(ctx, m)
+	}
+	if c, ok := s.peerTable.Conn(host); ok {
+		return s.txns.send(ctx, c, m)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrPeerNotConnected, string(host))
+}
+
+// listen opens the Diameter listener, with TLS when a certificate is set.
+func listen(networkType, addr, cert, key string) (net.Listener, error) {
 	if len(cert) > 0 && len(key) > 0 {
+		certificate, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		l, err := diam.Listen(networkType, addr)
+		if err != nil {
+			return nil, err
+		}
 		log.Println("Starting secure diameter server on", addr)
-		return diam.ListenAndServeNetworkTLS(networkType, addr, cert, key, logHandler(handler), nil)
+		return tls.NewListener(l, &tls.Config{Certificates: []tls.Certificate{certificate}}), nil
 	}
 	log.Println("Starting diameter server on", addr)
-	return diam.ListenAndServeNetwork(networkType, addr, logHandler(handler), nil)
+	return diam.MultistreamListen(networkType, addr)
 }
 
-func logHandler(handler diam.Handler) diam.HandlerFunc {
+// peerHandler runs the capabilities exchange through the peer table and
+// feeds the watchdog with the traffic of established peers.
+func peerHandler(table *PeerTable, handler diam.Handler) diam.HandlerFunc {
 	return func(c diam.Conn, m *diam.Message) {
-		if m.Header.CommandCode == diam.CapabilitiesExchange {
+		if m.Header.CommandCode == diam.CapabilitiesExchange && m.Header.CommandFlags&diam.RequestFlag != 0 {
 			log.Printf("New connection from %s", c.RemoteAddr())
+			table.HandleCER(c, m)
+			return
+		}
+		if meta, ok := smpeer.FromContext(c.Context()); ok {
+			table.Touch(meta.OriginHost)
+			if m.Header.CommandCode == diam.DisconnectPeer && m.Header.CommandFlags&diam.RequestFlag != 0 {
+				table.SetState(meta.OriginHost, PeerClosing)
+			}
 		}
 		handler.ServeDIAM(c, m)
 	}
 }
 
-func loadCustomDictionaries() (*dict.Parser, error) {
-	// List of dictionary files to load
-	dictionaries := []struct{ name, file string }{
-		{"Base", "base.xml"},
-		{"TGPP_S6a", "s6a.xml"},
-		{"TGPP_Swx", "swx.xml"},
-		{"TGPP_S6b", "s6b.xml"},
-		{"TGPP_GY", "gy.xml"},
-		{"TGPP_3GPP", "3gpp.xml"},
-	}
-
-	// Create a new parser
-	parser, err := dict.NewParser()
+// restoreSessions reloads the sessions persisted before a restart. Sessions
+// that expired meanwhile, most likely because their CCR-T or STR was missed,
+// are closed towards the AAA server with an Accounting-Stop, as is every
+// session when stop_sessions_on_restart is set.
+func (s *Server) restoreSessions() {
+	restored, err := s.sessions.Load(s.cfg.SessionStore)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create dictionary parser: %w", err)
+		log.Fatalf("Failed to load sessions from %s: %v", s.cfg.SessionStore, err)
 	}
 
-	// Load each dictionary file
-	for _, dictEntry := range dictionaries {
-		filePath := defaultDictionaryPath + dictEntry.file
-		data, err := os.ReadFile(filePath)
-		if err != nil {
-			return nil, fmt.Errorf("failed to read dictionary file %s: %w", filePath, err)
+	now := time.Now()
+	kept := 0
+	for _, session := range restored {
+		if !s.cfg.StopSessionsOnRestart && now.Before(session.Expires) {
+			kept++
+			continue
 		}
-
-		if err := parser.Load(bytes.NewReader(data)); err != nil {
-			return nil, fmt.Errorf("failed to load dictionary from file %s: %w", filePath, err)
+		s.sessions.Remove(session.ID)
+		if session.Accounting {
+			go s.stopSession(session, rfc2866.AcctTerminateCause_Value_NASReboot)
 		}
+	}
+	slog.Info("Restored sessions", "kept", kept, "restored", len(restored), "path", s.cfg.SessionStore)
+}
 
-		log.Printf("Successfully loaded dictionary from file %s", filePath)
+// stopSession sends the Accounting-Stop the Diameter peer never triggered for
+// a session, with the usage recorded up to its last request.
+func (s *Server) stopSession(session Session, cause rfc2866.AcctTerminateCause) {
+	reply := make(chan radius.Response, 1)
+	req := &radius.AccRequest{
+		Type:               radius.AccountingRequest,
+		Username:           session.UserName,
+		IMSI:               session.IMSI,
+		AcctStatus:         rfc2866.AcctStatusType_Value_Stop,
+		AcctSessionID:      session.AcctSessionID,
+		Class:              session.Class,
+		Sticky:             session.Sticky,
+		FramedIPv6Prefix:   parsePrefix(session.FramedIPv6Prefix),
+		UsedInputOctets:    session.InputOctets,
+		UsedOutputOctets:   session.OutputOctets,
+		Acctsessiontime:    uint32(session.LastSeen.Sub(session.StartTime) / time.Second),
+		AcctTerminateCause: cause,
+		Reply:              reply,
+	}
+	if session.FramedIP.To4() != nil {
+		req.Ipv4FramedIP = session.FramedIP
+	} else if session.FramedIP != nil {
+		req.Ipv6FramedIP = session.FramedIP
 	}
+	s.translation.Load().Profiles.Get(session.Profile).apply(req, nil)
 
-	return parser, nil
+	s.requestChan <- req
+	select {
+	case resp := <-reply:
+		slog.Info("Sent Accounting-Stop", "session_id", session.ID, "code", resp.GetCode().String())
+	case <-time.After(stopSessionTimeout):
+		slog.Warn("Timed out sending Accounting-Stop", "session_id", session.ID)
+	}
 }
@@ -0,0 +1,214 @@
+package diameter
+
+import (
+	"bufio"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+)
+
+const (
+	sessionRecordPut    = "put"
+	sessionRecordDelete = "del"
+
+	// The log is compacted once it holds this many records, and more than
+	// sessionLogCompactRatio records per live session.
+	sessionLogCompactRecords = 10000
+	sessionLogCompactRatio   = 4
+)
+
+// sessionLog persists the session store as an append-only file with one
+// JSON record per change. The file is compacted when it is opened and when
+// it grows past the thresholds above, since every update appends a record.
+type sessionLog struct {
+	path    string
+	f       *os.File
+	enc     *json.Encoder
+	records int
+
+	// While compacting is set, the records written are kept in pending as
+	// well, to be appended to the compacted file before it replaces the
+	// log. compacted is done once the compaction ended.
+	compacting bool
+	pending    []sessionRecord
+	compacted  sync.WaitGroup
+}
+
+type sessionRecord struct {
+	Op      string   `json:"op"`
+	ID      string   `json:"id"`
+	Session *Session `json:"session,omitempty"`
+}
+
+// openSessionLog replays the log at path, rewrites it with only the live
+// sessions and opens it for appending.
+func openSessionLog(path string) (*sessionLog, map[string]*Session, error) {
+	sessions := make(map[string]*Session)
+
+	f, err := os.Open(path)
+	if err == nil {
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			var rec sessionRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				// The last record may be torn if the process died mid-write.
+				slog.Warn("Skipping unreadable session record", "path", path, "error", err)
+				continue
+			}
+			switch rec.Op {
+			case sessionRecordPut:
+				if rec.Session != nil {
+					sessions[rec.ID] = rec.Session
+				}
+			case sessionRecordDelete:
+				delete(sessions, rec.ID)
+			}
+		}
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	if err := rewriteSessionLog(path, sessions); err != nil {
+		return nil, nil, err
+	}
+	f, err = os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &sessionLog{path: path, f: f, enc: json.NewEncoder(f), records: len(sessions)}, sessions, nil
+}
+
+// rewriteSessionLog replaces the log at path with one holding only sessions.
+func rewriteSessionLog(path string, sessions map[string]*Session) error {
+	tmp := path + ".tmp"
+	if err := writeSessionFile(tmp, sessions); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeSessionFile writes sessions to a new file at path and syncs it.
+func writeSessionFile(path string, sessions map[string]*Session) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for id, session := range sessions {
+		if err := enc.Encode(sessionRecord{Op: sessionRecordPut, ID: id, Session: session}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// compactDue reports whether the log should be compacted, given the number
+// of live sessions.
+func (l *sessionLog) compactDue(live int) bool {
+	return !l.compacting && l.records >= sessionLogCompactRecords && l.records > sessionLogCompactRatio*live
+}
+
+// compact rewrites the log with only the live sessions. mu guards the log
+// and the sessions and is held by the caller. The sessions are copied under
+// it, but written out and synced in the background: mu is taken again only
+// to append the records written meanwhile and swap the files. On failure
+// the log goes on appending to the file it had.
+func (l *sessionLog) compact(sessions map[string]*Session, mu sync.Locker) {
+	snapshot := make(map[string]*Session, len(sessions))
+	for id, session := range sessions {
+		c := session.copy()
+		snapshot[id] = &c
+	}
+	// Reset even on failure, so that a failed compaction is retried only
+	// when the log grows past the thresholds again.
+	l.records = len(snapshot)
+	l.compacting = true
+	l.compacted.Add(1)
+
+	go func() {
+		defer l.compacted.Done()
+		tmp := l.path + ".tmp"
+		err := writeSessionFile(tmp, snapshot)
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			err = l.replace(tmp)
+		}
+		l.compacting = false
+		l.pending = nil
+		if err != nil {
+			os.Remove(tmp)
+			slog.Error("Failed to compact the session log", "error", err)
+		}
+	}()
+}
+
+// replace appends the records written during the compaction to the
+// compacted file at tmp and makes it the log.
+func (l *sessionLog) replace(tmp string) error {
+	f, err := os.OpenFile(tmp, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, rec := range l.pending {
+		if err := enc.Encode(rec); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := os.Rename(tmp, l.path); err != nil {
+		f.Close()
+		return err
+	}
+	l.f.Close()
+	l.f = f
+	l.enc = enc
+	return nil
+}
+
+func (l *sessionLog) put(session *Session) {
+	l.write(sessionRecord{Op: sessionRecordPut, ID: session.ID, Session: session})
+}
+
+func (l *sessionLog) del(id string) {
+	l.write(sessionRecord{Op: sessionRecordDelete, ID: id})
+}
+
+func (l *sessionLog) write(rec sessionRecord) {
+	l.records++
+	if l.compacting {
+		l.pending = append(l.pending, rec)
+	}
+	if err := l.enc.Encode(rec); err != nil {
+		slog.Error("Failed to persist session", "session_id", rec.ID, "error", err)
+	}
+}
+
+// close waits for the compaction in progress, then flushes the log to disk
+// and closes it. Nothing may write to the log anymore.
+func (l *sessionLog) close() error {
+	l.compacted.Wait()
+	if err := l.f.Sync(); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
@@ -0,0 +1,109 @@
+package diameter
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func countRecords(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer f.Close()
+	n := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestSessionLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	s := NewSessions(nil)
+	if restored, err := s.Load(path); err != nil || len(restored) != 0 {
+		t.Fatalf("Load = %v, %v, want an empty store", restored, err)
+	}
+	s.Update("pgw;1", func(session *Session) { session.IMSI = "001010123456789" })
+	s.Update("pgw;2", func(*Session) {})
+	s.AddUsage("pgw;1", 0, 100, 200)
+	s.Remove("pgw;2")
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A record torn by a crash is skipped.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	f.WriteString(`{"op":"put","id":"pgw;3","sess`)
+	f.Close()
+
+	s = NewSessions(nil)
+	restored, err := s.Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	defer s.Close()
+	if len(restored) != 1 {
+		t.Fatalf("restored %d sessions, want 1", len(restored))
+	}
+	session, ok := s.Get("pgw;1")
+	if !ok || session.IMSI != "001010123456789" || session.InputOctets != 100 || session.NextRequestNumber != 1 {
+		t.Errorf("restored session = %+v", session)
+	}
+	if found := s.ByIMSI("001010123456789"); len(found) != 1 {
+		t.Errorf("restored session not indexed")
+	}
+	// Loading compacts the log to the live sessions.
+	if n := countRecords(t, path); n != 1 {
+		t.Errorf("log holds %d records after loading, want 1", n)
+	}
+}
+
+func TestSessionLogCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	l, _, err := openSessionLog(path)
+	if err != nil {
+		t.Fatalf("openSessionLog: %v", err)
+	}
+	live := map[string]*Session{
+		"pgw;1": {ID: "pgw;1"},
+		"pgw;2": {ID: "pgw;2"},
+	}
+	var mu sync.Mutex
+	mu.Lock()
+	for i := 0; i < 10; i++ {
+		l.put(live["pgw;1"])
+	}
+	l.put(live["pgw;2"])
+	l.compact(live, &mu)
+	if l.compactDue(0) {
+		t.Errorf("compaction due while one is in progress")
+	}
+	// Records written while the compacted file is written are kept.
+	l.put(&Session{ID: "pgw;3"})
+	l.del("pgw;1")
+	mu.Unlock()
+	if err := l.close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	if n := countRecords(t, path); n != 4 {
+		t.Errorf("log holds %d records after compaction, want 4", n)
+	}
+	l, sessions, err := openSessionLog(path)
+	if err != nil {
+		t.Fatalf("openSessionLog: %v", err)
+	}
+	defer l.close()
+	if len(sessions) != 2 || sessions["pgw;2"] == nil || sessions["pgw;3"] == nil {
+		t.Errorf("sessions after compaction = %v, want pgw;2 and pgw;3", sessions)
+	}
+}
@@ -0,0 +1,550 @@
+package diameter
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	radiusres "layeh.com/radius"
+)
+
+const (
+	// Sessions without a Session-Timeout are dropped after this long
+	// without traffic. Sessions with Auth-Session-State NO_STATE_MAINTAINED
+	// never see an STR, so they are kept for a shorter time.
+	stateMaintainedLifetime = 24 * time.Hour
+	noStateLifetime         = time.Hour
+	// A session aborted for outliving its authorized lifetime is kept this
+	// long for the STR that follows the ASA.
+	abortedLifetime = time.Minute
+
+	sessionExpiryInterval = 30 * time.Second
+	// At most this many ASRs, RARs and Accounting-Stops for expired and
+	// re-authorized sessions are in flight at once.
+	sessionLifetimeWorkers = 16
+
+	authSessionNoStateMaintained = 1
+)
+
+// Session is the state the agent keeps for a Diameter session between its
+// requests: who the subscriber is, how the RADIUS side knows it and what it
+// has used so far.
+type Session struct {
+	ID            string
+	AppID         uint32
+	OriginHost    datatype.DiameterIdentity
+	OriginRealm   datatype.DiameterIdentity
+	UserName      string
+	IMSI          string
+	AcctSessionID string
+	// Profile is the name of the translation profile of the session, empty
+	// for the global settings.
+	Profile string
+	Class   [][]byte
+	// State and Sticky are the State and sticky attributes of the
+	// Access-Accept, echoed on re-authorization and accounting.
+	State    []byte
+	Sticky   radiusres.Attributes
+	FramedIP net.IP
+	// Pool is the address pool FramedIP and FramedIPv6Prefix were allocated
+	// from, empty when the AAA server assigned them.
+	Pool             string
+	FramedIPv6Prefix string
+	StartTime        time.Time
+	LastSeen         time.Time
+	Expires          time.Time
+	// AuthTime is when the session was last authorized. The lifetime below
+	// comes from that Access-Accept and is in seconds, zero when not limited.
+	AuthTime        time.Time
+	Timeout         uint32
+	IdleTimeout     uint32
+	InterimInterval uint32
+	// ReAuth is set when the session must re-authorize once Timeout ends
+	// (Termination-Action RADIUS-Request) and ReAuthSent once a RAR was
+	// sent for that.
+	ReAuth          bool
+	ReAuthSent      bool
+	NoStateMaintain bool
+	// Aborted is set once the session outlived its authorized lifetime and
+	// is to be aborted with an ASR.
+	Aborted bool
+	// Accounting is set once an Accounting-Start was sent for the session.
+	Accounting   bool
+	InputOctets  uint64
+	OutputOctets uint64
+	// NextRequestNumber is the CC-Request-Number of the first CCR whose
+	// usage is not counted in the octets above yet.
+	NextRequestNumber uint32
+}
+
+// Sessions is the session store, keyed by Session-Id with secondary indexes
+// on IMSI, Framed-IP and Acct-Session-Id.
+type Sessions struct {
+	mu            sync.RWMutex
+	counter       uint32
+	byID          map[string]*Session
+	byIMSI        map[string]map[string]*Session
+	byFramedIP    map[string]map[string]*Session
+	byAcctSession map[string]*Session
+	log           *sessionLog
+	pools         *Pools
+}
+
+func NewSessions(pools *Pools) *Sessions {
+	return &Sessions{
+		pools:         pools,
+		byID:          make(map[string]*Session),
+		byIMSI:        make(map[string]map[string]*Session),
+		byFramedIP:    make(map[string]map[string]*Session),
+		byAcctSession: make(map[string]*Session),
+	}
+}
+
+// Update applies fn to the session with the given Session-Id, creating it
+// with a fresh Acct-Session-Id when it does not exist yet, and returns a copy
+// of the result.
+func (s *Sessions) Update(id string, fn func(*Session)) Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	session, ok := s.byID[id]
+	if ok {
+		s.unindex(session)
+	} else {
+		s.counter++
+		session = &Session{
+			ID:            id,
+			AcctSessionID: fmt.Sprintf("%08X%08X", uint32(now.Unix()), s.counter),
+			StartTime:     now,
+			AuthTime:      now,
+		}
+		s.byID[id] = session
+	}
+	fn(session)
+	session.LastSeen = now
+	session.Expires = session.expiry()
+	s.index(session)
+	if s.log != nil {
+		s.log.put(session)
+		s.compactLog()
+	}
+	return session.copy()
+}
+
+func (s *Sessions) Remove(id string) (Session, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.byID[id]
+	if !ok {
+		return Session{}, false
+	}
+	s.drop(session)
+	return session.copy(), true
+}
+
+// AddUsage counts the usage reported by the CCR with the given
+// CC-Request-Number in the totals of the session. A CCR is counted once, so
+// a retransmitted one adds nothing, and a session that is gone is left so.
+func (s *Sessions) AddUsage(id string, number uint32, input, output uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, ok := s.byID[id]
+	if !ok || session.counted(number) {
+		return
+	}
+	session.InputOctets += input
+	session.OutputOctets += output
+	session.NextRequestNumber = number + 1
+	if s.log != nil {
+		s.log.put(session)
+		s.compactLog()
+	}
+}
+
+// Allocate gives the session addresses from the pool of its APN and realm,
+// unless it already has them.
+func (s *Sessions) Allocate(id, apn, realm string) (Session, bool) {
+	var ok bool
+	session := s.Update(id, func(session *Session) {
+		if session.Pool != "" {
+			ok = true
+			return
+		}
+		session.Pool, session.FramedIP, session.FramedIPv6Prefix, ok = s.pools.Allocate(id, apn, realm)
+	})
+	return session, ok
+}
+
+func (s *Sessions) Get(id string) (Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.byID[id]
+	if !ok {
+		return Session{}, false
+	}
+	return session.copy(), true
+}
+
+// List returns every session in the store.
+func (s *Sessions) List() []Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sessions := make([]Session, 0, len(s.byID))
+	for _, session := range s.byID {
+		sessions = append(sessions, session.copy())
+	}
+	return sessions
+}
+
+// Len returns the number of sessions in the store.
+func (s *Sessions) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.byID)
+}
+
+func (s *Sessions) ByIMSI(imsi string) []Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copies(s.byIMSI[imsi])
+}
+
+func (s *Sessions) ByFramedIP(ip net.IP) []Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return copies(s.byFramedIP[ip.String()])
+}
+
+func (s *Sessions) ByAcctSessionID(acctSessionID string) (Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.byAcctSession[acctSessionID]
+	if !ok {
+		return Session{}, false
+	}
+	return session.copy(), true
+}
+
+// Find returns the sessions matching every identifier that is set. It
+// returns nothing when no identifier is set. A User-Name matches either the
+// stored User-Name or the IMSI.
+func (s *Sessions) Find(acctSessionID, userName string, framedIP net.IP) []Session {
+	var candidates []Session
+	switch {
+	case acctSessionID != "":
+		if session, ok := s.ByAcctSessionID(acctSessionID); ok {
+			candidates = append(candidates, session)
+		}
+	case framedIP != nil:
+		candidates = s.ByFramedIP(framedIP)
+	case userName != "":
+		s.mu.RLock()
+		for _, session := range s.byID {
+			candidates = append(candidates, session.copy())
+		}
+		s.mu.RUnlock()
+	}
+
+	var found []Session
+	for _, session := range candidates {
+		if userName != "" && session.UserName != userName && session.IMSI != userName {
+			continue
+		}
+		if framedIP != nil && !session.FramedIP.Equal(framedIP) {
+			continue
+		}
+		found = append(found, session)
+	}
+	return found
+}
+
+// Authorization returns the session holding the RADIUS authorization of the
+// subscriber of the given session: the session itself when it was granted a
+// lifetime, otherwise another session of the same IMSI that was, as for a
+// Gy session running next to its NASREQ one.
+func (s *Sessions) Authorization(id string) (Session, bool) {
+	return s.subscriber(id, (*Session).limited)
+}
+
+// Accepted returns the session whose Access-Accept the accounting of the
+// given session echoes: the session itself when its Access-Accept had a
+// Class or sticky attributes, otherwise another session of the same IMSI
+// whose Access-Accept had, as for a Gy session running next to its NASREQ
+// one.
+func (s *Sessions) Accepted(id string) (Session, bool) {
+	return s.subscriber(id, (*Session).accepted)
+}
+
+// subscriber returns the given session when it matches, otherwise a session
+// of the same IMSI that does.
+func (s *Sessions) subscriber(id string, match func(*Session) bool) (Session, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, ok := s.byID[id]
+	if !ok {
+		return Session{}, false
+	}
+	if match(session) {
+		return session.copy(), true
+	}
+	if session.IMSI == "" {
+		return Session{}, false
+	}
+	for _, other := range s.byIMSI[session.IMSI] {
+		if match(other) {
+			return other.copy(), true
+		}
+	}
+	return Session{}, false
+}
+
+// Load restores the sessions persisted in path and persists every later
+// change there. It returns the restored sessions.
+func (s *Sessions) Load(path string) ([]Session, error) {
+	sessionLog, sessions, err := openSessionLog(path)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.log = sessionLog
+	var restored []Session
+	for id, session := range sessions {
+		s.byID[id] = session
+		s.index(session)
+		s.pools.Reserve(*session)
+		restored = append(restored, session.copy())
+	}
+	return restored, nil
+}
+
+// Close flushes the persisted sessions to disk and stops persisting later
+// changes.
+func (s *Sessions) Close() error {
+	s.mu.Lock()
+	sessionLog := s.log
+	s.log = nil
+	s.mu.Unlock()
+	if sessionLog == nil {
+		return nil
+	}
+	// A compaction in progress takes the lock to finish.
+	return sessionLog.close()
+}
+
+// run drops the sessions that expired and passes them to expired, and passes
+// the sessions due for re-authorization to reauth, until the process exits.
+// The callbacks wait for peers and AAA servers, so they run in their own
+// goroutines, sessionLifetimeWorkers at most. While all are busy the loop
+// waits for one to finish, and the ticker drops the ticks it misses.
+func (s *Sessions) run(expired, reauth func(Session)) {
+	ticker := time.NewTicker(sessionExpiryInterval)
+	defer ticker.Stop()
+	workers := make(chan struct{}, sessionLifetimeWorkers)
+	dispatch := func(f func(Session), session Session) {
+		workers <- struct{}{}
+		go func() {
+			defer func() { <-workers }()
+			f(session)
+		}()
+	}
+	for now := range ticker.C {
+		for _, session := range s.expire(now) {
+			dispatch(expired, session)
+		}
+		for _, session := range s.reauthDue(now) {
+			dispatch(reauth, session)
+		}
+	}
+}
+
+// reauthDue marks and returns the sessions whose Authorization-Lifetime
+// ended and that were not asked to re-authorize yet.
+func (s *Sessions) reauthDue(now time.Time) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []Session
+	for _, session := range s.byID {
+		if !session.ReAuth || session.ReAuthSent || session.Timeout == 0 || now.Before(session.authorizationEnd()) {
+			continue
+		}
+		session.ReAuthSent = true
+		if s.log != nil {
+			s.log.put(session)
+			s.compactLog()
+		}
+		due = append(due, session.copy())
+	}
+	return due
+}
+
+// expire returns the sessions that expired. Those granted a lifetime are
+// marked aborted and kept for abortedLifetime, so that the STR following
+// the ASR finds them; the others are dropped, as are the aborted sessions
+// whose STR never came.
+func (s *Sessions) expire(now time.Time) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var expired []Session
+	for _, session := range s.byID {
+		if now.Before(session.Expires) {
+			continue
+		}
+		if session.Aborted {
+			s.drop(session)
+			continue
+		}
+		if !session.limited() {
+			s.drop(session)
+			expired = append(expired, session.copy())
+			continue
+		}
+		session.Aborted = true
+		expired = append(expired, session.copy())
+		session.Expires = now.Add(abortedLifetime)
+		if s.log != nil {
+			s.log.put(session)
+			s.compactLog()
+		}
+	}
+	return expired
+}
+
+// drop removes a session and releases its pool addresses.
+func (s *Sessions) drop(session *Session) {
+	s.unindex(session)
+	delete(s.byID, session.ID)
+	s.pools.Release(*session)
+	if s.log != nil {
+		s.log.del(session.ID)
+		s.compactLog()
+	}
+}
+
+// compactLog compacts the persisted sessions when the updates appended to
+// them outgrow the live sessions.
+func (s *Sessions) compactLog() {
+	if s.log.compactDue(len(s.byID)) {
+		s.log.compact(s.byID, &s.mu)
+	}
+}
+
+func (s *Sessions) index(session *Session) {
+	if session.IMSI != "" {
+		addToIndex(s.byIMSI, session.IMSI, session)
+	}
+	if session.FramedIP != nil {
+		addToIndex(s.byFramedIP, session.FramedIP.String(), session)
+	}
+	if session.AcctSessionID != "" {
+		s.byAcctSession[session.AcctSessionID] = session
+	}
+}
+
+func (s *Sessions) unindex(session *Session) {
+	if session.IMSI != "" {
+		removeFromIndex(s.byIMSI, session.IMSI, session.ID)
+	}
+	if session.FramedIP != nil {
+		removeFromIndex(s.byFramedIP, session.FramedIP.String(), session.ID)
+	}
+	if session.AcctSessionID != "" {
+		delete(s.byAcctSession, session.AcctSessionID)
+	}
+}
+
+func addToIndex(index map[string]map[string]*Session, key string, session *Session) {
+	if index[key] == nil {
+		index[key] = make(map[string]*Session)
+	}
+	index[key][session.ID] = session
+}
+
+func removeFromIndex(index map[string]map[string]*Session, key, id string) {
+	delete(index[key], id)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+// expiry is the end of the lifetime the session was granted, otherwise an
+// idle deadline that moves with each request.
+func (session *Session) expiry() time.Time {
+	if session.Aborted {
+		return session.Expires
+	}
+	if session.limited() {
+		var end time.Time
+		if session.Timeout > 0 {
+			end = session.authorizationEnd()
+			if session.ReAuth {
+				end = end.Add(authGracePeriod * time.Second)
+			}
+		}
+		if idle := session.idleEnd(); session.IdleTimeout > 0 && (end.IsZero() || idle.Before(end)) {
+			end = idle
+		}
+		return end
+	}
+	if session.NoStateMaintain {
+		return session.LastSeen.Add(noStateLifetime)
+	}
+	return session.LastSeen.Add(stateMaintainedLifetime)
+}
+
+// limited reports whether the Access-Accept granted the session a lifetime.
+func (session *Session) limited() bool {
+	return session.Timeout > 0 || session.IdleTimeout > 0
+}
+
+// accepted reports whether the Access-Accept of the session had attributes
+// to echo in its accounting.
+func (session *Session) accepted() bool {
+	return len(session.Class) > 0 || len(session.Sticky) > 0
+}
+
+func (session *Session) authorizationEnd() time.Time {
+	return session.AuthTime.Add(time.Duration(session.Timeout) * time.Second)
+}
+
+func (session *Session) idleEnd() time.Time {
+	return session.LastSeen.Add(time.Duration(session.IdleTimeout) * time.Second)
+}
+
+// idleExpired reports whether the session expired for being idle rather
+// than for reaching its Session-Timeout.
+func (session *Session) idleExpired() bool {
+	return session.IdleTimeout > 0 && !session.Expires.Before(session.idleEnd())
+}
+
+// counted reports whether the usage of the CCR with the given
+// CC-Request-Number is counted in the totals of the session.
+func (session *Session) counted(number uint32) bool {
+	return number < session.NextRequestNumber
+}
+
+// usageWith returns the totals of the session with the usage of the CCR
+// with the given CC-Request-Number, counted or not.
+func (session *Session) usageWith(number uint32, input, output uint64) (uint64, uint64) {
+	if session.counted(number) {
+		return session.InputOctets, session.OutputOctets
+	}
+	return session.InputOctets + input, session.OutputOctets + output
+}
+
+func (session *Session) copy() Session {
+	c := *session
+	c.Class = append([][]byte(nil), session.Class...)
+	return c
+}
+
+func copies(sessions map[string]*Session) []Session {
+	var result []Session
+	for _, session := range sessions {
+		result = append(result, session.copy())
+	}
+	return result
+}
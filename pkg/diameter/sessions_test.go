@@ -0,0 +1,90 @@
+package diameter
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSessionsIndexes(t *testing.T) {
+	s := NewSessions(nil)
+	first := s.Update("pgw;1", func(session *Session) {
+		session.UserName = "user@example.org"
+		session.IMSI = "001010123456789"
+		session.FramedIP = net.IPv4(10, 0, 0, 1)
+	})
+	s.Update("pgw;2", func(session *Session) {
+		session.IMSI = "001010123456789"
+		session.FramedIP = net.IPv4(10, 0, 0, 2)
+	})
+	if first.AcctSessionID == "" {
+		t.Fatalf("session created without an Acct-Session-Id")
+	}
+
+	tests := []struct {
+		name          string
+		acctSessionID string
+		userName      string
+		framedIP      net.IP
+		want          int
+	}{
+		{name: "Acct-Session-Id", acctSessionID: first.AcctSessionID, want: 1},
+		{name: "User-Name", userName: "user@example.org", want: 1},
+		{name: "IMSI as User-Name", userName: "001010123456789", want: 2},
+		{name: "Framed-IP-Address", framedIP: net.IPv4(10, 0, 0, 2), want: 1},
+		{name: "all identifiers must match", userName: "user@example.org", framedIP: net.IPv4(10, 0, 0, 2)},
+		{name: "unknown Acct-Session-Id", acctSessionID: "0000"},
+		{name: "no identifier"},
+	}
+	for _, tt := range tests {
+		if found := s.Find(tt.acctSessionID, tt.userName, tt.framedIP); len(found) != tt.want {
+			t.Errorf("%s: found %d sessions, want %d", tt.name, len(found), tt.want)
+		}
+	}
+
+	// Updates move a session in the indexes.
+	s.Update("pgw;1", func(session *Session) { session.FramedIP = net.IPv4(10, 0, 0, 3) })
+	if found := s.ByFramedIP(net.IPv4(10, 0, 0, 1)); len(found) != 0 {
+		t.Errorf("session still found by its former address")
+	}
+	if found := s.ByFramedIP(net.IPv4(10, 0, 0, 3)); len(found) != 1 {
+		t.Errorf("session not found by its new address")
+	}
+
+	if _, ok := s.Remove("pgw;1"); !ok {
+		t.Fatalf("Remove did not find the session")
+	}
+	if _, ok := s.Remove("pgw;1"); ok {
+		t.Errorf("session removed twice")
+	}
+	if _, ok := s.ByAcctSessionID(first.AcctSessionID); ok {
+		t.Errorf("removed session found by its Acct-Session-Id")
+	}
+	if found := s.ByIMSI("001010123456789"); len(found) != 1 || found[0].ID != "pgw;2" {
+		t.Errorf("sessions of the IMSI = %+v, want the one left", found)
+	}
+	if n := s.Len(); n != 1 {
+		t.Errorf("Len = %d, want 1", n)
+	}
+}
+
+func TestSessionsExpire(t *testing.T) {
+	s := NewSessions(nil)
+	s.Update("pgw;1", func(*Session) {})
+	s.Update("pgw;2", func(session *Session) { session.NoStateMaintain = true })
+	now := time.Now()
+
+	if expired := s.expire(now.Add(time.Minute)); len(expired) != 0 {
+		t.Errorf("%d sessions expired while active", len(expired))
+	}
+	expired := s.expire(now.Add(noStateLifetime + time.Minute))
+	if len(expired) != 1 || expired[0].ID != "pgw;2" {
+		t.Errorf("expired %+v, want the session without state", expired)
+	}
+	if expired := s.expire(now.Add(stateMaintainedLifetime + time.Minute)); len(expired) != 1 {
+		t.Errorf("expired %d sessions, want the one with state", len(expired))
+	}
+	if n := s.Len(); n != 0 {
+		t.Errorf("%d sessions left", n)
+	}
+}
@@ -0,0 +1,129 @@
+package diameter
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+)
+
+const (
+	// disconnectCauseRebooting is the Disconnect-Cause REBOOTING of RFC 6733
+	// section 5.4.3: the peer should reconnect once the agent is back.
+	disconnectCauseRebooting = 0
+
+	disconnectPeerTimeout = 3 * time.Second
+)
+
+// tracked runs handler in its own goroutine and counts it in flight until
+// it returns, so that Shutdown can wait for its answer. Once the server is
+// shutting down requests are answered with DIAMETER_TOO_BUSY instead, which
+// lets the peer send them elsewhere.
+func (s *Server) tracked(handler diam.Handler) diam.HandlerFunc {
+	return func(c diam.Conn, m *diam.Message) {
+		s.drainMu.Lock()
+		if s.draining {
+			s.drainMu.Unlock()
+			if _, err := sendReply(c, s.router.errorAnswer(m, diam.TooBusy)); err != nil {
+				slog.Error("Failed to send answer", "session_id", sessionID(m), "result_code", diam.TooBusy, "error", err)
+			}
+			return
+		}
+		s.inflight.Add(1)
+		s.drainMu.Unlock()
+		go func() {
+			defer s.inflight.Done()
+			handler.ServeDIAM(c, m)
+		}()
+	}
+}
+
+// Shutdown stops accepting connections, tells every peer the agent is
+// rebooting with a DPR, waits for the requests being translated to be
+// answered, then closes the peer connections, the session store and the
+// admin server. It gives up waiting when ctx is done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.drainMu.Lock()
+	s.draining = true
+	s.drainMu.Unlock()
+
+	var errs []error
+	if s.listener != nil {
+		if err := s.listener.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	s.listening.Store(false)
+
+	conns := s.disconnectPeers(ctx)
+
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		slog.Info("Drained the Diameter requests in flight")
+	case <-ctx.Done():
+		slog.Warn("Gave up waiting for the Diameter requests in flight", "error", ctx.Err())
+		errs = append(errs, ctx.Err())
+	}
+
+	if s.stopPeers != nil {
+		s.stopPeers()
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+	if err := s.sessions.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	for _, server := range []*http.Server{s.healthServer, s.adminServer} {
+		if server == nil {
+			continue
+		}
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// disconnectPeers sends a DPR to every open peer and waits for their DPA,
+// leaving the connections open for the answers still to come. It returns
+// the connections to close.
+func (s *Server) disconnectPeers(ctx context.Context) []diam.Conn {
+	if s.peerTable == nil {
+		return nil
+	}
+	var conns []diam.Conn
+	var wg sync.WaitGroup
+	for _, entry := range s.peerTable.List() {
+		c, ok := s.peerTable.Conn(entry.OriginHost)
+		if !ok {
+			continue
+		}
+		s.peerTable.SetState(entry.OriginHost, PeerClosing)
+		conns = append(conns, c)
+		wg.Add(1)
+		go func(host datatype.DiameterIdentity, c diam.Conn) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, disconnectPeerTimeout)
+			defer cancel()
+			a, err := s.txns.send(ctx, c, BuildDisconnectPeerRequest(s.settings, s.dictionary.Load(), disconnectCauseRebooting))
+			if err != nil {
+				slog.Warn("No DPA from peer", "peer", string(host), "error", err)
+				return
+			}
+			slog.Info("Disconnected peer", "peer", string(host), "result_code", answerResultCode(a))
+		}(entry.OriginHost, c)
+	}
+	wg.Wait()
+	return conns
+}
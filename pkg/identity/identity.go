@@ -0,0 +1,232 @@
+// Package identity works out who a subscriber is from the names a request
+// carries, a NAI in User-Name and Subscription-Id AVPs, and builds the
+// User-Name sent to the AAA server from them.
+package identity
+
+import (
+	"bytes"
+	"strings"
+	"text/template"
+)
+
+// Subscription-Id-Type values (RFC 4006 section 8.47).
+const (
+	SubscriptionE164    = 0
+	SubscriptionIMSI    = 1
+	SubscriptionSIPURI  = 2
+	SubscriptionNAI     = 3
+	SubscriptionPrivate = 4
+)
+
+// Lengths of an IMSI in digits.
+const (
+	minIMSILength = 14
+	maxIMSILength = 15
+)
+
+// Kinds of EAP identity, given by the first character of the NAI username
+// (RFC 4186, RFC 4187, RFC 5448 and 3GPP TS 23.003 section 19.3).
+const (
+	KindPermanent = "permanent"
+	KindPseudonym = "pseudonym"
+	KindReauth    = "reauth"
+)
+
+var naiPrefixes = map[byte]string{
+	'0': KindPermanent, // EAP-AKA
+	'1': KindPermanent, // EAP-SIM
+	'2': KindPseudonym,
+	'3': KindPseudonym,
+	'4': KindReauth,
+	'5': KindReauth,
+	'6': KindPermanent, // EAP-AKA'
+	'7': KindPseudonym,
+	'8': KindReauth,
+}
+
+// SubscriptionID is one Subscription-Id AVP.
+type SubscriptionID struct {
+	Type uint32
+	Data string
+}
+
+// Identity is what is known of a subscriber. Fields that the request did
+// not carry are empty.
+type Identity struct {
+	// NAI is the User-Name as received, Username its part before the realm
+	// without any decoration, and Realm its home realm.
+	NAI      string
+	Username string
+	Realm    string
+	// Kind is the kind of EAP identity of Username, empty when it has none
+	// of the 3GPP prefixes.
+	Kind    string
+	IMSI    string
+	MSISDN  string
+	SIPURI  string
+	Private string
+	// MCC and MNC are those of the 3GPP realm, or of the IMSI assuming a
+	// two digit MNC when the realm is not a 3GPP one.
+	MCC string
+	MNC string
+}
+
+// New combines the User-Name and the Subscription-Id AVPs of a request. A
+// User-Name of bare digits is only taken for an IMSI until a Subscription-Id
+// says what it is.
+func New(userName string, ids []SubscriptionID) Identity {
+	id := ParseNAI(userName)
+	guessed := id.IMSI != "" && id.Kind == ""
+	for _, sub := range ids {
+		switch sub.Type {
+		case SubscriptionE164:
+			if guessed && sub.Data == id.IMSI {
+				id.IMSI, guessed = "", false
+			}
+			setOnce(&id.MSISDN, sub.Data)
+		case SubscriptionIMSI:
+			if guessed {
+				id.IMSI, guessed = "", false
+			}
+			setOnce(&id.IMSI, sub.Data)
+		case SubscriptionSIPURI:
+			setOnce(&id.SIPURI, sub.Data)
+		case SubscriptionNAI:
+			if id.NAI == "" {
+				nai := ParseNAI(sub.Data)
+				id.NAI, id.Username, id.Realm, id.Kind = nai.NAI, nai.Username, nai.Realm, nai.Kind
+				id.MCC, id.MNC = nai.MCC, nai.MNC
+				setOnce(&id.IMSI, nai.IMSI)
+			}
+		case SubscriptionPrivate:
+			setOnce(&id.Private, sub.Data)
+		}
+	}
+	if id.MCC == "" && len(id.IMSI) >= 5 {
+		id.MCC, id.MNC = id.IMSI[:3], id.IMSI[3:5]
+	}
+	return id
+}
+
+// ParseNAI parses a NAI such as
+// 0001010000000001@nai.epc.mnc001.mcc001.3gppnetwork.org, a decorated NAI
+// such as home.example.org!user@visited.example.org (RFC 7542 section 3.3)
+// or a bare IMSI.
+func ParseNAI(nai string) Identity {
+	id := Identity{NAI: nai, Username: nai}
+	if at := strings.LastIndexByte(nai, '@'); at >= 0 {
+		id.Username, id.Realm = nai[:at], nai[at+1:]
+	}
+	if bang := strings.IndexByte(id.Username, '!'); bang >= 0 {
+		id.Realm, id.Username = id.Username[:bang], id.Username[bang+1:]
+	}
+	id.MCC, id.MNC = realmPLMN(id.Realm)
+
+	name := id.Username
+	switch {
+	case len(name) == 16 && naiPrefixes[name[0]] == KindPermanent && isIMSI(name[1:]):
+		id.Kind, id.IMSI = KindPermanent, name[1:]
+	case isIMSI(name):
+		id.IMSI = name
+	case len(name) > 1 && naiPrefixes[name[0]] != "" && naiPrefixes[name[0]] != KindPermanent:
+		id.Kind = naiPrefixes[name[0]]
+	}
+	return id
+}
+
+// Name is the User-Name sent when no template is configured: the NAI
+// without its realm, or else the IMSI, MSISDN, SIP URI or private id.
+func (id Identity) Name() string {
+	return firstOf(id.Username, id.IMSI, id.MSISDN, id.SIPURI, id.Private)
+}
+
+// realmPLMN returns the MCC and MNC of a realm such as
+// epc.mnc001.mcc001.3gppnetwork.org, with the MNC in two digits when it
+// has a leading zero.
+func realmPLMN(realm string) (mcc, mnc string) {
+	for _, label := range strings.Split(strings.ToLower(realm), ".") {
+		switch {
+		case strings.HasPrefix(label, "mcc") && len(label) == 6:
+			mcc = label[3:]
+		case strings.HasPrefix(label, "mnc") && len(label) == 6:
+			mnc = strings.TrimPrefix(label[3:], "0")
+		}
+	}
+	if mcc == "" || mnc == "" || !isDigits(mcc) || !isDigits(mnc) {
+		return "", ""
+	}
+	if len(mnc) == 1 {
+		mnc = "0" + mnc
+	}
+	return mcc, mnc
+}
+
+// isIMSI reports whether s has the digits of an IMSI: a three digit MCC, a
+// two or three digit MNC and an MSIN of nine or ten digits (3GPP TS 23.003
+// section 2.2).
+func isIMSI(s string) bool {
+	return len(s) >= minIMSILength && len(s) <= maxIMSILength && isDigits(s)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func setOnce(field *string, value string) {
+	if *field == "" {
+		*field = value
+	}
+}
+
+func firstOf(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// Template builds a User-Name from an Identity. It is a text/template with
+// the fields of Identity, such as {{.IMSI}}@{{.Realm}}, and the functions
+// mnc3, which pads an MNC to three digits, and default, which returns the
+// first non-empty argument:
+//
+//	0{{.IMSI}}@nai.epc.mnc{{mnc3 .MNC}}.mcc{{.MCC}}.3gppnetwork.org
+//	{{default .MSISDN .IMSI}}
+type Template struct {
+	tmpl *template.Template
+}
+
+var funcs = template.FuncMap{
+	"mnc3": func(mnc string) string {
+		if len(mnc) < 3 {
+			return strings.Repeat("0", 3-len(mnc)) + mnc
+		}
+		return mnc
+	},
+	"default": firstOf,
+}
+
+// ParseTemplate compiles a User-Name template.
+func ParseTemplate(text string) (*Template, error) {
+	tmpl, err := template.New("user_name").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	return &Template{tmpl: tmpl}, nil
+}
+
+// Execute builds the User-Name of id.
+func (t *Template) Execute(id Identity) (string, error) {
+	var b bytes.Buffer
+	if err := t.tmpl.Execute(&b, id); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
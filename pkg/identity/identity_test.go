@@ -0,0 +1,147 @@
+package identity
+
+import "testing"
+
+func TestParseNAI(t *testing.T) {
+	tests := []struct {
+		nai  string
+		want Identity
+	}{
+		{
+			nai: "0001010000000001@nai.epc.mnc001.mcc001.3gppnetwork.org",
+			want: Identity{
+				Username: "0001010000000001", Realm: "nai.epc.mnc001.mcc001.3gppnetwork.org",
+				Kind: KindPermanent, IMSI: "001010000000001", MCC: "001", MNC: "01",
+			},
+		},
+		{
+			nai: "6310410123456789@nai.epc.mnc410.mcc310.3gppnetwork.org",
+			want: Identity{
+				Username: "6310410123456789", Realm: "nai.epc.mnc410.mcc310.3gppnetwork.org",
+				Kind: KindPermanent, IMSI: "310410123456789", MCC: "310", MNC: "410",
+			},
+		},
+		{
+			nai:  "2pseudonym@wlan.mnc001.mcc001.3gppnetwork.org",
+			want: Identity{Username: "2pseudonym", Realm: "wlan.mnc001.mcc001.3gppnetwork.org", Kind: KindPseudonym, MCC: "001", MNC: "01"},
+		},
+		{
+			nai:  "4reauthid@example.org",
+			want: Identity{Username: "4reauthid", Realm: "example.org", Kind: KindReauth},
+		},
+		{
+			nai:  "001010123456789",
+			want: Identity{Username: "001010123456789", IMSI: "001010123456789"},
+		},
+		{
+			nai:  "001010123456789@example.org",
+			want: Identity{Username: "001010123456789", Realm: "example.org", IMSI: "001010123456789"},
+		},
+		{
+			nai:  "home.example.org!alice@visited.example.org",
+			want: Identity{Username: "alice", Realm: "home.example.org"},
+		},
+		{
+			nai:  "wlan.mnc001.mcc001.3gppnetwork.org!0001010000000001@visited.example.org",
+			want: Identity{Username: "0001010000000001", Realm: "wlan.mnc001.mcc001.3gppnetwork.org", Kind: KindPermanent, IMSI: "001010000000001", MCC: "001", MNC: "01"},
+		},
+		{
+			nai:  "alice@epc.mncABC.mcc001.3gppnetwork.org",
+			want: Identity{Username: "alice", Realm: "epc.mncABC.mcc001.3gppnetwork.org"},
+		},
+		{
+			nai:  "1234",
+			want: Identity{Username: "1234"},
+		},
+		{
+			// An MSISDN is too short for an IMSI.
+			nai:  "15551234567",
+			want: Identity{Username: "15551234567"},
+		},
+		{
+			nai:  "0015551234567@example.org",
+			want: Identity{Username: "0015551234567", Realm: "example.org"},
+		},
+		{
+			nai:  "00101123456789012",
+			want: Identity{Username: "00101123456789012"},
+		},
+		{
+			nai:  "",
+			want: Identity{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.nai, func(t *testing.T) {
+			tt.want.NAI = tt.nai
+			if got := ParseNAI(tt.nai); got != tt.want {
+				t.Errorf("ParseNAI(%q) = %+v, want %+v", tt.nai, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNew(t *testing.T) {
+	id := New("", []SubscriptionID{
+		{Type: SubscriptionE164, Data: "15551234567"},
+		{Type: SubscriptionIMSI, Data: "310410123456789"},
+		{Type: SubscriptionIMSI, Data: "001010000000001"},
+	})
+	want := Identity{MSISDN: "15551234567", IMSI: "310410123456789", MCC: "310", MNC: "41"}
+	if id != want {
+		t.Errorf("New = %+v, want %+v", id, want)
+	}
+	if name := id.Name(); name != "310410123456789" {
+		t.Errorf("Name = %q, want the IMSI", name)
+	}
+
+	id = New("", []SubscriptionID{{Type: SubscriptionNAI, Data: "0001010000000001@nai.epc.mnc001.mcc001.3gppnetwork.org"}})
+	if id.IMSI != "001010000000001" || id.Realm != "nai.epc.mnc001.mcc001.3gppnetwork.org" || id.MNC != "01" {
+		t.Errorf("New with a NAI Subscription-Id = %+v", id)
+	}
+}
+
+// TestNewSubscriptionType checks that the Subscription-Id types decide what a
+// User-Name of bare digits is.
+func TestNewSubscriptionType(t *testing.T) {
+	tests := []struct {
+		name     string
+		userName string
+		ids      []SubscriptionID
+		imsi     string
+		msisdn   string
+	}{
+		{name: "no Subscription-Id", userName: "001010123456789", imsi: "001010123456789"},
+		{
+			name:     "MSISDN",
+			userName: "491701234567890",
+			ids:      []SubscriptionID{{Type: SubscriptionE164, Data: "491701234567890"}},
+			msisdn:   "491701234567890",
+		},
+		{
+			name:     "other IMSI",
+			userName: "491701234567890",
+			ids:      []SubscriptionID{{Type: SubscriptionIMSI, Data: "262011234567890"}},
+			imsi:     "262011234567890",
+		},
+		{
+			name:     "other MSISDN",
+			userName: "001010123456789",
+			ids:      []SubscriptionID{{Type: SubscriptionE164, Data: "15551234567"}},
+			imsi:     "001010123456789",
+			msisdn:   "15551234567",
+		},
+		{
+			name:     "permanent NAI",
+			userName: "0001010000000001@nai.epc.mnc001.mcc001.3gppnetwork.org",
+			ids:      []SubscriptionID{{Type: SubscriptionIMSI, Data: "262011234567890"}},
+			imsi:     "001010000000001",
+		},
+	}
+	for _, tt := range tests {
+		id := New(tt.userName, tt.ids)
+		if id.IMSI != tt.imsi || id.MSISDN != tt.msisdn {
+			t.Errorf("%s: IMSI %q and MSISDN %q, want %q and %q", tt.name, id.IMSI, id.MSISDN, tt.imsi, tt.msisdn)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// Package location decodes the 3GPP-User-Location-Info and 3GPP-MS-TimeZone
+// values of 3GPP TS 29.061 section 16.4.7.2 into their fields.
+package location
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Geographic Location Types of 3GPP-User-Location-Info.
+const (
+	TypeCGI     = 0
+	TypeSAI     = 1
+	TypeRAI     = 2
+	TypeTAI     = 128
+	TypeECGI    = 129
+	TypeTAIECGI = 130
+	TypeNCGI    = 135
+	Type5GSTAI  = 136
+	Type5GSNCGI = 137
+)
+
+var typeNames = map[byte]string{
+	TypeCGI:     "CGI",
+	TypeSAI:     "SAI",
+	TypeRAI:     "RAI",
+	TypeTAI:     "TAI",
+	TypeECGI:    "ECGI",
+	TypeTAIECGI: "TAI+ECGI",
+	TypeNCGI:    "NCGI",
+	Type5GSTAI:  "5GS-TAI",
+	Type5GSNCGI: "5GS-TAI+NCGI",
+}
+
+var errShort = errors.New("user location info too short")
+
+// Location is a decoded 3GPP-User-Location-Info. Fields holds the
+// identifiers it carries in decimal, keyed by lac, ci, sac, rac, tac, eci
+// or nci, along with location_type, mcc and mnc.
+type Location struct {
+	Type   byte
+	Fields map[string]string
+}
+
+// Decode decodes a 3GPP-User-Location-Info value: a Geographic Location
+// Type octet followed by the location identifiers of that type, each
+// starting with the MCC and MNC of TS 24.008.
+func Decode(b []byte) (Location, error) {
+	if len(b) < 1 {
+		return Location{}, errShort
+	}
+	loc := Location{Type: b[0], Fields: make(map[string]string)}
+	name, ok := typeNames[loc.Type]
+	if !ok {
+		return Location{}, fmt.Errorf("unsupported geographic location type %d", loc.Type)
+	}
+	loc.Fields["location_type"] = name
+
+	b = b[1:]
+	var err error
+	switch loc.Type {
+	case TypeCGI:
+		err = loc.decode(b, field{"lac", 2, 0}, field{"ci", 2, 0})
+	case TypeSAI:
+		err = loc.decode(b, field{"lac", 2, 0}, field{"sac", 2, 0})
+	case TypeRAI:
+		err = loc.decode(b, field{"lac", 2, 0}, field{"rac", 1, 0})
+	case TypeTAI:
+		err = loc.decode(b, field{"tac", 2, 0})
+	case TypeECGI:
+		err = loc.decode(b, field{"eci", 4, 28})
+	case TypeTAIECGI:
+		if err = loc.decode(b, field{"tac", 2, 0}); err == nil {
+			err = loc.decode(b[5:], field{"eci", 4, 28})
+		}
+	case TypeNCGI:
+		err = loc.decode(b, field{"nci", 5, 36})
+	case Type5GSTAI:
+		err = loc.decode(b, field{"tac", 3, 0})
+	case Type5GSNCGI:
+		if err = loc.decode(b, field{"tac", 3, 0}); err == nil {
+			err = loc.decode(b[6:], field{"nci", 5, 36})
+		}
+	}
+	if err != nil {
+		return Location{}, err
+	}
+	return loc, nil
+}
+
+// field is an identifier of size octets, of which the low bits are used
+// when bits is set.
+type field struct {
+	name string
+	size int
+	bits uint
+}
+
+// decode reads a PLMN identity followed by fields. The PLMN of the last
+// identity is the one kept.
+func (loc *Location) decode(b []byte, fields ...field) error {
+	size := 3
+	for _, f := range fields {
+		size += f.size
+	}
+	if len(b) < size {
+		return errShort
+	}
+	loc.Fields["mcc"], loc.Fields["mnc"] = PLMN(b[:3])
+	b = b[3:]
+	for _, f := range fields {
+		buf := make([]byte, 8)
+		copy(buf[8-f.size:], b[:f.size])
+		v := binary.BigEndian.Uint64(buf)
+		if f.bits != 0 {
+			v &= 1<<f.bits - 1
+		}
+		loc.Fields[f.name] = strconv.FormatUint(v, 10)
+		b = b[f.size:]
+	}
+	return nil
+}
+
+// PLMN decodes the MCC and MNC of a three octet PLMN identity
+// (3GPP TS 24.008 section 10.5.1.3).
+func PLMN(b []byte) (mcc, mnc string) {
+	digit := func(n byte) byte { return '0' + n&0x0f }
+	mccDigits := []byte{digit(b[0]), digit(b[0] >> 4), digit(b[1])}
+	mncDigits := []byte{digit(b[2]), digit(b[2] >> 4)}
+	if b[1]>>4 != 0x0f {
+		mncDigits = append(mncDigits, digit(b[1]>>4))
+	}
+	return string(mccDigits), string(mncDigits)
+}
+
+// TimeZone is a decoded 3GPP-MS-TimeZone.
+type TimeZone struct {
+	// Offset is the offset from UTC in minutes, daylight saving time
+	// included, and DST the hours of daylight saving time adjustment.
+	Offset int
+	DST    int
+}
+
+// DecodeTimeZone decodes a 3GPP-MS-TimeZone value: the Time Zone octet of
+// 3GPP TS 24.008 section 10.5.3.8, in quarter hours, and the Daylight
+// Saving Time octet of section 10.5.3.12.
+func DecodeTimeZone(b []byte) (TimeZone, error) {
+	if len(b) < 2 {
+		return TimeZone{}, errors.New("ms time zone too short")
+	}
+	quarters := int(b[0]&0x07)*10 + int(b[0]>>4)
+	if b[0]&0x08 != 0 {
+		quarters = -quarters
+	}
+	return TimeZone{Offset: quarters * 15, DST: int(b[1] & 0x03)}, nil
+}
+
+// String formats the offset from UTC as ±hh:mm.
+func (tz TimeZone) String() string {
+	sign, offset := '+', tz.Offset
+	if offset < 0 {
+		sign, offset = '-', -offset
+	}
+	return fmt.Sprintf("%c%02d:%02d", sign, offset/60, offset%60)
+}
@@ -0,0 +1,141 @@
+package location
+
+import (
+	"reflect"
+	"testing"
+)
+
+// plmn001 is MCC 001 and MNC 01, plmn310 MCC 310 and MNC 410.
+var (
+	plmn001 = []byte{0x00, 0xf1, 0x10}
+	plmn310 = []byte{0x13, 0x00, 0x14}
+)
+
+func join(parts ...[]byte) []byte {
+	var b []byte
+	for _, p := range parts {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want map[string]string
+	}{
+		{
+			name: "CGI",
+			in:   join([]byte{TypeCGI}, plmn001, []byte{0x12, 0x34, 0xab, 0xcd}),
+			want: map[string]string{"location_type": "CGI", "mcc": "001", "mnc": "01", "lac": "4660", "ci": "43981"},
+		},
+		{
+			name: "SAI",
+			in:   join([]byte{TypeSAI}, plmn001, []byte{0x00, 0x01, 0x00, 0x02}),
+			want: map[string]string{"location_type": "SAI", "mcc": "001", "mnc": "01", "lac": "1", "sac": "2"},
+		},
+		{
+			name: "RAI",
+			in:   join([]byte{TypeRAI}, plmn001, []byte{0x00, 0x01, 0x07}),
+			want: map[string]string{"location_type": "RAI", "mcc": "001", "mnc": "01", "lac": "1", "rac": "7"},
+		},
+		{
+			name: "TAI with a three digit MNC",
+			in:   join([]byte{TypeTAI}, plmn310, []byte{0x01, 0x00}),
+			want: map[string]string{"location_type": "TAI", "mcc": "310", "mnc": "410", "tac": "256"},
+		},
+		{
+			name: "ECGI keeps 28 bits",
+			in:   join([]byte{TypeECGI}, plmn001, []byte{0xf1, 0x23, 0x45, 0x67}),
+			want: map[string]string{"location_type": "ECGI", "mcc": "001", "mnc": "01", "eci": "19088743"},
+		},
+		{
+			name: "TAI+ECGI keeps the PLMN of the ECGI",
+			in:   join([]byte{TypeTAIECGI}, plmn001, []byte{0x00, 0x01}, plmn310, []byte{0x01, 0x23, 0x45, 0x67}),
+			want: map[string]string{"location_type": "TAI+ECGI", "mcc": "310", "mnc": "410", "tac": "1", "eci": "19088743"},
+		},
+		{
+			name: "NCGI keeps 36 bits",
+			in:   join([]byte{TypeNCGI}, plmn001, []byte{0xf0, 0x12, 0x34, 0x56, 0x78}),
+			want: map[string]string{"location_type": "NCGI", "mcc": "001", "mnc": "01", "nci": "305419896"},
+		},
+		{
+			name: "5GS TAI",
+			in:   join([]byte{Type5GSTAI}, plmn001, []byte{0x01, 0x00, 0x00}),
+			want: map[string]string{"location_type": "5GS-TAI", "mcc": "001", "mnc": "01", "tac": "65536"},
+		},
+		{
+			name: "5GS TAI+NCGI",
+			in:   join([]byte{Type5GSNCGI}, plmn001, []byte{0x00, 0x00, 0x02}, plmn001, []byte{0x00, 0x00, 0x00, 0x00, 0x09}),
+			want: map[string]string{"location_type": "5GS-TAI+NCGI", "mcc": "001", "mnc": "01", "tac": "2", "nci": "9"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := Decode(tt.in)
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if loc.Type != tt.in[0] {
+				t.Errorf("Type = %d, want %d", loc.Type, tt.in[0])
+			}
+			if !reflect.DeepEqual(loc.Fields, tt.want) {
+				t.Errorf("Fields = %v, want %v", loc.Fields, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"unknown type", join([]byte{5}, plmn001, []byte{0, 1})},
+		{"no PLMN", []byte{TypeTAI, 0x00}},
+		{"short TAI", join([]byte{TypeTAI}, plmn001, []byte{0x01})},
+		{"TAI+ECGI without ECGI", join([]byte{TypeTAIECGI}, plmn001, []byte{0x00, 0x01})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if loc, err := Decode(tt.in); err == nil {
+				t.Errorf("Decode = %v, want an error", loc)
+			}
+		})
+	}
+}
+
+func TestDecodeTimeZone(t *testing.T) {
+	tests := []struct {
+		in     []byte
+		offset int
+		dst    int
+		text   string
+	}{
+		{[]byte{0x00, 0x00}, 0, 0, "+00:00"},
+		{[]byte{0x80, 0x01}, 120, 1, "+02:00"},
+		{[]byte{0x0a, 0x00}, -300, 0, "-05:00"},
+		{[]byte{0x32, 0x00}, 345, 0, "+05:45"},
+		{[]byte{0x8b, 0x02}, -570, 2, "-09:30"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.text, func(t *testing.T) {
+			tz, err := DecodeTimeZone(tt.in)
+			if err != nil {
+				t.Fatalf("DecodeTimeZone: %v", err)
+			}
+			if tz.Offset != tt.offset || tz.DST != tt.dst {
+				t.Errorf("DecodeTimeZone = %+v, want offset %d and DST %d", tz, tt.offset, tt.dst)
+			}
+			if s := tz.String(); s != tt.text {
+				t.Errorf("String = %q, want %q", s, tt.text)
+			}
+		})
+	}
+
+	if tz, err := DecodeTimeZone([]byte{0x80}); err == nil {
+		t.Errorf("DecodeTimeZone of one octet = %+v, want an error", tz)
+	}
+}
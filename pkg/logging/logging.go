@@ -0,0 +1,170 @@
+// Package logging sets up the structured, levelled log of the agent and
+// redacts the subscriber identities written to it.
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"diametertransfereagent/pkg/config"
+)
+
+// Identities that can be masked in the log.
+const (
+	MaskIMSI   = "imsi"
+	MaskMSISDN = "msisdn"
+	MaskIMEI   = "imei"
+)
+
+var (
+	level = new(slog.LevelVar)
+	// masked holds the identities to mask. Setup swaps in a new map, which
+	// is never changed once stored, so loggers read it without locking.
+	masked atomic.Pointer[map[string]bool]
+)
+
+// Setup makes the default logger, which the log package also writes
+// through, log at the configured level in JSON or text.
+func Setup(cfg config.LogConfig) error {
+	if err := SetLevel(cfg.Level); err != nil {
+		return err
+	}
+	kinds := make(map[string]bool)
+	for _, kind := range cfg.Mask {
+		switch kind = strings.ToLower(kind); kind {
+		case MaskIMSI, MaskMSISDN, MaskIMEI:
+			kinds[kind] = true
+		default:
+			return fmt.Errorf("unknown identity to mask %q", kind)
+		}
+	}
+	masked.Store(&kinds)
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch cfg.Format {
+	case "", "json":
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+// SetLevel changes the level of the log: debug, info, warn or error.
+// Empty is info.
+func SetLevel(name string) error {
+	if name == "" {
+		name = "info"
+	}
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return err
+	}
+	level.Set(l)
+	return nil
+}
+
+// LevelHandler reports the log level on GET and changes it to the level in
+// the body of a PUT or POST.
+func LevelHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut, http.MethodPost:
+			body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := SetLevel(strings.TrimSpace(string(body))); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			slog.Info("Changed log level", "level", level.Level().String())
+		default:
+			w.Header().Set("Allow", "GET, PUT, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		fmt.Fprintln(w, level.Level().String())
+	})
+}
+
+// TransactionID returns a new identifier for a transaction, to correlate
+// its log records from the request to the answer.
+func TransactionID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "0000000000000000"
+	}
+	return hex.EncodeToString(b)
+}
+
+// IMSI is the log attribute of an IMSI, keeping only its MCC and MNC when
+// IMSIs are masked.
+func IMSI(imsi string) slog.Attr {
+	return slog.String("imsi", maskIf(MaskIMSI, imsi, 5, 0))
+}
+
+// MSISDN is the log attribute of an MSISDN, keeping only its last four
+// digits when MSISDNs are masked.
+func MSISDN(msisdn string) slog.Attr {
+	return slog.String("msisdn", maskIf(MaskMSISDN, msisdn, 0, 4))
+}
+
+// IMEI is the log attribute of an IMEI or IMEISV, keeping only its Type
+// Allocation Code when IMEIs are masked.
+func IMEI(imei string) slog.Attr {
+	return slog.String("imei", maskIf(MaskIMEI, imei, 8, 0))
+}
+
+// UserName is the log attribute of a User-Name. Its username commonly holds
+// the IMSI, so it is masked along with IMSIs, keeping the realm and the EAP
+// identity prefix, MCC and MNC.
+func UserName(name string) slog.Attr {
+	if !isMasked(MaskIMSI) {
+		return slog.String("user_name", name)
+	}
+	user, realm, found := strings.Cut(name, "@")
+	head := 5
+	if len(user) == 16 {
+		head = 6
+	}
+	name = mask(user, head, 0)
+	if found {
+		name += "@" + realm
+	}
+	return slog.String("user_name", name)
+}
+
+func isMasked(kind string) bool {
+	kinds := masked.Load()
+	return kinds != nil && (*kinds)[kind]
+}
+
+func maskIf(kind, value string, head, tail int) string {
+	if !isMasked(kind) {
+		return value
+	}
+	return mask(value, head, tail)
+}
+
+// mask replaces all but the first head and the last tail characters of
+// value with asterisks.
+func mask(value string, head, tail int) string {
+	if len(value) <= head+tail {
+		return strings.Repeat("*", len(value))
+	}
+	return value[:head] + strings.Repeat("*", len(value)-head-tail) + value[len(value)-tail:]
+}
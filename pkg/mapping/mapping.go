@@ -0,0 +1,466 @@
+// Package mapping copies values between Diameter AVPs and RADIUS attributes
+// as declared in a mapping file, on top of the translation built into the
+// agent.
+package mapping
+
+import (
+	"bytes"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"diametertransfereagent/pkg/radiusdict"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"gopkg.in/yaml.v3"
+	"layeh.com/radius"
+)
+
+const (
+	// DirectionRequest rules copy AVPs of a Diameter request into the RADIUS
+	// request, DirectionAnswer rules copy attributes of the RADIUS reply into
+	// the Diameter answer.
+	DirectionRequest = "request"
+	DirectionAnswer  = "answer"
+
+	TypeOctets  = "octets"
+	TypeString  = "string"
+	TypeInteger = "integer"
+	TypeAddress = "address"
+	TypeTime    = "time"
+)
+
+// Rule maps one AVP onto one RADIUS attribute. AVP is a path of AVP names
+// through grouped AVPs, such as
+// Service-Information/PS-Information/SGSN-Address. Attribute is the name of
+// a RADIUS attribute in the RADIUS dictionaries, vendor ones included, or a
+// number with Vendor set, by number or name, for Vendor-Specific ones.
+//
+// The value is rendered as text, looked up in Enum and expanded with
+// Template ({{.Value}} is the text) when they are set, then encoded as Type
+// on the RADIUS side or as the dictionary type of the AVP on the Diameter
+// side. Type defaults to the one the RADIUS dictionary gives the attribute.
+// Default is used when the source is absent. Octets copies the value
+// unchanged.
+type Rule struct {
+	Command   string            `yaml:"command" json:"command"`
+	Direction string            `yaml:"direction" json:"direction"`
+	AVP       string            `yaml:"avp" json:"avp"`
+	Attribute string            `yaml:"attribute" json:"attribute"`
+	Vendor    string            `yaml:"vendor" json:"vendor"`
+	Type      string            `yaml:"type" json:"type"`
+	Enum      map[string]string `yaml:"enum" json:"enum"`
+	Template  string            `yaml:"template" json:"template"`
+	Default   string            `yaml:"default" json:"default"`
+}
+
+type file struct {
+	Rules []Rule `yaml:"rules" json:"rules"`
+}
+
+type rule struct {
+	Rule
+	path      []*dict.AVP
+	attribute *radiusdict.Attribute
+	template  *template.Template
+	// attributes is the dictionary the RADIUS attribute is looked up in.
+	attributes *radiusdict.Dictionary
+}
+
+// Mapper applies the rules of a mapping file. A nil Mapper maps nothing.
+type Mapper struct {
+	rules map[string][]*rule
+}
+
+// Load reads a YAML or JSON mapping file and checks its AVP paths against
+// the dictionaries of parser and its RADIUS attributes against attributes.
+func Load(path string, parser *dict.Parser, attributes *radiusdict.Dictionary) (*Mapper, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f file
+	if err := yaml.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing %s: %v", path, err)
+	}
+
+	mp := &Mapper{rules: make(map[string][]*rule)}
+	for i, r := range f.Rules {
+		compiled, err := compile(r, parser, attributes)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d of %s: %v", i+1, path, err)
+		}
+		key := ruleKey(r.Command, r.Direction)
+		mp.rules[key] = append(mp.rules[key], compiled)
+	}
+	slog.Info("Loaded mapping rules", "rules", len(f.Rules), "path", path)
+	return mp, nil
+}
+
+func compile(r Rule, parser *dict.Parser, attributes *radiusdict.Dictionary) (*rule, error) {
+	if r.Command == "" {
+		return nil, fmt.Errorf("no command")
+	}
+	if r.Direction != DirectionRequest && r.Direction != DirectionAnswer {
+		return nil, fmt.Errorf("direction %q is neither %q nor %q", r.Direction, DirectionRequest, DirectionAnswer)
+	}
+	switch r.Type {
+	case "", TypeOctets, TypeString, TypeInteger, TypeAddress, TypeTime:
+	default:
+		return nil, fmt.Errorf("unknown type %q", r.Type)
+	}
+
+	compiled := &rule{Rule: r, attributes: attributes}
+	for _, name := range strings.Split(r.AVP, "/") {
+		a, err := parser.ScanAVP(name)
+		if err != nil {
+			return nil, fmt.Errorf("AVP %q of %q is not in the dictionaries", name, r.AVP)
+		}
+		compiled.path = append(compiled.path, a)
+	}
+	for _, a := range compiled.path[:len(compiled.path)-1] {
+		if a.Data.Type != datatype.GroupedType {
+			return nil, fmt.Errorf("AVP %s of %q is not grouped", a.Name, r.AVP)
+		}
+	}
+	if last := compiled.path[len(compiled.path)-1]; last.Data.Type == datatype.GroupedType {
+		return nil, fmt.Errorf("AVP %s of %q is grouped, name one of its members", last.Name, r.AVP)
+	}
+
+	attr, err := lookupAttribute(attributes, r.Attribute, r.Vendor)
+	if err != nil {
+		return nil, err
+	}
+	compiled.attribute = attr
+	if compiled.Type == "" {
+		compiled.Type = defaultType(attr)
+	}
+
+	if r.Template != "" {
+		t, err := template.New(r.AVP).Option("missingkey=error").Parse(r.Template)
+		if err != nil {
+			return nil, fmt.Errorf("template: %v", err)
+		}
+		compiled.template = t
+	}
+	return compiled, nil
+}
+
+// lookupAttribute finds a RADIUS attribute by name, or by number in the
+// space of vendor.
+func lookupAttribute(attributes *radiusdict.Dictionary, name, vendor string) (*radiusdict.Attribute, error) {
+	if vendor == "" {
+		if a, ok := attributes.Attribute(name); ok {
+			return a, nil
+		}
+	}
+	var vendorID uint32
+	if vendor != "" {
+		v, ok := attributes.Vendor(vendor)
+		if !ok {
+			return nil, fmt.Errorf("unknown RADIUS vendor %q", vendor)
+		}
+		vendorID = v.ID
+	}
+	n, err := strconv.ParseUint(name, 10, 8)
+	if err != nil || n == 0 {
+		return nil, fmt.Errorf("unknown RADIUS attribute %q", name)
+	}
+	return attributes.Numbered(vendorID, uint32(n)), nil
+}
+
+// defaultType is the type of the rules on a, after its dictionary type.
+func defaultType(a *radiusdict.Attribute) string {
+	switch a.Type {
+	case "octets":
+		return TypeOctets
+	case "byte", "short", "integer", "integer64", "signed":
+		return TypeInteger
+	case "date":
+		return TypeTime
+	case "ipaddr", "ipv6addr":
+		return TypeAddress
+	}
+	return TypeString
+}
+
+func ruleKey(command, direction string) string {
+	return strings.ToUpper(command) + "/" + direction
+}
+
+// ToRadius returns the RADIUS attributes the request rules of command make
+// out of a Diameter request.
+func (mp *Mapper) ToRadius(command string, m *diam.Message) radius.Attributes {
+	if mp == nil {
+		return nil
+	}
+	var attrs radius.Attributes
+	for _, r := range mp.rules[ruleKey(command, DirectionRequest)] {
+		values := findPath(m.AVP, r.path)
+		if len(values) == 0 && r.Default == "" {
+			continue
+		}
+		if len(values) == 0 {
+			values = []datatype.Type{datatype.UTF8String(r.Default)}
+		}
+		for _, value := range values {
+			encoded, err := r.toRadius(value)
+			if err != nil {
+				slog.Warn("Failed to map AVP", "avp", r.AVP, "attribute", r.Attribute, "error", err)
+				continue
+			}
+			typ, value, err := r.attribute.Encode(encoded)
+			if err != nil {
+				slog.Warn("Failed to map AVP", "avp", r.AVP, "attribute", r.Attribute, "error", err)
+				continue
+			}
+			attrs.Add(typ, value)
+		}
+	}
+	return attrs
+}
+
+// ToDiameter adds to a Diameter answer the AVPs the answer rules of command
+// make out of the attributes of a RADIUS reply. Rules whose paths share
+// grouped AVPs fill one AVP of each.
+func (mp *Mapper) ToDiameter(command string, attrs radius.Attributes, a *diam.Message) {
+	if mp == nil {
+		return
+	}
+	var avps []*diam.AVP
+	for _, r := range mp.rules[ruleKey(command, DirectionAnswer)] {
+		var values []string
+		for _, value := range r.attributes.Find(attrs, r.attribute) {
+			values = append(values, r.attributeText(value))
+		}
+		if len(values) == 0 && r.Default == "" {
+			continue
+		}
+		if len(values) == 0 {
+			values = []string{r.Default}
+		}
+		for _, value := range values {
+			data, err := r.toDiameter(value)
+			if err != nil {
+				slog.Warn("Failed to map attribute", "attribute", r.Attribute, "avp", r.AVP, "error", err)
+				continue
+			}
+			avps = merge(avps, r.nest(data))
+		}
+	}
+	for _, mapped := range avps {
+		a.AddAVP(mapped)
+	}
+}
+
+func (r *rule) toRadius(value datatype.Type) (radius.Attribute, error) {
+	if r.Type == TypeOctets && r.Enum == nil && r.template == nil {
+		return value.Serialize(), nil
+	}
+	text, err := r.transform(text(value))
+	if err != nil {
+		return nil, err
+	}
+	switch r.Type {
+	case TypeInteger, TypeTime:
+		n, err := strconv.ParseUint(text, 10, 64)
+		if err != nil {
+			// The names of the VALUEs of the attribute stand for their number.
+			var ok bool
+			if n, ok = r.attribute.Value(text); !ok {
+				return nil, err
+			}
+		}
+		return r.attribute.EncodeInteger(n), nil
+	case TypeAddress:
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an address", text)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return radius.Attribute(ip4), nil
+		}
+		return radius.Attribute(ip), nil
+	}
+	return radius.Attribute(text), nil
+}
+
+// attributeText renders a RADIUS attribute value as text according to the
+// type of the rule.
+func (r *rule) attributeText(value []byte) string {
+	switch r.Type {
+	case TypeInteger, TypeTime:
+		switch len(value) {
+		case 1, 2, 4, 8:
+			var n uint64
+			for _, b := range value {
+				n = n<<8 | uint64(b)
+			}
+			return strconv.FormatUint(n, 10)
+		}
+	case TypeAddress:
+		if len(value) == net.IPv4len || len(value) == net.IPv6len {
+			return net.IP(value).String()
+		}
+	}
+	return string(value)
+}
+
+func (r *rule) toDiameter(value string) (datatype.Type, error) {
+	avp := r.path[len(r.path)-1]
+	if r.Type == TypeOctets && r.Enum == nil && r.template == nil {
+		return datatype.Decode(avp.Data.Type, []byte(value))
+	}
+	text, err := r.transform(value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch avp.Data.Type {
+	case datatype.Unsigned32Type:
+		n, err := strconv.ParseUint(text, 10, 32)
+		return datatype.Unsigned32(n), err
+	case datatype.Unsigned64Type:
+		n, err := strconv.ParseUint(text, 10, 64)
+		return datatype.Unsigned64(n), err
+	case datatype.Integer32Type:
+		n, err := strconv.ParseInt(text, 10, 32)
+		return datatype.Integer32(n), err
+	case datatype.EnumeratedType:
+		n, err := strconv.ParseInt(text, 10, 32)
+		return datatype.Enumerated(n), err
+	case datatype.Integer64Type:
+		n, err := strconv.ParseInt(text, 10, 64)
+		return datatype.Integer64(n), err
+	case datatype.AddressType:
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an address", text)
+		}
+		return datatype.Address(ip), nil
+	case datatype.TimeType:
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return datatype.Time(time.Unix(n, 0)), nil
+	case datatype.UTF8StringType:
+		return datatype.UTF8String(text), nil
+	case datatype.DiameterIdentityType:
+		return datatype.DiameterIdentity(text), nil
+	}
+	return datatype.OctetString(text), nil
+}
+
+// transform applies the enum table and the template of the rule.
+func (r *rule) transform(value string) (string, error) {
+	if r.Enum != nil {
+		mapped, ok := r.Enum[value]
+		if !ok {
+			return "", fmt.Errorf("%q is not in the enum table", value)
+		}
+		value = mapped
+	}
+	if r.template != nil {
+		var b bytes.Buffer
+		if err := r.template.Execute(&b, struct{ Value string }{value}); err != nil {
+			return "", err
+		}
+		value = b.String()
+	}
+	return value, nil
+}
+
+// nest wraps the value of the last AVP of the path in the grouped AVPs
+// before it.
+func (r *rule) nest(data datatype.Type) *diam.AVP {
+	last := r.path[len(r.path)-1]
+	a := diam.NewAVP(last.Code, flags(last), last.VendorID, data)
+	for i := len(r.path) - 2; i >= 0; i-- {
+		group := r.path[i]
+		a = diam.NewAVP(group.Code, flags(group), group.VendorID, &diam.GroupedAVP{AVP: []*diam.AVP{a}})
+	}
+	return a
+}
+
+// merge adds a, made by nest, to avps. When avps already has the grouped
+// AVP a is, the members of a are merged into it instead.
+func merge(avps []*diam.AVP, a *diam.AVP) []*diam.AVP {
+	group, ok := a.Data.(*diam.GroupedAVP)
+	if !ok {
+		return append(avps, a)
+	}
+	for i, other := range avps {
+		otherGroup, ok := other.Data.(*diam.GroupedAVP)
+		if !ok || other.Code != a.Code || other.VendorID != a.VendorID {
+			continue
+		}
+		members := otherGroup.AVP
+		for _, member := range group.AVP {
+			members = merge(members, member)
+		}
+		avps[i] = diam.NewAVP(other.Code, other.Flags, other.VendorID, &diam.GroupedAVP{AVP: members})
+		return avps
+	}
+	return append(avps, a)
+}
+
+func flags(a *dict.AVP) uint8 {
+	var f uint8
+	if a.Must != "" && strings.Contains(a.Must, "M") {
+		f |= 0x40
+	}
+	if a.VendorID != 0 {
+		f |= 0x80
+	}
+	return f
+}
+
+// findPath returns the values of the AVPs at the end of path.
+func findPath(avps []*diam.AVP, path []*dict.AVP) []datatype.Type {
+	var values []datatype.Type
+	for _, a := range avps {
+		if a.Code != path[0].Code || a.VendorID != path[0].VendorID {
+			continue
+		}
+		if len(path) == 1 {
+			values = append(values, a.Data)
+			continue
+		}
+		if group, ok := a.Data.(*diam.GroupedAVP); ok {
+			values = append(values, findPath(group.AVP, path[1:])...)
+		}
+	}
+	return values
+}
+
+// text renders an AVP value the way rules see it: numbers in decimal,
+// addresses in their usual notation and times as Unix seconds.
+func text(value datatype.Type) string {
+	switch v := value.(type) {
+	case datatype.Address:
+		return net.IP(v).String()
+	case datatype.IPv4:
+		return net.IP(v).String()
+	case datatype.Time:
+		return strconv.FormatInt(time.Time(v).Unix(), 10)
+	case datatype.Unsigned32:
+		return strconv.FormatUint(uint64(v), 10)
+	case datatype.Unsigned64:
+		return strconv.FormatUint(uint64(v), 10)
+	case datatype.Integer32:
+		return strconv.FormatInt(int64(v), 10)
+	case datatype.Integer64:
+		return strconv.FormatInt(int64(v), 10)
+	case datatype.Enumerated:
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return string(value.Serialize())
+}
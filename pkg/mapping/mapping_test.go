@@ -0,0 +1,135 @@
+package mapping
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"diametertransfereagent/pkg/radiusdict"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
+)
+
+func load(t *testing.T, rules string) (*Mapper, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "mapping.yaml")
+	if err := os.WriteFile(path, []byte(rules), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	return Load(path, dict.Default, radiusdict.New())
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		rule  string
+		error string
+	}{
+		{"unknown AVP", "{command: CCR, direction: request, avp: No-Such-AVP, attribute: User-Name}", "not in the dictionaries"},
+		{"leaf in the path", "{command: CCR, direction: request, avp: Session-Id/User-Name, attribute: User-Name}", "is not grouped"},
+		{"grouped leaf", "{command: CCA, direction: answer, avp: Multiple-Services-Credit-Control, attribute: Class}", "is grouped"},
+		{"unknown attribute", "{command: CCR, direction: request, avp: Session-Id, attribute: No-Such-Attribute}", "unknown RADIUS attribute"},
+		{"direction", "{command: CCR, direction: sideways, avp: Session-Id, attribute: User-Name}", "direction"},
+	}
+	for _, tt := range tests {
+		_, err := load(t, "rules:\n  - "+tt.rule+"\n")
+		if err == nil || !strings.Contains(err.Error(), tt.error) {
+			t.Errorf("%s: Load = %v, want an error about %q", tt.name, err, tt.error)
+		}
+	}
+}
+
+func TestToRadius(t *testing.T) {
+	mp, err := load(t, `
+rules:
+  - {command: CCR, direction: request, avp: Subscription-Id/Subscription-Id-Data, attribute: User-Name, template: "imsi-{{.Value}}"}
+  - {command: CCR, direction: request, avp: CC-Request-Type, attribute: Service-Type, enum: {"1": Framed-User}}
+  - {command: CCR, direction: request, avp: Called-Station-Id, attribute: Called-Station-Id, default: internet}
+`)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	m := diam.NewRequest(diam.CreditControl, 4, dict.Default)
+	m.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(1))
+	m.NewAVP(avp.SubscriptionID, avp.Mbit, 0, &diam.GroupedAVP{AVP: []*diam.AVP{
+		diam.NewAVP(avp.SubscriptionIDType, avp.Mbit, 0, datatype.Enumerated(1)),
+		diam.NewAVP(avp.SubscriptionIDData, avp.Mbit, 0, datatype.UTF8String("001010123456789")),
+	}})
+
+	p := &radius.Packet{Attributes: mp.ToRadius("ccr", m)}
+	if name := rfc2865.UserName_GetString(p); name != "imsi-001010123456789" {
+		t.Errorf("User-Name = %q", name)
+	}
+	if serviceType := rfc2865.ServiceType_Get(p); serviceType != rfc2865.ServiceType_Value_FramedUser {
+		t.Errorf("Service-Type = %v", serviceType)
+	}
+	if station := rfc2865.CalledStationID_GetString(p); station != "internet" {
+		t.Errorf("Called-Station-Id = %q, want the default", station)
+	}
+}
+
+func TestToDiameter(t *testing.T) {
+	mp, err := load(t, `
+rules:
+  - {command: CCA, direction: answer, avp: Multiple-Services-Credit-Control/Granted-Service-Unit/CC-Time, attribute: Session-Timeout}
+  - {command: CCA, direction: answer, avp: Multiple-Services-Credit-Control/Granted-Service-Unit/CC-Total-Octets, attribute: Class, type: integer, default: "18446744073709551615"}
+  - {command: CCA, direction: answer, avp: Multiple-Services-Credit-Control/Validity-Time, attribute: Acct-Interim-Interval}
+`)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	p := radius.New(radius.CodeAccessAccept, []byte("secret"))
+	_ = rfc2865.SessionTimeout_Set(p, 4000000000)
+	_ = rfc2869.AcctInterimInterval_Set(p, 300)
+
+	m := diam.NewRequest(diam.CreditControl, 4, dict.Default)
+	a := m.Answer(diam.Success)
+	mp.ToDiameter("CCA", p.Attributes, a)
+
+	msccs, _ := a.FindAVPs(avp.MultipleServicesCreditControl, 0)
+	if len(msccs) != 1 {
+		t.Fatalf("answer has %d Multiple-Services-Credit-Control, want the rules merged in one", len(msccs))
+	}
+	mscc := msccs[0].Data.(*diam.GroupedAVP)
+	if len(mscc.AVP) != 2 {
+		t.Fatalf("Multiple-Services-Credit-Control = %v, want a Granted-Service-Unit and a Validity-Time", mscc)
+	}
+	var gsu *diam.GroupedAVP
+	for _, member := range mscc.AVP {
+		switch member.Code {
+		case avp.GrantedServiceUnit:
+			gsu = member.Data.(*diam.GroupedAVP)
+		case avp.ValidityTime:
+			if member.Data.(datatype.Unsigned32) != 300 {
+				t.Errorf("Validity-Time = %v", member.Data)
+			}
+		}
+	}
+	if gsu == nil || len(gsu.AVP) != 2 {
+		t.Fatalf("Granted-Service-Unit = %v, want the two units", gsu)
+	}
+	for _, unit := range gsu.AVP {
+		switch unit.Code {
+		case avp.CCTime:
+			if unit.Data.(datatype.Unsigned32) != 4000000000 {
+				t.Errorf("CC-Time = %v", unit.Data)
+			}
+		case avp.CCTotalOctets:
+			if unit.Data.(datatype.Unsigned64) != 18446744073709551615 {
+				t.Errorf("CC-Total-Octets = %v", unit.Data)
+			}
+		}
+	}
+
+	b, err := a.Serialize()
+	if err != nil || len(b) != int(a.Header.MessageLength) {
+		t.Errorf("answer of %d bytes with a Message-Length of %d: %v", len(b), a.Header.MessageLength, err)
+	}
+}
@@ -0,0 +1,109 @@
+// Package metrics holds the Prometheus metrics of the agent and serves them.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "dta"
+
+// Legs of a translated transaction, for InFlight.
+const (
+	LegDiameter = "diameter"
+	LegRadius   = "radius"
+)
+
+// Registry is where the metrics of the agent are registered.
+var Registry = prometheus.NewRegistry()
+
+var (
+	DiameterRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "diameter_requests_total",
+		Help:      "Diameter requests received, by command.",
+	}, []string{"command"})
+
+	DiameterAnswers = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "diameter_answers_total",
+		Help:      "Diameter answers sent, by command and Result-Code.",
+	}, []string{"command", "result_code"})
+
+	DiameterDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "diameter_request_duration_seconds",
+		Help:      "Time from receiving a Diameter request to answering it, by command.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command"})
+
+	DiameterTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "diameter_timeouts_total",
+		Help:      "Diameter requests answered because no RADIUS response came in time, by command.",
+	}, []string{"command"})
+
+	RadiusRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "radius_requests_total",
+		Help:      "RADIUS packets sent, by code and server.",
+	}, []string{"code", "server"})
+
+	RadiusResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "radius_responses_total",
+		Help:      "RADIUS packets received in response, by code and server.",
+	}, []string{"code", "server"})
+
+	RadiusDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "radius_request_duration_seconds",
+		Help:      "Time from sending a RADIUS packet to its response, by request code and server.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"code", "server"})
+
+	RadiusTimeouts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "radius_timeouts_total",
+		Help:      "RADIUS packets that got no response, by server.",
+	}, []string{"server"})
+
+	InFlight = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "inflight_transactions",
+		Help:      "Transactions waiting for an answer, by leg.",
+	}, []string{"leg"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		DiameterRequests, DiameterAnswers, DiameterDuration, DiameterTimeouts,
+		RadiusRequests, RadiusResponses, RadiusDuration, RadiusTimeouts,
+		InFlight,
+	)
+}
+
+// Gauge registers a gauge whose value is read from fn at each scrape.
+func Gauge(name, help string, fn func() float64) {
+	Registry.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, fn))
+}
+
+// ResultCode is the label value of a Result-Code.
+func ResultCode(code uint32) string {
+	return strconv.FormatUint(uint64(code), 10)
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
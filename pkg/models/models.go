@@ -42,6 +42,17 @@ type AuthenticationAuthorizationRequest struct {
 	UserName                 datatype.UTF8String       `avp:"User-Name"`
 	VisitedNetworkIdentifier datatype.Unsigned32       `avp:"Visited-Network-Identifier"`
 	ServiceSelection         datatype.UTF8String       `avp:"Service-Selection"`
+	AuthSessionState         datatype.Enumerated       `avp:"Auth-Session-State"`
+}
+
+type SessionTerminationRequest struct {
+	SessionID         datatype.UTF8String       `avp:"Session-Id"`
+	OriginHost        datatype.DiameterIdentity `avp:"Origin-Host"`
+	OriginRealm       datatype.DiameterIdentity `avp:"Origin-Realm"`
+	DestinationRealm  datatype.DiameterIdentity `avp:"Destination-Realm"`
+	AuthApplicationID datatype.Unsigned32       `avp:"Auth-Application-Id"`
+	TerminationCause  datatype.Enumerated       `avp:"Termination-Cause"`
+	UserName          datatype.UTF8String       `avp:"User-Name"`
 }
 
 type DisconnectPeerRequest struct {
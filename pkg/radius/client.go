@@ -2,17 +2,30 @@ package radius
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"sort"
+	"sync/atomic"
 	"time"
 
 	"diametertransfereagent/pkg/config"
-
-	"github.com/rwxe/overflow"
+	"diametertransfereagent/pkg/logging"
+	"diametertransfereagent/pkg/metrics"
+	"diametertransfereagent/pkg/radiusdict"
+	"diametertransfereagent/pkg/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"layeh.com/radius"
 	"layeh.com/radius/rfc2865"
 	"layeh.com/radius/rfc2866"
+	"layeh.com/radius/rfc2869"
+	"layeh.com/radius/rfc3162"
+	"layeh.com/radius/rfc6911"
 )
 
 const FramedProtocolGPRSPDPContext uint32 = 7
@@ -25,23 +38,56 @@ const (
 )
 
 type AuthRequest struct {
-	Type             RequestType
+	Type             RequestType `script:"readonly"`
 	Username         string
-	Password         string
+	Password         string `script:"-"`
 	NASIPAddress     string
 	NASPortType      rfc2865.NASPortType
 	ServiceType      rfc2865.ServiceType
 	CalledStationID  string
 	CallingStationID string
+	// State and Sticky come from the Access-Accept that authorized the
+	// session, when this request re-authorizes it.
+	State  []byte
+	Sticky radius.Attributes
+	// Mapped holds the attributes added by the mapping rules.
+	Mapped radius.Attributes
+	// Server is the host of the AAA server to send the request to instead
+	// of the configured one.
+	Server string
+	// Servers and Secret are the AAA server group of the translation
+	// profile of the request, when it has one.
+	Servers []string
+	Secret  string `script:"-"`
+	// Log is the logger of the transaction the request belongs to, nil
+	// for the default one.
+	Log *slog.Logger
+	// Context carries the trace of the transaction the request belongs to,
+	// nil for none.
+	Context context.Context
+	// Reply receives the response. It should have room for it, as the
+	// client does not wait for the sender of the request; nil discards it.
+	Reply chan Response
 }
 type AuthResponse struct {
-	Code      radius.Code
+	Code      radius.Code `script:"readonly"`
 	FramedIP  net.IP
 	FramedMTU uint32
+	Class     [][]byte
+	State     []byte
+	// Sticky holds the configured sticky attributes of the Access-Accept.
+	Sticky radius.Attributes
+	// Lifetime of the session in seconds, zero when not limited.
+	SessionTimeout      uint32
+	IdleTimeout         uint32
+	AcctInterimInterval uint32
+	TerminationAction   rfc2865.TerminationAction
+	// Attributes are all the attributes of the reply.
+	Attributes radius.Attributes
 }
 
 type AccRequest struct {
-	Type             RequestType
+	Type             RequestType `script:"readonly"`
 	Username         string
 	Ipv4FramedIP     net.IP
 	Ipv6FramedIP     net.IP
@@ -60,13 +106,45 @@ type AccRequest struct {
 	RATType          string
 	UserLocationInfo string
 	Timezone         string
-	EventTimestamp   string
+	// Location holds the fields decoded from UserLocationInfo and Timezone
+	// (see package location), with the time zone as time_zone and dst.
+	Location         map[string]string
+	EventTimestamp   time.Time
 	UsedInputOctets  uint64
 	UsedOutputOctets uint64
 	Acctsessiontime  uint32
+	// Class and Sticky are echoed from the Access-Accept of the session
+	// (RFC 2865 section 5.25).
+	Class  [][]byte
+	Sticky radius.Attributes
+	// FramedIPv6Prefix is the prefix delegated to the session, nil
+	// for none.
+	FramedIPv6Prefix *net.IPNet
+	// Mapped holds the attributes added by the mapping rules.
+	Mapped radius.Attributes
+	// Server is the host of the AAA server to send the request to instead
+	// of the configured one.
+	Server string
+	// Servers and Secret are the AAA server group of the translation
+	// profile of the request, when it has one.
+	Servers []string
+	Secret  string `script:"-"`
+	// Log is the logger of the transaction the request belongs to, nil
+	// for the default one.
+	Log *slog.Logger
+	// Context carries the trace of the transaction the request belongs to,
+	// nil for none.
+	Context context.Context
+	// AcctTerminateCause is sent with Stop records when set.
+	AcctTerminateCause rfc2866.AcctTerminateCause
+	// Reply receives the response. It should have room for it, as the
+	// client does not wait for the sender of the request; nil discards it.
+	Reply chan Response
 }
 type AccResponse struct {
-	Code radius.Code
+	Code radius.Code `script:"readonly"`
+	// Attributes are all the attributes of the reply.
+	Attributes radius.Attributes
 }
 type Request interface {
 	GetType() RequestType
@@ -90,17 +168,39 @@ func (ar AccResponse) GetCode() radius.Code {
 }
 
 type Client struct {
-	cfg          *config.RadiusConfig
-	requestChan  chan Request // Changed to interface type
-	responseChan chan Response
+	cfg         atomic.Pointer[config.RadiusConfig]
+	attributes  atomic.Pointer[radiusdict.Dictionary]
+	requestChan chan Request // Changed to interface type
+	health      *health
+	// groups are the server groups of the translation profiles, which
+	// probe checks too.
+	groups atomic.Pointer[[]ServerGroup]
+	// transport sends the requests from client_port when it is set.
+	transport *transport
+	// active counts the requests taken off requestChan and not done yet.
+	active atomic.Int64
 }
 
 func (c *Client) Start() {
+	cfg := c.cfg.Load()
+	if cfg.ClientPort != 0 {
+		var err error
+		if c.transport, err = newTransport(cfg.ClientPort); err != nil {
+			log.Fatalf("Failed to bind RADIUS client port %d: %v", cfg.ClientPort, err)
+		}
+	}
 	log.Println("Radius client started")
+	if cfg.StatusInterval > 0 {
+		go c.probe()
+	}
 
 	for req := range c.requestChan {
+		c.active.Add(1)
 		go func(req Request) {
-			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer c.active.Add(-1)
+			ctx := requestContext(req)
+			tracing.Dequeue(ctx)
+			ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 			defer cancel()
 			var err error
 			switch req.GetType() {
@@ -119,7 +219,7 @@ func (c *Client) Start() {
 			}
 
 			if err != nil {
-				log.Println("Failed to send Radius access request:", err)
+				requestLog(req).Error("Failed to send RADIUS request", "error", err)
 			}
 
 		}(req)
@@ -128,154 +228,379 @@ func (c *Client) Start() {
 
 }
 
-func NewClient(cfg config.RadiusConfig, requestChan chan Request, responseChan chan Response) *Client {
-	return &Client{cfg: &cfg, requestChan: requestChan, responseChan: responseChan}
+// Shutdown waits for the queued requests to be sent and for the exchanges in
+// progress to end, such as the Accounting-Stop of the sessions closed while
+// shutting down, or for ctx to be done.
+func (c *Client) Shutdown(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for len(c.requestChan) > 0 || c.active.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d RADIUS requests still pending: %w", len(c.requestChan)+int(c.active.Load()), ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	if c.transport != nil {
+		return c.transport.close()
+	}
+	return nil
 }
 
-func (c *Client) SendAccessRequest(ctx context.Context, req AuthRequest) error {
+// servers are the AAA servers a request goes to, in order: its own server
+// when set, then its server group, otherwise the configured one.
+func servers(cfg *config.RadiusConfig, server string, group []string) []string {
+	if server != "" {
+		return []string{server}
+	}
+	if len(group) > 0 {
+		return group
+	}
+	return []string{cfg.Addr}
+}
+
+// serverAddr is the address of server on port, unless server has a port of
+// its own.
+func serverAddr(server, port string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, port)
+}
+
+func secret(cfg *config.RadiusConfig, secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+	return []byte(cfg.Secret)
+}
+
+// exchange sends packet to each server in turn until one answers, giving
+// each an equal share of the time left.
+func (c *Client) exchange(ctx context.Context, logger *slog.Logger, packet *radius.Packet, servers []string, port string) (*radius.Packet, error) {
+	ctx, span := tracing.Tracer.Start(ctx, "radius.exchange", trace.WithAttributes(
+		attribute.String("radius.code", packet.Code.String()),
+		attribute.StringSlice("radius.servers", servers),
+	))
+	defer span.End()
+
+	var err error
+	for i, server := range servers {
+		span.SetAttributes(attribute.Int("radius.attempts", i+1))
+		attempt, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			attempt, cancel = context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(servers)-i))
+		}
+		var response *radius.Packet
+		response, err = c.exchangeOne(attempt, logger, packet, serverAddr(server, port))
+		cancel()
+		if err == nil {
+			return response, nil
+		}
+		if len(servers) > 1 {
+			logger.Warn("RADIUS server did not answer", "server", server, "error", err)
+		}
+	}
+	span.SetStatus(codes.Error, err.Error())
+	return nil, err
+}
+
+// exchangeOne sends packet to a single server and records the outcome in
+// the metrics, the log and the health of the server.
+func (c *Client) exchangeOne(ctx context.Context, logger *slog.Logger, packet *radius.Packet, addr string) (*radius.Packet, error) {
+	code := packet.Code.String()
+	ctx, span := tracing.Tracer.Start(ctx, "radius.attempt", trace.WithAttributes(attribute.String("radius.server", addr)))
+	defer span.End()
+	metrics.RadiusRequests.WithLabelValues(code, addr).Inc()
+	metrics.InFlight.WithLabelValues(metrics.LegRadius).Inc()
+	defer metrics.InFlight.WithLabelValues(metrics.LegRadius).Dec()
+
+	start := time.Now()
+	var response *radius.Packet
+	var err error
+	if c.transport != nil {
+		response, err = c.transport.exchange(ctx, packet, addr)
+	} else {
+		response, err = radius.Exchange(ctx, packet, addr)
+	}
+	c.health.record(addr, err)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		if errors.Is(err, context.DeadlineExceeded) {
+			metrics.RadiusTimeouts.WithLabelValues(addr).Inc()
+		}
+		return nil, err
+	}
+	metrics.RadiusDuration.WithLabelValues(code, addr).Observe(time.Since(start).Seconds())
+	metrics.RadiusResponses.WithLabelValues(response.Code.String(), addr).Inc()
+	span.SetAttributes(attribute.String("radius.response_code", response.Code.String()))
+	logger.Debug("Received RADIUS response", "server", addr, "request", code,
+		"code", response.Code.String(), "duration", time.Since(start),
+		"attributes", packetAttributes{c.attributes.Load(), response.Attributes})
+	return response, nil
+}
+
+// packetAttributes logs the attributes of a packet by name, decoded with a
+// dictionary, only when the record is written. Subscriber identities are
+// masked like elsewhere and encrypted values left out.
+type packetAttributes struct {
+	dictionary *radiusdict.Dictionary
+	attrs      radius.Attributes
+}
+
+func (p packetAttributes) LogValue() slog.Value {
+	var attrs []slog.Attr
+	for _, f := range p.dictionary.Decode(p.attrs) {
+		value := slog.StringValue(f.String())
+		switch {
+		case f.Attribute.Encrypt != 0:
+			value = slog.StringValue("<redacted>")
+		case f.Name() == "User-Name":
+			value = logging.UserName(f.String()).Value
+		case f.Name() == "3GPP-IMSI":
+			value = logging.IMSI(f.String()).Value
+		case f.Name() == "3GPP-IMEISV":
+			value = logging.IMEI(f.String()).Value
+		case f.Name() == "Calling-Station-Id":
+			value = logging.MSISDN(f.String()).Value
+		}
+		attrs = append(attrs, slog.Attr{Key: f.Name(), Value: value})
+	}
+	return slog.GroupValue(attrs...)
+}
+
+// requestLog returns the logger of a request, or the default one when it
+// has none.
+func requestLog(req Request) *slog.Logger {
+	var logger *slog.Logger
+	switch req := req.(type) {
+	case *AuthRequest:
+		logger = req.Log
+	case *AccRequest:
+		logger = req.Log
+	}
+	if logger == nil {
+		return slog.Default()
+	}
+	return logger
+}
+
+// requestContext returns the context of a request, or an empty one when it
+// has none.
+func requestContext(req Request) context.Context {
+	var ctx context.Context
+	switch req := req.(type) {
+	case *AuthRequest:
+		ctx = req.Context
+	case *AccRequest:
+		ctx = req.Context
+	}
+	if ctx == nil {
+		return context.Background()
+	}
+	return ctx
+}
+
+// NewClient creates the client of the AAA servers. The attributes of their
+// replies are logged as named in attributes.
+func NewClient(cfg config.RadiusConfig, attributes *radiusdict.Dictionary, requestChan chan Request) *Client {
+	c := &Client{requestChan: requestChan, health: newHealth()}
+	c.cfg.Store(&cfg)
+	c.attributes.Store(attributes)
+	return c
+}
+
+// Reload makes new requests use cfg and attributes. The client port and
+// status interval only change on restart.
+func (c *Client) Reload(cfg config.RadiusConfig, attributes *radiusdict.Dictionary) {
+	c.cfg.Store(&cfg)
+	c.attributes.Store(attributes)
+}
 
-	packet := radius.New(radius.CodeAccessRequest, []byte(c.cfg.Secret))
+func (c *Client) SendAccessRequest(ctx context.Context, req AuthRequest) error {
+	cfg := c.cfg.Load()
+	logger := requestLog(&req)
+	packet := radius.New(radius.CodeAccessRequest, secret(cfg, req.Secret))
 	if err := rfc2865.UserName_SetString(packet, req.Username); err != nil {
-		log.Printf("Error Setting Username: %v", err)
+		logger.Error("Failed to set Username", "error", err)
 		return err
 	}
 
 	if err := rfc2865.UserPassword_SetString(packet, req.Password); err != nil {
-		log.Printf("Error Setting Password: %v", err)
+		logger.Error("Failed to set Password", "error", err)
 		return err
 	}
 
 	if err := rfc2865.NASIPAddress_Set(packet, net.ParseIP(req.NASIPAddress)); err != nil {
-		log.Printf("Error Setting NASIPAddress: %v", err)
+		logger.Error("Failed to set NASIPAddress", "error", err)
 		return err
 	}
 
 	if err := rfc2865.NASPortType_Set(packet, req.NASPortType); err != nil {
-		log.Printf("Error Setting NASPortType: %v", err)
+		logger.Error("Failed to set NASPortType", "error", err)
 		return err
 	}
 
 	if err := rfc2865.ServiceType_Set(packet, req.ServiceType); err != nil {
-		log.Printf("Error Setting ServiceType: %v", err)
+		logger.Error("Failed to set ServiceType", "error", err)
 		return err
 	}
 
 	if err := rfc2865.CalledStationID_SetString(packet, req.CalledStationID); err != nil {
-		log.Printf("Error Setting CalledStationID: %v", err)
+		logger.Error("Failed to set CalledStationID", "error", err)
 		return err
 	}
 
 	if err := rfc2865.CallingStationID_SetString(packet, req.CallingStationID); err != nil {
-		log.Printf("Error Setting CallingStationID: %v", err)
+		logger.Error("Failed to set CallingStationID", "error", err)
 		return err
 	}
 
 	packet.Attributes.Add(rfc2865.FramedProtocol_Type, radius.NewInteger(FramedProtocolGPRSPDPContext))
 
-	authaddress := c.cfg.Addr + ":" + "1812"
+	if req.State != nil {
+		if err := rfc2865.State_Set(packet, req.State); err != nil {
+			logger.Error("Failed to set State", "error", err)
+			return err
+		}
+	}
+	addAttributes(packet, req.Sticky)
+	addAttributes(packet, req.Mapped)
 
-	response, err := radius.Exchange(ctx, packet, authaddress)
+	response, err := c.exchange(ctx, logger, packet, servers(cfg, req.Server, req.Servers), "1812")
 	if err != nil {
-		log.Printf("Respone error: %v", err)
 		return err
 	}
 	framedIP := rfc2865.FramedIPAddress_Get(response)
 	framedMTU := uint32(rfc2865.FramedMTU_Get(response))
+	class, _ := rfc2865.Class_Gets(response)
+	state, _ := rfc2865.State_Lookup(response)
 
-	// Send the response back through the response channel
-	c.responseChan <- AuthResponse{
+	if req.Reply == nil {
+		return nil
+	}
+	req.Reply <- AuthResponse{
 		Code:      response.Code,
 		FramedIP:  framedIP,
 		FramedMTU: framedMTU,
+		Class:     class,
+		State:     state,
+		Sticky:    stickyAttributes(cfg, response),
+
+		SessionTimeout:      uint32(rfc2865.SessionTimeout_Get(response)),
+		IdleTimeout:         uint32(rfc2865.IdleTimeout_Get(response)),
+		AcctInterimInterval: uint32(rfc2869.AcctInterimInterval_Get(response)),
+		TerminationAction:   rfc2865.TerminationAction_Get(response),
+		Attributes:          response.Attributes,
 	}
 	return nil
 }
 
 func (c *Client) SendAcctRequest(ctx context.Context, req AccRequest) error {
-
-	packet := radius.New(radius.CodeAccountingRequest, []byte(c.cfg.Secret))
+	cfg := c.cfg.Load()
+	logger := requestLog(&req)
+	packet := radius.New(radius.CodeAccountingRequest, secret(cfg, req.Secret))
 
 	if err := rfc2865.UserName_SetString(packet, req.Username); err != nil {
-		log.Printf("Error Setting UserName: %v", err)
+		logger.Error("Failed to set UserName", "error", err)
 		return err
 	}
 
 	if err := rfc2866.AcctStatusType_Set(packet, req.AcctStatus); err != nil {
-		log.Printf("Error Setting AcctStatusType: %v", err)
+		logger.Error("Failed to set AcctStatusType", "error", err)
 		return err
 	}
 
-	if req.PDPType == 0 {
+	if req.Ipv4FramedIP != nil {
 		if err := rfc2865.FramedIPAddress_Set(packet, req.Ipv4FramedIP); err != nil {
-			log.Printf("Error Setting FramedIPAddress: %v", err)
+			logger.Error("Failed to set FramedIPAddress", "error", err)
 			return err
 		}
-	} else {
-		if err := rfc2865.FramedIPAddress_Set(packet, req.Ipv4FramedIP); err != nil {
-			log.Printf("Error Setting FramedIPAddress: %v", err)
+	}
+	if req.Ipv6FramedIP != nil {
+		if err := rfc6911.FramedIPv6Address_Set(packet, req.Ipv6FramedIP); err != nil {
+			logger.Error("Failed to set FramedIPv6Address", "error", err)
 			return err
 		}
-		if err := rfc2865.FramedIPAddress_Set(packet, req.Ipv6FramedIP); err != nil {
-			log.Printf("Error Setting FramedIPAddressipv6: %v", err)
+	}
+	if req.FramedIPv6Prefix != nil {
+		if err := rfc3162.FramedIPv6Prefix_Set(packet, req.FramedIPv6Prefix); err != nil {
+			logger.Error("Failed to set FramedIPv6Prefix", "error", err)
 			return err
 		}
 	}
 
 	if err := rfc2865.CalledStationID_SetString(packet, req.CalledStationID); err != nil {
-		log.Printf("Error Setting CalledStationID: %v", err)
+		logger.Error("Failed to set CalledStationID", "error", err)
 		return err
 	}
 
 	if err := rfc2866.AcctSessionID_Set(packet, []byte(req.AcctSessionID)); err != nil {
-		log.Printf("Error Setting AcctSessionID: %v", err)
+		logger.Error("Failed to set AcctSessionID", "error", err)
 		return err
 	}
 
+	for _, class := range req.Class {
+		if err := rfc2865.Class_Add(packet, class); err != nil {
+			logger.Error("Failed to set Class", "error", err)
+			return err
+		}
+	}
+	addAttributes(packet, req.Sticky)
+	addAttributes(packet, req.Mapped)
+
 	switch req.AcctStatus {
 
 	case rfc2866.AcctStatusType_Value_Start:
 
 		if err := rfc2866.AcctDelayTime_Set(packet, req.AcctDelayTime); err != nil {
-			log.Printf("Error Setting AcctDelayTime: %v", err)
+			logger.Error("Failed to set AcctDelayTime", "error", err)
 			return err
 		}
 
-	case rfc2866.AcctStatusType_Value_InterimUpdate:
+	case rfc2866.AcctStatusType_Value_InterimUpdate, rfc2866.AcctStatusType_Value_Stop:
 
-		if inputOctets, ok := overflow.Uint64ToUint32(req.UsedInputOctets); !ok {
-			log.Printf("UsedInputOctets value too large: %d", req.UsedInputOctets)
-			return fmt.Errorf("UsedInputOctets value too large: %d", req.UsedInputOctets)
-		} else {
-			if err := rfc2866.AcctInputOctets_Set(packet, rfc2866.AcctInputOctets(inputOctets)); err != nil {
-				log.Printf("Error Setting AcctInputOctets: %v", err)
-				return err
-			}
+		// Totals above 32 bits carry their high part in the Gigawords
+		// attributes (RFC 2869 section 5.1).
+		if err := rfc2866.AcctInputOctets_Set(packet, rfc2866.AcctInputOctets(uint32(req.UsedInputOctets))); err != nil {
+			logger.Error("Failed to set AcctInputOctets", "error", err)
+			return err
+		}
+		if err := rfc2869.AcctInputGigawords_Set(packet, rfc2869.AcctInputGigawords(req.UsedInputOctets>>32)); err != nil {
+			logger.Error("Failed to set AcctInputGigawords", "error", err)
+			return err
 		}
 
-		if outputOctets, ok := overflow.Uint64ToUint32(req.UsedOutputOctets); !ok {
-			log.Printf("UsedOutputOctets value too large: %d", req.UsedOutputOctets)
-			return fmt.Errorf("UsedOutputOctets value too large: %d", req.UsedOutputOctets)
-		} else {
-			if err := rfc2866.AcctOutputOctets_Set(packet, rfc2866.AcctOutputOctets(outputOctets)); err != nil {
-				log.Printf("Error Setting AcctOutputOctets: %v", err)
-				return err
-			}
+		if err := rfc2866.AcctOutputOctets_Set(packet, rfc2866.AcctOutputOctets(uint32(req.UsedOutputOctets))); err != nil {
+			logger.Error("Failed to set AcctOutputOctets", "error", err)
+			return err
+		}
+		if err := rfc2869.AcctOutputGigawords_Set(packet, rfc2869.AcctOutputGigawords(req.UsedOutputOctets>>32)); err != nil {
+			logger.Error("Failed to set AcctOutputGigawords", "error", err)
+			return err
 		}
 
 		if err := rfc2866.AcctInputPackets_Set(packet, 0); err != nil {
-			log.Printf("Error Setting AcctInputPackets: %v", err)
+			logger.Error("Failed to set AcctInputPackets", "error", err)
 			return err
 		}
 
 		if err := rfc2866.AcctOutputPackets_Set(packet, 0); err != nil {
-			log.Printf("Error Setting AcctOutputPackets: %v", err)
+			logger.Error("Failed to set AcctOutputPackets", "error", err)
 			return err
 		}
 
 		if err := rfc2866.AcctSessionTime_Set(packet, rfc2866.AcctSessionTime(req.Acctsessiontime)); err != nil {
-			log.Printf("Error Setting AcctSessionTime: %v", err)
+			logger.Error("Failed to set AcctSessionTime", "error", err)
 			return err
 		}
+
+		if req.AcctTerminateCause != 0 {
+			if err := rfc2866.AcctTerminateCause_Set(packet, req.AcctTerminateCause); err != nil {
+				logger.Error("Failed to set AcctTerminateCause", "error", err)
+				return err
+			}
+		}
 	}
 
 	// Helper function to add Vendor-Specific AVPs
@@ -319,28 +644,68 @@ func (c *Client) SendAcctRequest(ctx context.Context, req AccRequest) error {
 		return fmt.Errorf("failed to add RAT-Type: %v", err)
 	}
 
-	if err := addVendorSpecific(vendorID, 22, []byte(req.UserLocationInfo)); err != nil { // User Location Info
-		return fmt.Errorf("failed to add User Location Info: %v", err)
+	if req.UserLocationInfo != "" {
+		if err := addVendorSpecific(vendorID, 22, []byte(req.UserLocationInfo)); err != nil { // User Location Info
+			return fmt.Errorf("failed to add User Location Info: %v", err)
+		}
+	}
+
+	if req.Timezone != "" {
+		if err := addVendorSpecific(vendorID, 23, []byte(req.Timezone)); err != nil { // MS Timezone
+			return fmt.Errorf("failed to add MS Timezone: %v", err)
+		}
 	}
 
-	if err := addVendorSpecific(vendorID, 23, []byte(req.Timezone)); err != nil { // MS Timezone
-		return fmt.Errorf("failed to add MS Timezone: %v", err)
+	if !req.EventTimestamp.IsZero() {
+		if err := rfc2869.EventTimestamp_Set(packet, req.EventTimestamp); err != nil {
+			logger.Error("Failed to set EventTimestamp", "error", err)
+			return err
+		}
 	}
 
-	// if err := addVendorSpecific(vendorID, 55, []byte(req.EventTimestamp)); err != nil { // Event Timestamp
-	// 	return fmt.Errorf("failed to add Event Timestamp: %v", err)
-	// }
-	accaddress := c.cfg.Addr + ":" + "1813"
-	response, err := radius.Exchange(ctx, packet, accaddress)
+	if attrs := cfg.LocationAttributes; attrs.Vendor != 0 {
+		names := make([]string, 0, len(attrs.Types))
+		for name := range attrs.Types {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if value, ok := req.Location[name]; ok {
+				if err := addVendorSpecific(attrs.Vendor, attrs.Types[name], []byte(value)); err != nil {
+					return fmt.Errorf("failed to add %s: %v", name, err)
+				}
+			}
+		}
+	}
+	response, err := c.exchange(ctx, logger, packet, servers(cfg, req.Server, req.Servers), "1813")
 	if err != nil {
-		log.Printf("Respone error: %v", err)
 		return err
 	}
 
-	log.Printf("Respone: %v", response.Code)
-	c.responseChan <- AccResponse{
-		Code: response.Code,
+	if req.Reply != nil {
+		req.Reply <- AccResponse{Code: response.Code, Attributes: response.Attributes}
 	}
 	return nil
 
 }
+
+// stickyAttributes returns the attributes of an Access-Accept whose type is
+// listed in sticky_attributes.
+func stickyAttributes(cfg *config.RadiusConfig, p *radius.Packet) radius.Attributes {
+	var sticky radius.Attributes
+	for _, avp := range p.Attributes {
+		for _, t := range cfg.StickyAttributes {
+			if int(avp.Type) == t {
+				sticky.Add(avp.Type, avp.Attribute)
+				break
+			}
+		}
+	}
+	return sticky
+}
+
+func addAttributes(packet *radius.Packet, attrs radius.Attributes) {
+	for _, avp := range attrs {
+		packet.Attributes.Add(avp.Type, avp.Attribute)
+	}
+}
@@ -0,0 +1,325 @@
+package radius_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+	agent "diametertransfereagent/pkg/radius"
+	"diametertransfereagent/pkg/radiusdict"
+	"diametertransfereagent/pkg/radiustest"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+)
+
+const testSecret = "secret"
+
+// testTimeout bounds the exchanges of the cases where the server does not
+// answer in time.
+const testTimeout = 300 * time.Millisecond
+
+func newClient(t *testing.T, srv *radiustest.Server) *agent.Client {
+	t.Helper()
+	cfg := config.RadiusConfig{Addr: srv.Addr, Secret: testSecret, StickyAttributes: []int{int(rfc2865.Class_Type)}}
+	return agent.NewClient(cfg, radiusdict.New(), make(chan agent.Request))
+}
+
+func accessRequest(reply chan agent.Response) agent.AuthRequest {
+	return agent.AuthRequest{
+		Type:             agent.AccessRequest,
+		Username:         "001010000000001",
+		Password:         "password",
+		NASIPAddress:     "127.0.0.1",
+		NASPortType:      rfc2865.NASPortType_Value_Virtual,
+		ServiceType:      rfc2865.ServiceType_Value_FramedUser,
+		CalledStationID:  "internet",
+		CallingStationID: "15551234567",
+		Reply:            reply,
+	}
+}
+
+func TestSendAccessRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		response radiustest.Response
+		// code is the code of the reply, zero when the exchange fails.
+		code  radius.Code
+		check func(*testing.T, agent.AuthResponse)
+	}{
+		{
+			name: "accept",
+			response: radiustest.Accept(
+				radiustest.Attr("Framed-IP-Address", "10.0.0.1"),
+				radiustest.Attr("Framed-MTU", "1400"),
+				radiustest.Attr("Class", "0x0102"),
+				radiustest.Attr("Session-Timeout", "3600"),
+				radiustest.Attr("Idle-Timeout", "600"),
+				radiustest.Attr("Acct-Interim-Interval", "300"),
+				radiustest.Attr("Termination-Action", "RADIUS-Request"),
+			),
+			code: radius.CodeAccessAccept,
+			check: func(t *testing.T, r agent.AuthResponse) {
+				if r.FramedIP.String() != "10.0.0.1" || r.FramedMTU != 1400 {
+					t.Errorf("FramedIP, FramedMTU = %s, %d", r.FramedIP, r.FramedMTU)
+				}
+				if len(r.Class) != 1 || !bytes.Equal(r.Class[0], []byte{1, 2}) {
+					t.Errorf("Class = %x", r.Class)
+				}
+				if len(r.Sticky) != 1 || r.Sticky[0].Type != rfc2865.Class_Type {
+					t.Errorf("Sticky = %v, want the Class", r.Sticky)
+				}
+				if r.SessionTimeout != 3600 || r.IdleTimeout != 600 || r.AcctInterimInterval != 300 {
+					t.Errorf("timeouts = %d, %d, %d", r.SessionTimeout, r.IdleTimeout, r.AcctInterimInterval)
+				}
+				if r.TerminationAction != rfc2865.TerminationAction_Value_RADIUSRequest {
+					t.Errorf("TerminationAction = %v", r.TerminationAction)
+				}
+			},
+		},
+		{
+			name:     "reject",
+			response: radiustest.Reject(radiustest.Attr("Reply-Message", "no")),
+			code:     radius.CodeAccessReject,
+			check: func(t *testing.T, r agent.AuthResponse) {
+				if r.FramedIP != nil {
+					t.Errorf("FramedIP = %s", r.FramedIP)
+				}
+			},
+		},
+		{
+			name:     "challenge",
+			response: radiustest.Challenge(radiustest.Attr("State", "0xabcd")),
+			code:     radius.CodeAccessChallenge,
+			check: func(t *testing.T, r agent.AuthResponse) {
+				if !bytes.Equal(r.State, []byte{0xab, 0xcd}) {
+					t.Errorf("State = %x", r.State)
+				}
+			},
+		},
+		{
+			name:     "delayed within the timeout",
+			response: radiustest.Accept().After(testTimeout / 3),
+			code:     radius.CodeAccessAccept,
+		},
+		{
+			name:     "delayed beyond the timeout",
+			response: radiustest.Accept().After(2 * testTimeout),
+		},
+		{
+			name:     "dropped",
+			response: radiustest.Drop(),
+		},
+		{
+			name:     "malformed",
+			response: radiustest.Malformed(),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := radiustest.NewServer(testSecret)
+			defer srv.Close()
+			srv.On(radiustest.Code(radius.CodeAccessRequest), tt.response)
+			c := newClient(t, srv)
+
+			reply := make(chan agent.Response, 1)
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			err := c.SendAccessRequest(ctx, accessRequest(reply))
+
+			received := srv.Received()
+			if len(received) != 1 {
+				t.Fatalf("server received %d requests, want 1", len(received))
+			}
+			p := received[0]
+			if !p.Authentic {
+				t.Errorf("request is not authentic")
+			}
+			if name, _ := p.Value("User-Name"); name != "001010000000001" {
+				t.Errorf("User-Name = %q", name)
+			}
+			if station, _ := p.Value("Called-Station-Id"); station != "internet" {
+				t.Errorf("Called-Station-Id = %q", station)
+			}
+			if password := rfc2865.UserPassword_GetString(p.Packet); password != "password" {
+				t.Errorf("User-Password = %q", password)
+			}
+
+			if tt.code == 0 {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("SendAccessRequest = %v, want a timeout", err)
+				}
+				if len(reply) != 0 {
+					t.Errorf("got a reply: %v", <-reply)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendAccessRequest: %v", err)
+			}
+			r := (<-reply).(agent.AuthResponse)
+			if r.Code != tt.code {
+				t.Errorf("Code = %v, want %v", r.Code, tt.code)
+			}
+			if tt.check != nil {
+				tt.check(t, r)
+			}
+		})
+	}
+}
+
+func TestSendAcctRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   rfc2866.AcctStatusType
+		response radiustest.Response
+		ok       bool
+	}{
+		{"start", rfc2866.AcctStatusType_Value_Start, radiustest.Accept(), true},
+		{"stop", rfc2866.AcctStatusType_Value_Stop, radiustest.Accept(), true},
+		{"rejected", rfc2866.AcctStatusType_Value_Start, radiustest.Reject(), false},
+		{"dropped", rfc2866.AcctStatusType_Value_InterimUpdate, radiustest.Drop(), false},
+		{"malformed", rfc2866.AcctStatusType_Value_Stop, radiustest.Malformed(), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			srv := radiustest.NewServer(testSecret)
+			defer srv.Close()
+			srv.On(radiustest.Code(radius.CodeAccountingRequest), tt.response)
+			c := newClient(t, srv)
+
+			reply := make(chan agent.Response, 1)
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			err := c.SendAcctRequest(ctx, agent.AccRequest{
+				Type:               agent.AccountingRequest,
+				Username:           "001010000000001",
+				AcctStatus:         tt.status,
+				AcctSessionID:      "0000000100000001",
+				IMSI:               "001010000000001",
+				Ipv6FramedIP:       net.ParseIP("2001:db8::1"),
+				FramedIPv6Prefix:   &net.IPNet{IP: net.ParseIP("2001:db8:1::"), Mask: net.CIDRMask(64, 128)},
+				UsedInputOctets:    5<<32 + 7,
+				AcctTerminateCause: rfc2866.AcctTerminateCause_Value_UserRequest,
+				Reply:              reply,
+			})
+
+			received := srv.Received()
+			if len(received) != 1 {
+				t.Fatalf("server received %d requests, want 1", len(received))
+			}
+			p := received[0]
+			if !p.Authentic {
+				t.Errorf("request is not authentic")
+			}
+			if id, _ := p.Value("Acct-Session-Id"); id != "0000000100000001" {
+				t.Errorf("Acct-Session-Id = %q", id)
+			}
+			if imsi, _ := p.Value("3GPP-IMSI"); imsi != "001010000000001" {
+				t.Errorf("3GPP-IMSI = %q", imsi)
+			}
+			if ip, ok := p.Value("Framed-IP-Address"); ok {
+				t.Errorf("Framed-IP-Address = %q, want the IPv6 address in Framed-IPv6-Address", ip)
+			}
+			if ip, _ := p.Value("Framed-IPv6-Address"); ip != "2001:db8::1" {
+				t.Errorf("Framed-IPv6-Address = %q", ip)
+			}
+			if prefix, _ := p.Value("Framed-IPv6-Prefix"); prefix != "2001:db8:1::/64" {
+				t.Errorf("Framed-IPv6-Prefix = %q", prefix)
+			}
+			if tt.status != rfc2866.AcctStatusType_Value_Start {
+				if octets, _ := p.Value("Acct-Input-Octets"); octets != "7" {
+					t.Errorf("Acct-Input-Octets = %q", octets)
+				}
+				if gigawords, _ := p.Value("Acct-Input-Gigawords"); gigawords != "5" {
+					t.Errorf("Acct-Input-Gigawords = %q", gigawords)
+				}
+			}
+
+			if !tt.ok {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Errorf("SendAcctRequest = %v, want a timeout", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendAcctRequest: %v", err)
+			}
+			if r := <-reply; r.GetCode() != radius.CodeAccountingResponse {
+				t.Errorf("Code = %v", r.GetCode())
+			}
+		})
+	}
+}
+
+// TestFailover checks that a request goes to the next server of its group
+// when one does not answer.
+func TestFailover(t *testing.T) {
+	down := radiustest.NewServer(testSecret)
+	defer down.Close()
+	down.On(radiustest.Any(), radiustest.Drop())
+	up := radiustest.NewServer(testSecret)
+	defer up.Close()
+	c := newClient(t, up)
+
+	req := accessRequest(make(chan agent.Response, 1))
+	req.Servers = []string{down.Addr, up.Addr}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*testTimeout)
+	defer cancel()
+	if err := c.SendAccessRequest(ctx, req); err != nil {
+		t.Fatalf("SendAccessRequest: %v", err)
+	}
+	if r := <-req.Reply; r.GetCode() != radius.CodeAccessAccept {
+		t.Errorf("Code = %v", r.GetCode())
+	}
+	if n, m := len(down.Received()), len(up.Received()); n != 1 || m != 1 {
+		t.Errorf("servers received %d and %d requests, want 1 each", n, m)
+	}
+}
+
+// TestReplies checks that concurrent requests queued to the client each get
+// the response to their own request.
+func TestReplies(t *testing.T) {
+	srv := radiustest.NewServer(testSecret)
+	defer srv.Close()
+	for i := 0; i < 10; i++ {
+		user := fmt.Sprintf("user%d", i)
+		srv.On(radiustest.Equal("User-Name", user), radiustest.Accept(
+			radiustest.Attr("Framed-IP-Address", fmt.Sprintf("10.0.0.%d", i)),
+		).After(time.Duration(10-i)*10*time.Millisecond))
+	}
+
+	requests := make(chan agent.Request)
+	c := agent.NewClient(config.RadiusConfig{Addr: srv.Addr, Secret: testSecret}, radiusdict.New(), requests)
+	go c.Start()
+	defer close(requests)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			req := accessRequest(make(chan agent.Response, 1))
+			req.Username = fmt.Sprintf("user%d", i)
+			requests <- &req
+			select {
+			case r := <-req.Reply:
+				if ip := r.(agent.AuthResponse).FramedIP.String(); ip != fmt.Sprintf("10.0.0.%d", i) {
+					t.Errorf("user%d got the response for %s", i, ip)
+				}
+			case <-time.After(2 * time.Second):
+				t.Errorf("user%d got no response", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,100 @@
+package radius
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+
+	"diametertransfereagent/pkg/config"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc3576"
+)
+
+// DynamicAuthorizer applies the Disconnect and CoA requests of RFC 5176 to
+// the Diameter sessions they target. A zero Error-Cause means the request
+// succeeded.
+type DynamicAuthorizer interface {
+	Disconnect(ctx context.Context, req *radius.Request) (rfc3576.ErrorCause, error)
+	ChangeOfAuthorization(ctx context.Context, req *radius.Request) (rfc3576.ErrorCause, error)
+}
+
+// DAEServer is the Dynamic Authorization Extensions listener the AAA server
+// uses to disconnect or re-authorize subscribers.
+type DAEServer struct {
+	cfg        atomic.Pointer[config.RadiusConfig]
+	authorizer DynamicAuthorizer
+	server     *radius.PacketServer
+}
+
+func NewDAEServer(cfg config.RadiusConfig, authorizer DynamicAuthorizer) *DAEServer {
+	s := &DAEServer{authorizer: authorizer}
+	s.cfg.Store(&cfg)
+	return s
+}
+
+// Reload makes the listener check new requests with the secret of cfg. Its
+// address only changes on restart.
+func (s *DAEServer) Reload(cfg config.RadiusConfig) {
+	s.cfg.Store(&cfg)
+}
+
+// RADIUSSecret is the secret the AAA server signs its requests with.
+func (s *DAEServer) RADIUSSecret(ctx context.Context, remoteAddr net.Addr) ([]byte, error) {
+	return []byte(s.cfg.Load().Secret), nil
+}
+
+func (s *DAEServer) Start() {
+	s.server = &radius.PacketServer{
+		Addr:         s.cfg.Load().DAEAddr,
+		Handler:      radius.HandlerFunc(s.handleDAERequest),
+		SecretSource: s,
+	}
+	go serve(s.server, "dynamic authorization")
+}
+
+// Shutdown stops accepting Disconnect and CoA requests and waits for those
+// being handled to be answered, or for ctx to be done.
+func (s *DAEServer) Shutdown(ctx context.Context) error {
+	if s.server == nil {
+		return nil
+	}
+	return shutdown(ctx, s.server)
+}
+
+func (s *DAEServer) handleDAERequest(w radius.ResponseWriter, r *radius.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), gatewayTimeout)
+	defer cancel()
+
+	var cause rfc3576.ErrorCause
+	var err error
+	var ack, nak radius.Code
+	switch r.Code {
+	case radius.CodeDisconnectRequest:
+		log.Printf("Handling Disconnect-Request from %s", r.RemoteAddr)
+		cause, err = s.authorizer.Disconnect(ctx, r)
+		ack, nak = radius.CodeDisconnectACK, radius.CodeDisconnectNAK
+	case radius.CodeCoARequest:
+		log.Printf("Handling CoA-Request from %s", r.RemoteAddr)
+		cause, err = s.authorizer.ChangeOfAuthorization(ctx, r)
+		ack, nak = radius.CodeCoAACK, radius.CodeCoANAK
+	default:
+		log.Printf("Ignoring %s from %s on the dynamic authorization port", r.Code, r.RemoteAddr)
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to handle %s: %v", r.Code, err)
+	}
+
+	reply := r.Response(ack)
+	if cause != 0 {
+		reply = r.Response(nak)
+		if err := rfc3576.ErrorCause_Set(reply, cause); err != nil {
+			log.Printf("Error Setting ErrorCause: %v", err)
+		}
+	}
+	if err := w.Write(reply); err != nil {
+		log.Printf("Failed to send %s to %s: %v", reply.Code, r.RemoteAddr, err)
+	}
+}
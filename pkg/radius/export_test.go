@@ -0,0 +1,8 @@
+package radius
+
+// Hooks for the tests of package radius_test.
+var (
+	ProbeAll         = (*Client).probeAll
+	ReadyAt          = ready
+	HealthRetryAfter = healthRetryAfter
+)
@@ -1,13 +1,117 @@
 package radius
 
 import (
-	"fmt"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
 	"log"
+	"log/slog"
+	"time"
+
+	"diametertransfereagent/pkg/logging"
 
 	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2869"
 )
 
-func HandleAccessRequest(c *Client, packet *radius.Packet) {
-	log.Printf("Handling Access-Request for user: %s", fmt.Sprintf("%v", packet))
-	// Add your handling logic here
+const gatewayTimeout = 5 * time.Second
+
+func (s *Server) handleAccessRequest(w radius.ResponseWriter, r *radius.Request) {
+	if r.Code != radius.CodeAccessRequest {
+		log.Printf("Ignoring %s from %s on the authentication port", r.Code, r.RemoteAddr)
+		return
+	}
+	logger := packetLog(r)
+	logger.Debug("Handling Access-Request")
+
+	if len(rfc2869.EAPMessage_Get(r.Packet)) > 0 && !validMessageAuthenticator(r.Packet) {
+		logger.Warn("Dropping Access-Request: invalid Message-Authenticator")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), gatewayTimeout)
+	defer cancel()
+
+	reply, err := s.gateway.Authenticate(ctx, r)
+	if err != nil {
+		logger.Error("Failed to authenticate", "error", err)
+		reply = r.Response(radius.CodeAccessReject)
+	}
+	if reply == nil {
+		return
+	}
+	if len(rfc2869.EAPMessage_Get(reply)) > 0 {
+		if err := SetMessageAuthenticator(reply); err != nil {
+			logger.Error("Failed to set Message-Authenticator", "error", err)
+			return
+		}
+	}
+	if err := w.Write(reply); err != nil {
+		logger.Error("Failed to send reply", "code", reply.Code.String(), "error", err)
+		return
+	}
+	logger.Info("Sent reply", "code", reply.Code.String())
+}
+
+func (s *Server) handleAccountingRequest(w radius.ResponseWriter, r *radius.Request) {
+	if r.Code != radius.CodeAccountingRequest {
+		log.Printf("Ignoring %s from %s on the accounting port", r.Code, r.RemoteAddr)
+		return
+	}
+	logger := packetLog(r)
+	logger.Debug("Handling Accounting-Request")
+
+	ctx, cancel := context.WithTimeout(r.Context(), gatewayTimeout)
+	defer cancel()
+
+	// RFC 2866 forbids answering when the record could not be stored, so
+	// that the NAS retransmits it.
+	reply, err := s.gateway.Account(ctx, r)
+	if err != nil {
+		logger.Error("Failed to account", "error", err)
+		return
+	}
+	if reply == nil {
+		return
+	}
+	if err := w.Write(reply); err != nil {
+		logger.Error("Failed to send reply", "code", reply.Code.String(), "error", err)
+		return
+	}
+	logger.Info("Sent reply", "code", reply.Code.String())
+}
+
+// packetLog is the logger of a request received from a NAS, with the fields
+// identifying its transaction and subscriber.
+func packetLog(r *radius.Request) *slog.Logger {
+	return slog.Default().With(
+		slog.String("txn_id", logging.TransactionID()),
+		slog.String("request", r.Code.String()),
+		slog.Int("identifier", int(r.Identifier)),
+		slog.String("remote_addr", r.RemoteAddr.String()),
+		logging.UserName(rfc2865.UserName_GetString(r.Packet)),
+	)
+}
+
+// validMessageAuthenticator checks the Message-Authenticator of a request.
+func validMessageAuthenticator(p *radius.Packet) bool {
+	received := rfc2869.MessageAuthenticator_Get(p)
+	if len(received) != md5.Size {
+		return false
+	}
+	clone := *p
+	clone.Attributes = make(radius.Attributes, len(p.Attributes))
+	copy(clone.Attributes, p.Attributes)
+	if err := rfc2869.MessageAuthenticator_Set(&clone, make([]byte, md5.Size)); err != nil {
+		return false
+	}
+	b, err := clone.MarshalBinary()
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(md5.New, p.Secret)
+	mac.Write(b)
+	return bytes.Equal(mac.Sum(nil), received)
 }
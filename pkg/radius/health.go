@@ -0,0 +1,156 @@
+package radius
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+)
+
+// ServerHealth is what the client last saw of an AAA server. Any response
+// counts as an answer, an Access-Reject included.
+type ServerHealth struct {
+	Server       string    `json:"server"`
+	Up           bool      `json:"up"`
+	LastAnswered time.Time `json:"last_answered"`
+	LastFailed   time.Time `json:"last_failed"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+// healthRetryAfter is how long a server that failed is held down. Past it,
+// Ready no longer counts the failure, so that an agent taken out of service
+// while its servers were down gets traffic again to find out whether they
+// are back.
+const healthRetryAfter = time.Minute
+
+// ServerGroup is an AAA server group of a translation profile, which probe
+// checks along with the configured server.
+type ServerGroup struct {
+	Servers []string
+	// Secret is the shared secret of the group, empty for the configured
+	// one.
+	Secret string
+}
+
+// health tracks the AAA servers from the outcome of the exchanges with them.
+type health struct {
+	mu      sync.Mutex
+	servers map[string]*ServerHealth
+}
+
+func newHealth() *health {
+	return &health{servers: make(map[string]*ServerHealth)}
+}
+
+func (h *health) record(addr string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	server, ok := h.servers[addr]
+	if !ok {
+		server = &ServerHealth{Server: addr}
+		h.servers[addr] = server
+	}
+	server.Up = err == nil
+	if err == nil {
+		server.LastAnswered = time.Now()
+		server.LastError = ""
+	} else {
+		server.LastFailed = time.Now()
+		server.LastError = err.Error()
+	}
+}
+
+// Health returns the AAA servers the client exchanged with, by address.
+func (c *Client) Health() []ServerHealth {
+	c.health.mu.Lock()
+	defer c.health.mu.Unlock()
+	servers := make([]ServerHealth, 0, len(c.health.servers))
+	for _, server := range c.health.servers {
+		servers = append(servers, *server)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Server < servers[j].Server })
+	return servers
+}
+
+// Ready fails when none of the AAA servers answered its last request within
+// healthRetryAfter. It succeeds before any request was sent, as soon as
+// any server answers again, and once the failures are older than
+// healthRetryAfter.
+func (c *Client) Ready() error {
+	return ready(c.Health(), time.Now())
+}
+
+func ready(servers []ServerHealth, now time.Time) error {
+	var down []string
+	for _, server := range servers {
+		if server.Up || now.Sub(server.LastFailed) >= healthRetryAfter {
+			return nil
+		}
+		down = append(down, fmt.Sprintf("%s: %s", server.Server, server.LastError))
+	}
+	if len(down) == 0 {
+		return nil
+	}
+	return errors.New("no RADIUS server answered: " + strings.Join(down, "; "))
+}
+
+// SetServerGroups makes probe check the AAA servers of groups too. It is
+// called with the server groups of the translation profiles at start and
+// on reload.
+func (c *Client) SetServerGroups(groups []ServerGroup) {
+	c.groups.Store(&groups)
+}
+
+// probeTargets are the AAA servers probe checks, by address on the
+// authentication port, with their secrets: the configured server and those
+// of the server groups.
+func (c *Client) probeTargets() map[string]string {
+	cfg := c.cfg.Load()
+	targets := map[string]string{serverAddr(cfg.Addr, "1812"): cfg.Secret}
+	if groups := c.groups.Load(); groups != nil {
+		for _, group := range *groups {
+			for _, server := range group.Servers {
+				targets[serverAddr(server, "1812")] = string(secret(cfg, group.Secret))
+			}
+		}
+	}
+	return targets
+}
+
+// probe sends a Status-Server (RFC 5997) to each AAA server every
+// status_interval seconds, so that its liveness is known without traffic.
+func (c *Client) probe() {
+	interval := time.Duration(c.cfg.Load().StatusInterval) * time.Second
+	for range time.Tick(interval) {
+		c.probeAll(interval / 2)
+	}
+}
+
+// probeAll sends a Status-Server to each AAA server at once and waits up to
+// timeout for their answers.
+func (c *Client) probeAll(timeout time.Duration) {
+	var wg sync.WaitGroup
+	for addr, key := range c.probeTargets() {
+		packet := radius.New(radius.CodeStatusServer, []byte(key))
+		if err := SetMessageAuthenticator(packet); err != nil {
+			slog.Error("Failed to set Message-Authenticator", "error", err)
+			continue
+		}
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if _, err := c.exchangeOne(ctx, slog.Default(), packet, addr); err != nil {
+				slog.Warn("RADIUS server did not answer Status-Server", "server", addr, "error", err)
+			}
+		}(addr)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,85 @@
+package radius_test
+
+import (
+	"testing"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+	agent "diametertransfereagent/pkg/radius"
+	"diametertransfereagent/pkg/radiusdict"
+	"diametertransfereagent/pkg/radiustest"
+
+	"layeh.com/radius"
+)
+
+func TestReady(t *testing.T) {
+	now := time.Now()
+	down := agent.ServerHealth{Server: "192.0.2.1:1812", LastFailed: now, LastError: "timeout"}
+	up := agent.ServerHealth{Server: "192.0.2.2:1812", Up: true, LastAnswered: now}
+	tests := []struct {
+		name    string
+		servers []agent.ServerHealth
+		now     time.Time
+		ready   bool
+	}{
+		{name: "no request sent", now: now, ready: true},
+		{name: "server down", servers: []agent.ServerHealth{down}, now: now},
+		{name: "another server up", servers: []agent.ServerHealth{down, up}, now: now, ready: true},
+		{name: "failure held down", servers: []agent.ServerHealth{down}, now: now.Add(agent.HealthRetryAfter / 2)},
+		{name: "failure timed out", servers: []agent.ServerHealth{down}, now: now.Add(agent.HealthRetryAfter), ready: true},
+	}
+	for _, tt := range tests {
+		if err := agent.ReadyAt(tt.servers, tt.now); (err == nil) != tt.ready {
+			t.Errorf("%s: ready = %v, want ready %t", tt.name, err, tt.ready)
+		}
+	}
+}
+
+// TestProbe checks that the configured server and those of the profiles
+// are probed, each with its own secret, and that readiness comes back with
+// the first answer.
+func TestProbe(t *testing.T) {
+	srv := radiustest.NewServer(testSecret)
+	defer srv.Close()
+	group := radiustest.NewServer("group-secret")
+	defer group.Close()
+	srv.On(radiustest.Any(), radiustest.Drop()).Times(1)
+
+	cfg := config.RadiusConfig{Addr: srv.Addr, Secret: testSecret}
+	c := agent.NewClient(cfg, radiusdict.New(), make(chan agent.Request))
+	c.SetServerGroups([]agent.ServerGroup{
+		{Servers: []string{group.Addr}, Secret: "group-secret"},
+		// A server of several groups is probed once.
+		{Servers: []string{srv.Addr}},
+	})
+
+	agent.ProbeAll(c, testTimeout)
+	for _, s := range []*radiustest.Server{srv, group} {
+		received := s.Received()
+		if len(received) != 1 || received[0].Code != radius.CodeStatusServer || !received[0].Authentic {
+			t.Fatalf("%s received %v, want one authentic Status-Server", s.Addr, received)
+		}
+	}
+	health := c.Health()
+	if len(health) != 2 {
+		t.Fatalf("Health = %+v, want both servers", health)
+	}
+	for _, server := range health {
+		if server.Up != (server.Server == group.Addr) {
+			t.Errorf("%s up = %t", server.Server, server.Up)
+		}
+	}
+
+	// Once the only server of a client is down, it is not ready until the
+	// server answers again.
+	srv.On(radiustest.Any(), radiustest.Drop()).Times(1)
+	alone := agent.NewClient(cfg, radiusdict.New(), make(chan agent.Request))
+	agent.ProbeAll(alone, testTimeout)
+	if err := alone.Ready(); err == nil {
+		t.Errorf("Ready with the server down")
+	}
+	agent.ProbeAll(alone, testTimeout)
+	if err := alone.Ready(); err != nil {
+		t.Errorf("Ready = %v after the server answered", err)
+	}
+}
@@ -0,0 +1,99 @@
+package radius
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"log"
+
+	"diametertransfereagent/pkg/config"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+)
+
+// Gateway forwards the requests received by the RADIUS server to the
+// Diameter core and returns the RADIUS reply to send back. A nil reply
+// means the request must be silently discarded.
+type Gateway interface {
+	Authenticate(ctx context.Context, req *radius.Request) (*radius.Packet, error)
+	Account(ctx context.Context, req *radius.Request) (*radius.Packet, error)
+}
+
+// Server is the RADIUS front end that lets NAS and WLAN gateways reach the
+// Diameter core.
+type Server struct {
+	cfg     *config.RadiusServerConfig
+	gateway Gateway
+	servers []*radius.PacketServer
+}
+
+func NewServer(cfg config.RadiusServerConfig, gateway Gateway) *Server {
+	return &Server{cfg: &cfg, gateway: gateway}
+}
+
+func (s *Server) Start() {
+	secret := radius.StaticSecretSource([]byte(s.cfg.Secret))
+
+	if s.cfg.AuthAddr != "" {
+		server := &radius.PacketServer{
+			Addr:         s.cfg.AuthAddr,
+			Handler:      radius.HandlerFunc(s.handleAccessRequest),
+			SecretSource: secret,
+		}
+		s.servers = append(s.servers, server)
+		go serve(server, "authentication")
+	}
+
+	if s.cfg.AcctAddr != "" {
+		server := &radius.PacketServer{
+			Addr:         s.cfg.AcctAddr,
+			Handler:      radius.HandlerFunc(s.handleAccountingRequest),
+			SecretSource: secret,
+		}
+		s.servers = append(s.servers, server)
+		go serve(server, "accounting")
+	}
+}
+
+// Shutdown stops accepting requests and waits for those being handled to be
+// answered, or for ctx to be done.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return shutdown(ctx, s.servers...)
+}
+
+// serve runs a RADIUS listener until it is shut down.
+func serve(server *radius.PacketServer, name string) {
+	log.Printf("Starting radius %s server on %s", name, server.Addr)
+	if err := server.ListenAndServe(); !errors.Is(err, radius.ErrServerShutdown) {
+		log.Fatal(err)
+	}
+}
+
+func shutdown(ctx context.Context, servers ...*radius.PacketServer) error {
+	var errs []error
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("radius server %s: %w", server.Addr, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// SetMessageAuthenticator adds the Message-Authenticator attribute required
+// in replies carrying EAP-Message (RFC 3579 section 3.2).
+func SetMessageAuthenticator(p *radius.Packet) error {
+	p.Attributes.Del(rfc2869.MessageAuthenticator_Type)
+	if err := rfc2869.MessageAuthenticator_Set(p, make([]byte, md5.Size)); err != nil {
+		return err
+	}
+	b, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(md5.New, p.Secret)
+	mac.Write(b)
+	return rfc2869.MessageAuthenticator_Set(p, mac.Sum(nil))
+}
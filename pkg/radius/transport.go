@@ -0,0 +1,149 @@
+package radius
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+)
+
+const retransmitInterval = time.Second
+
+// transport sends every request of the client from one UDP socket bound to
+// client_port, as radius.Exchange would from a socket of its own. Responses
+// are told apart by the server they come from and their Identifier, which
+// is assigned here so that no two pending requests to a server share one.
+type transport struct {
+	conn net.PacketConn
+
+	mu      sync.Mutex
+	pending map[transportKey]chan []byte
+	next    map[string]byte
+}
+
+type transportKey struct {
+	addr       string
+	identifier byte
+}
+
+func newTransport(port int) (*transport, error) {
+	conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, err
+	}
+	t := &transport{conn: conn, pending: make(map[transportKey]chan []byte), next: make(map[string]byte)}
+	go t.read()
+	return t, nil
+}
+
+func (t *transport) read() {
+	buf := make([]byte, radius.MaxPacketLength)
+	for {
+		n, addr, err := t.conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			slog.Error("Failed to read RADIUS response", "error", err)
+			continue
+		}
+		if n < 20 {
+			continue
+		}
+		key := transportKey{addr: addr.String(), identifier: buf[1]}
+		t.mu.Lock()
+		responses, ok := t.pending[key]
+		t.mu.Unlock()
+		if !ok {
+			slog.Debug("Dropping unexpected RADIUS response", "server", key.addr, "identifier", key.identifier)
+			continue
+		}
+		select {
+		case responses <- append([]byte(nil), buf[:n]...):
+		default:
+		}
+	}
+}
+
+// exchange sends packet to the server at addr with a free Identifier,
+// resending it every second, and waits for the authentic response.
+func (t *transport) exchange(ctx context.Context, packet *radius.Packet, addr string) (*radius.Packet, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	key, responses, err := t.register(raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	defer t.release(key)
+
+	p := *packet
+	p.Identifier = key.identifier
+	p.Attributes = append(radius.Attributes(nil), packet.Attributes...)
+	if _, ok := p.Attributes.Lookup(rfc2869.MessageAuthenticator_Type); ok {
+		if err := SetMessageAuthenticator(&p); err != nil {
+			return nil, err
+		}
+	}
+	wire, err := p.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := t.conn.WriteTo(wire, raddr); err != nil {
+		return nil, err
+	}
+
+	retransmit := time.NewTicker(retransmitInterval)
+	defer retransmit.Stop()
+	for {
+		select {
+		case b := <-responses:
+			response, err := radius.Parse(b, p.Secret)
+			if err != nil || !radius.IsAuthenticResponse(b, wire, p.Secret) {
+				slog.Debug("Dropping invalid RADIUS response", "server", key.addr, "identifier", key.identifier)
+				continue
+			}
+			return response, nil
+		case <-retransmit.C:
+			if _, err := t.conn.WriteTo(wire, raddr); err != nil {
+				return nil, err
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// register reserves the next Identifier not pending towards addr.
+func (t *transport) register(addr string) (transportKey, chan []byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := 0; i < 256; i++ {
+		key := transportKey{addr: addr, identifier: t.next[addr]}
+		t.next[addr]++
+		if _, busy := t.pending[key]; busy {
+			continue
+		}
+		responses := make(chan []byte, 1)
+		t.pending[key] = responses
+		return key, responses, nil
+	}
+	return transportKey{}, nil, fmt.Errorf("all 256 RADIUS identifiers towards %s are in use", addr)
+}
+
+func (t *transport) release(key transportKey) {
+	t.mu.Lock()
+	delete(t.pending, key)
+	t.mu.Unlock()
+}
+
+func (t *transport) close() error {
+	return t.conn.Close()
+}
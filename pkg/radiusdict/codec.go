@@ -0,0 +1,379 @@
+package radiusdict
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"layeh.com/radius"
+)
+
+// Field is an attribute of a packet decoded with a dictionary. The
+// Vendor-Specific, extended and TLV attributes are decoded into the
+// attributes they carry.
+type Field struct {
+	Attribute *Attribute
+	Value     []byte
+}
+
+// Decode returns the attributes of a packet as fields. Fragmented long
+// extended attributes are put back together; the fragments of vendors with
+// a continuation byte are decoded apart.
+func (d *Dictionary) Decode(attrs radius.Attributes) []Field {
+	var fields []Field
+	for i := 0; i < len(attrs); i++ {
+		a := d.Numbered(0, uint32(attrs[i].Type))
+		value := []byte(attrs[i].Attribute)
+		if a.Type == "long-extended" && len(value) >= 2 && value[1]&0x80 != 0 {
+			value = append([]byte{value[0], 0}, value[2:]...)
+			for i+1 < len(attrs) && attrs[i+1].Type == attrs[i].Type {
+				i++
+				next := attrs[i].Attribute
+				if len(next) < 2 || next[0] != value[0] {
+					break
+				}
+				value = append(value, next[2:]...)
+				if next[1]&0x80 == 0 {
+					break
+				}
+			}
+		}
+		fields = append(fields, d.decode(a, value)...)
+	}
+	return fields
+}
+
+// Find returns the values of the attribute a in a packet.
+func (d *Dictionary) Find(attrs radius.Attributes, a *Attribute) [][]byte {
+	var values [][]byte
+	for _, f := range d.Decode(attrs) {
+		if f.Attribute.VendorID() == a.VendorID() && oidString(f.Attribute.OID) == oidString(a.OID) {
+			values = append(values, f.Value)
+		}
+	}
+	return values
+}
+
+func (d *Dictionary) decode(a *Attribute, value []byte) []Field {
+	switch a.Type {
+	case "vsa":
+		vendor, payload, err := radius.VendorSpecific(value)
+		if err != nil {
+			break
+		}
+		if fields, ok := d.decodeVendor(vendor, payload); ok {
+			return fields
+		}
+	case "extended":
+		if len(value) >= 1 {
+			return d.decode(d.child(a, value[0]), value[1:])
+		}
+	case "long-extended":
+		if len(value) >= 2 {
+			return d.decode(d.child(a, value[0]), value[2:])
+		}
+	case "evs":
+		if len(value) >= 5 {
+			return d.decode(d.Numbered(binary.BigEndian.Uint32(value), uint32(value[4])), value[5:])
+		}
+	case "tlv":
+		var fields []Field
+		rest := value
+		for len(rest) >= 2 && int(rest[1]) >= 2 && int(rest[1]) <= len(rest) {
+			fields = append(fields, d.decode(d.child(a, rest[0]), rest[2:rest[1]])...)
+			rest = rest[rest[1]:]
+		}
+		if len(rest) == 0 {
+			return fields
+		}
+	default:
+		return []Field{{Attribute: a, Value: value}}
+	}
+	// The value does not hold what its type says it should.
+	return []Field{{Attribute: a, Value: value}}
+}
+
+// decodeVendor decodes the attributes of a Vendor-Specific attribute in the
+// format of their vendor.
+func (d *Dictionary) decodeVendor(vendor uint32, payload []byte) ([]Field, bool) {
+	v, ok := d.vendorIDs[vendor]
+	if !ok {
+		v = &Vendor{ID: vendor, TypeSize: 1, LengthSize: 1}
+	}
+	header := v.TypeSize + v.LengthSize
+	if v.Continuation {
+		header++
+	}
+
+	var fields []Field
+	for len(payload) > 0 {
+		if len(payload) < header {
+			return nil, false
+		}
+		n := uint32(readUint(payload[:v.TypeSize]))
+		length := len(payload)
+		if v.LengthSize > 0 {
+			length = int(readUint(payload[v.TypeSize : v.TypeSize+v.LengthSize]))
+		}
+		if length < header || length > len(payload) {
+			return nil, false
+		}
+		fields = append(fields, d.decode(d.Numbered(vendor, n), payload[header:length])...)
+		payload = payload[length:]
+	}
+	return fields, true
+}
+
+func (d *Dictionary) child(parent *Attribute, n byte) *Attribute {
+	if a := parent.child(uint32(n)); a != nil {
+		return a
+	}
+	return d.unknown(0, parent, uint32(n))
+}
+
+// Name is the name of the attribute of the field.
+func (f Field) Name() string {
+	return f.Attribute.Name
+}
+
+// String renders the value of the field according to the type of its
+// attribute, with the name of integer values when the dictionary has one.
+// Values that do not fit their type are rendered in hexadecimal.
+func (f Field) String() string {
+	a, v := f.Attribute, f.Value
+	if a.HasTag && len(v) > 0 && v[0] < 0x20 && (a.Type == "string" || a.Type == "integer" && len(v) == 4) {
+		if a.Type == "integer" {
+			v = append([]byte{0}, v[1:]...)
+		} else {
+			v = v[1:]
+		}
+	}
+	switch a.Type {
+	case "string":
+		if utf8.Valid(v) {
+			return string(v)
+		}
+	case "byte", "short", "integer", "integer64":
+		if n, ok := integerValue(a, v); ok {
+			if name, ok := a.ValueName(n); ok {
+				return name
+			}
+			return strconv.FormatUint(n, 10)
+		}
+	case "signed":
+		if len(v) == 4 {
+			return strconv.FormatInt(int64(int32(binary.BigEndian.Uint32(v))), 10)
+		}
+	case "date":
+		if len(v) == 4 {
+			return time.Unix(int64(binary.BigEndian.Uint32(v)), 0).UTC().Format(time.RFC3339)
+		}
+	case "ipaddr", "ipv6addr", "combo-ip":
+		if len(v) == net.IPv4len && a.Type != "ipv6addr" || len(v) == net.IPv6len && a.Type != "ipaddr" {
+			return net.IP(v).String()
+		}
+	case "ipv6prefix":
+		if len(v) >= 2 && len(v) <= 18 && int(v[1]) <= 128 {
+			ip := make(net.IP, net.IPv6len)
+			copy(ip, v[2:])
+			return fmt.Sprintf("%s/%d", ip, v[1])
+		}
+	case "ipv4prefix":
+		if len(v) == 6 && int(v[1]&0x3f) <= 32 {
+			return fmt.Sprintf("%s/%d", net.IP(v[2:]), v[1]&0x3f)
+		}
+	case "ifid":
+		if len(v) == 8 {
+			s := hex.EncodeToString(v)
+			return strings.Join([]string{s[0:4], s[4:8], s[8:12], s[12:16]}, ":")
+		}
+	case "ether":
+		if len(v) == 6 {
+			return net.HardwareAddr(v).String()
+		}
+	}
+	return "0x" + hex.EncodeToString(v)
+}
+
+// integerValue reads an integer of the size of the type of a.
+func integerValue(a *Attribute, v []byte) (uint64, bool) {
+	if len(v) != a.size() {
+		return 0, false
+	}
+	return readUint(v), true
+}
+
+func readUint(b []byte) uint64 {
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+// size is the size of the integer types.
+func (a *Attribute) size() int {
+	switch a.Type {
+	case "byte":
+		return 1
+	case "short":
+		return 2
+	case "integer64":
+		return 8
+	}
+	return 4
+}
+
+// EncodeInteger returns n in the size of the integer type of a, four bytes
+// for the other types.
+func (a *Attribute) EncodeInteger(n uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, n)
+	return b[8-a.size():]
+}
+
+// Parse encodes the text of a value of a, as rendered by Field.String: the
+// name or number of integers, addresses and prefixes in their usual notation,
+// dates in RFC 3339 or as Unix seconds and octets in hexadecimal after 0x.
+func (a *Attribute) Parse(text string) ([]byte, error) {
+	switch a.Type {
+	case "string":
+		return []byte(text), nil
+	case "byte", "short", "integer", "integer64":
+		n, ok := a.Value(text)
+		if !ok {
+			var err error
+			if n, err = strconv.ParseUint(text, 10, a.size()*8); err != nil {
+				return nil, fmt.Errorf("%s: %q is neither a number nor a value name", a.Name, text)
+			}
+		}
+		return a.EncodeInteger(n), nil
+	case "signed":
+		n, err := strconv.ParseInt(text, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Name, err)
+		}
+		return binary.BigEndian.AppendUint32(nil, uint32(n)), nil
+	case "date":
+		if t, err := time.Parse(time.RFC3339, text); err == nil {
+			return binary.BigEndian.AppendUint32(nil, uint32(t.Unix())), nil
+		}
+		n, err := strconv.ParseUint(text, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q is not a date", a.Name, text)
+		}
+		return binary.BigEndian.AppendUint32(nil, uint32(n)), nil
+	case "ipaddr", "ipv6addr", "combo-ip":
+		ip := net.ParseIP(text)
+		if ip4 := ip.To4(); ip4 != nil && a.Type != "ipv6addr" {
+			return ip4, nil
+		}
+		if ip != nil && ip.To4() == nil && a.Type != "ipaddr" {
+			return ip, nil
+		}
+		return nil, fmt.Errorf("%s: %q is not an %s", a.Name, text, a.Type)
+	case "ipv6prefix", "ipv4prefix":
+		_, prefix, err := net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Name, err)
+		}
+		ones, bits := prefix.Mask.Size()
+		if a.Type == "ipv4prefix" {
+			if bits != 8*net.IPv4len {
+				return nil, fmt.Errorf("%s: %q is not an IPv4 prefix", a.Name, text)
+			}
+			return append([]byte{0, byte(ones)}, prefix.IP.To4()...), nil
+		}
+		if bits != 8*net.IPv6len {
+			return nil, fmt.Errorf("%s: %q is not an IPv6 prefix", a.Name, text)
+		}
+		return append([]byte{0, byte(ones)}, prefix.IP[:(ones+7)/8]...), nil
+	case "ifid":
+		b, err := hex.DecodeString(strings.ReplaceAll(text, ":", ""))
+		if err != nil || len(b) != 8 {
+			return nil, fmt.Errorf("%s: %q is not an interface id", a.Name, text)
+		}
+		return b, nil
+	case "ether":
+		mac, err := net.ParseMAC(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Name, err)
+		}
+		return mac, nil
+	}
+	if hexText, ok := strings.CutPrefix(text, "0x"); ok {
+		b, err := hex.DecodeString(hexText)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", a.Name, err)
+		}
+		return b, nil
+	}
+	return []byte(text), nil
+}
+
+// Encode returns the attribute of a packet carrying value as a: a itself,
+// or the Vendor-Specific, extended or TLV attribute it goes in.
+func (a *Attribute) Encode(value []byte) (radius.Type, radius.Attribute, error) {
+	top := a
+	for ; top.parent != nil; top = top.parent {
+		n := byte(top.Number())
+		switch top.parent.Type {
+		case "tlv":
+			if len(value) > 253 {
+				return 0, nil, fmt.Errorf("%s: value of %d bytes is too long", a.Name, len(value))
+			}
+			value = append([]byte{n, byte(len(value) + 2)}, value...)
+		case "extended":
+			value = append([]byte{n}, value...)
+		case "long-extended":
+			value = append([]byte{n, 0}, value...)
+		}
+	}
+
+	typ := radius.Type(top.Number())
+	if v := top.Vendor; v != nil {
+		if v.Extended != 0 {
+			// Extended-Vendor-Specific (RFC 6929 section 2.4)
+			evs := binary.BigEndian.AppendUint32([]byte{26}, v.ID)
+			if v.Extended >= 245 {
+				evs = append([]byte{26, 0}, evs[1:]...)
+			}
+			value = append(append(evs, byte(top.Number())), value...)
+			typ = radius.Type(v.Extended)
+		} else {
+			header := make([]byte, v.TypeSize+v.LengthSize)
+			putUint(header[:v.TypeSize], uint64(top.Number()))
+			length := len(header) + len(value)
+			if v.Continuation {
+				header = append(header, 0)
+				length++
+			}
+			putUint(header[v.TypeSize:v.TypeSize+v.LengthSize], uint64(length))
+			value = append(header, value...)
+			if len(value) > 249 {
+				return 0, nil, fmt.Errorf("%s: value of %d bytes is too long", a.Name, len(value))
+			}
+			vsa, err := radius.NewVendorSpecific(v.ID, value)
+			if err != nil {
+				return 0, nil, fmt.Errorf("%s: %w", a.Name, err)
+			}
+			return radius.Type(26), vsa, nil
+		}
+	}
+	if len(value) > 253 {
+		return 0, nil, fmt.Errorf("%s: value of %d bytes is too long", a.Name, len(value))
+	}
+	return typ, value, nil
+}
+
+func putUint(b []byte, n uint64) {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i] = byte(n)
+		n >>= 8
+	}
+}
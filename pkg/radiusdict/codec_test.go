@@ -0,0 +1,150 @@
+package radiusdict
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"layeh.com/radius"
+)
+
+func TestRoundTrip(t *testing.T) {
+	d := loadTestDictionary(t)
+
+	tests := []struct {
+		name  string
+		text  string
+		typ   radius.Type
+		value []byte
+	}{
+		{"User-Name", "alice@example.org", 1, []byte("alice@example.org")},
+		{"Service-Type", "Framed-User", 6, []byte{0, 0, 0, 2}},
+		{"Framed-IP-Address", "10.0.0.1", 8, []byte{10, 0, 0, 1}},
+		{"Framed-IPv6-Prefix", "2001:db8::/32", 97, []byte{0, 32, 0x20, 0x01, 0x0d, 0xb8}},
+		{"Class", "0x0102ff", 25, []byte{1, 2, 0xff}},
+		{"3GPP-Charging-Id", "42", 26, []byte{0, 0, 0x28, 0xaf, 2, 6, 0, 0, 0, 42}},
+		{"Cisco-AVPair", "ip:addr-pool=gold", 26, append([]byte{0, 0, 0, 9, 1, 19}, "ip:addr-pool=gold"...)},
+		{"Cisco-Disconnect-Cause", "Idle-Timeout", 26, []byte{0, 0, 0, 9, 195, 6, 0, 0, 0, 4}},
+		{"Lucent-Max-Shared-Users", "3", 26, []byte{0, 0, 0x12, 0xee, 0, 2, 0, 8, 0, 0, 0, 3}},
+		{"WiMAX-Release", "2.1", 26, []byte{0, 0, 0x60, 0xb5, 1, 8, 0, 1, 5, '2', '.', '1'}},
+		{"WiMAX-Accounting-Capabilities", "1", 26, []byte{0, 0, 0x60, 0xb5, 1, 6, 0, 2, 3, 1}},
+		{"Example-Extended", "192.0.2.1", 241, []byte{1, 192, 0, 2, 1}},
+		{"Example-Long", "0xabcd", 245, []byte{1, 0, 0xab, 0xcd}},
+		{"Nokia-Long-Octets", "0x01", 245, []byte{26, 0, 0, 0, 0, 94, 1, 1}},
+		{"Included-Attribute", "7", 251, []byte{0, 0, 0, 7}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := mustAttribute(t, d, tt.name)
+			value, err := a.Parse(tt.text)
+			if err != nil {
+				t.Fatalf("Parse(%q): %v", tt.text, err)
+			}
+			typ, attr, err := a.Encode(value)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if typ != tt.typ || !bytes.Equal(attr, tt.value) {
+				t.Fatalf("Encode = %d %x, want %d %x", typ, []byte(attr), tt.typ, tt.value)
+			}
+
+			fields := d.Decode(radius.Attributes{{Type: typ, Attribute: attr}})
+			if len(fields) != 1 {
+				t.Fatalf("Decode = %v, want one field", fields)
+			}
+			if fields[0].Attribute != a || fields[0].String() != tt.text {
+				t.Errorf("Decode = %s %s, want %s %s", fields[0].Name(), fields[0], tt.name, tt.text)
+			}
+			if values := d.Find(radius.Attributes{{Type: 44, Attribute: radius.Attribute("x")}, {Type: typ, Attribute: attr}}, a); len(values) != 1 || !bytes.Equal(values[0], value) {
+				t.Errorf("Find = %x, want %x", values, value)
+			}
+		})
+	}
+}
+
+func TestDecode(t *testing.T) {
+	d := loadTestDictionary(t)
+	vsa := func(vendor uint32, payload ...byte) radius.Attribute {
+		attr, err := radius.NewVendorSpecific(vendor, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return attr
+	}
+
+	tests := []struct {
+		name  string
+		attrs radius.Attributes
+		want  []string
+	}{
+		{
+			name:  "several attributes in one Vendor-Specific",
+			attrs: radius.Attributes{{Type: 26, Attribute: vsa(9, 1, 5, 'a', '=', 'b', 1, 5, 'c', '=', 'd')}},
+			want:  []string{"Cisco-AVPair=a=b", "Cisco-AVPair=c=d"},
+		},
+		{
+			name:  "unknown attributes",
+			attrs: radius.Attributes{{Type: 222, Attribute: radius.Attribute{1, 2}}, {Type: 26, Attribute: vsa(9, 99, 3, 7)}, {Type: 26, Attribute: vsa(1234, 5, 3, 7)}},
+			want:  []string{"Attr-222=0x0102", "Vendor-9-Attr-99=0x07", "Vendor-1234-Attr-5=0x07"},
+		},
+		{
+			name:  "malformed Vendor-Specific",
+			attrs: radius.Attributes{{Type: 26, Attribute: vsa(9, 1, 9, 'a')}},
+			want:  []string{"Vendor-Specific=0x00000009010961"},
+		},
+		{
+			name:  "value that does not fit its type",
+			attrs: radius.Attributes{{Type: 8, Attribute: radius.Attribute{10, 0, 0}}},
+			want:  []string{"Framed-IP-Address=0x0a0000"},
+		},
+		{
+			name: "long extended attribute in fragments",
+			attrs: radius.Attributes{
+				{Type: 245, Attribute: radius.Attribute{1, 0x80, 0xab}},
+				{Type: 245, Attribute: radius.Attribute{1, 0, 0xcd}},
+			},
+			want: []string{"Example-Long=0xabcd"},
+		},
+		{
+			name:  "tagged string",
+			attrs: radius.Attributes{{Type: 250, Attribute: radius.Attribute{1, 'x'}}},
+			want:  []string{"Example-Tag=x"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, f := range d.Decode(tt.attrs) {
+				got = append(got, f.Name()+"="+f.String())
+			}
+			if strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("Decode = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	d := New()
+	tests := []struct {
+		name, text string
+	}{
+		{"Service-Type", "Bogus-User"},
+		{"NAS-Port", "-1"},
+		{"Framed-IP-Address", "2001:db8::1"},
+		{"Framed-IPv6-Prefix", "10.0.0.0/8"},
+		{"Class", "0xzz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if value, err := mustAttribute(t, d, tt.name).Parse(tt.text); err == nil {
+				t.Errorf("Parse(%q) = %x, want an error", tt.text, value)
+			}
+		})
+	}
+
+	a := mustAttribute(t, d, "User-Name")
+	if _, _, err := a.Encode(bytes.Repeat([]byte("x"), 254)); err == nil {
+		t.Errorf("Encode of 254 bytes succeeded")
+	}
+}
@@ -0,0 +1,506 @@
+// Package radiusdict reads RADIUS dictionaries in the FreeRADIUS format, so
+// that attributes, vendor ones included, can be referred to by name and
+// decoded from packets. It understands VENDOR, BEGIN-VENDOR/END-VENDOR with
+// the format of the vendor, ATTRIBUTE with dotted numbers for TLVs and the
+// extended attributes of RFC 6929, VALUE, BEGIN-TLV/END-TLV and $INCLUDE.
+//
+// The attributes of the RFCs and of 3GPP TS 29.061 are built in; the
+// dictionaries of other vendors, such as Cisco, Ericsson, Huawei or WiMAX,
+// are loaded from the files FreeRADIUS ships.
+package radiusdict
+
+import (
+	"bufio"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// builtin holds the dictionaries every Dictionary starts with.
+//
+//go:embed dictionary.rfc dictionary.3gpp
+var builtin embed.FS
+
+// Vendor is a vendor of Vendor-Specific attributes.
+type Vendor struct {
+	Name string
+	ID   uint32
+	// TypeSize and LengthSize are the sizes of the type and length fields
+	// of its attributes, 1 and 1 unless the format of the vendor says
+	// otherwise. A LengthSize of zero means there is no length field.
+	TypeSize, LengthSize int
+	// Continuation is set when its attributes carry a continuation byte
+	// after the length, as WiMAX ones do (format=1,1,c).
+	Continuation bool
+	// Extended is the extended attribute type (241 to 246) its attributes
+	// are carried in as Extended-Vendor-Specific, or zero for
+	// Vendor-Specific.
+	Extended byte
+}
+
+// Attribute is the definition of an attribute.
+type Attribute struct {
+	Name string
+	// Vendor is the vendor of a Vendor-Specific attribute, nil for the
+	// attributes of the RFCs.
+	Vendor *Vendor
+	// OID are the numbers leading to the attribute from the top of its
+	// space, such as 1 for User-Name, 241.1 for an extended attribute or
+	// 1.2 for the second sub-attribute of a TLV.
+	OID []uint32
+	// Type is the FreeRADIUS data type, such as string, octets, integer,
+	// ipaddr or tlv.
+	Type    string
+	HasTag  bool
+	Encrypt int
+	Concat  bool
+
+	parent   *Attribute
+	children map[uint32]*Attribute
+	values   map[string]uint64
+	names    map[uint64]string
+}
+
+// Number is the number of the attribute within its parent, or within its
+// vendor space at the top.
+func (a *Attribute) Number() uint32 {
+	return a.OID[len(a.OID)-1]
+}
+
+// VendorID is the vendor of the attribute, zero for the RFC ones.
+func (a *Attribute) VendorID() uint32 {
+	if a.Vendor == nil {
+		return 0
+	}
+	return a.Vendor.ID
+}
+
+// Value returns the number of a named value of the attribute.
+func (a *Attribute) Value(name string) (uint64, bool) {
+	n, ok := a.values[strings.ToLower(name)]
+	return n, ok
+}
+
+// ValueName returns the name of a value of the attribute.
+func (a *Attribute) ValueName(n uint64) (string, bool) {
+	name, ok := a.names[n]
+	return name, ok
+}
+
+func (a *Attribute) child(n uint32) *Attribute {
+	return a.children[n]
+}
+
+// key identifies an attribute at the top of a vendor space, vendor zero
+// being that of the RFCs.
+type key struct {
+	vendor uint32
+	number uint32
+}
+
+// Dictionary holds attribute definitions by name and number.
+type Dictionary struct {
+	vendors    map[string]*Vendor
+	vendorIDs  map[uint32]*Vendor
+	attributes map[string]*Attribute
+	top        map[key]*Attribute
+	// Files are the files the dictionary was loaded from, the built-in
+	// ones excepted.
+	Files []string
+}
+
+// New returns a dictionary of the built-in attributes.
+func New() *Dictionary {
+	d := &Dictionary{
+		vendors:    make(map[string]*Vendor),
+		vendorIDs:  make(map[uint32]*Vendor),
+		attributes: make(map[string]*Attribute),
+		top:        make(map[key]*Attribute),
+	}
+	for _, name := range []string{"dictionary.rfc", "dictionary.3gpp"} {
+		if err := d.load(builtin, name); err != nil {
+			panic(fmt.Sprintf("radiusdict: built-in %v", err))
+		}
+	}
+	return d
+}
+
+// Load returns a dictionary of the built-in attributes and of those of the
+// files, which may be glob patterns. Files may define the built-in
+// attributes again.
+func Load(files ...string) (*Dictionary, error) {
+	d := New()
+	for _, pattern := range files {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("RADIUS dictionaries %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no RADIUS dictionary matches %q", pattern)
+		}
+		for _, file := range matches {
+			if err := d.LoadFile(file); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return d, nil
+}
+
+// LoadFile adds the definitions of a dictionary file, and of the files it
+// includes, to d.
+func (d *Dictionary) LoadFile(file string) error {
+	dir, name := filepath.Split(file)
+	if dir == "" {
+		dir = "."
+	}
+	if err := d.load(os.DirFS(dir), name); err != nil {
+		return err
+	}
+	d.Files = append(d.Files, file)
+	return nil
+}
+
+// Attribute returns the attribute with the given name. Names are not case
+// sensitive.
+func (d *Dictionary) Attribute(name string) (*Attribute, bool) {
+	a, ok := d.attributes[strings.ToLower(name)]
+	return a, ok
+}
+
+// Vendor returns the vendor with the given name or number.
+func (d *Dictionary) Vendor(name string) (*Vendor, bool) {
+	if v, ok := d.vendors[strings.ToLower(name)]; ok {
+		return v, true
+	}
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		v, ok := d.vendorIDs[uint32(id)]
+		return v, ok
+	}
+	return nil, false
+}
+
+// Numbered returns the attribute numbered n at the top of the space of a
+// vendor, or of the RFCs for vendor zero. Attributes missing from the
+// dictionary are returned as octets named after their number.
+func (d *Dictionary) Numbered(vendor, n uint32) *Attribute {
+	if a, ok := d.top[key{vendor, n}]; ok {
+		return a
+	}
+	return d.unknown(vendor, nil, n)
+}
+
+// unknown makes up the definition of an attribute missing from the
+// dictionary, named as FreeRADIUS does.
+func (d *Dictionary) unknown(vendor uint32, parent *Attribute, n uint32) *Attribute {
+	a := &Attribute{Type: "octets", parent: parent}
+	switch {
+	case parent != nil:
+		a.Vendor = parent.Vendor
+		a.OID = append(append([]uint32(nil), parent.OID...), n)
+	case vendor != 0:
+		a.Vendor = d.vendorIDs[vendor]
+		if a.Vendor == nil {
+			a.Vendor = &Vendor{Name: strconv.FormatUint(uint64(vendor), 10), ID: vendor, TypeSize: 1, LengthSize: 1}
+		}
+		a.OID = []uint32{n}
+	default:
+		a.OID = []uint32{n}
+	}
+	a.Name = "Attr-" + oidString(a.OID)
+	if a.Vendor != nil {
+		a.Name = fmt.Sprintf("Vendor-%d-%s", a.Vendor.ID, a.Name)
+	}
+	return a
+}
+
+// parseNumber reads a number in decimal, or in hexadecimal after 0x.
+func parseNumber(s string, bits int) (uint64, error) {
+	if hex, ok := strings.CutPrefix(s, "0x"); ok {
+		return strconv.ParseUint(hex, 16, bits)
+	}
+	return strconv.ParseUint(s, 10, bits)
+}
+
+func oidString(oid []uint32) string {
+	parts := make([]string, len(oid))
+	for i, n := range oid {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// parser holds the state of the file being read: the vendor block and the
+// TLV blocks it is in.
+type parser struct {
+	d      *Dictionary
+	fsys   fs.FS
+	file   string
+	line   int
+	vendor *Vendor
+	tlvs   []*Attribute
+}
+
+func (d *Dictionary) load(fsys fs.FS, file string) error {
+	p := &parser{d: d, fsys: fsys, file: file}
+	return p.read()
+}
+
+func (p *parser) read() error {
+	f, err := p.fsys.Open(p.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		p.line++
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if err := p.parse(fields); err != nil {
+			return fmt.Errorf("%s:%d: %w", p.file, p.line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("%s: %w", p.file, err)
+	}
+	return nil
+}
+
+func (p *parser) parse(fields []string) error {
+	switch keyword := fields[0]; keyword {
+	case "$INCLUDE", "$INCLUDE-":
+		if len(fields) != 2 {
+			return fmt.Errorf("%s takes a file name", keyword)
+		}
+		included := &parser{d: p.d, fsys: p.fsys, file: path.Join(path.Dir(p.file), fields[1])}
+		if filepath.IsAbs(fields[1]) {
+			dir, name := filepath.Split(fields[1])
+			included.fsys, included.file = os.DirFS(dir), name
+		}
+		if err := included.read(); err != nil {
+			if keyword == "$INCLUDE-" && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		return nil
+	case "VENDOR":
+		return p.parseVendor(fields)
+	case "BEGIN-VENDOR":
+		if len(fields) < 2 {
+			return fmt.Errorf("BEGIN-VENDOR takes a vendor name")
+		}
+		v, ok := p.d.Vendor(fields[1])
+		if !ok {
+			return fmt.Errorf("unknown vendor %s", fields[1])
+		}
+		for _, option := range fields[2:] {
+			format, ok := strings.CutPrefix(option, "format=Extended-Vendor-Specific-")
+			n, err := strconv.Atoi(format)
+			if !ok || err != nil || n < 1 || n > 6 {
+				return fmt.Errorf("unsupported BEGIN-VENDOR option %s", option)
+			}
+			v.Extended = byte(240 + n)
+		}
+		p.vendor = v
+		return nil
+	case "END-VENDOR":
+		p.vendor = nil
+		return nil
+	case "BEGIN-TLV":
+		if len(fields) != 2 {
+			return fmt.Errorf("BEGIN-TLV takes an attribute name")
+		}
+		a, ok := p.d.Attribute(fields[1])
+		if !ok || a.Type != "tlv" {
+			return fmt.Errorf("%s is not a tlv attribute", fields[1])
+		}
+		p.tlvs = append(p.tlvs, a)
+		return nil
+	case "END-TLV":
+		if len(p.tlvs) == 0 {
+			return fmt.Errorf("END-TLV without BEGIN-TLV")
+		}
+		p.tlvs = p.tlvs[:len(p.tlvs)-1]
+		return nil
+	case "ATTRIBUTE":
+		return p.parseAttribute(fields)
+	case "VALUE":
+		return p.parseValue(fields)
+	case "BEGIN-PROTOCOL", "END-PROTOCOL", "FLAGS":
+		return nil
+	default:
+		return fmt.Errorf("unknown keyword %s", keyword)
+	}
+}
+
+// parseVendor reads VENDOR name number [format=t,l[,c]].
+func (p *parser) parseVendor(fields []string) error {
+	if len(fields) < 3 || len(fields) > 4 {
+		return fmt.Errorf("VENDOR takes a name, a number and a format")
+	}
+	id, err := strconv.ParseUint(fields[2], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid vendor number %s", fields[2])
+	}
+	v := &Vendor{Name: fields[1], ID: uint32(id), TypeSize: 1, LengthSize: 1}
+	if len(fields) == 4 {
+		format, ok := strings.CutPrefix(fields[3], "format=")
+		parts := strings.Split(format, ",")
+		if !ok || len(parts) < 2 || len(parts) > 3 {
+			return fmt.Errorf("invalid vendor format %s", fields[3])
+		}
+		if v.TypeSize, err = strconv.Atoi(parts[0]); err != nil || (v.TypeSize != 1 && v.TypeSize != 2 && v.TypeSize != 4) {
+			return fmt.Errorf("invalid vendor type size in %s", fields[3])
+		}
+		if v.LengthSize, err = strconv.Atoi(parts[1]); err != nil || v.LengthSize < 0 || v.LengthSize > 2 {
+			return fmt.Errorf("invalid vendor length size in %s", fields[3])
+		}
+		if len(parts) == 3 {
+			if parts[2] != "c" || v.TypeSize != 1 || v.LengthSize != 1 {
+				return fmt.Errorf("invalid vendor continuation in %s", fields[3])
+			}
+			v.Continuation = true
+		}
+	}
+	if existing, ok := p.d.vendorIDs[v.ID]; ok {
+		*existing = *v
+		v = existing
+	}
+	p.d.vendors[strings.ToLower(v.Name)] = v
+	p.d.vendorIDs[v.ID] = v
+	return nil
+}
+
+// parseAttribute reads ATTRIBUTE name number type [flags], where the flags
+// may also be the name of the vendor in older dictionaries.
+func (p *parser) parseAttribute(fields []string) error {
+	if len(fields) < 4 || len(fields) > 5 {
+		return fmt.Errorf("ATTRIBUTE takes a name, a number, a type and flags")
+	}
+	a := &Attribute{Name: fields[1], Type: fields[3], Vendor: p.vendor}
+	if i := strings.IndexByte(a.Type, '['); i >= 0 {
+		a.Type = a.Type[:i] // octets[16] and the like
+	}
+	for _, part := range strings.Split(fields[2], ".") {
+		n, err := parseNumber(part, 32)
+		if err != nil {
+			return fmt.Errorf("invalid attribute number %s", fields[2])
+		}
+		a.OID = append(a.OID, uint32(n))
+	}
+	if len(fields) == 5 {
+		if v, ok := p.d.Vendor(fields[4]); ok {
+			a.Vendor = v
+		} else if err := a.parseFlags(fields[4]); err != nil {
+			return err
+		}
+	}
+
+	// Inside BEGIN-TLV the numbers are those of the sub-attributes.
+	if len(p.tlvs) > 0 {
+		parent := p.tlvs[len(p.tlvs)-1]
+		a.OID = append(append([]uint32(nil), parent.OID...), a.OID...)
+		a.Vendor = parent.Vendor
+	}
+	return p.d.define(a)
+}
+
+func (a *Attribute) parseFlags(flags string) error {
+	for _, flag := range strings.Split(flags, ",") {
+		name, value, _ := strings.Cut(flag, "=")
+		switch name {
+		case "has_tag":
+			a.HasTag = true
+		case "encrypt":
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid flag %s", flag)
+			}
+			a.Encrypt = n
+		case "concat":
+			a.Concat = true
+		case "array", "virtual", "long", "internal", "secret":
+		default:
+			return fmt.Errorf("unknown flag %s", flag)
+		}
+	}
+	return nil
+}
+
+// define adds a to the dictionary under its parent, which must be defined
+// already. A definition replaces an earlier one of the same number.
+func (d *Dictionary) define(a *Attribute) error {
+	if prev, ok := d.attributes[strings.ToLower(a.Name)]; ok && (prev.VendorID() != a.VendorID() || oidString(prev.OID) != oidString(a.OID)) {
+		return fmt.Errorf("attribute %s is already defined as %s", a.Name, oidString(prev.OID))
+	}
+
+	n := a.Number()
+	if len(a.OID) == 1 {
+		k := key{a.VendorID(), n}
+		if prev, ok := d.top[k]; ok {
+			a.children, a.values, a.names = prev.children, prev.values, prev.names
+		}
+		d.top[k] = a
+	} else {
+		parent, ok := d.top[key{a.VendorID(), a.OID[0]}]
+		for _, m := range a.OID[1 : len(a.OID)-1] {
+			if !ok {
+				break
+			}
+			parent = parent.child(m)
+			ok = parent != nil
+		}
+		if !ok {
+			return fmt.Errorf("attribute %s has no parent %s", a.Name, oidString(a.OID[:len(a.OID)-1]))
+		}
+		switch parent.Type {
+		case "tlv", "extended", "long-extended":
+		default:
+			return fmt.Errorf("attribute %s is under %s, of type %s", a.Name, parent.Name, parent.Type)
+		}
+		if parent.children == nil {
+			parent.children = make(map[uint32]*Attribute)
+		}
+		if prev, ok := parent.children[n]; ok {
+			a.children, a.values, a.names = prev.children, prev.values, prev.names
+		}
+		a.parent = parent
+		parent.children[n] = a
+	}
+	d.attributes[strings.ToLower(a.Name)] = a
+	return nil
+}
+
+// parseValue reads VALUE attribute name number.
+func (p *parser) parseValue(fields []string) error {
+	if len(fields) != 4 {
+		return fmt.Errorf("VALUE takes an attribute, a name and a number")
+	}
+	a, ok := p.d.Attribute(fields[1])
+	if !ok {
+		return fmt.Errorf("VALUE of unknown attribute %s", fields[1])
+	}
+	n, err := parseNumber(fields[3], 64)
+	if err != nil {
+		return fmt.Errorf("invalid value %s", fields[3])
+	}
+	if a.values == nil {
+		a.values = make(map[string]uint64)
+		a.names = make(map[uint64]string)
+	}
+	a.values[strings.ToLower(fields[2])] = n
+	a.names[n] = fields[2]
+	return nil
+}
@@ -0,0 +1,162 @@
+package radiusdict
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testDictionary = `
+# Vendors in the formats FreeRADIUS knows.
+VENDOR		Cisco		9
+VENDOR		Lucent		4846	format=2,2
+VENDOR		WiMAX		24757	format=1,1,c
+VENDOR		Nokia		94
+$INCLUDE	dictionary.include
+
+BEGIN-VENDOR	Cisco
+ATTRIBUTE	Cisco-AVPair		1	string
+ATTRIBUTE	Cisco-Disconnect-Cause	195	integer
+VALUE	Cisco-Disconnect-Cause	Idle-Timeout		4
+END-VENDOR	Cisco
+
+BEGIN-VENDOR	Lucent
+ATTRIBUTE	Lucent-Max-Shared-Users	2	integer
+END-VENDOR	Lucent
+
+BEGIN-VENDOR	WiMAX
+ATTRIBUTE	WiMAX-Capability	1	tlv
+BEGIN-TLV	WiMAX-Capability
+ATTRIBUTE	WiMAX-Release		1	string
+ATTRIBUTE	WiMAX-Accounting-Capabilities	2	byte
+END-TLV		WiMAX-Capability
+END-VENDOR	WiMAX
+
+BEGIN-VENDOR	Nokia	format=Extended-Vendor-Specific-5
+ATTRIBUTE	Nokia-Long-Octets	1	octets
+END-VENDOR	Nokia
+
+ATTRIBUTE	Example-Extended	241.1	ipaddr
+ATTRIBUTE	Example-Long		245.1	octets
+ATTRIBUTE	Example-Tag		250	string	has_tag
+`
+
+func loadTestDictionary(t *testing.T) *Dictionary {
+	t.Helper()
+	dir := t.TempDir()
+	write := func(name, text string) {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("dictionary.test", testDictionary)
+	write("dictionary.include", "ATTRIBUTE\tIncluded-Attribute\t251\tinteger\n")
+	d, err := Load(filepath.Join(dir, "dictionary.*"))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return d
+}
+
+func TestLoad(t *testing.T) {
+	d := loadTestDictionary(t)
+
+	tests := []struct {
+		name   string
+		vendor uint32
+		oid    string
+		typ    string
+	}{
+		{"User-Name", 0, "1", "string"},
+		{"3GPP-Charging-Id", 10415, "2", "integer"},
+		{"cisco-avpair", 9, "1", "string"},
+		{"WiMAX-Release", 24757, "1.1", "string"},
+		{"Nokia-Long-Octets", 94, "1", "octets"},
+		{"Example-Extended", 0, "241.1", "ipaddr"},
+		{"Included-Attribute", 0, "251", "integer"},
+	}
+	for _, tt := range tests {
+		a, ok := d.Attribute(tt.name)
+		if !ok {
+			t.Errorf("Attribute(%q) is missing", tt.name)
+			continue
+		}
+		if a.VendorID() != tt.vendor || oidString(a.OID) != tt.oid || a.Type != tt.typ {
+			t.Errorf("Attribute(%q) = vendor %d, %s %s, want vendor %d, %s %s", tt.name, a.VendorID(), oidString(a.OID), a.Type, tt.vendor, tt.oid, tt.typ)
+		}
+	}
+
+	if v, ok := d.Vendor("4846"); !ok || v.Name != "Lucent" || v.TypeSize != 2 || v.LengthSize != 2 {
+		t.Errorf("Vendor(4846) = %+v, %t", v, ok)
+	}
+	if v, _ := d.Vendor("WiMAX"); !v.Continuation {
+		t.Errorf("WiMAX has no continuation byte")
+	}
+	if v, _ := d.Vendor("Nokia"); v.Extended != 245 {
+		t.Errorf("Nokia is carried in attribute %d, want 245", v.Extended)
+	}
+	if a, _ := d.Attribute("Example-Tag"); !a.HasTag {
+		t.Errorf("Example-Tag has no tag")
+	}
+	if a := mustAttribute(t, d, "WiMAX-Release"); a.parent != mustAttribute(t, d, "WiMAX-Capability") {
+		t.Errorf("WiMAX-Release is not under WiMAX-Capability")
+	}
+	if n, ok := mustAttribute(t, d, "Cisco-Disconnect-Cause").Value("idle-timeout"); !ok || n != 4 {
+		t.Errorf("Value(idle-timeout) = %d, %t", n, ok)
+	}
+	if len(d.Files) != 2 {
+		t.Errorf("Files = %v, want the two files", d.Files)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		err  string
+	}{
+		{"unknown keyword", "ATTRIBUTES\tFoo\t1\tstring\n", "unknown keyword"},
+		{"bad number", "ATTRIBUTE\tFoo\tx\tstring\n", "invalid attribute number"},
+		{"unknown flag", "ATTRIBUTE\tFoo\t250\tstring\tbogus\n", "unknown flag"},
+		{"unknown vendor", "BEGIN-VENDOR\tNobody\n", "unknown vendor"},
+		{"value of unknown attribute", "VALUE\tFoo\tBar\t1\n", "VALUE of unknown attribute"},
+		{"no parent", "ATTRIBUTE\tFoo\t250.1\tstring\n", "has no parent"},
+		{"parent not a tlv", "ATTRIBUTE\tFoo\t1.1\tstring\n", "is under"},
+		{"redefinition", "ATTRIBUTE\tUser-Name\t250\tstring\n", "already defined"},
+		{"missing include", "$INCLUDE\tnowhere\n", "nowhere"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "dictionary")
+			if err := os.WriteFile(file, []byte(tt.text), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, err := Load(file)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Load = %v, want an error with %q", err, tt.err)
+			}
+			if err != nil && !strings.Contains(err.Error(), "dictionary:1:") && tt.name != "missing include" {
+				t.Errorf("Load = %v, want the line of the error", err)
+			}
+		})
+	}
+
+	if _, err := Load(filepath.Join(t.TempDir(), "dictionary.*")); err == nil {
+		t.Errorf("Load of a pattern matching nothing succeeded")
+	}
+	file := filepath.Join(t.TempDir(), "dictionary")
+	os.WriteFile(file, []byte("$INCLUDE-\tnowhere\n"), 0o600)
+	if _, err := Load(file); err != nil {
+		t.Errorf("Load with an optional include missing: %v", err)
+	}
+}
+
+func mustAttribute(t *testing.T, d *Dictionary, name string) *Attribute {
+	t.Helper()
+	a, ok := d.Attribute(name)
+	if !ok {
+		t.Fatalf("no attribute %s", name)
+	}
+	return a
+}
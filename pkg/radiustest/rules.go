@@ -0,0 +1,191 @@
+package radiustest
+
+import (
+	"time"
+
+	"layeh.com/radius"
+)
+
+// Match selects the requests a rule applies to.
+type Match func(*Packet) bool
+
+// Any matches every request.
+func Any() Match {
+	return func(*Packet) bool { return true }
+}
+
+// Code matches the requests of a code, such as radius.CodeAccountingRequest.
+func Code(code radius.Code) Match {
+	return func(p *Packet) bool { return p.Code == code }
+}
+
+// Has matches the requests with the named attribute.
+func Has(name string) Match {
+	return func(p *Packet) bool {
+		_, ok := p.Value(name)
+		return ok
+	}
+}
+
+// Equal matches the requests with the named attribute set to value, as
+// rendered by radiusdict.Field.String.
+func Equal(name, value string) Match {
+	return func(p *Packet) bool {
+		for _, v := range p.Values(name) {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// All matches the requests all of matches match.
+func All(matches ...Match) Match {
+	return func(p *Packet) bool {
+		for _, m := range matches {
+			if !m(p) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Value returns the first value of the named attribute of the packet.
+func (p *Packet) Value(name string) (string, bool) {
+	values := p.Values(name)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// Values returns the values of the named attribute of the packet, rendered
+// as text. Encrypted attributes such as User-Password are not decrypted.
+func (p *Packet) Values(name string) []string {
+	var values []string
+	for _, f := range p.Fields {
+		if f.Name() == name {
+			values = append(values, f.String())
+		}
+	}
+	return values
+}
+
+// Rule is a rule of a server.
+type Rule struct {
+	server   *Server
+	match    Match
+	response Response
+	attrs    radius.Attributes
+	times    int
+	used     int
+}
+
+// Times makes the rule apply to the first n requests it matches only, after
+// which the next rules are tried.
+func (r *Rule) Times(n int) *Rule {
+	r.server.mu.Lock()
+	defer r.server.mu.Unlock()
+	r.times = n
+	return r
+}
+
+// Used returns how many requests the rule was applied to.
+func (r *Rule) Used() int {
+	r.server.mu.Lock()
+	defer r.server.mu.Unlock()
+	return r.used
+}
+
+// Attribute is an attribute of a reply, by name in the dictionary of the
+// server, with its value as text: the name or number of integers, addresses
+// and prefixes in their usual notation and octets in hexadecimal after 0x.
+type Attribute struct {
+	Name  string
+	Value string
+}
+
+// Attr returns the attribute name with the given value.
+func Attr(name, value string) Attribute {
+	return Attribute{Name: name, Value: value}
+}
+
+type outcome int
+
+const (
+	accept outcome = iota
+	reject
+	challenge
+)
+
+// Response is how a rule replies.
+type Response struct {
+	outcome    outcome
+	attributes []Attribute
+	delay      time.Duration
+	drop       bool
+	malformed  bool
+}
+
+// Accept replies with the positive answer to the request: Access-Accept,
+// Accounting-Response, CoA-ACK or Disconnect-ACK.
+func Accept(attrs ...Attribute) Response {
+	return Response{outcome: accept, attributes: attrs}
+}
+
+// Reject replies with Access-Reject, CoA-NAK or Disconnect-NAK. Accounting
+// requests, which cannot be rejected, get no reply.
+func Reject(attrs ...Attribute) Response {
+	return Response{outcome: reject, attributes: attrs}
+}
+
+// Challenge replies to Access-Requests with an Access-Challenge, usually
+// carrying a State and an EAP-Message.
+func Challenge(attrs ...Attribute) Response {
+	return Response{outcome: challenge, attributes: attrs}
+}
+
+// Drop does not reply, as a server that is down.
+func Drop() Response {
+	return Response{drop: true}
+}
+
+// Malformed replies with a packet clients cannot parse.
+func Malformed() Response {
+	return Response{malformed: true}
+}
+
+// After delays the reply by d.
+func (r Response) After(d time.Duration) Response {
+	r.delay = d
+	return r
+}
+
+// code is the code of the reply to a request of the given code, if any.
+func (r Response) code(request radius.Code) (radius.Code, bool) {
+	switch request {
+	case radius.CodeAccessRequest, radius.CodeStatusServer:
+		switch r.outcome {
+		case reject:
+			return radius.CodeAccessReject, true
+		case challenge:
+			return radius.CodeAccessChallenge, request == radius.CodeAccessRequest
+		}
+		return radius.CodeAccessAccept, true
+	case radius.CodeAccountingRequest:
+		return radius.CodeAccountingResponse, r.outcome == accept
+	case radius.CodeCoARequest:
+		if r.outcome == accept {
+			return radius.CodeCoAACK, true
+		}
+		return radius.CodeCoANAK, true
+	case radius.CodeDisconnectRequest:
+		if r.outcome == accept {
+			return radius.CodeDisconnectACK, true
+		}
+		return radius.CodeDisconnectNAK, true
+	}
+	return 0, false
+}
@@ -0,0 +1,277 @@
+// Package radiustest provides a RADIUS server for tests of the code talking
+// to AAA servers, in the manner of net/http/httptest. It listens on the
+// loopback interface, records the requests it receives with their
+// attributes decoded, and replies to each according to the first of its
+// rules that matches:
+//
+//	srv := radiustest.NewServer("secret")
+//	defer srv.Close()
+//	srv.On(radiustest.Equal("User-Name", "blocked"), radiustest.Reject())
+//	srv.On(radiustest.Code(radius.CodeAccessRequest), radiustest.Accept(
+//		radiustest.Attr("Framed-IP-Address", "10.0.0.1"),
+//		radiustest.Attr("3GPP-Charging-Id", "42"),
+//	))
+//	cfg := config.RadiusConfig{Addr: srv.Addr, Secret: "secret"}
+//
+// Requests no rule matches are accepted without attributes.
+package radiustest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	agent "diametertransfereagent/pkg/radius"
+	"diametertransfereagent/pkg/radiusdict"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2869"
+)
+
+// Server is a RADIUS server for tests. Authentication and accounting
+// requests both go to Addr.
+type Server struct {
+	// Addr is the host:port the server listens on, to be used as the
+	// address of the AAA server.
+	Addr   string
+	Secret []byte
+	// Dictionary decodes the requests and encodes the attributes of the
+	// replies. Set it before the rules are added.
+	Dictionary *radiusdict.Dictionary
+
+	conn net.PacketConn
+	done chan struct{}
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	rules    []*Rule
+	received []*Packet
+	// changed is closed, and replaced, whenever a request is recorded.
+	changed chan struct{}
+}
+
+// Packet is a request the server received.
+type Packet struct {
+	*radius.Packet
+	// Fields are the attributes of the packet decoded with the dictionary
+	// of the server.
+	Fields []radiusdict.Field
+	// Authentic reports whether the Request Authenticator of an accounting
+	// or dynamic authorization request, and the Message-Authenticator of
+	// any request, are valid for the secret of the server.
+	Authentic bool
+	From      net.Addr
+	Received  time.Time
+}
+
+// NewServer starts a server with the given secret and the built-in
+// dictionary. It panics if it cannot listen.
+func NewServer(secret string) *Server {
+	s := NewUnstartedServer(secret)
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a server that does not listen until Start is
+// called, so that its dictionary can be changed.
+func NewUnstartedServer(secret string) *Server {
+	return &Server{
+		Secret:     []byte(secret),
+		Dictionary: radiusdict.New(),
+		done:       make(chan struct{}),
+		changed:    make(chan struct{}),
+	}
+}
+
+// Start listens on a port of the loopback interface and serves requests.
+// It panics if it cannot listen.
+func (s *Server) Start() {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("radiustest: failed to listen: %v", err))
+	}
+	s.conn = conn
+	s.Addr = conn.LocalAddr().String()
+	s.wg.Add(1)
+	go s.serve()
+}
+
+// Close stops the server, without sending the replies still delayed, and
+// waits for it to finish.
+func (s *Server) Close() {
+	close(s.done)
+	s.conn.Close()
+	s.wg.Wait()
+}
+
+// On adds a rule replying response to the requests match selects. Rules
+// are tried in the order they were added. It panics if an attribute of
+// response is not in the dictionary or its value cannot be encoded.
+func (s *Server) On(match Match, response Response) *Rule {
+	attrs, err := s.encodeAttributes(response.attributes)
+	if err != nil {
+		panic(fmt.Sprintf("radiustest: %v", err))
+	}
+	r := &Rule{server: s, match: match, response: response, attrs: attrs}
+	s.mu.Lock()
+	s.rules = append(s.rules, r)
+	s.mu.Unlock()
+	return r
+}
+
+// Received returns the requests received so far, in order.
+func (s *Server) Received() []*Packet {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Packet(nil), s.received...)
+}
+
+// Wait waits until n requests have been received and returns them, or
+// returns those received when ctx is done.
+func (s *Server) Wait(ctx context.Context, n int) ([]*Packet, error) {
+	for {
+		s.mu.Lock()
+		received := append([]*Packet(nil), s.received...)
+		changed := s.changed
+		s.mu.Unlock()
+		if len(received) >= n {
+			return received, nil
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return received, fmt.Errorf("radiustest: %d of %d requests received: %w", len(received), n, ctx.Err())
+		}
+	}
+}
+
+// Reset forgets the requests received and removes the rules.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received = nil
+	s.rules = nil
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	buf := make([]byte, radius.MaxPacketLength)
+	for {
+		n, from, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		b := append([]byte(nil), buf[:n]...)
+		s.wg.Add(1)
+		go s.handle(b, from)
+	}
+}
+
+// handle records a request and replies to it as its rule says.
+func (s *Server) handle(b []byte, from net.Addr) {
+	defer s.wg.Done()
+	p, err := radius.Parse(b, s.Secret)
+	if err != nil {
+		return
+	}
+	packet := &Packet{
+		Packet:    p,
+		Fields:    s.Dictionary.Decode(p.Attributes),
+		Authentic: authentic(b, p),
+		From:      from,
+		Received:  time.Now(),
+	}
+	response, attrs := s.record(packet)
+
+	if response.delay > 0 {
+		select {
+		case <-time.After(response.delay):
+		case <-s.done:
+			return
+		}
+	}
+	if response.drop {
+		return
+	}
+	code, ok := response.code(p.Code)
+	if !ok {
+		return
+	}
+	reply := p.Response(code)
+	reply.Attributes = append(reply.Attributes, attrs...)
+	if _, ok := p.Attributes.Lookup(rfc2869.MessageAuthenticator_Type); ok {
+		if err := agent.SetMessageAuthenticator(reply); err != nil {
+			return
+		}
+	}
+	out, err := reply.Encode()
+	if err != nil {
+		return
+	}
+	if response.malformed {
+		// A length beyond the end of the datagram, which clients discard.
+		out[2], out[3] = byte((len(out)+16)>>8), byte(len(out)+16)
+	}
+	s.conn.WriteTo(out, from)
+}
+
+// record adds packet to the requests received and returns the response of
+// the first rule matching it.
+func (s *Server) record(packet *Packet) (Response, radius.Attributes) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received = append(s.received, packet)
+	close(s.changed)
+	s.changed = make(chan struct{})
+	for _, r := range s.rules {
+		if r.times > 0 && r.used >= r.times {
+			continue
+		}
+		if r.match(packet) {
+			r.used++
+			return r.response, r.attrs
+		}
+	}
+	return Accept(), nil
+}
+
+// authentic checks the authenticators of a request.
+func authentic(b []byte, p *radius.Packet) bool {
+	if p.Code != radius.CodeAccessRequest && p.Code != radius.CodeStatusServer && !radius.IsAuthenticRequest(b, p.Secret) {
+		return false
+	}
+	if _, ok := p.Attributes.Lookup(rfc2869.MessageAuthenticator_Type); !ok {
+		return true
+	}
+	received := rfc2869.MessageAuthenticator_Get(p)
+	clone := &radius.Packet{Code: p.Code, Identifier: p.Identifier, Authenticator: p.Authenticator, Secret: p.Secret}
+	clone.Attributes = append(radius.Attributes(nil), p.Attributes...)
+	if err := agent.SetMessageAuthenticator(clone); err != nil {
+		return false
+	}
+	return string(rfc2869.MessageAuthenticator_Get(clone)) == string(received)
+}
+
+// encodeAttributes encodes attributes given by name and text with the
+// dictionary of the server.
+func (s *Server) encodeAttributes(attrs []Attribute) (radius.Attributes, error) {
+	var encoded radius.Attributes
+	for _, attr := range attrs {
+		a, ok := s.Dictionary.Attribute(attr.Name)
+		if !ok {
+			return nil, fmt.Errorf("unknown attribute %q", attr.Name)
+		}
+		value, err := a.Parse(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		typ, v, err := a.Encode(value)
+		if err != nil {
+			return nil, err
+		}
+		encoded.Add(typ, v)
+	}
+	return encoded, nil
+}
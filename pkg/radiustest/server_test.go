@@ -0,0 +1,138 @@
+package radiustest_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"diametertransfereagent/pkg/radiustest"
+
+	"layeh.com/radius"
+	"layeh.com/radius/rfc2865"
+	"layeh.com/radius/rfc2866"
+)
+
+const testSecret = "secret"
+
+// exchange sends a request with the given code and User-Name to srv and
+// returns the reply, nil when there is none in time.
+func exchange(t *testing.T, srv *radiustest.Server, code radius.Code, userName string) *radius.Packet {
+	t.Helper()
+	p := radius.New(code, []byte(testSecret))
+	_ = rfc2865.UserName_SetString(p, userName)
+	if code == radius.CodeAccountingRequest {
+		_ = rfc2866.AcctStatusType_Set(p, rfc2866.AcctStatusType_Value_Start)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	reply, err := radius.Exchange(ctx, p, srv.Addr)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	if err != nil {
+		t.Fatalf("Exchange: %v", err)
+	}
+	return reply
+}
+
+func TestRules(t *testing.T) {
+	srv := radiustest.NewServer(testSecret)
+	defer srv.Close()
+	srv.On(radiustest.Equal("User-Name", "blocked"), radiustest.Reject(radiustest.Attr("Reply-Message", "blocked")))
+	once := srv.On(radiustest.All(radiustest.Code(radius.CodeAccessRequest), radiustest.Has("User-Name")), radiustest.Accept(
+		radiustest.Attr("Framed-IP-Address", "10.0.0.1"),
+		radiustest.Attr("Class", "0x0102"),
+	)).Times(1)
+	srv.On(radiustest.Equal("User-Name", "eap"), radiustest.Challenge())
+
+	reply := exchange(t, srv, radius.CodeAccessRequest, "alice")
+	if reply == nil || reply.Code != radius.CodeAccessAccept || rfc2865.FramedIPAddress_Get(reply).String() != "10.0.0.1" {
+		t.Fatalf("first reply = %v, want an Access-Accept with the address", reply)
+	}
+	if class := rfc2865.Class_Get(reply); string(class) != "\x01\x02" {
+		t.Errorf("Class = %x", class)
+	}
+	if once.Used() != 1 {
+		t.Errorf("rule used %d times", once.Used())
+	}
+	// The rule is used up: the next ones apply, then the default.
+	if reply := exchange(t, srv, radius.CodeAccessRequest, "eap"); reply == nil || reply.Code != radius.CodeAccessChallenge {
+		t.Errorf("reply = %v, want an Access-Challenge", reply)
+	}
+	if reply := exchange(t, srv, radius.CodeAccessRequest, "alice"); reply == nil || reply.Code != radius.CodeAccessAccept || len(reply.Attributes) != 0 {
+		t.Errorf("reply = %v, want the default Access-Accept", reply)
+	}
+	if reply := exchange(t, srv, radius.CodeAccessRequest, "blocked"); reply == nil || reply.Code != radius.CodeAccessReject || rfc2865.ReplyMessage_GetString(reply) != "blocked" {
+		t.Errorf("reply = %v, want an Access-Reject", reply)
+	}
+	// Accounting requests cannot be rejected: they get no reply.
+	if reply := exchange(t, srv, radius.CodeAccountingRequest, "blocked"); reply != nil {
+		t.Errorf("reply = %v, want none", reply)
+	}
+	if reply := exchange(t, srv, radius.CodeAccountingRequest, "alice"); reply == nil || reply.Code != radius.CodeAccountingResponse {
+		t.Errorf("reply = %v, want an Accounting-Response", reply)
+	}
+
+	received := srv.Received()
+	if len(received) != 6 {
+		t.Fatalf("received %d requests, want 6", len(received))
+	}
+	for _, p := range received {
+		if !p.Authentic {
+			t.Errorf("request %v not authentic", p.Code)
+		}
+	}
+	if name, ok := received[0].Value("User-Name"); !ok || name != "alice" {
+		t.Errorf("User-Name = %q, %t", name, ok)
+	}
+	if status := received[5].Values("Acct-Status-Type"); len(status) != 1 || status[0] != "Start" {
+		t.Errorf("Acct-Status-Type = %v", status)
+	}
+
+	srv.Reset()
+	if len(srv.Received()) != 0 {
+		t.Errorf("requests kept after Reset")
+	}
+	if reply := exchange(t, srv, radius.CodeAccessRequest, "blocked"); reply == nil || reply.Code != radius.CodeAccessAccept {
+		t.Errorf("reply = %v, want the rules removed by Reset", reply)
+	}
+}
+
+func TestFailures(t *testing.T) {
+	srv := radiustest.NewServer(testSecret)
+	defer srv.Close()
+	srv.On(radiustest.Equal("User-Name", "down"), radiustest.Drop())
+	srv.On(radiustest.Equal("User-Name", "garbled"), radiustest.Malformed())
+	srv.On(radiustest.Equal("User-Name", "slow"), radiustest.Accept().After(time.Second))
+	srv.On(radiustest.Equal("User-Name", "late"), radiustest.Accept().After(50*time.Millisecond))
+
+	for _, name := range []string{"down", "garbled", "slow"} {
+		if reply := exchange(t, srv, radius.CodeAccessRequest, name); reply != nil {
+			t.Errorf("%s: reply = %v, want none", name, reply)
+		}
+	}
+	if reply := exchange(t, srv, radius.CodeAccessRequest, "late"); reply == nil {
+		t.Errorf("delayed reply not received")
+	}
+
+	// A request with the wrong secret is recorded as not authentic.
+	p := radius.New(radius.CodeAccountingRequest, []byte("wrong"))
+	_ = rfc2865.UserName_SetString(p, "spoofed")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	radius.Exchange(ctx, p, srv.Addr)
+	received, err := srv.Wait(context.Background(), 5)
+	if err != nil {
+		t.Fatalf("Wait: %v", err)
+	}
+	if received[4].Authentic {
+		t.Errorf("request with the wrong secret is authentic")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if received, err := srv.Wait(ctx, 6); err == nil || len(received) != 5 {
+		t.Errorf("Wait = %d requests, %v, want a timeout", len(received), err)
+	}
+}
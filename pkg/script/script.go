@@ -0,0 +1,444 @@
+// Package script runs operator supplied Starlark hooks on the messages the
+// agent translates, so they can be adjusted or rejected without a rebuild.
+//
+// A script defines any of the hook functions below. Each receives the
+// command ("AIR", "AAR" or "CCR") and a dict of message fields it may change
+// in place:
+//
+//	after_decode(command, avps)            the Diameter request
+//	before_radius(command, request, avps)  the RADIUS request
+//	after_radius(command, reply, avps)     the RADIUS reply
+//	before_answer(command, avps)           the Diameter answer
+//
+// Diameter messages are seen as their top-level, non-grouped AVPs keyed by
+// dictionary name; setting a key adds or replaces the AVP and setting it to
+// None removes it. The avps argument of before_radius and after_radius is the
+// Diameter request, read-only. RADIUS requests and replies are seen as their
+// scalar fields in snake case, such as username, called_station_id or
+// framed_ip; server selects the AAA server a request is sent to. The type of
+// a request and the code of a reply are read-only: a hook rejects a message
+// with reject.
+//
+// Calling reject(code) stops the hook and answers the request with that
+// Result-Code. Scripts cannot load modules or do I/O, and each call is
+// limited to maxSteps steps.
+package script
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	"go.starlark.net/starlark"
+)
+
+const (
+	AfterDecode  = "after_decode"
+	BeforeRadius = "before_radius"
+	AfterRadius  = "after_radius"
+	BeforeAnswer = "before_answer"
+
+	maxSteps = 1000000
+
+	rejectKey = "reject"
+	// readOnly is the script tag of the fields hooks may read only.
+	readOnly = "readonly"
+)
+
+var hookNames = []string{AfterDecode, BeforeRadius, AfterRadius, BeforeAnswer}
+
+// Script holds the hooks of a loaded script. A nil Script runs none.
+type Script struct {
+	hooks map[string]*starlark.Function
+}
+
+// Load runs the script at path and collects its hooks.
+func Load(path string) (*Script, error) {
+	thread := newThread(path)
+	globals, err := starlark.ExecFile(thread, path, nil, starlark.StringDict{
+		"reject": starlark.NewBuiltin("reject", reject),
+	})
+	if err != nil {
+		return nil, err
+	}
+	globals.Freeze()
+
+	s := &Script{hooks: make(map[string]*starlark.Function)}
+	for _, name := range hookNames {
+		value, ok := globals[name]
+		if !ok {
+			continue
+		}
+		fn, ok := value.(*starlark.Function)
+		if !ok {
+			return nil, fmt.Errorf("%s is a %s, not a function", name, value.Type())
+		}
+		s.hooks[name] = fn
+	}
+	slog.Info("Loaded script", "path", path, "hooks", len(s.hooks))
+	return s, nil
+}
+
+func newThread(name string) *starlark.Thread {
+	thread := &starlark.Thread{
+		Name: name,
+		Print: func(thread *starlark.Thread, msg string) {
+			slog.Info("Script printed", "hook", thread.Name, "message", msg)
+		},
+	}
+	thread.SetMaxExecutionSteps(maxSteps)
+	return thread
+}
+
+func reject(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var code int
+	if err := starlark.UnpackPositionalArgs(fn.Name(), args, kwargs, 1, &code); err != nil {
+		return nil, err
+	}
+	if code <= 0 {
+		return nil, fmt.Errorf("reject: invalid Result-Code %d", code)
+	}
+	thread.SetLocal(rejectKey, uint32(code))
+	return nil, fmt.Errorf("rejected with Result-Code %d", code)
+}
+
+// Message runs hook on the AVPs of a Diameter message and applies the
+// changes it makes. It returns the Result-Code the hook rejected with, or 0.
+func (s *Script) Message(hook, command string, m *diam.Message) uint32 {
+	if s == nil || s.hooks[hook] == nil {
+		return 0
+	}
+	avps := messageDict(m)
+	code := s.call(hook, starlark.String(command), avps)
+	if code == 0 {
+		applyMessage(avps, m)
+	}
+	return code
+}
+
+// Fields runs hook on the fields of the RADIUS request or reply v points to
+// and applies the changes it makes. m is the Diameter request, which the hook
+// can read. It returns the Result-Code the hook rejected with, or 0.
+func (s *Script) Fields(hook, command string, v interface{}, m *diam.Message) uint32 {
+	if s == nil || s.hooks[hook] == nil {
+		return 0
+	}
+	fields := structDict(v)
+	avps := messageDict(m)
+	avps.Freeze()
+	code := s.call(hook, starlark.String(command), fields, avps)
+	if code == 0 {
+		applyStruct(fields, v)
+	}
+	return code
+}
+
+func (s *Script) call(hook string, args ...starlark.Value) uint32 {
+	thread := newThread(hook)
+	start := time.Now()
+	_, err := starlark.Call(thread, s.hooks[hook], args, nil)
+	if code, ok := thread.Local(rejectKey).(uint32); ok {
+		slog.Info("Script rejected the message", "hook", hook, "result_code", code)
+		return code
+	}
+	if err != nil {
+		// A failing hook leaves the message as it was.
+		slog.Error("Script failed", "hook", hook, "duration", time.Since(start), "error", err)
+	}
+	return 0
+}
+
+// messageDict returns the top-level AVPs of m that are in the dictionary,
+// keyed by name. Only the first of repeated AVPs is included.
+func messageDict(m *diam.Message) *starlark.Dict {
+	avps := starlark.NewDict(len(m.AVP))
+	for _, a := range m.AVP {
+		if _, grouped := a.Data.(*diam.GroupedAVP); grouped {
+			continue
+		}
+		d, err := m.Dictionary().FindAVPWithVendor(m.Header.ApplicationID, a.Code, a.VendorID)
+		if err != nil {
+			continue
+		}
+		key := starlark.String(d.Name)
+		if _, found, _ := avps.Get(key); found {
+			continue
+		}
+		_ = avps.SetKey(key, avpValue(a.Data))
+	}
+	return avps
+}
+
+func avpValue(data datatype.Type) starlark.Value {
+	switch v := data.(type) {
+	case datatype.Unsigned32:
+		return starlark.MakeUint64(uint64(v))
+	case datatype.Unsigned64:
+		return starlark.MakeUint64(uint64(v))
+	case datatype.Integer32:
+		return starlark.MakeInt64(int64(v))
+	case datatype.Integer64:
+		return starlark.MakeInt64(int64(v))
+	case datatype.Enumerated:
+		return starlark.MakeInt64(int64(v))
+	case datatype.Address:
+		return starlark.String(net.IP(v).String())
+	case datatype.IPv4:
+		return starlark.String(net.IP(v).String())
+	case datatype.Time:
+		return starlark.MakeInt64(time.Time(v).Unix())
+	}
+	return starlark.String(data.Serialize())
+}
+
+// applyMessage writes the AVPs the hook changed, added or removed back to m.
+func applyMessage(avps *starlark.Dict, m *diam.Message) {
+	before := messageDict(m)
+	for _, name := range before.Keys() {
+		if _, found, _ := avps.Get(name); !found {
+			removeAVP(m, string(name.(starlark.String)))
+		}
+	}
+	for _, item := range avps.Items() {
+		name, ok := starlark.AsString(item[0])
+		if !ok {
+			continue
+		}
+		old, found, _ := before.Get(item[0])
+		if found {
+			if eq, _ := starlark.Equal(old, item[1]); eq {
+				continue
+			}
+		}
+		if item[1] == starlark.None {
+			removeAVP(m, name)
+			continue
+		}
+		if err := setAVP(m, name, item[1]); err != nil {
+			slog.Warn("Script cannot set AVP", "avp", name, "value", item[1].String(), "error", err)
+		}
+	}
+	m.Header.MessageLength = uint32(m.Len())
+}
+
+func removeAVP(m *diam.Message, name string) {
+	d, err := findAVP(m, name)
+	if err != nil {
+		return
+	}
+	kept := m.AVP[:0]
+	for _, a := range m.AVP {
+		if a.Code != d.Code || a.VendorID != d.VendorID {
+			kept = append(kept, a)
+		}
+	}
+	m.AVP = kept
+}
+
+func setAVP(m *diam.Message, name string, value starlark.Value) error {
+	d, err := findAVP(m, name)
+	if err != nil {
+		return err
+	}
+	data, err := avpData(d.Data.Type, value)
+	if err != nil {
+		return err
+	}
+	for _, a := range m.AVP {
+		if a.Code == d.Code && a.VendorID == d.VendorID {
+			a.Data = data
+			a.Length = a.Len() - data.Padding()
+			return nil
+		}
+	}
+	var flags uint8
+	if strings.Contains(d.Must, "M") {
+		flags |= avp.Mbit
+	}
+	if d.VendorID != 0 {
+		flags |= avp.Vbit
+	}
+	_, err = m.NewAVP(d.Code, flags, d.VendorID, data)
+	return err
+}
+
+// findAVP looks name up in the application of m, then in all of the
+// dictionaries of m.
+func findAVP(m *diam.Message, name string) (*dict.AVP, error) {
+	if d, err := m.Dictionary().FindAVP(m.Header.ApplicationID, name); err == nil {
+		return d, nil
+	}
+	return m.Dictionary().ScanAVP(name)
+}
+
+func avpData(typ datatype.TypeID, value starlark.Value) (datatype.Type, error) {
+	switch typ {
+	case datatype.Unsigned32Type, datatype.Integer32Type, datatype.EnumeratedType, datatype.Unsigned64Type, datatype.Integer64Type, datatype.TimeType:
+		var n int64
+		if err := starlark.AsInt(value, &n); err != nil {
+			return nil, err
+		}
+		switch typ {
+		case datatype.Unsigned32Type:
+			return datatype.Unsigned32(n), nil
+		case datatype.Integer32Type:
+			return datatype.Integer32(n), nil
+		case datatype.EnumeratedType:
+			return datatype.Enumerated(n), nil
+		case datatype.Unsigned64Type:
+			return datatype.Unsigned64(n), nil
+		case datatype.TimeType:
+			return datatype.Time(time.Unix(n, 0)), nil
+		}
+		return datatype.Integer64(n), nil
+	}
+	text, ok := starlark.AsString(value)
+	if !ok {
+		return nil, fmt.Errorf("want string, got %s", value.Type())
+	}
+	switch typ {
+	case datatype.AddressType:
+		ip := net.ParseIP(text)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an address", text)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		return datatype.Address(ip), nil
+	case datatype.UTF8StringType:
+		return datatype.UTF8String(text), nil
+	case datatype.DiameterIdentityType:
+		return datatype.DiameterIdentity(text), nil
+	case datatype.DiameterURIType:
+		return datatype.DiameterURI(text), nil
+	}
+	return datatype.OctetString(text), nil
+}
+
+var ipType = reflect.TypeOf(net.IP{})
+
+// structDict returns the string, number, boolean and address fields of the
+// struct v points to, keyed by their names in snake case. Fields tagged
+// script:"-", such as passwords and shared secrets, are left out, so hooks
+// can neither read nor change them. Fields tagged script:"readonly", such as
+// the code of a reply, are in but applyStruct ignores changes to them.
+func structDict(v interface{}) *starlark.Dict {
+	rv := reflect.ValueOf(v).Elem()
+	fields := starlark.NewDict(rv.NumField())
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if !field.IsExported() || field.Tag.Get("script") == "-" {
+			continue
+		}
+		f := rv.Field(i)
+		var value starlark.Value
+		switch {
+		case f.Type() == ipType:
+			value = starlark.String("")
+			if !f.IsNil() {
+				value = starlark.String(f.Interface().(net.IP).String())
+			}
+		case f.Kind() == reflect.String:
+			value = starlark.String(f.String())
+		case f.Kind() == reflect.Bool:
+			value = starlark.Bool(f.Bool())
+		case f.CanInt():
+			value = starlark.MakeInt64(f.Int())
+		case f.CanUint():
+			value = starlark.MakeUint64(f.Uint())
+		default:
+			continue
+		}
+		_ = fields.SetKey(starlark.String(snakeCase(field.Name)), value)
+	}
+	return fields
+}
+
+// applyStruct writes the fields the hook changed back to the struct v points
+// to.
+func applyStruct(fields *starlark.Dict, v interface{}) {
+	before := structDict(v)
+	rv := reflect.ValueOf(v).Elem()
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		key := starlark.String(snakeCase(field.Name))
+		old, found, _ := before.Get(key)
+		if !found {
+			continue
+		}
+		value, _, _ := fields.Get(key)
+		if eq, _ := starlark.Equal(old, value); eq || value == nil {
+			continue
+		}
+		if field.Tag.Get("script") == readOnly {
+			slog.Warn("Script cannot set a read-only field", "field", string(key))
+			continue
+		}
+		if err := setField(rv.Field(i), value); err != nil {
+			slog.Warn("Script cannot set field", "field", string(key), "value", value.String(), "error", err)
+		}
+	}
+}
+
+func setField(f reflect.Value, value starlark.Value) error {
+	switch {
+	case f.Type() == ipType:
+		text, ok := starlark.AsString(value)
+		if !ok {
+			return fmt.Errorf("want string, got %s", value.Type())
+		}
+		ip := net.ParseIP(text)
+		if ip == nil && text != "" {
+			return fmt.Errorf("%q is not an address", text)
+		}
+		f.Set(reflect.ValueOf(ip))
+	case f.Kind() == reflect.String:
+		text, ok := starlark.AsString(value)
+		if !ok {
+			return fmt.Errorf("want string, got %s", value.Type())
+		}
+		f.SetString(text)
+	case f.Kind() == reflect.Bool:
+		f.SetBool(bool(value.Truth()))
+	case f.CanInt():
+		var n int64
+		if err := starlark.AsInt(value, &n); err != nil {
+			return err
+		}
+		f.SetInt(n)
+	case f.CanUint():
+		var n uint64
+		if err := starlark.AsInt(value, &n); err != nil {
+			return err
+		}
+		f.SetUint(n)
+	}
+	return nil
+}
+
+// snakeCase turns a Go field name such as CalledStationID into
+// called_station_id.
+func snakeCase(name string) string {
+	var b strings.Builder
+	runes := []rune(name)
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				i+1 < len(runes) && unicode.IsLower(runes[i+1]) && unicode.IsUpper(runes[i-1])) {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,155 @@
+package script
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"diametertransfereagent/pkg/radius"
+
+	"github.com/fiorix/go-diameter/v4/diam"
+	"github.com/fiorix/go-diameter/v4/diam/avp"
+	"github.com/fiorix/go-diameter/v4/diam/datatype"
+	"github.com/fiorix/go-diameter/v4/diam/dict"
+	layehradius "layeh.com/radius"
+)
+
+func load(t *testing.T, source string) *Script {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hooks.star")
+	if err := os.WriteFile(path, []byte(source), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	s, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	return s
+}
+
+func request() *diam.Message {
+	m := diam.NewRequest(diam.CreditControl, 4, dict.Default)
+	m.NewAVP(avp.SessionID, avp.Mbit, 0, datatype.UTF8String("pgw;1"))
+	m.NewAVP(avp.UserName, avp.Mbit, 0, datatype.UTF8String("alice@example.org"))
+	m.NewAVP(avp.CCRequestType, avp.Mbit, 0, datatype.Enumerated(1))
+	return m
+}
+
+func TestMessage(t *testing.T) {
+	s := load(t, `
+def after_decode(command, avps):
+    avps["User-Name"] = avps["User-Name"].split("@")[0]
+    avps["Called-Station-Id"] = "internet"
+    avps["CC-Request-Type"] = None
+`)
+	m := request()
+	if code := s.Message(AfterDecode, "CCR", m); code != 0 {
+		t.Fatalf("Message = %d, want no reject", code)
+	}
+	if a, err := m.FindAVP(avp.UserName, 0); err != nil || a.Data.(datatype.UTF8String) != "alice" {
+		t.Errorf("User-Name = %v, %v", a, err)
+	}
+	if a, err := m.FindAVP(avp.CalledStationID, 0); err != nil || a.Data.(datatype.UTF8String) != "internet" {
+		t.Errorf("Called-Station-Id = %v, %v", a, err)
+	}
+	if a, _ := m.FindAVP(avp.CCRequestType, 0); a != nil {
+		t.Errorf("CC-Request-Type = %v, want it removed", a)
+	}
+	b, err := m.Serialize()
+	if err != nil || len(b) != int(m.Header.MessageLength) {
+		t.Errorf("message of %d bytes with a Message-Length of %d: %v", len(b), m.Header.MessageLength, err)
+	}
+}
+
+func TestFields(t *testing.T) {
+	s := load(t, `
+def before_radius(command, request, avps):
+    if "password" in request or "secret" in request:
+        fail("secrets visible to the hook")
+    request["username"] = avps["User-Name"].upper()
+    request["called_station_id"] = command
+    request["type"] = 1
+
+def after_radius(command, reply, avps):
+    reply["code"] = 2
+    reply["framed_ip"] = "192.0.2.7"
+`)
+	m := request()
+	req := &radius.AuthRequest{Username: "alice", Password: "pa55", Secret: "s3cret"}
+	if code := s.Fields(BeforeRadius, "AAR", req, m); code != 0 {
+		t.Fatalf("Fields = %d, want no reject", code)
+	}
+	if req.Username != "ALICE@EXAMPLE.ORG" || req.CalledStationID != "AAR" {
+		t.Errorf("request = %+v, want the username and called station rewritten", req)
+	}
+	if req.Type != radius.AccessRequest {
+		t.Errorf("Type = %v, want it left read-only", req.Type)
+	}
+	if req.Password != "pa55" || req.Secret != "s3cret" {
+		t.Errorf("secrets changed to %q and %q", req.Password, req.Secret)
+	}
+
+	reply := &radius.AuthResponse{Code: layehradius.CodeAccessReject}
+	s.Fields(AfterRadius, "AAR", reply, m)
+	if reply.Code != layehradius.CodeAccessReject {
+		t.Errorf("Code = %v, want it left read-only", reply.Code)
+	}
+	if reply.FramedIP.String() != "192.0.2.7" {
+		t.Errorf("FramedIP = %v", reply.FramedIP)
+	}
+}
+
+func TestReject(t *testing.T) {
+	s := load(t, `
+def after_decode(command, avps):
+    if avps["User-Name"].endswith("@example.org"):
+        reject(5003)
+    avps["User-Name"] = "changed"
+
+def before_answer(command, avps):
+    fail("broken")
+`)
+	m := request()
+	if code := s.Message(AfterDecode, "CCR", m); code != 5003 {
+		t.Errorf("Message = %d, want 5003", code)
+	}
+	if a, _ := m.FindAVP(avp.UserName, 0); a.Data.(datatype.UTF8String) != "alice@example.org" {
+		t.Errorf("User-Name = %v, want the rejected message unchanged", a)
+	}
+	// A failing hook neither rejects nor changes the message.
+	if code := s.Message(BeforeAnswer, "CCR", m); code != 0 {
+		t.Errorf("failing hook = %d, want no reject", code)
+	}
+	// Hooks the script does not define, or a nil script, do nothing.
+	if code := s.Message(AfterRadius, "CCR", m); code != 0 {
+		t.Errorf("undefined hook = %d", code)
+	}
+	var none *Script
+	if code := none.Fields(BeforeRadius, "CCR", &radius.AuthRequest{}, m); code != 0 {
+		t.Errorf("nil script = %d", code)
+	}
+}
+
+func TestLoadNotFunction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hooks.star")
+	if err := os.WriteFile(path, []byte("after_decode = 1\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := Load(path); err == nil {
+		t.Errorf("Load accepted a hook that is not a function")
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	for name, want := range map[string]string{
+		"Username":        "username",
+		"CalledStationID": "called_station_id",
+		"NASIPAddress":    "nasip_address",
+		"FramedIP":        "framed_ip",
+		"Ipv6FramedIP":    "ipv6_framed_ip",
+	} {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Package tracing exports OpenTelemetry spans of the translation of each
+// request, from its receipt to its answer, to an OTLP collector or a file.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"diametertransfereagent/pkg/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "diameter-transfer-agent"
+
+// Exporters of the spans.
+const (
+	ExporterOTLP = "otlp"
+	ExporterFile = "file"
+)
+
+// Tracer starts the spans of the agent. It does nothing until Setup
+// configures an exporter.
+var Tracer = otel.Tracer("diametertransfereagent")
+
+// Setup exports the spans as configured and returns the function flushing
+// them on shutdown. Without an exporter spans are not recorded.
+func Setup(cfg config.TracingConfig) (func(context.Context) error, error) {
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch cfg.Exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		opts := []otlptracehttp.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		exporter, err = otlptracehttp.New(context.Background(), opts...)
+	case ExporterFile:
+		var f *os.File
+		if f, err = os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err == nil {
+			exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+		}
+	default:
+		return nil, fmt.Errorf("unknown trace exporter %q", cfg.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", cfg.Exporter, err)
+	}
+
+	sampler := sdktrace.AlwaysSample()
+	if cfg.SampleRatio > 0 && cfg.SampleRatio < 1 {
+		sampler = sdktrace.TraceIDRatioBased(cfg.SampleRatio)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sampler)),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+type enqueuedKey struct{}
+
+// Enqueue marks the time a request carrying ctx is queued for the RADIUS
+// client.
+func Enqueue(ctx context.Context) context.Context {
+	return context.WithValue(ctx, enqueuedKey{}, time.Now())
+}
+
+// Dequeue records the radius.queue span of the time the request carrying
+// ctx spent queued since Enqueue.
+func Dequeue(ctx context.Context, attrs ...attribute.KeyValue) {
+	enqueued, ok := ctx.Value(enqueuedKey{}).(time.Time)
+	if !ok {
+		return
+	}
+	_, span := Tracer.Start(ctx, "radius.queue", trace.WithTimestamp(enqueued), trace.WithAttributes(attrs...))
+	span.End()
+}